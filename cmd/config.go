@@ -16,12 +16,14 @@ import (
 	"github.com/nuts-foundation/nuts-knooppunt/component/lrza"
 	"github.com/nuts-foundation/nuts-knooppunt/component/mcsd"
 	"github.com/nuts-foundation/nuts-knooppunt/component/mcsdadmin"
+	"github.com/nuts-foundation/nuts-knooppunt/component/mcsdquery"
 	"github.com/nuts-foundation/nuts-knooppunt/component/mitz"
 	"github.com/nuts-foundation/nuts-knooppunt/component/nutsnode"
 	"github.com/nuts-foundation/nuts-knooppunt/component/nvi"
 	"github.com/nuts-foundation/nuts-knooppunt/component/pdp"
 	"github.com/nuts-foundation/nuts-knooppunt/component/pseudonymisation"
 	"github.com/nuts-foundation/nuts-knooppunt/component/tracing"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/resilience"
 )
 
 type Config struct {
@@ -29,6 +31,7 @@ type Config struct {
 	MCSD             mcsd.Config             `koanf:"mcsd"`
 	LRZA             lrza.Config             `koanf:"lrza"`
 	MCSDAdmin        mcsdadmin.Config        `koanf:"mcsdadmin"`
+	MCSDQuery        mcsdquery.Config        `koanf:"mcsdquery"`
 	Nuts             nutsnode.Config         `koanf:"nuts"`
 	NVI              nvi.Config              `koanf:"nvi"`
 	PDP              pdp.Config              `koanf:"pdp"`
@@ -37,6 +40,8 @@ type Config struct {
 	AuthN            authn.Config            `koanf:"authn"`
 	Tracing          tracing.Config          `koanf:"tracing"`
 	Pseudonymisation pseudonymisation.Config `koanf:"pseudo"`
+	// HTTPClient configures the resilience (timeouts, retries and circuit breakers) of outbound HTTP requests to FHIR servers.
+	HTTPClient resilience.Config `koanf:"httpclient"`
 }
 
 func DefaultConfig() Config {
@@ -47,12 +52,13 @@ func DefaultConfig() Config {
 		Nuts: nutsnode.Config{
 			Enabled: false,
 		},
-		MCSDAdmin: mcsdadmin.Config{},
-		NVI:       nvi.DefaultConfig(),
-		PDP:       pdp.DefaultConfig(),
-		MITZ:      mitz.Config{},
-		HTTP:      http.DefaultConfig(),
-		Tracing:   tracing.DefaultConfig(),
+		MCSDAdmin:  mcsdadmin.Config{},
+		NVI:        nvi.DefaultConfig(),
+		PDP:        pdp.DefaultConfig(),
+		MITZ:       mitz.Config{},
+		HTTP:       http.DefaultConfig(),
+		Tracing:    tracing.DefaultConfig(),
+		HTTPClient: resilience.DefaultConfig(),
 	}
 }
 
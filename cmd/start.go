@@ -12,6 +12,7 @@ import (
 	"github.com/nuts-foundation/nuts-knooppunt/component/lrza"
 	"github.com/nuts-foundation/nuts-knooppunt/component/mcsd"
 	"github.com/nuts-foundation/nuts-knooppunt/component/mcsdadmin"
+	"github.com/nuts-foundation/nuts-knooppunt/component/mcsdquery"
 	"github.com/nuts-foundation/nuts-knooppunt/component/mitz"
 	"github.com/nuts-foundation/nuts-knooppunt/component/nutsnode"
 	"github.com/nuts-foundation/nuts-knooppunt/component/nvi"
@@ -20,6 +21,7 @@ import (
 	"github.com/nuts-foundation/nuts-knooppunt/component/status"
 	"github.com/nuts-foundation/nuts-knooppunt/component/tracing"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/resilience"
 	"github.com/pkg/errors"
 )
 
@@ -40,6 +42,30 @@ func Start(ctx context.Context, config Config) error {
 		return errors.Wrap(err, "failed to start tracing component")
 	}
 
+	// Must be configured before the components create their HTTP clients
+	resilience.Configure(config.HTTPClient)
+
+	// The Nuts node is created first, so other components can request access tokens through its internal API
+	var nutsNode *nutsnode.Component
+	if config.Nuts.Enabled {
+		// Pass tracing config to nuts-node so it can create its own TracerProvider
+		config.Nuts.TracingConfig = nutsnode.TracingConfig{
+			OTLPEndpoint: config.Tracing.OTLPEndpoint,
+			Insecure:     config.Tracing.Insecure,
+		}
+		var err error
+		nutsNode, err = nutsnode.New(config.Nuts)
+		if err != nil {
+			return errors.Wrap(err, "failed to create nuts node component")
+		}
+		if config.MCSD.Nuts.NodeURL == "" {
+			config.MCSD.Nuts.NodeURL = nutsNode.InternalURL().String()
+		}
+		if config.MCSDQuery.NutsNodeURL == "" {
+			config.MCSDQuery.NutsNodeURL = nutsNode.InternalURL().String()
+		}
+	}
+
 	mcsdUpdateClient, err := mcsd.New(config.MCSD)
 	if err != nil {
 		return errors.Wrap(err, "failed to create mCSD Update Client")
@@ -60,20 +86,13 @@ func Start(ctx context.Context, config Config) error {
 			return errors.Wrap(err, "failed to create LRZA sync client")
 		}
 		components = append(components, lrzaClient)
+		// Authoritative Organizations of mCSD directories can be cross-checked against the LRZA (mcsd.validation.lrza)
+		mcsdUpdateClient.SetTrustAnchor(lrzaClient)
 	} else {
 		slog.InfoContext(ctx, "LRZA sync client is disabled (LRZA base URL not configured)")
 	}
 
-	if config.Nuts.Enabled {
-		// Pass tracing config to nuts-node so it can create its own TracerProvider
-		config.Nuts.TracingConfig = nutsnode.TracingConfig{
-			OTLPEndpoint: config.Tracing.OTLPEndpoint,
-			Insecure:     config.Tracing.Insecure,
-		}
-		nutsNode, err := nutsnode.New(config.Nuts)
-		if err != nil {
-			return errors.Wrap(err, "failed to create nuts node component")
-		}
+	if nutsNode != nil {
 		components = append(components, nutsNode)
 	} else {
 		slog.InfoContext(ctx, "Nuts node is disabled")
@@ -97,14 +116,28 @@ func Start(ctx context.Context, config Config) error {
 	}
 
 	// Create PDP component
+	var pdpComponent *pdp.Component
 	if config.PDP.Enabled {
-		pdpComponent, err := pdp.New(config.PDP, consentChecker)
+		pdpComponent, err = pdp.New(config.PDP, consentChecker)
 		if err != nil {
 			return errors.Wrap(err, "failed to create PDP component")
 		}
 		components = append(components, pdpComponent)
 	}
 
+	// Create mCSD query API, which authorizes requests through the PDP
+	if config.MCSDQuery.Enabled {
+		var decider mcsdquery.PolicyDecider
+		if pdpComponent != nil {
+			decider = pdpComponent
+		}
+		mcsdQueryAPI, err := mcsdquery.New(config.MCSDQuery, config.MCSD.QueryDirectory.FHIRBaseURL, httpComponent.Public().URL(), decider)
+		if err != nil {
+			return errors.Wrap(err, "failed to create mCSD query API")
+		}
+		components = append(components, mcsdQueryAPI)
+	}
+
 	// Create NVI component
 	if config.NVI.Enabled() {
 		pseudoComponent := pseudonymisation.New(config.Pseudonymisation, authnComponent.MinVWSHTTPClient)
@@ -3,11 +3,13 @@
 //
 // Unlike the mcsd component - which discovers peer directories and applies anti-spoofing validation
 // to their contents - lrza syncs from one directory that is trusted wholesale. There is therefore no
-// discovery phase and no per-resource validation: every resource the source returns is imported into
-// the local query directory as-is. The first sync reads the current resources via a full search; once
+// discovery phase and no anti-spoofing validation: every resource the source returns is imported into
+// the local query directory as-is, unless profile validation is configured to reject resources that don't
+// conform to their nl-gf profile. The first sync reads the current resources via a full search; once
 // a timestamp has been recorded, later syncs read changes incrementally via _history with _since
-// (which also propagates deletions). Each cycle deduplicates to one entry per resource and replays the
-// result as a FHIR transaction against the query directory.
+// (which also propagates deletions). Each cycle spools the fetched pages to the state store, deduplicates
+// to one entry per resource and replays the result as FHIR transactions of bounded size against the query
+// directory. Its progress is recorded, so a sync that fails part-way through resumes instead of restarting.
 package lrza
 
 import (
@@ -18,6 +20,7 @@ import (
 	"log/slog"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,9 +29,15 @@ import (
 	fhirclient "github.com/SanteonNL/go-fhir-client"
 	"github.com/nuts-foundation/nuts-knooppunt/component"
 	"github.com/nuts-foundation/nuts-knooppunt/component/tracing"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/fanout"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/fhirapi"
 	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/httpauth"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/profile"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/resilience"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/scheduler"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/statestore"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/tlsutil"
 	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
 )
@@ -38,9 +47,9 @@ var _ component.Lifecycle = &Component{}
 // defaultResourceTypes are the resource types synced from the trusted directory by default.
 var defaultResourceTypes = []string{"Organization", "Endpoint", "Location", "HealthcareService", "PractitionerRole", "Practitioner"}
 
-// maxUpdateEntries limits the number of entries processed in a single FHIR transaction to prevent
-// excessive load on the FHIR server.
-const maxUpdateEntries = 10000
+// defaultTransactionSize is the default maximum number of entries in a single FHIR transaction applied to the query directory,
+// to prevent excessive load on the FHIR server.
+const defaultTransactionSize = 1000
 
 // searchPageSize is a fixed FHIR search result page size, so behavior is deterministic across FHIR
 // servers rather than relying on (widely varying) server defaults.
@@ -52,7 +61,13 @@ var clockSkewBuffer = 2 * time.Second
 
 func DefaultConfig() Config {
 	return Config{
-		ResourceTypes: defaultResourceTypes,
+		ResourceTypes:   defaultResourceTypes,
+		TransactionSize: defaultTransactionSize,
+		Sync: scheduler.Config{
+			InitialDelay: 10 * time.Second,
+			Jitter:       30 * time.Second,
+			MaxBackoff:   time.Hour,
+		},
 	}
 }
 
@@ -62,16 +77,37 @@ type Config struct {
 	// QueryBaseUrl is the base URL of the local mCSD query directory that synced resources are
 	// written into.
 	QueryBaseUrl string `koanf:"querybaseurl"`
+	// QueryTargets are additional FHIR servers, by name, that receive the same changes as the query directory.
+	QueryTargets map[string]fanout.TargetConfig `koanf:"querytargets"`
 	// ResourceTypes are the FHIR resource types to sync. Defaults to defaultResourceTypes.
 	ResourceTypes []string `koanf:"resourcetypes"`
 	// Auth optionally configures OAuth2 client-credentials authentication against the source.
 	Auth httpauth.OAuth2Config `koanf:"auth"`
+	// Validation configures how synced resources are validated. The source is trusted, so by default they aren't.
+	Validation ValidationConfig `koanf:"validation"`
+	// Sync configures the built-in schedule for syncing from the LRZA.
+	// It is disabled when no interval is set, in which case syncs are only triggered through the internal API.
+	Sync scheduler.Config `koanf:"sync"`
+	// StateFile is the path of the file in which the _since timestamp of the next incremental sync and the progress of an interrupted sync
+	// are persisted. It's also used to spool the entries fetched during a sync. When not set, they're kept in memory and every restart causes a full sync.
+	StateFile string `koanf:"statefile"`
+	// TransactionSize is the maximum number of entries in a single transaction applied to the query directory. Defaults to 1000.
+	TransactionSize int `koanf:"transactionsize"`
+	// InitialLoad is how the initial full sync reads the LRZA: search (default) pages through a search of every resource type,
+	// export uses the FHIR Bulk Data Access $export operation.
+	InitialLoad string `koanf:"initialload"`
 	// Config carries the optional mTLS client-certificate settings for the source connection
 	// (tlscertfile/tlskeyfile/tlskeypassword/tlscafile). The national LRZA environment requires a
 	// client certificate; the local query directory connection does not use these.
 	tlsutil.Config `koanf:",squash"`
 }
 
+type ValidationConfig struct {
+	// Profiles is the mode of validating resources against the nl-gf profiles (StructureDefinitions): off (default),
+	// warn (report resources that don't conform, but import them) or reject (don't import them).
+	Profiles string `koanf:"profiles"`
+}
+
 // UpdateReport summarizes the outcome of a single sync cycle.
 type UpdateReport struct {
 	CountCreated int      `json:"created"`
@@ -79,6 +115,44 @@ type UpdateReport struct {
 	CountDeleted int      `json:"deleted"`
 	Warnings     []string `json:"warnings"`
 	Errors       []string `json:"errors"`
+	// Items holds the warnings and errors in machine-readable form.
+	Items []libfhir.ReportItem `json:"items"`
+	// ResourceTypes holds the created, updated and deleted counts per resource type.
+	ResourceTypes libfhir.ResourceTypeCounts `json:"resourceTypes"`
+	// DurationMs is how long the sync cycle took, in milliseconds.
+	DurationMs int64 `json:"durationMs"`
+	// Changes lists the changes a dry run would make to the query directory.
+	Changes []libfhir.TransactionChange `json:"changes,omitempty"`
+}
+
+// warn records a warning in the report.
+func (r *UpdateReport) warn(item libfhir.ReportItem) {
+	item.Severity = libfhir.SeverityWarning
+	r.Warnings = append(r.Warnings, item.Message)
+	r.Items = append(r.Items, item)
+}
+
+// count records a change (libfhir.ChangeCreate, ChangeUpdate or ChangeDelete) of a resource of the given type in the report.
+func (r *UpdateReport) count(resourceType string, action string) {
+	switch action {
+	case libfhir.ChangeCreate:
+		r.CountCreated++
+	case libfhir.ChangeUpdate:
+		r.CountUpdated++
+	case libfhir.ChangeDelete:
+		r.CountDeleted++
+	}
+	if r.ResourceTypes == nil {
+		r.ResourceTypes = make(libfhir.ResourceTypeCounts)
+	}
+	r.ResourceTypes.Add(resourceType, action)
+}
+
+// OperationOutcome represents the report as FHIR OperationOutcome, of which the issues are the report's warnings and errors.
+func (r UpdateReport) OperationOutcome(sourceBaseURL string) fhir.OperationOutcome {
+	summary := fmt.Sprintf("LRZA %s: %d created, %d updated, %d deleted, %d warnings, %d errors (took %dms)",
+		sourceBaseURL, r.CountCreated, r.CountUpdated, r.CountDeleted, len(r.Warnings), len(r.Errors), r.DurationMs)
+	return libfhir.ReportOutcome(sourceBaseURL, summary, r.Items)
 }
 
 // Component syncs a single trusted mCSD Directory into the local query directory.
@@ -86,28 +160,50 @@ type Component struct {
 	config          Config
 	fhirLRZAClient  fhirclient.Client
 	fhirQueryClient fhirclient.Client
-
-	resourceTypes  []string
-	lastUpdateTime string // _since value for the next incremental sync; empty means full sync
-	updateMux      *sync.Mutex
+	// lrzaHTTPClient is used for the requests of a bulk export, which fhirLRZAClient doesn't support,
+	// and downloadClient and authenticatedDownloadClient for downloading export files (see sourceHTTPClients).
+	lrzaHTTPClient              *http.Client
+	downloadClient              *http.Client
+	authenticatedDownloadClient *http.Client
+	// queryTargets applies the changes made to the query directory to the configured query targets.
+	queryTargets *fanout.Replicator
+
+	resourceTypes []string
+	// profileValidator validates resources against the nl-gf profiles, if profile validation is enabled.
+	profileValidator *profile.Validator
+	// stateStore holds the sync state: in the state file, or in memory when no state file is configured.
+	stateStore statestore.Store
+	scheduler  *scheduler.Scheduler
+	updateMux  *sync.Mutex
 }
 
-// syncRun holds the state of a single sync cycle, threaded through each step (fetch -> build -> apply
+// syncRun holds the state of a single sync cycle, threaded through each step (fetch -> plan -> apply
 // -> record) so the steps take one argument instead of a growing parameter list. The search
 // configuration is set when the run is created; the remaining fields are filled as the run
-// progresses.
+// progresses. The fetched entries aren't kept in memory, but spooled to the state store: this allows
+// syncing an LRZA of any size. The progress is recorded in a checkpoint, so a sync that fails part-way
+// through resumes where it stopped instead of starting over.
 type syncRun struct {
 	// configuration, set at construction
 	queryStart   time.Time
 	searchParams url.Values
+	// dryRun determines the changes to the query directory without making them or recording the sync timestamp.
+	dryRun bool
+	// dryRunStore holds the spooled entries of a dry run, which doesn't use (or change) the sync state.
+	dryRunStore statestore.Store
 
 	// working state, filled as the run progresses
-	entries []fhir.BundleEntry // deduplicated history entries to sync
+	checkpoint syncCheckpoint
+	// planner plans the transaction chunks for the spooled entries
+	planner *libfhir.TransactionPlanner
+	// spooled holds the location of every spooled entry in the state store, by position in the planner
+	spooled []spoolLocation
+	entries []fhir.BundleEntry // deduplicated entries of the chunk being applied
 	// sourceLastUpdated is the source server's meta.lastUpdated from the first resource type's search
 	// set (the server's own clock), recorded as the next _since timestamp. Nil if the server didn't
 	// report one, in which case recordSyncTimestamp falls back to the local query start time.
 	sourceLastUpdated *string
-	tx                fhir.Bundle // transaction bundle applied to the query directory
+	tx                fhir.Bundle // transaction bundle of the chunk being applied to the query directory
 	report            UpdateReport
 }
 
@@ -117,7 +213,7 @@ func New(config Config) (*Component, error) {
 		return nil, fmt.Errorf("invalid LRZA source FHIR base URL (url=%s): %w", config.LRZABaseUrl, err)
 	}
 
-	sourceHTTPClient, err := newSourceHTTPClient(config)
+	sourceHTTPClients, err := newSourceHTTPClient(config)
 	if err != nil {
 		return nil, err
 	}
@@ -131,100 +227,242 @@ func New(config Config) (*Component, error) {
 	if len(resourceTypes) == 0 {
 		resourceTypes = append([]string(nil), defaultResourceTypes...)
 	}
+	if config.TransactionSize <= 0 {
+		config.TransactionSize = defaultTransactionSize
+	}
+	if err := validateInitialLoad(config.InitialLoad); err != nil {
+		return nil, fmt.Errorf("lrza.initialload: %w", err)
+	}
 
-	return &Component{
-		config:          config,
-		fhirLRZAClient:  fhirclient.New(sourceBaseURL, sourceHTTPClient, &fhirclient.Config{UsePostSearch: false}),
-		fhirQueryClient: fhirclient.New(queryBaseURL, tracing.NewHTTPClient(), &fhirclient.Config{UsePostSearch: false}),
-		resourceTypes:   resourceTypes,
-		updateMux:       &sync.Mutex{},
-	}, nil
+	if config.Validation.Profiles, err = profile.ParseValidationMode(config.Validation.Profiles); err != nil {
+		return nil, fmt.Errorf("lrza.validation.profiles: %w", err)
+	}
+	var profileValidator *profile.Validator
+	if config.Validation.Profiles != profile.ValidationOff {
+		if profileValidator, err = profile.NewValidator(); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &Component{
+		config:                      config,
+		fhirLRZAClient:              fhirclient.New(sourceBaseURL, sourceHTTPClients.source, &fhirclient.Config{UsePostSearch: false}),
+		lrzaHTTPClient:              sourceHTTPClients.source,
+		downloadClient:              sourceHTTPClients.download,
+		authenticatedDownloadClient: sourceHTTPClients.authenticatedDownload,
+		fhirQueryClient:             fhirclient.New(queryBaseURL, &http.Client{Transport: resilience.WrapTransport(tracing.WrapTransport(nil))}, &fhirclient.Config{UsePostSearch: false}),
+		resourceTypes:               resourceTypes,
+		profileValidator:            profileValidator,
+		updateMux:                   &sync.Mutex{},
+	}
+	result.scheduler = scheduler.New("LRZA update", config.Sync, func(ctx context.Context) error {
+		_, err := result.update(ctx, false)
+		return err
+	})
+	// The state file is kept open for the lifetime of the component
+	if result.stateStore, err = statestore.Open(config.StateFile); err != nil {
+		return nil, fmt.Errorf("failed to open LRZA state (lrza.statefile): %w", err)
+	}
+	// Query targets that missed changes are resynchronized from the query directory, with the resources imported from the LRZA
+	sourcePrefix := strings.TrimRight(config.LRZABaseUrl, "/") + "/"
+	result.queryTargets, err = fanout.New(config.QueryTargets, resilience.WrapTransport(tracing.WrapTransport(nil)), fanout.Source{
+		Client:        result.fhirQueryClient,
+		ResourceTypes: resourceTypes,
+		Owns: func(source string) bool {
+			return strings.HasPrefix(source, sourcePrefix)
+		},
+		TransactionSize: config.TransactionSize,
+	}, result.stateStore)
+	if err != nil {
+		_ = result.stateStore.Close()
+		return nil, fmt.Errorf("lrza.querytargets: %w", err)
+	}
+	lastUpdate, err := result.loadLastUpdateTime()
+	if err != nil {
+		_ = result.stateStore.Close()
+		return nil, fmt.Errorf("failed to read LRZA state (lrza.statefile): %w", err)
+	}
+	if lastUpdate != "" {
+		slog.Info("Restored LRZA sync state, continuing incrementally", logging.FHIRServer(config.LRZABaseUrl), slog.String("_since", lastUpdate))
+	}
+	return result, nil
+}
+
+// sourceHTTPClients are the HTTP clients used to talk to the trusted source directory.
+type sourceHTTPClients struct {
+	// source is used for the requests to the source directory.
+	source *http.Client
+	// download and authenticatedDownload download the files of a bulk export, without and with OAuth2 (if configured).
+	// Unlike source, they don't time out: the files can be large, so downloading them is only bounded by the request's context.
+	download              *http.Client
+	authenticatedDownload *http.Client
 }
 
-// newSourceHTTPClient builds the HTTP client used to talk to the trusted source directory. It layers,
+// newSourceHTTPClient builds the HTTP clients used to talk to the trusted source directory. They layer,
 // from the bottom up: an optional mTLS transport when a client certificate is configured (required by
-// the national LRZA environment), then OpenTelemetry tracing, then optional OAuth2 client-credentials.
+// the national LRZA environment), then OpenTelemetry tracing, retries and circuit breaking, then optional OAuth2 client-credentials.
 // The same base transport - including mTLS - is reused for OAuth2 token requests.
-func newSourceHTTPClient(config Config) (*http.Client, error) {
+func newSourceHTTPClient(config Config) (sourceHTTPClients, error) {
 	var baseTransport http.RoundTripper = http.DefaultTransport
 	if config.TLSCertFile != "" {
 		tlsConfig, err := tlsutil.CreateTLSConfig(config.Config)
 		if err != nil {
-			return nil, fmt.Errorf("LRZA mTLS is configured but failed to load: %w", err)
+			return sourceHTTPClients{}, fmt.Errorf("LRZA mTLS is configured but failed to load: %w", err)
 		}
 		baseTransport = &http.Transport{TLSClientConfig: tlsConfig}
 	}
 
-	tracedTransport := tracing.WrapTransport(baseTransport)
+	tracedTransport := resilience.WrapTransport(tracing.WrapTransport(baseTransport))
+	downloadTransport := resilience.WrapStreamingTransport(tracing.WrapTransport(baseTransport))
+	result := sourceHTTPClients{
+		source:                &http.Client{Transport: tracedTransport},
+		download:              &http.Client{Transport: downloadTransport},
+		authenticatedDownload: &http.Client{Transport: downloadTransport},
+	}
 
 	// The current implementation in the iRealisatie proeftuin does not use oAuth delegation, this is therefore untested
 	if config.Auth.IsConfigured() {
-		return httpauth.NewOAuth2HTTPClient(config.Auth, tracedTransport)
+		var err error
+		if result.source, err = httpauth.NewOAuth2HTTPClient(config.Auth, tracedTransport); err != nil {
+			return sourceHTTPClients{}, err
+		}
+		if result.authenticatedDownload, err = httpauth.NewOAuth2HTTPClientWithTokenTransport(config.Auth, tracedTransport, downloadTransport); err != nil {
+			return sourceHTTPClients{}, err
+		}
 	}
-	return &http.Client{Transport: tracedTransport}, nil
+	return result, nil
 }
 
 func (c *Component) Start() error {
 	slog.Info("Starting LRZA sync component",
 		logging.FHIRServer(c.config.LRZABaseUrl),
 		slog.Any("resourceTypes", c.resourceTypes))
-
+	c.queryTargets.Start()
+	c.scheduler.Start()
 	return nil
 }
 
-func (c *Component) Stop(ctx context.Context) error { return nil }
+func (c *Component) Stop(ctx context.Context) error {
+	if err := c.scheduler.Stop(ctx); err != nil {
+		return err
+	}
+	// Wait for a running update to finish, so its changes are queued for the query targets
+	c.updateMux.Lock()
+	defer c.updateMux.Unlock()
+	return errors.Join(c.queryTargets.Stop(ctx), c.stateStore.Close())
+}
 
 func (c *Component) RegisterHttpHandlers(publicMux, internalMux *http.ServeMux) {
 	internalMux.HandleFunc("POST /lrza/update", func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		report, err := c.update(ctx)
+		dryRun := false
+		if value := r.URL.Query().Get("dryRun"); value != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(value); err != nil {
+				http.Error(w, "Invalid dryRun parameter: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		report, err := c.update(ctx, dryRun)
 		if err != nil {
 			slog.ErrorContext(ctx, "LRZA update failed", logging.Error(err))
 			http.Error(w, "Failed to update LRZA: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if fhirapi.AcceptsFHIR(r) {
+			fhirapi.SendResponse(ctx, w, http.StatusOK, report.OperationOutcome(c.config.LRZABaseUrl))
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		_ = json.NewEncoder(w).Encode(report)
 	})
+	internalMux.HandleFunc("GET /lrza/querytargets", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(c.queryTargets.Statuses())
+	})
 }
 
-// update runs one sync cycle: fetch the trusted source's history, build a transaction from it, apply
-// it to the query directory, and record the timestamp for the next incremental sync.
-func (c *Component) update(ctx context.Context) (UpdateReport, error) {
+// update runs one sync cycle: fetch the trusted source's history, plan the transactions for it, apply
+// them to the query directory, and record the timestamp for the next incremental sync.
+// A dry run reports the changes the transactions would make instead of applying them.
+func (c *Component) update(ctx context.Context, dryRun bool) (UpdateReport, error) {
 	c.updateMux.Lock()
 	defer c.updateMux.Unlock()
 
-	run := c.newSyncRun()
+	run, err := c.startSyncRun(ctx, dryRun)
+	if err != nil {
+		return UpdateReport{}, err
+	}
 	slog.InfoContext(ctx, "Updating from central LRZA directory",
-		slog.Bool("incremental", run.incremental()))
+		slog.Bool("incremental", run.incremental()), slog.Bool("dryRun", run.dryRun))
 
-	if err := c.fetchEntries(ctx, run); err != nil {
+	if err := c.sync(ctx, run); err != nil {
 		return UpdateReport{}, err
 	}
-	c.buildTransaction(ctx, run)
-	if len(run.tx.Entry) > 0 {
-		if err := c.applyTransaction(ctx, run); err != nil {
-			return UpdateReport{}, err
-		}
+	if !run.dryRun {
+		c.recordSyncTimestamp(ctx, run)
+		c.clearSyncProgress(ctx)
 	}
-	c.recordSyncTimestamp(ctx, run)
-
 	return run.finalizedReport(), nil
 }
 
+// sync fetches and spools the entries of the given run, and plans and applies the transactions for them.
+func (c *Component) sync(ctx context.Context, run *syncRun) error {
+	if err := c.fetchEntries(ctx, run); err != nil {
+		return err
+	}
+	if err := c.planTransactions(ctx, run); err != nil {
+		return err
+	}
+	return c.applyTransactions(ctx, run)
+}
+
+// startSyncRun prepares a sync cycle. If a previous sync didn't complete, the run resumes from its checkpoint,
+// using the same _since as the interrupted sync. A dry run always starts from the last completed sync.
+func (c *Component) startSyncRun(ctx context.Context, dryRun bool) (*syncRun, error) {
+	lastUpdate, err := c.loadLastUpdateTime()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read LRZA sync state: %w", err)
+	}
+	run := c.newSyncRun(lastUpdate)
+	run.checkpoint = syncCheckpoint{Since: lastUpdate, QueryStart: run.queryStart, ChunkSize: c.config.TransactionSize}
+	if dryRun {
+		run.dryRun = true
+		run.dryRunStore = statestore.NewMemoryStore()
+		return run, nil
+	}
+	resumed, err := c.loadCheckpoint(run)
+	if err != nil {
+		return nil, err
+	}
+	if resumed {
+		slog.InfoContext(ctx, "Resuming interrupted LRZA sync", logging.FHIRServer(c.config.LRZABaseUrl),
+			slog.Any("fetchedResourceTypes", run.checkpoint.FetchedTypes), slog.Int("appliedChunks", run.checkpoint.AppliedChunks))
+		resumedRun := c.newSyncRun(run.checkpoint.Since)
+		resumedRun.checkpoint = run.checkpoint
+		resumedRun.queryStart = run.checkpoint.QueryStart
+		if run.checkpoint.SourceLastUpdated != "" {
+			resumedRun.sourceLastUpdated = &run.checkpoint.SourceLastUpdated
+		}
+		return resumedRun, nil
+	}
+	return run, nil
+}
+
 // newSyncRun creates a run with the search parameters for this cycle. The first sync (no timestamp
 // known) is a full search of current resources; later syncs are incremental _history queries with
 // _since. Both pin newest-first ordering so deduplication can keep the first entry per resource.
-func (c *Component) newSyncRun() *syncRun {
+func (c *Component) newSyncRun(lastUpdate string) *syncRun {
 	params := url.Values{
 		"_count": []string{strconv.Itoa(searchPageSize)},
 		// Pin newest-first ordering: deduplication relies on it (a history Bundle is sorted with
 		// oldest versions last). Don't trust the server default.
 		"_sort": []string{"-_lastUpdated"},
 	}
-	if c.lastUpdateTime != "" {
-		params.Set("_since", c.lastUpdateTime)
+	if lastUpdate != "" {
+		params.Set("_since", lastUpdate)
 	}
 	return &syncRun{
 		queryStart:   time.Now(),
@@ -239,54 +477,196 @@ func (run *syncRun) incremental() bool {
 	return run.searchParams.Has("_since")
 }
 
-// fetchEntries queries every configured resource type, combines the results, and deduplicates them
-// to one entry per resource. The first sync reads current resources via a full search (so it imports
-// only what currently exists, with no deletions to replay); later syncs read changes via _history.
+// fetchEntries pages through every configured resource type, and spools the entries page by page. The
+// first sync reads current resources via a full search (so it imports only what currently exists, with
+// no deletions to replay), or a bulk export if configured; later syncs read changes via _history.
+// Resource types that were fetched by an interrupted sync aren't fetched again.
 func (c *Component) fetchEntries(ctx context.Context, run *syncRun) error {
-	var entries []fhir.BundleEntry
-	for i, resourceType := range c.resourceTypes {
-		curr, searchSet, err := c.queryResourceType(ctx, run, resourceType, cloneValues(run.searchParams))
-		if err != nil {
+	if !run.incremental() && c.config.InitialLoad == initialLoadExport {
+		return c.fetchExport(ctx, run)
+	}
+	for _, resourceType := range c.resourceTypes {
+		if slices.Contains(run.checkpoint.FetchedTypes, resourceType) {
+			continue
+		}
+		if err := c.fetchResourceType(ctx, run, resourceType); err != nil {
 			return fmt.Errorf("failed to query %s: %w", resourceType, err)
 		}
-		entries = append(entries, curr...)
-		if i == 0 && searchSet.Meta != nil && *searchSet.Meta.LastUpdated != "" {
-			run.sourceLastUpdated = searchSet.Meta.LastUpdated
+		run.checkpoint.FetchedTypes = append(run.checkpoint.FetchedTypes, resourceType)
+		run.checkpoint.NextPage = ""
+		run.checkpoint.Spooled = 0
+		if err := c.saveCheckpoint(run); err != nil {
+			return err
 		}
 	}
-	run.entries = libfhir.DeduplicateHistoryEntries(entries)
 	return nil
 }
 
-// queryResourceType queries a single resource type, following pagination up to maxUpdateEntries. It
-// reads the _history endpoint for an incremental sync, or searches the resource type directly for the
-// initial full sync.
-func (c *Component) queryResourceType(ctx context.Context, run *syncRun, resourceType string, searchParams url.Values) ([]fhir.BundleEntry, fhir.Bundle, error) {
-	path := resourceType
-	if run.incremental() {
-		path = resourceType + "/_history"
+// fetchResourceType pages through a single resource type, and spools the most recent version of every
+// resource. It reads the _history endpoint for an incremental sync, or searches the resource type
+// directly for the initial full sync. The progress is recorded after every page, so the fetch of an
+// interrupted sync continues from the page it stopped at. If that page can't be fetched anymore (search
+// result pages expire), the resource type is fetched from the start.
+func (c *Component) fetchResourceType(ctx context.Context, run *syncRun, resourceType string) error {
+	bucket := spoolBucket(resourceType)
+	var page fhir.Bundle
+	resumed := false
+	if run.checkpoint.NextPage != "" {
+		if err := c.fetchPage(ctx, run.checkpoint.NextPage, &page); err != nil {
+			slog.WarnContext(ctx, "Failed to continue interrupted LRZA fetch, fetching resource type from the start", logging.FHIRServer(c.config.LRZABaseUrl),
+				slog.String("resourceType", resourceType), logging.Error(err))
+		} else {
+			resumed = true
+		}
 	}
-
-	var searchSet fhir.Bundle
-	if err := c.fhirLRZAClient.SearchWithContext(ctx, "", searchParams, &searchSet, fhirclient.AtPath(path)); err != nil {
-		return nil, fhir.Bundle{}, fmt.Errorf("search of %s failed: %w", path, err)
+	if !resumed {
+		// Discard what an interrupted fetch of this resource type left behind
+		if err := c.runStore(run).DeleteBucket(bucket); err != nil {
+			return fmt.Errorf("failed to clear spooled %s entries: %w", resourceType, err)
+		}
+		run.checkpoint.Spooled = 0
+		path := resourceType
+		if run.incremental() {
+			path = resourceType + "/_history"
+		}
+		page = fhir.Bundle{}
+		if err := c.fhirLRZAClient.SearchWithContext(ctx, "", cloneValues(run.searchParams), &page, fhirclient.AtPath(path)); err != nil {
+			return fmt.Errorf("search of %s failed: %w", path, err)
+		}
+		if resourceType == c.resourceTypes[0] && page.Meta != nil && page.Meta.LastUpdated != nil && *page.Meta.LastUpdated != "" {
+			run.sourceLastUpdated = page.Meta.LastUpdated
+			run.checkpoint.SourceLastUpdated = *page.Meta.LastUpdated
+		}
 	}
 
-	var entries []fhir.BundleEntry
-	err := fhirclient.Paginate(ctx, c.fhirLRZAClient, searchSet, func(set *fhir.Bundle) (bool, error) {
-		entries = append(entries, set.Entry...)
-		if len(entries) >= maxUpdateEntries {
-			return false, fmt.Errorf("too many entries (%d), aborting update to prevent excessive memory usage", len(entries))
+	// The pages are sorted newest-first, so keeping the first occurrence of each resource keeps its most recent version.
+	deduplicator := libfhir.NewHistoryDeduplicator()
+	for {
+		nextPage, err := c.nextPageURL(page)
+		if err != nil {
+			return err
 		}
-		return true, nil
-	})
+		values := make(map[string]any, len(page.Entry))
+		for _, entry := range page.Entry {
+			if !deduplicator.Keep(entry) {
+				continue
+			}
+			values[spoolKey(run.checkpoint.Spooled)] = entry
+			run.checkpoint.Spooled++
+		}
+		run.checkpoint.NextPage = nextPage
+		// Spool the page and record the progress
+		if err := c.runStore(run).PutAll(bucket, values); err != nil {
+			return fmt.Errorf("failed to spool %s entries: %w", resourceType, err)
+		}
+		if err := c.saveCheckpoint(run); err != nil {
+			return err
+		}
+		if nextPage == "" {
+			slog.DebugContext(ctx, "Fetched LRZA entries", logging.FHIRServer(c.config.LRZABaseUrl), slog.String("resourceType", resourceType), slog.Int("count", run.checkpoint.Spooled))
+			return nil
+		}
+		page = fhir.Bundle{}
+		if err := c.fetchPage(ctx, nextPage, &page); err != nil {
+			return fmt.Errorf("pagination of %s failed: %w", resourceType, err)
+		}
+	}
+}
+
+// fetchPage fetches a page of search results from the LRZA, by the URL of its 'next' link.
+func (c *Component) fetchPage(ctx context.Context, pageURL string, target *fhir.Bundle) error {
+	parsed, err := url.Parse(pageURL)
 	if err != nil {
-		return nil, fhir.Bundle{}, fmt.Errorf("pagination of %s search failed: %w", path, err)
+		return fmt.Errorf("invalid page URL: %w", err)
+	}
+	return c.fhirLRZAClient.SearchWithContext(ctx, "", nil, target, fhirclient.AtUrl(parsed))
+}
+
+// nextPageURL returns the URL of the 'next' link of the given page, or an empty string if it's the last page.
+// The link must refer to the LRZA, so the LRZA's credentials aren't sent elsewhere.
+func (c *Component) nextPageURL(page fhir.Bundle) (string, error) {
+	for _, link := range page.Link {
+		if link.Relation != "next" {
+			continue
+		}
+		if !strings.HasPrefix(link.Url, c.fhirLRZAClient.Path().String()) {
+			return "", fmt.Errorf("next link of search set does not start with the LRZA base URL (url=%s)", link.Url)
+		}
+		return link.Url, nil
+	}
+	return "", nil
+}
+
+// planTransactions reads back the spooled entries to plan the transaction chunks. The TransactionPlanner
+// keeps conditional references resolvable across chunks: a referenced resource is applied in the same
+// chunk as, or an earlier chunk than, the resource referring to it. Only the keys and references of the
+// entries are kept in memory.
+func (c *Component) planTransactions(ctx context.Context, run *syncRun) error {
+	run.planner = libfhir.NewTransactionPlanner()
+	run.spooled = nil
+	store := c.runStore(run)
+	for _, resourceType := range c.resourceTypes {
+		bucket := spoolBucket(resourceType)
+		// A fetch that continued from an interrupted one may have spooled older versions of resources spooled before
+		deduplicator := libfhir.NewHistoryDeduplicator()
+		err := store.Walk(bucket, func(key string, value []byte) error {
+			var entry fhir.BundleEntry
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return fmt.Errorf("invalid spooled entry (key=%s): %w", key, err)
+			}
+			if !deduplicator.Keep(entry) {
+				return nil
+			}
+			run.planner.Add(entry)
+			run.spooled = append(run.spooled, spoolLocation{bucket: bucket, key: key})
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read spooled %s entries: %w", resourceType, err)
+		}
 	}
-	return entries, searchSet, nil
+	slog.DebugContext(ctx, "Got LRZA entries", logging.FHIRServer(c.config.LRZABaseUrl), slog.Int("count", run.planner.Len()))
+	return nil
+}
+
+// applyTransactions builds and applies the transactions for the planned chunks of spooled entries, so every
+// transaction is of bounded size. The checkpoint is updated after every chunk, so chunks applied by an
+// interrupted sync aren't applied again. A dry run describes the changes of every chunk instead.
+func (c *Component) applyTransactions(ctx context.Context, run *syncRun) error {
+	chunks := run.planner.Chunks(run.checkpoint.ChunkSize)
+	for i, chunk := range chunks {
+		if i < run.checkpoint.AppliedChunks {
+			continue
+		}
+		run.entries = make([]fhir.BundleEntry, 0, len(chunk))
+		for _, position := range chunk {
+			var entry fhir.BundleEntry
+			location := run.spooled[position]
+			if _, err := c.runStore(run).Get(location.bucket, location.key, &entry); err != nil {
+				return fmt.Errorf("failed to read spooled entry: %w", err)
+			}
+			run.entries = append(run.entries, entry)
+		}
+		c.buildTransaction(ctx, run)
+		if run.dryRun {
+			if err := c.describeTransaction(ctx, run); err != nil {
+				return fmt.Errorf("%w (chunk %d of %d)", err, i+1, len(chunks))
+			}
+		} else if len(run.tx.Entry) > 0 {
+			slog.DebugContext(ctx, "Applying LRZA update to query directory", slog.Int("chunk", i+1), slog.Int("chunks", len(chunks)), slog.Int("count", len(run.tx.Entry)))
+			if err := c.applyTransaction(ctx, run); err != nil {
+				return fmt.Errorf("%w (chunk %d of %d)", err, i+1, len(chunks))
+			}
+		}
+		run.checkpoint.AppliedChunks = i + 1
+		if err := c.saveCheckpoint(run); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// buildTransaction converts the deduplicated entries into a FHIR transaction bundle for the query
+// buildTransaction converts the deduplicated entries of a chunk into a FHIR transaction bundle for the query
 // directory. Entries that can't be processed are recorded as warnings rather than failing the whole
 // sync.
 func (c *Component) buildTransaction(ctx context.Context, run *syncRun) {
@@ -296,7 +676,11 @@ func (c *Component) buildTransaction(ctx context.Context, run *syncRun) {
 	}
 	for i, entry := range run.entries {
 		if err := c.appendTransactionEntry(ctx, run, entry); err != nil {
-			run.report.Warnings = append(run.report.Warnings, fmt.Sprintf("entry #%d: %s", i, err.Error()))
+			code := libfhir.ReportCodeInvalidEntry
+			if errors.As(err, new(profile.ConformanceError)) {
+				code = libfhir.ReportCodeNonConformant
+			}
+			run.report.warn(libfhir.EntryReportItem(entry, code, libfhir.SeverityWarning, fmt.Sprintf("entry #%d: %s", i, err.Error())))
 		}
 	}
 }
@@ -311,7 +695,7 @@ func (c *Component) buildTransaction(ctx context.Context, run *syncRun) {
 //
 // This is lrza's trimmed counterpart to mcsd's buildUpdateTransaction: because the source is trusted,
 // there is no anti-spoofing validation and no discoverable-directory filtering - every entry is
-// imported as-is.
+// imported as-is, apart from the optional profile validation.
 func (c *Component) appendTransactionEntry(ctx context.Context, run *syncRun, entry fhir.BundleEntry) error {
 	// A DELETE history entry carries no resource body; translate to a conditional delete keyed by
 	// _source. Everything else (a history upsert, or a full-search result with no request) is an upsert.
@@ -348,6 +732,14 @@ func (c *Component) appendTransactionEntry(ctx context.Context, run *syncRun, en
 	if info.ID == "" {
 		return errors.New("resource has no id")
 	}
+	if c.profileValidator != nil {
+		if err := c.profileValidator.Validate(entry.Resource); err != nil {
+			if c.config.Validation.Profiles == profile.ValidationReject {
+				return err
+			}
+			run.report.warn(libfhir.EntryReportItem(entry, libfhir.ReportCodeNonConformant, libfhir.SeverityWarning, err.Error()))
+		}
+	}
 	resourceType, resourceID, resource := info.ResourceType, info.ID, info.Resource
 	sourceURL, err := libfhir.BuildSourceURL(c.config.LRZABaseUrl, resourceType, resourceID)
 	if err != nil {
@@ -377,7 +769,8 @@ func (c *Component) appendTransactionEntry(ctx context.Context, run *syncRun, en
 }
 
 // applyTransaction sends the transaction bundle to the query directory and tallies the per-entry
-// outcomes (created/updated/deleted) into the report.
+// outcomes (created/updated/deleted) into the report. Once applied, the transaction is queued for the
+// query targets, which are updated in the background.
 //
 // Outcomes are classified by the request method we sent, not by the response status code alone. The
 // status is ambiguous on its own: per the FHIR spec a DELETE returns 200 (with a payload) or 204 (no
@@ -390,44 +783,72 @@ func (c *Component) applyTransaction(ctx context.Context, run *syncRun) error {
 	if err := c.fhirQueryClient.CreateWithContext(ctx, run.tx, &txResult, fhirclient.AtPath("/")); err != nil {
 		return fmt.Errorf("failed to apply LRZA update to query directory: %w", err)
 	}
+	c.queryTargets.Apply(ctx, run.tx)
 	run.tallyTransactionResult(txResult)
 	return nil
 }
 
+// describeTransaction determines the changes the run's transaction would make to the query directory,
+// and records them in the run's report instead of applying the transaction.
+func (c *Component) describeTransaction(ctx context.Context, run *syncRun) error {
+	changes, err := libfhir.DescribeTransaction(ctx, c.fhirQueryClient, run.tx)
+	if err != nil {
+		return fmt.Errorf("failed to determine LRZA changes to query directory: %w", err)
+	}
+	for _, change := range changes {
+		run.report.count(change.ResourceType, change.Action)
+	}
+	run.report.Changes = append(run.report.Changes, changes...)
+	return nil
+}
+
 // tallyTransactionResult classifies each response entry against the request that produced it (same
 // index, since transaction responses preserve request order) and accumulates the counts and warnings
 // onto the run's report. See applyTransaction for why classification is by request method.
 func (run *syncRun) tallyTransactionResult(txResult fhir.Bundle) {
 	for i, entry := range txResult.Entry {
+		var request fhir.BundleEntry
+		if i < len(run.tx.Entry) {
+			request = run.tx.Entry[i]
+		}
+		// The report item identifies the resource by the request, but the response's fullUrl (if any) is more specific
+		item := func(code string, message string) libfhir.ReportItem {
+			result := libfhir.EntryReportItem(request, code, libfhir.SeverityWarning, message)
+			if entry.FullUrl != nil {
+				result.FullURL = *entry.FullUrl
+			}
+			return result
+		}
 		if entry.Response == nil {
-			run.report.Warnings = append(run.report.Warnings, fmt.Sprintf("Skipping entry with no response: #%d", i))
+			run.report.warn(item(libfhir.ReportCodeMissingResponse, fmt.Sprintf("Skipping entry with no response: #%d", i)))
 			continue
 		}
 		status := entry.Response.Status
 		method, ok := requestMethodAt(run.tx, i)
 		if !ok {
-			run.report.Warnings = append(run.report.Warnings, fmt.Sprintf("Response #%d has no matching request to classify (status=%q, url=%v)", i, status, entry.FullUrl))
+			run.report.warn(item(libfhir.ReportCodeUnexpectedStatus, fmt.Sprintf("Response #%d has no matching request to classify (status=%q, url=%v)", i, status, entry.FullUrl)))
 			continue
 		}
+		resourceType := item("", "").ResourceType
 		switch method {
 		case fhir.HTTPVerbDELETE:
 			if strings.HasPrefix(status, "2") {
-				run.report.CountDeleted++
+				run.report.count(resourceType, libfhir.ChangeDelete)
 			} else {
-				run.report.Warnings = append(run.report.Warnings, fmt.Sprintf("Unexpected status %q for DELETE (url=%v)", status, entry.FullUrl))
+				run.report.warn(item(libfhir.ReportCodeUnexpectedStatus, fmt.Sprintf("Unexpected status %q for DELETE (url=%v)", status, entry.FullUrl)))
 			}
 		case fhir.HTTPVerbPUT:
 			switch {
 			case strings.HasPrefix(status, "201"):
-				run.report.CountCreated++
+				run.report.count(resourceType, libfhir.ChangeCreate)
 			case strings.HasPrefix(status, "2"):
 				// Any other 2xx (200, or 204 with no body) is a successful upsert of an existing resource.
-				run.report.CountUpdated++
+				run.report.count(resourceType, libfhir.ChangeUpdate)
 			default:
-				run.report.Warnings = append(run.report.Warnings, fmt.Sprintf("Unexpected status %q for PUT (url=%v)", status, entry.FullUrl))
+				run.report.warn(item(libfhir.ReportCodeUnexpectedStatus, fmt.Sprintf("Unexpected status %q for PUT (url=%v)", status, entry.FullUrl)))
 			}
 		default:
-			run.report.Warnings = append(run.report.Warnings, fmt.Sprintf("Unexpected request method for response #%d (status=%q, url=%v)", i, status, entry.FullUrl))
+			run.report.warn(item(libfhir.ReportCodeUnexpectedStatus, fmt.Sprintf("Unexpected request method for response #%d (status=%q, url=%v)", i, status, entry.FullUrl)))
 		}
 	}
 }
@@ -442,28 +863,35 @@ func requestMethodAt(tx fhir.Bundle, i int) (method fhir.HTTPVerb, ok bool) {
 	return method, false
 }
 
-// recordSyncTimestamp stores the timestamp used as the _since value for the next incremental sync.
+// recordSyncTimestamp persists the timestamp used as the _since value for the next incremental sync.
 // It prefers the search result Bundle's meta.lastUpdated (the FHIR server's own clock, avoiding
 // skew) and falls back to the local query start time minus a buffer.
 func (c *Component) recordSyncTimestamp(ctx context.Context, run *syncRun) {
 	if run.sourceLastUpdated != nil {
-		c.lastUpdateTime = *run.sourceLastUpdated
+		c.saveLastUpdateTime(ctx, *run.sourceLastUpdated)
 		return
 	}
-	c.lastUpdateTime = run.queryStart.Add(-clockSkewBuffer).Format(time.RFC3339Nano)
+	c.saveLastUpdateTime(ctx, run.queryStart.Add(-clockSkewBuffer).Format(time.RFC3339Nano))
 	slog.WarnContext(ctx, "Bundle meta.lastUpdated not available, using local time with buffer - may cause clock skew issues", logging.FHIRServer(c.config.LRZABaseUrl))
 }
 
-// finalizedReport returns the run's report with nil slices replaced by empty ones, for a nicer JSON
-// REST response.
+// finalizedReport returns the run's report with its duration, and nil slices and maps replaced by empty
+// ones, for a nicer JSON REST response.
 func (run *syncRun) finalizedReport() UpdateReport {
 	report := run.report
+	report.DurationMs = time.Since(run.queryStart).Milliseconds()
 	if report.Warnings == nil {
 		report.Warnings = []string{}
 	}
 	if report.Errors == nil {
 		report.Errors = []string{}
 	}
+	if report.Items == nil {
+		report.Items = []libfhir.ReportItem{}
+	}
+	if report.ResourceTypes == nil {
+		report.ResourceTypes = libfhir.ResourceTypeCounts{}
+	}
 	return report
 }
 
@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"net/url"
 	"testing"
+	"time"
 
 	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/profile"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/test"
 	"github.com/stretchr/testify/require"
 	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
 	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
@@ -174,5 +177,97 @@ func TestTallyTransactionResult(t *testing.T) {
 		run := build(pair(req, resp))
 		require.Equal(t, 0, run.report.CountCreated+run.report.CountUpdated+run.report.CountDeleted)
 		require.Len(t, run.report.Warnings, 1)
+		require.Equal(t, []libfhir.ReportItem{{
+			Code:         libfhir.ReportCodeUnexpectedStatus,
+			Severity:     libfhir.SeverityWarning,
+			ResourceType: "Organization",
+			Message:      run.report.Warnings[0],
+		}}, run.report.Items)
+	})
+
+	t.Run("counts per resource type", func(t *testing.T) {
+		org, orgResp := put("201 Created")
+		endpoint, endpointResp := del("204 No Content")
+		endpoint.Request.Url = "Endpoint?_source=x"
+		run := build(pair(org, orgResp), pair(endpoint, endpointResp))
+		require.Equal(t, libfhir.ResourceTypeCounts{
+			"Organization": {Created: 1},
+			"Endpoint":     {Deleted: 1},
+		}, run.report.ResourceTypes)
+	})
+}
+
+func TestUpdateReport_OperationOutcome(t *testing.T) {
+	run := &syncRun{queryStart: time.Now()}
+	run.report.count("Organization", libfhir.ChangeCreate)
+	run.report.warn(libfhir.EntryReportItem(fhir.BundleEntry{Request: &fhir.BundleEntryRequest{Method: fhir.HTTPVerbDELETE, Url: "Organization/1"}},
+		libfhir.ReportCodeInvalidEntry, libfhir.SeverityWarning, "entry #0: invalid"))
+	report := run.finalizedReport()
+
+	outcome := report.OperationOutcome(testSourceBaseURL)
+
+	require.Len(t, outcome.Issue, 2)
+	require.Contains(t, *outcome.Issue[0].Diagnostics, "1 created, 0 updated, 0 deleted, 1 warnings, 0 errors")
+	require.Equal(t, fhir.IssueTypeInvalid, outcome.Issue[1].Code)
+	require.Equal(t, "Organization/1", *outcome.Issue[1].Extension[0].ValueReference.Reference)
+	require.Equal(t, testSourceBaseURL, *outcome.Extension[0].ValueUri)
+}
+
+func TestDescribeTransaction(t *testing.T) {
+	existingSource, err := libfhir.BuildSourceURL(testSourceBaseURL, "Organization", "1")
+	require.NoError(t, err)
+	queryClient := &test.StubFHIRClient{
+		Resources: []any{
+			fhir.Organization{Id: to.Ptr("local-1"), Meta: &fhir.Meta{Source: to.Ptr(existingSource)}},
+		},
+	}
+	c := &Component{config: Config{LRZABaseUrl: testSourceBaseURL}, fhirQueryClient: queryClient}
+	run := &syncRun{dryRun: true, entries: []fhir.BundleEntry{
+		{Resource: json.RawMessage(`{"resourceType":"Organization","id":"1","name":"Existing"}`)},
+		{Resource: json.RawMessage(`{"resourceType":"Organization","id":"2","name":"New"}`)},
+		{Request: &fhir.BundleEntryRequest{Method: fhir.HTTPVerbDELETE, Url: "Organization/3"}},
+	}}
+	c.buildTransaction(context.Background(), run)
+
+	require.NoError(t, c.describeTransaction(context.Background(), run))
+
+	require.Equal(t, 1, run.report.CountCreated)
+	require.Equal(t, 1, run.report.CountUpdated)
+	require.Equal(t, 1, run.report.CountDeleted)
+	require.Len(t, run.report.Changes, 3)
+	require.Equal(t, libfhir.ChangeUpdate, run.report.Changes[0].Action)
+	require.Equal(t, existingSource, run.report.Changes[0].Source)
+	require.Equal(t, libfhir.ChangeCreate, run.report.Changes[1].Action)
+	require.Equal(t, libfhir.ChangeDelete, run.report.Changes[2].Action)
+	require.Empty(t, queryClient.CreatedResources, "a dry run must not change the query directory")
+}
+
+func TestBuildTransaction_profileValidation(t *testing.T) {
+	validator, err := profile.NewValidator()
+	require.NoError(t, err)
+	entries := []fhir.BundleEntry{
+		{Resource: json.RawMessage(`{"resourceType":"Organization","id":"1","name":"Conforms"}`)},
+		{Resource: json.RawMessage(`{"resourceType":"Organization","id":"2"}`)},
+	}
+
+	t.Run("warn", func(t *testing.T) {
+		c := &Component{config: Config{LRZABaseUrl: testSourceBaseURL, Validation: ValidationConfig{Profiles: profile.ValidationWarn}}, profileValidator: validator}
+		run := &syncRun{entries: entries}
+		c.buildTransaction(context.Background(), run)
+
+		require.Len(t, run.tx.Entry, 2, "non-conformant resource should still be imported")
+		require.Len(t, run.report.Items, 1)
+		require.Equal(t, libfhir.ReportCodeNonConformant, run.report.Items[0].Code)
+		require.Equal(t, "2", run.report.Items[0].ResourceID)
+	})
+	t.Run("reject", func(t *testing.T) {
+		c := &Component{config: Config{LRZABaseUrl: testSourceBaseURL, Validation: ValidationConfig{Profiles: profile.ValidationReject}}, profileValidator: validator}
+		run := &syncRun{entries: entries}
+		c.buildTransaction(context.Background(), run)
+
+		require.Len(t, run.tx.Entry, 1, "non-conformant resource shouldn't be imported")
+		require.Len(t, run.report.Items, 1)
+		require.Equal(t, libfhir.ReportCodeNonConformant, run.report.Items[0].Code)
+		require.Contains(t, run.report.Items[0].Message, "entry #1: resource doesn't conform to profile")
 	})
 }
@@ -0,0 +1,287 @@
+package lrza
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// Initial load modes, which determine how the initial full sync reads the LRZA.
+const (
+	// initialLoadSearch pages through a search of every resource type.
+	initialLoadSearch = "search"
+	// initialLoadExport uses the FHIR Bulk Data Access $export operation: the LRZA prepares NDJSON files with all resources
+	// in the background, which are then downloaded. It's faster, and puts less load on the LRZA.
+	initialLoadExport = "export"
+)
+
+var initialLoadModes = []string{initialLoadSearch, initialLoadExport}
+
+// exportPollInterval is the time between polls of the status of a bulk export, when the LRZA doesn't specify it (Retry-After).
+var exportPollInterval = 10 * time.Second
+
+// exportMaxWait is the maximum time to wait for a bulk export to complete.
+const exportMaxWait = 2 * time.Hour
+
+// errExportExpired is returned when the status of a bulk export isn't available anymore (e.g. because the LRZA removed the export).
+var errExportExpired = errors.New("bulk export is not available anymore")
+
+// validateInitialLoad returns an error if the given initial load mode isn't supported. An empty mode means search.
+func validateInitialLoad(mode string) error {
+	if mode != "" && !slices.Contains(initialLoadModes, mode) {
+		return fmt.Errorf("invalid mode %q (supported: %s)", mode, strings.Join(initialLoadModes, ", "))
+	}
+	return nil
+}
+
+// exportManifest is the response of a completed bulk export, listing the files that hold the exported resources.
+type exportManifest struct {
+	// TransactionTime is the time of the LRZA's state the export reflects: changes after it are read by the next incremental sync.
+	TransactionTime     string       `json:"transactionTime"`
+	RequiresAccessToken bool         `json:"requiresAccessToken"`
+	Output              []exportFile `json:"output"`
+	Error               []exportFile `json:"error"`
+}
+
+type exportFile struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// fetchExport reads the LRZA for the initial sync through a bulk export: it kicks off the export of the configured resource types,
+// waits for it to complete, and spools the resources of the exported files. The export's transaction time is recorded as the
+// next _since timestamp, so the next sync continues incrementally from the state the export reflects.
+// An interrupted sync continues with the export it started, unless the LRZA doesn't have it anymore.
+func (c *Component) fetchExport(ctx context.Context, run *syncRun) error {
+	resumed := run.checkpoint.ExportStatus != ""
+	if resumed && !slices.ContainsFunc(c.resourceTypes, func(resourceType string) bool {
+		return !slices.Contains(run.checkpoint.FetchedTypes, resourceType)
+	}) {
+		// All exported files were downloaded, and the export deleted
+		return nil
+	}
+	if !resumed {
+		statusURL, err := c.kickOffExport(ctx)
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Started LRZA bulk export", logging.FHIRServer(c.config.LRZABaseUrl), slog.String("status", statusURL))
+		run.checkpoint.ExportStatus = statusURL
+		run.checkpoint.FetchedTypes = nil
+		if err := c.saveCheckpoint(run); err != nil {
+			return err
+		}
+	}
+	manifest, err := c.awaitExport(ctx, run)
+	if errors.Is(err, errExportExpired) && resumed {
+		slog.WarnContext(ctx, "Bulk export of interrupted LRZA sync is not available anymore, starting a new export", logging.FHIRServer(c.config.LRZABaseUrl), logging.Error(err))
+		run.checkpoint.ExportStatus = ""
+		return c.fetchExport(ctx, run)
+	}
+	if err != nil {
+		return err
+	}
+	if manifest.TransactionTime == "" {
+		return errors.New("LRZA bulk export manifest has no transactionTime")
+	}
+	if len(manifest.Error) > 0 {
+		slog.WarnContext(ctx, "LRZA bulk export reported errors", logging.FHIRServer(c.config.LRZABaseUrl), slog.Int("errorFiles", len(manifest.Error)))
+	}
+	run.sourceLastUpdated = &manifest.TransactionTime
+	run.checkpoint.SourceLastUpdated = manifest.TransactionTime
+
+	client := c.downloadClient
+	if manifest.RequiresAccessToken {
+		client = c.authenticatedDownloadClient
+	}
+	for _, resourceType := range c.resourceTypes {
+		if slices.Contains(run.checkpoint.FetchedTypes, resourceType) {
+			continue
+		}
+		if err := c.downloadExport(ctx, run, client, manifest, resourceType); err != nil {
+			return fmt.Errorf("failed to download exported %s resources: %w", resourceType, err)
+		}
+		run.checkpoint.FetchedTypes = append(run.checkpoint.FetchedTypes, resourceType)
+		run.checkpoint.Spooled = 0
+		if err := c.saveCheckpoint(run); err != nil {
+			return err
+		}
+	}
+	c.deleteExport(ctx, run.checkpoint.ExportStatus)
+	return nil
+}
+
+// kickOffExport requests the LRZA to export the configured resource types, and returns the URL at which the status of the export can be polled.
+func (c *Component) kickOffExport(ctx context.Context) (string, error) {
+	kickOffURL := c.fhirLRZAClient.Path("$export")
+	kickOffURL.RawQuery = url.Values{"_type": []string{strings.Join(c.resourceTypes, ",")}}.Encode()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, kickOffURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Accept", "application/fhir+json")
+	request.Header.Set("Prefer", "respond-async")
+	response, err := c.lrzaHTTPClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("LRZA bulk export kick-off failed: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("LRZA bulk export kick-off failed (status=%d)", response.StatusCode)
+	}
+	location, err := kickOffURL.Parse(response.Header.Get("Content-Location"))
+	if err != nil || response.Header.Get("Content-Location") == "" {
+		return "", fmt.Errorf("LRZA bulk export kick-off response has no valid Content-Location (value=%s)", response.Header.Get("Content-Location"))
+	}
+	return location.String(), nil
+}
+
+// awaitExport polls the status of the run's bulk export until it completes, and returns its manifest.
+func (c *Component) awaitExport(ctx context.Context, run *syncRun) (*exportManifest, error) {
+	deadline := time.Now().Add(exportMaxWait)
+	for {
+		manifest, wait, err := c.pollExport(ctx, run.checkpoint.ExportStatus)
+		if err != nil || manifest != nil {
+			return manifest, err
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return nil, fmt.Errorf("LRZA bulk export didn't complete within %s", exportMaxWait)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// pollExport requests the status of a bulk export. It returns the manifest if the export completed,
+// or otherwise the time to wait before polling again.
+func (c *Component) pollExport(ctx context.Context, statusURL string) (*exportManifest, time.Duration, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, statusURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	request.Header.Set("Accept", "application/json")
+	response, err := c.lrzaHTTPClient.Do(request)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to poll LRZA bulk export status: %w", err)
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+		var manifest exportManifest
+		if err := json.NewDecoder(response.Body).Decode(&manifest); err != nil {
+			return nil, 0, fmt.Errorf("invalid LRZA bulk export manifest: %w", err)
+		}
+		return &manifest, 0, nil
+	case http.StatusAccepted:
+		slog.DebugContext(ctx, "LRZA bulk export in progress", logging.FHIRServer(c.config.LRZABaseUrl), slog.String("progress", response.Header.Get("X-Progress")))
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			return nil, time.Duration(seconds) * time.Second, nil
+		}
+		return nil, exportPollInterval, nil
+	case http.StatusNotFound, http.StatusGone:
+		return nil, 0, fmt.Errorf("%w (status=%d)", errExportExpired, response.StatusCode)
+	default:
+		return nil, 0, fmt.Errorf("LRZA bulk export failed (status=%d)", response.StatusCode)
+	}
+}
+
+// downloadExport downloads the exported files of the given resource type, and spools their resources.
+// The files are streamed, and spooled in batches of searchPageSize resources, so they don't have to fit in memory.
+func (c *Component) downloadExport(ctx context.Context, run *syncRun, client *http.Client, manifest *exportManifest, resourceType string) error {
+	bucket := spoolBucket(resourceType)
+	// Discard what an interrupted download of this resource type left behind
+	if err := c.runStore(run).DeleteBucket(bucket); err != nil {
+		return fmt.Errorf("failed to clear spooled entries: %w", err)
+	}
+	run.checkpoint.Spooled = 0
+	spool := func(values map[string]any) error {
+		if err := c.runStore(run).PutAll(bucket, values); err != nil {
+			return fmt.Errorf("failed to spool entries: %w", err)
+		}
+		return c.saveCheckpoint(run)
+	}
+	for _, file := range manifest.Output {
+		if file.Type != resourceType {
+			continue
+		}
+		values := make(map[string]any, searchPageSize)
+		err := c.readExportFile(ctx, client, file, func(resource json.RawMessage) error {
+			values[spoolKey(run.checkpoint.Spooled)] = fhir.BundleEntry{Resource: resource}
+			run.checkpoint.Spooled++
+			if len(values) < searchPageSize {
+				return nil
+			}
+			err := spool(values)
+			values = make(map[string]any, searchPageSize)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := spool(values); err != nil {
+			return err
+		}
+	}
+	slog.DebugContext(ctx, "Downloaded exported LRZA resources", logging.FHIRServer(c.config.LRZABaseUrl), slog.String("resourceType", resourceType), slog.Int("count", run.checkpoint.Spooled))
+	return nil
+}
+
+// readExportFile downloads an NDJSON file of a bulk export, and calls fn for every resource in it.
+func (c *Component) readExportFile(ctx context.Context, client *http.Client, file exportFile, fn func(resource json.RawMessage) error) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, file.URL, nil)
+	if err != nil {
+		return fmt.Errorf("invalid export file URL (url=%s): %w", file.URL, err)
+	}
+	request.Header.Set("Accept", "application/fhir+ndjson")
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to download export file (url=%s): %w", file.URL, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download export file (url=%s, status=%d)", file.URL, response.StatusCode)
+	}
+	// Every line of an NDJSON file holds a resource, which json.Decoder reads as a stream of values
+	decoder := json.NewDecoder(response.Body)
+	for line := 1; ; line++ {
+		var resource json.RawMessage
+		if err := decoder.Decode(&resource); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid export file (url=%s, line=%d): %w", file.URL, line, err)
+		}
+		if err := fn(resource); err != nil {
+			return err
+		}
+	}
+}
+
+// deleteExport signals the LRZA that the files of a bulk export have been downloaded, so it can remove them.
+// Failing to do so isn't fatal: the LRZA removes them after a while anyway.
+func (c *Component) deleteExport(ctx context.Context, statusURL string) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodDelete, statusURL, nil)
+	if err == nil {
+		var response *http.Response
+		if response, err = c.lrzaHTTPClient.Do(request); err == nil {
+			_ = response.Body.Close()
+		}
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to delete LRZA bulk export", logging.FHIRServer(c.config.LRZABaseUrl), logging.Error(err))
+	}
+}
@@ -0,0 +1,196 @@
+package lrza
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/resilience"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestComponent_update_export(t *testing.T) {
+	const transactionTime = "2026-01-01T12:00:00Z"
+	// newLRZA returns an LRZA that exports 3 Organizations and an Endpoint, and reports the export in progress on the first poll.
+	// It records the requests it received.
+	newLRZA := func(t *testing.T) (*httptest.Server, *[]string) {
+		var mux sync.Mutex
+		var requests []string
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mux.Lock()
+			requests = append(requests, r.Method+" "+r.URL.RequestURI())
+			polls := 0
+			for _, request := range requests {
+				if request == "GET /status" {
+					polls++
+				}
+			}
+			mux.Unlock()
+			switch r.Method + " " + r.URL.Path {
+			case "GET /$export":
+				require.Equal(t, "respond-async", r.Header.Get("Prefer"))
+				require.Equal(t, "Organization,Endpoint", r.URL.Query().Get("_type"))
+				w.Header().Set("Content-Location", "/status")
+				w.WriteHeader(http.StatusAccepted)
+			case "GET /status":
+				if polls == 1 {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(http.StatusAccepted)
+					return
+				}
+				_ = json.NewEncoder(w).Encode(exportManifest{
+					TransactionTime: transactionTime,
+					Output: []exportFile{
+						{Type: "Organization", URL: server.URL + "/files/organization-1.ndjson"},
+						{Type: "Endpoint", URL: server.URL + "/files/endpoint.ndjson"},
+						{Type: "Organization", URL: server.URL + "/files/organization-2.ndjson"},
+					},
+				})
+			case "DELETE /status":
+				w.WriteHeader(http.StatusAccepted)
+			case "GET /files/organization-1.ndjson":
+				_, _ = w.Write([]byte(`{"resourceType":"Organization","id":"1","endpoint":[{"reference":"Endpoint/1"}]}` + "\n" +
+					`{"resourceType":"Organization","id":"2"}` + "\n"))
+			case "GET /files/organization-2.ndjson":
+				_, _ = w.Write([]byte(`{"resourceType":"Organization","id":"3"}` + "\n"))
+			case "GET /files/endpoint.ndjson":
+				_, _ = w.Write([]byte(`{"resourceType":"Endpoint","id":"1","address":"https://example.com"}` + "\n"))
+			default:
+				w.Header().Set("Content-Type", "application/fhir+json")
+				_ = json.NewEncoder(w).Encode(fhir.Bundle{Type: fhir.BundleTypeHistory})
+			}
+		}))
+		t.Cleanup(server.Close)
+		return server, &requests
+	}
+	// newQueryDirectory returns a query directory that records the transactions it applied
+	newQueryDirectory := func(t *testing.T) (*httptest.Server, *[]fhir.Bundle) {
+		var applied []fhir.Bundle
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var tx fhir.Bundle
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&tx))
+			applied = append(applied, tx)
+			result := fhir.Bundle{Type: fhir.BundleTypeTransactionResponse}
+			for range tx.Entry {
+				result.Entry = append(result.Entry, fhir.BundleEntry{Response: &fhir.BundleEntryResponse{Status: "201 Created"}})
+			}
+			w.Header().Set("Content-Type", "application/fhir+json")
+			_ = json.NewEncoder(w).Encode(result)
+		}))
+		t.Cleanup(server.Close)
+		return server, &applied
+	}
+	newComponent := func(t *testing.T, lrzaURL string, queryURL string) *Component {
+		config := DefaultConfig()
+		config.LRZABaseUrl = lrzaURL
+		config.QueryBaseUrl = queryURL
+		config.ResourceTypes = []string{"Organization", "Endpoint"}
+		config.InitialLoad = initialLoadExport
+		component, err := New(config)
+		require.NoError(t, err)
+		// Don't retry failed requests
+		lrzaBaseURL, _ := url.Parse(lrzaURL)
+		queryBaseURL, _ := url.Parse(queryURL)
+		component.fhirLRZAClient = fhirclient.New(lrzaBaseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		component.fhirQueryClient = fhirclient.New(queryBaseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		component.lrzaHTTPClient = http.DefaultClient
+		component.downloadClient = http.DefaultClient
+		component.authenticatedDownloadClient = http.DefaultClient
+		return component
+	}
+
+	t.Run("initial load, then incremental", func(t *testing.T) {
+		lrza, requests := newLRZA(t)
+		queryDirectory, applied := newQueryDirectory(t)
+		component := newComponent(t, lrza.URL, queryDirectory.URL)
+
+		report, err := component.update(context.Background(), false)
+
+		require.NoError(t, err)
+		require.Equal(t, 4, report.CountCreated)
+		require.Len(t, *applied, 1)
+		require.Len(t, (*applied)[0].Entry, 4)
+		require.Contains(t, *requests, "DELETE /status", "the export must be deleted after downloading its files")
+		// The next sync continues incrementally from the export's transaction time
+		lastUpdate, err := component.loadLastUpdateTime()
+		require.NoError(t, err)
+		require.Equal(t, transactionTime, lastUpdate)
+
+		_, err = component.update(context.Background(), false)
+
+		require.NoError(t, err)
+		require.Contains(t, (*requests)[len(*requests)-2], "GET /Organization/_history?")
+		require.Contains(t, (*requests)[len(*requests)-2], "_since="+url.QueryEscape(transactionTime))
+	})
+	t.Run("interrupted sync continues with its export", func(t *testing.T) {
+		lrza, requests := newLRZA(t)
+		queryDirectory, applied := newQueryDirectory(t)
+		component := newComponent(t, lrza.URL, queryDirectory.URL)
+		run := &syncRun{checkpoint: syncCheckpoint{ExportStatus: lrza.URL + "/status", ChunkSize: component.config.TransactionSize}}
+		require.NoError(t, component.saveCheckpoint(run))
+
+		report, err := component.update(context.Background(), false)
+
+		require.NoError(t, err)
+		require.Equal(t, 4, report.CountCreated)
+		require.Len(t, *applied, 1)
+		require.NotContains(t, *requests, "GET /$export?_type=Organization%2CEndpoint")
+	})
+	t.Run("invalid mode", func(t *testing.T) {
+		config := DefaultConfig()
+		config.InitialLoad = "other"
+
+		_, err := New(config)
+
+		require.EqualError(t, err, `lrza.initialload: invalid mode "other" (supported: search, export)`)
+	})
+}
+
+func TestComponent_readExportFile(t *testing.T) {
+	// The export file is written slower than the timeout of a request attempt
+	resilience.Configure(resilience.Config{Timeout: 50 * time.Millisecond})
+	t.Cleanup(func() {
+		resilience.Configure(resilience.Config{})
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/fhir+ndjson")
+		for i := range 4 {
+			_, _ = fmt.Fprintf(w, `{"resourceType":"Organization","id":"%d"}`+"\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	clients, err := newSourceHTTPClient(DefaultConfig())
+	require.NoError(t, err)
+	component := &Component{}
+	read := func(client *http.Client) (int, error) {
+		var count int
+		err := component.readExportFile(t.Context(), client, exportFile{Type: "Organization", URL: server.URL}, func(json.RawMessage) error {
+			count++
+			return nil
+		})
+		return count, err
+	}
+
+	t.Run("slow file is downloaded completely", func(t *testing.T) {
+		count, err := read(clients.download)
+
+		require.NoError(t, err)
+		require.Equal(t, 4, count)
+	})
+	t.Run("requests to the LRZA time out", func(t *testing.T) {
+		_, err := read(clients.source)
+
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
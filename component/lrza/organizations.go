@@ -0,0 +1,49 @@
+package lrza
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// errNotSynchronized is returned when the LRZA is looked up before it has been synchronized.
+var errNotSynchronized = errors.New("LRZA hasn't been synchronized yet")
+
+// RegisteredOrganizations returns the Organizations the LRZA registers with the given URA, as imported into the query directory
+// by the last sync. It returns an empty slice if the LRZA doesn't list the URA.
+// It's used by the mcsd component to cross-check the authoritative Organizations of other directories against the LRZA.
+func (c *Component) RegisteredOrganizations(ctx context.Context, ura string) ([]fhir.Organization, error) {
+	// Without a completed sync, not finding the URA doesn't mean the LRZA doesn't list it
+	lastUpdate, err := c.loadLastUpdateTime()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read LRZA sync state: %w", err)
+	}
+	if lastUpdate == "" {
+		return nil, errNotSynchronized
+	}
+	var searchSet fhir.Bundle
+	err = c.fhirQueryClient.SearchWithContext(ctx, "Organization", url.Values{
+		"identifier": []string{coding.URANamingSystem + "|" + ura},
+		// Only Organizations imported from the LRZA, not the ones claiming the URA in other directories
+		"_source:below": []string{c.config.LRZABaseUrl},
+		"_count":        []string{strconv.Itoa(searchPageSize)},
+	}, &searchSet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search LRZA Organizations in query directory: %w", err)
+	}
+	result := make([]fhir.Organization, 0, len(searchSet.Entry))
+	for _, entry := range searchSet.Entry {
+		var organization fhir.Organization
+		if err := json.Unmarshal(entry.Resource, &organization); err != nil {
+			return nil, fmt.Errorf("failed to read LRZA Organization: %w", err)
+		}
+		result = append(result, organization)
+	}
+	return result, nil
+}
@@ -0,0 +1,59 @@
+package lrza
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/test"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestComponent_RegisteredOrganizations(t *testing.T) {
+	lrzaSource, err := libfhir.BuildSourceURL(testSourceBaseURL, "Organization", "1")
+	require.NoError(t, err)
+	uraIdentifier := []fhir.Identifier{{System: to.Ptr(coding.URANamingSystem), Value: to.Ptr("1234")}}
+	config := DefaultConfig()
+	config.LRZABaseUrl = testSourceBaseURL
+	config.QueryBaseUrl = "http://query.example/fhir"
+	newComponent := func(t *testing.T) *Component {
+		component, err := New(config)
+		require.NoError(t, err)
+		component.fhirQueryClient = &test.StubFHIRClient{
+			Resources: []any{
+				fhir.Organization{Id: to.Ptr("a"), Name: to.Ptr("Zorgaanbieder"), Identifier: uraIdentifier, Meta: &fhir.Meta{Source: to.Ptr(lrzaSource)}},
+				// Imported from another directory, claiming the same URA
+				fhir.Organization{Id: to.Ptr("b"), Name: to.Ptr("Spoofed"), Identifier: uraIdentifier, Meta: &fhir.Meta{Source: to.Ptr("http://other.example/fhir/Organization/1")}},
+			},
+		}
+		return component
+	}
+
+	t.Run("only Organizations imported from the LRZA", func(t *testing.T) {
+		component := newComponent(t)
+		component.saveLastUpdateTime(context.Background(), "2026-01-01T00:00:00Z")
+
+		organizations, err := component.RegisteredOrganizations(context.Background(), "1234")
+
+		require.NoError(t, err)
+		require.Len(t, organizations, 1)
+		require.Equal(t, "Zorgaanbieder", *organizations[0].Name)
+	})
+	t.Run("URA not listed", func(t *testing.T) {
+		component := newComponent(t)
+		component.saveLastUpdateTime(context.Background(), "2026-01-01T00:00:00Z")
+
+		organizations, err := component.RegisteredOrganizations(context.Background(), "5678")
+
+		require.NoError(t, err)
+		require.Empty(t, organizations)
+	})
+	t.Run("not synchronized yet", func(t *testing.T) {
+		_, err := newComponent(t).RegisteredOrganizations(context.Background(), "1234")
+
+		require.ErrorIs(t, err, errNotSynchronized)
+	})
+}
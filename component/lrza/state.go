@@ -0,0 +1,122 @@
+package lrza
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/statestore"
+)
+
+const (
+	// lastUpdateBucket holds the _since timestamp for the next incremental sync, by LRZA base URL.
+	// Keying by base URL makes a change of source directory start with a full sync.
+	lastUpdateBucket = "lrza_lastupdate"
+	// checkpointBucket holds the progress of a sync that hasn't completed yet, by LRZA base URL.
+	checkpointBucket = "lrza_checkpoint"
+	// spoolBucketPrefix prefixes the buckets that hold the entries fetched by a sync that hasn't completed yet, one bucket per resource type.
+	spoolBucketPrefix = "lrza_spool|"
+)
+
+// syncCheckpoint records the progress of a sync that hasn't completed yet, so a failed sync resumes where it stopped instead of starting over.
+type syncCheckpoint struct {
+	// Since is the _since value of the sync, empty for the initial full sync.
+	Since string `json:"since"`
+	// QueryStart is when the sync started, SourceLastUpdated the LRZA's meta.lastUpdated of the first search (see syncRun).
+	QueryStart        time.Time `json:"queryStart"`
+	SourceLastUpdated string    `json:"sourceLastUpdated,omitempty"`
+	// FetchedTypes are the resource types of which all entries have been fetched and spooled.
+	FetchedTypes []string `json:"fetchedTypes"`
+	// ExportStatus is the status URL of the bulk export the sync reads the LRZA through, if any.
+	ExportStatus string `json:"exportStatus,omitempty"`
+	// NextPage is the URL of the next page of the resource type being fetched, and Spooled the number of its entries spooled so far.
+	NextPage string `json:"nextPage,omitempty"`
+	Spooled  int    `json:"spooled"`
+	// ChunkSize is the transaction size the sync was planned with.
+	ChunkSize int `json:"chunkSize"`
+	// AppliedChunks is the number of transaction chunks that have been applied to the query directory.
+	AppliedChunks int `json:"appliedChunks"`
+}
+
+// spoolLocation is the location of a spooled entry in the state store.
+type spoolLocation struct {
+	bucket string
+	key    string
+}
+
+// loadLastUpdateTime returns the _since timestamp for the next incremental sync, or an empty string if no sync completed yet.
+func (c *Component) loadLastUpdateTime() (string, error) {
+	var lastUpdate string
+	_, err := c.stateStore.Get(lastUpdateBucket, c.config.LRZABaseUrl, &lastUpdate)
+	return lastUpdate, err
+}
+
+// saveLastUpdateTime records the _since timestamp for the next incremental sync.
+// Failing to persist it isn't fatal: the next sync then starts from the previous timestamp, and reapplies the same changes.
+func (c *Component) saveLastUpdateTime(ctx context.Context, lastUpdate string) {
+	if err := c.stateStore.Put(lastUpdateBucket, c.config.LRZABaseUrl, lastUpdate); err != nil {
+		slog.ErrorContext(ctx, "Failed to persist LRZA last update time", logging.FHIRServer(c.config.LRZABaseUrl), logging.Error(err))
+	}
+}
+
+// runStore returns the store that holds the progress of the given sync run: the state store,
+// or a temporary store for a dry run, so it doesn't interfere with the state of regular syncs.
+func (c *Component) runStore(run *syncRun) statestore.Store {
+	if run.dryRunStore != nil {
+		return run.dryRunStore
+	}
+	return c.stateStore
+}
+
+// loadCheckpoint returns the checkpoint of an interrupted sync into the given run, if any.
+func (c *Component) loadCheckpoint(run *syncRun) (bool, error) {
+	var checkpoint syncCheckpoint
+	found, err := c.stateStore.Get(checkpointBucket, c.config.LRZABaseUrl, &checkpoint)
+	if err != nil {
+		return false, fmt.Errorf("failed to read LRZA sync checkpoint: %w", err)
+	}
+	if found {
+		run.checkpoint = checkpoint
+	}
+	return found, nil
+}
+
+// saveCheckpoint records the progress of the given sync run. A dry run doesn't record its progress.
+func (c *Component) saveCheckpoint(run *syncRun) error {
+	if run.dryRun {
+		return nil
+	}
+	return run.putCheckpoint(c.stateStore, c.config.LRZABaseUrl)
+}
+
+func (run *syncRun) putCheckpoint(store statestore.Store, key string) error {
+	if err := store.Put(checkpointBucket, key, run.checkpoint); err != nil {
+		return fmt.Errorf("failed to save LRZA sync checkpoint: %w", err)
+	}
+	return nil
+}
+
+// clearSyncProgress removes the checkpoint and spooled entries of a completed sync from the state store.
+// Failing to remove them isn't fatal: the next sync then resumes the completed sync, and applies the same changes again.
+func (c *Component) clearSyncProgress(ctx context.Context) {
+	var errs []error
+	for _, resourceType := range c.resourceTypes {
+		errs = append(errs, c.stateStore.DeleteBucket(spoolBucket(resourceType)))
+	}
+	if err := errors.Join(append(errs, c.stateStore.Delete(checkpointBucket, c.config.LRZABaseUrl))...); err != nil {
+		slog.ErrorContext(ctx, "Failed to remove LRZA sync progress", logging.FHIRServer(c.config.LRZABaseUrl), logging.Error(err))
+	}
+}
+
+// spoolBucket returns the name of the bucket holding the spooled entries of the given resource type.
+func spoolBucket(resourceType string) string {
+	return spoolBucketPrefix + resourceType
+}
+
+// spoolKey returns the key of the n-th spooled entry, zero-padded to keep the entries in order.
+func spoolKey(n int) string {
+	return fmt.Sprintf("%010d", n)
+}
@@ -0,0 +1,73 @@
+package lrza
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
+)
+
+func TestComponent_lastUpdateTime(t *testing.T) {
+	config := DefaultConfig()
+	config.LRZABaseUrl = testSourceBaseURL
+	config.QueryBaseUrl = "http://query.example/fhir"
+
+	t.Run("persisted across restarts", func(t *testing.T) {
+		config := config
+		config.StateFile = filepath.Join(t.TempDir(), "lrza.db")
+		first, err := New(config)
+		require.NoError(t, err)
+		first.recordSyncTimestamp(context.Background(), &syncRun{sourceLastUpdated: to.Ptr("2026-01-01T00:00:00Z")})
+		require.NoError(t, first.Stop(context.Background()))
+
+		second, err := New(config)
+		require.NoError(t, err)
+		defer second.Stop(context.Background())
+		lastUpdate, err := second.loadLastUpdateTime()
+
+		require.NoError(t, err)
+		require.Equal(t, "2026-01-01T00:00:00Z", lastUpdate)
+		run := second.newSyncRun(lastUpdate)
+		require.True(t, run.incremental())
+		require.Equal(t, "2026-01-01T00:00:00Z", run.searchParams.Get("_since"))
+	})
+	t.Run("other LRZA starts with a full sync", func(t *testing.T) {
+		config := config
+		config.StateFile = filepath.Join(t.TempDir(), "lrza.db")
+		first, err := New(config)
+		require.NoError(t, err)
+		first.saveLastUpdateTime(context.Background(), "2026-01-01T00:00:00Z")
+		require.NoError(t, first.Stop(context.Background()))
+
+		config.LRZABaseUrl = "http://other.example/fhir"
+		second, err := New(config)
+		require.NoError(t, err)
+		defer second.Stop(context.Background())
+		lastUpdate, err := second.loadLastUpdateTime()
+
+		require.NoError(t, err)
+		require.Empty(t, lastUpdate)
+	})
+	t.Run("in memory without state file", func(t *testing.T) {
+		component, err := New(config)
+		require.NoError(t, err)
+		component.saveLastUpdateTime(context.Background(), "2026-01-01T00:00:00Z")
+
+		lastUpdate, err := component.loadLastUpdateTime()
+
+		require.NoError(t, err)
+		require.Equal(t, "2026-01-01T00:00:00Z", lastUpdate)
+	})
+	t.Run("unusable state file", func(t *testing.T) {
+		config := config
+		config.StateFile = t.TempDir()
+		require.NoError(t, os.MkdirAll(config.StateFile, 0o700))
+
+		_, err := New(config)
+
+		require.ErrorContains(t, err, "failed to open LRZA state (lrza.statefile)")
+	})
+}
@@ -0,0 +1,126 @@
+package lrza
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestComponent_update_chunked(t *testing.T) {
+	// newLRZA returns an LRZA that lists 5 Organizations, 2 per page
+	newLRZA := func(t *testing.T) *httptest.Server {
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bundle := fhir.Bundle{Type: fhir.BundleTypeSearchset}
+			if r.URL.Path == "/Organization" {
+				offset := 0
+				_, _ = fmt.Sscan(r.URL.Query().Get("offset"), &offset)
+				for i := offset; i < min(offset+2, 5); i++ {
+					bundle.Entry = append(bundle.Entry, fhir.BundleEntry{
+						Resource: json.RawMessage(fmt.Sprintf(`{"resourceType":"Organization","id":"%d","name":"Organization %d"}`, i, i)),
+					})
+				}
+				if offset+2 < 5 {
+					bundle.Link = append(bundle.Link, fhir.BundleLink{Relation: "next", Url: fmt.Sprintf("%s/Organization?offset=%d", server.URL, offset+2)})
+				}
+			}
+			w.Header().Set("Content-Type", "application/fhir+json")
+			_ = json.NewEncoder(w).Encode(bundle)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	// newQueryDirectory returns a query directory that fails the transaction with the given number (counting from 1) once,
+	// and records the number of entries of every transaction it applied
+	newQueryDirectory := func(t *testing.T, failTransaction int32) (*httptest.Server, *[]int) {
+		var received atomic.Int32
+		var applied []int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var tx fhir.Bundle
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&tx))
+			w.Header().Set("Content-Type", "application/fhir+json")
+			if received.Add(1) == failTransaction {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"resourceType":"OperationOutcome"}`))
+				return
+			}
+			applied = append(applied, len(tx.Entry))
+			result := fhir.Bundle{Type: fhir.BundleTypeTransactionResponse}
+			for range tx.Entry {
+				result.Entry = append(result.Entry, fhir.BundleEntry{Response: &fhir.BundleEntryResponse{Status: "201 Created"}})
+			}
+			_ = json.NewEncoder(w).Encode(result)
+		}))
+		t.Cleanup(server.Close)
+		return server, &applied
+	}
+	newComponent := func(t *testing.T, lrzaURL string, queryURL string, stateFile string) *Component {
+		config := DefaultConfig()
+		config.LRZABaseUrl = lrzaURL
+		config.QueryBaseUrl = queryURL
+		config.ResourceTypes = []string{"Organization", "Endpoint"}
+		config.TransactionSize = 2
+		config.StateFile = stateFile
+		component, err := New(config)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = component.Stop(context.Background())
+		})
+		// Don't retry failed requests
+		lrzaBaseURL, _ := url.Parse(lrzaURL)
+		queryBaseURL, _ := url.Parse(queryURL)
+		component.fhirLRZAClient = fhirclient.New(lrzaBaseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		component.fhirQueryClient = fhirclient.New(queryBaseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		return component
+	}
+
+	t.Run("applies transactions of bounded size", func(t *testing.T) {
+		queryDirectory, applied := newQueryDirectory(t, 0)
+		component := newComponent(t, newLRZA(t).URL, queryDirectory.URL, "")
+
+		report, err := component.update(context.Background(), false)
+
+		require.NoError(t, err)
+		require.Equal(t, 5, report.CountCreated)
+		require.Equal(t, []int{2, 2, 1}, *applied)
+		// The progress of a completed sync is removed
+		var checkpoint syncCheckpoint
+		found, err := component.stateStore.Get(checkpointBucket, component.config.LRZABaseUrl, &checkpoint)
+		require.NoError(t, err)
+		require.False(t, found)
+		lastUpdate, err := component.loadLastUpdateTime()
+		require.NoError(t, err)
+		require.NotEmpty(t, lastUpdate)
+	})
+	t.Run("failed sync resumes after restart", func(t *testing.T) {
+		lrza := newLRZA(t)
+		queryDirectory, applied := newQueryDirectory(t, 2)
+		stateFile := filepath.Join(t.TempDir(), "lrza.db")
+		first := newComponent(t, lrza.URL, queryDirectory.URL, stateFile)
+
+		_, err := first.update(context.Background(), false)
+		require.ErrorContains(t, err, "chunk 2 of 3")
+		require.Equal(t, []int{2}, *applied)
+		require.NoError(t, first.Stop(context.Background()))
+
+		second := newComponent(t, lrza.URL, queryDirectory.URL, stateFile)
+		report, err := second.update(context.Background(), false)
+
+		require.NoError(t, err)
+		require.Equal(t, 3, report.CountCreated, "chunks applied before the failure must not be applied again")
+		require.Equal(t, []int{2, 2, 1}, *applied)
+		lastUpdate, err := second.loadLastUpdateTime()
+		require.NoError(t, err)
+		require.NotEmpty(t, lastUpdate)
+	})
+}
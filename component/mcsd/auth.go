@@ -0,0 +1,270 @@
+package mcsd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/nuts-foundation/nuts-knooppunt/component/tracing"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/httpauth"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/resilience"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/tlsutil"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// DirectoryAuthConfig holds credentials for authenticating to remote administration directories.
+// Only one of OAuth2 and Nuts can be configured; both can be combined with mTLS.
+type DirectoryAuthConfig struct {
+	// FHIRBaseURLs are the FHIR base URLs (or prefixes of them) of the administration directories the credentials are used for.
+	// Credentials can also be selected by name, through the auth option of a root administration directory.
+	FHIRBaseURLs []string `koanf:"fhirbaseurls"`
+	// OAuth2 configures OAuth2 client credentials authentication.
+	OAuth2 httpauth.OAuth2Config `koanf:"oauth2"`
+	// Config configures mTLS: the client certificate presented to the directory, and optionally the CA to verify it with.
+	tlsutil.Config `koanf:",squash"`
+	// Nuts configures authentication with access tokens requested through the Nuts node.
+	// Settings that aren't configured are taken from the mcsd.nuts options, and the authorization server from the discovered Endpoint.
+	Nuts NutsAuthConfig `koanf:"nuts"`
+}
+
+// NutsAuthConfig configures requesting access tokens for administration directories through the Nuts node's request-service-access-token API.
+type NutsAuthConfig struct {
+	// Subject is the Nuts subject of the local organization, that requests the access tokens.
+	Subject string `koanf:"subject"`
+	// Scope is the scope of the requested access tokens.
+	Scope string `koanf:"scope"`
+	// AuthorizationServer is the OAuth2 authorization server of the directory. When not set, it's taken from the Endpoint the directory was discovered from.
+	AuthorizationServer string `koanf:"authorizationserver"`
+}
+
+func (c NutsAuthConfig) isSet() bool {
+	return c != NutsAuthConfig{}
+}
+
+// NutsConfig configures the Nuts node through which access tokens for administration directories are requested.
+type NutsConfig struct {
+	// NodeURL is the base URL of the Nuts node's internal API. It defaults to the embedded Nuts node, if enabled.
+	NodeURL string `koanf:"nodeurl"`
+	// Subject is the default Nuts subject that requests access tokens.
+	Subject string `koanf:"subject"`
+	// Scope is the default scope of the requested access tokens.
+	Scope string `koanf:"scope"`
+}
+
+// directoryCredentials are loaded DirectoryAuthConfig.
+type directoryCredentials struct {
+	config    DirectoryAuthConfig
+	tlsConfig *tls.Config
+}
+
+// directoryAuthSelection holds how the credentials of an administration directory are selected.
+type directoryAuthSelection struct {
+	// credentials is the name of the credentials configured for the directory, if any.
+	credentials string
+	// authorizationServer is the OAuth2 authorization server advertised by the Endpoint the directory was discovered from, if any.
+	authorizationServer string
+}
+
+// adminAuth provides the HTTP clients for the administration directories, authenticating with the credentials that apply to each directory.
+// Clients are created on first use and reused for all directories that share credentials and authorization server.
+type adminAuth struct {
+	credentials map[string]directoryCredentials
+	nuts        NutsConfig
+	mux         *sync.Mutex
+	// selections holds the credential selections of the registered administration directories, by FHIR base URL (without trailing slash).
+	selections map[string]directoryAuthSelection
+	clients    map[string]*http.Client
+}
+
+// newAdminAuth loads the configured credentials for the administration directories.
+func newAdminAuth(config Config) (*adminAuth, error) {
+	result := &adminAuth{
+		credentials: make(map[string]directoryCredentials),
+		nuts:        config.Nuts,
+		mux:         &sync.Mutex{},
+		selections:  make(map[string]directoryAuthSelection),
+		clients:     make(map[string]*http.Client),
+	}
+	for name, authConfig := range config.DirectoryAuth {
+		credentials, err := loadDirectoryCredentials(authConfig, config.Nuts)
+		if err != nil {
+			return nil, fmt.Errorf("mcsd.directoryauth.%s: %w", name, err)
+		}
+		result.credentials[name] = credentials
+	}
+	for _, rootDirectory := range config.AdministrationDirectories {
+		if _, ok := result.credentials[rootDirectory.Auth]; rootDirectory.Auth != "" && !ok {
+			return nil, fmt.Errorf("root administration directory (url=%s): unknown credentials: %s", rootDirectory.FHIRBaseURL, rootDirectory.Auth)
+		}
+	}
+	return result, nil
+}
+
+func loadDirectoryCredentials(config DirectoryAuthConfig, nuts NutsConfig) (directoryCredentials, error) {
+	result := directoryCredentials{config: config}
+	oauth2 := config.OAuth2
+	if (oauth2.TokenEndpoint != "" || oauth2.ClientID != "" || oauth2.ClientSecret != "") && !oauth2.IsConfigured() {
+		return directoryCredentials{}, fmt.Errorf("oauth2 configuration is incomplete: tokenendpoint, clientid, and clientsecret are required")
+	}
+	if config.Nuts.isSet() {
+		if oauth2.IsConfigured() {
+			return directoryCredentials{}, fmt.Errorf("oauth2 and nuts can't both be configured")
+		}
+		if nuts.NodeURL == "" {
+			return directoryCredentials{}, fmt.Errorf("nuts is configured, but there's no Nuts node (mcsd.nuts.nodeurl)")
+		}
+		if config.Nuts.Subject == "" && nuts.Subject == "" {
+			return directoryCredentials{}, fmt.Errorf("nuts subject is not configured")
+		}
+		if config.Nuts.Scope == "" && nuts.Scope == "" {
+			return directoryCredentials{}, fmt.Errorf("nuts scope is not configured")
+		}
+	}
+	if config.TLSCertFile != "" {
+		tlsConfig, err := tlsutil.CreateTLSConfig(config.Config)
+		if err != nil {
+			return directoryCredentials{}, fmt.Errorf("mTLS is configured but failed to load: %w", err)
+		}
+		result.tlsConfig = tlsConfig
+	}
+	return result, nil
+}
+
+// register records the credential selection of a registered administration directory.
+func (a *adminAuth) register(directory administrationDirectory) {
+	if directory.auth == "" && directory.authorizationServer == "" {
+		return
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.selections[strings.TrimSuffix(directory.fhirBaseURL, "/")] = directoryAuthSelection{
+		credentials:         directory.auth,
+		authorizationServer: directory.authorizationServer,
+	}
+}
+
+// httpClient returns the HTTP client for the administration directory with the given FHIR base URL. Its credentials are selected:
+//  1. by name, if configured for the (root) directory,
+//  2. by the longest matching FHIR base URL prefix of the configured credentials.
+//
+// If no OAuth2 credentials are selected and the Endpoint the directory was discovered from advertises an authorization server,
+// a Nuts access token is requested from it (if the Nuts subject and scope are configured).
+func (a *adminAuth) httpClient(fhirBaseURL string) *http.Client {
+	fhirBaseURL = strings.TrimSuffix(fhirBaseURL, "/")
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	selection := a.selections[fhirBaseURL]
+	name := selection.credentials
+	if name == "" {
+		name = a.matchCredentials(fhirBaseURL)
+	}
+	credentials := a.credentials[name]
+
+	var nutsConfig *httpauth.NutsTokenConfig
+	if !credentials.config.OAuth2.IsConfigured() && (credentials.config.Nuts.isSet() || selection.authorizationServer != "") {
+		nutsConfig = &httpauth.NutsTokenConfig{
+			NodeURL:             a.nuts.NodeURL,
+			Subject:             firstNonEmpty(credentials.config.Nuts.Subject, a.nuts.Subject),
+			Scope:               firstNonEmpty(credentials.config.Nuts.Scope, a.nuts.Scope),
+			AuthorizationServer: firstNonEmpty(credentials.config.Nuts.AuthorizationServer, selection.authorizationServer),
+		}
+	}
+	clientKey := name
+	if nutsConfig != nil {
+		clientKey += "|" + nutsConfig.AuthorizationServer
+	}
+	if client, ok := a.clients[clientKey]; ok {
+		return client
+	}
+	client := newDirectoryHTTPClient(credentials, nutsConfig, fhirBaseURL)
+	a.clients[clientKey] = client
+	return client
+}
+
+// matchCredentials returns the name of the credentials with the longest FHIR base URL prefix matching the given FHIR base URL,
+// or an empty string if there are none. See matchesBaseURLPrefix.
+func (a *adminAuth) matchCredentials(fhirBaseURL string) string {
+	var result string
+	var longest int
+	for name, credentials := range a.credentials {
+		for _, prefix := range credentials.config.FHIRBaseURLs {
+			if matchesBaseURLPrefix(fhirBaseURL, prefix) && len(prefix) > longest {
+				result, longest = name, len(prefix)
+			}
+		}
+	}
+	return result
+}
+
+// matchesBaseURLPrefix returns whether the given FHIR base URL has the same scheme and host (including port) as the prefix,
+// and a path that's equal to the prefix's path, or below it. So https://example.com/fhir matches https://example.com/fhir/tenant,
+// but not https://example.com/fhir2 or https://example.com.other.org/fhir.
+func matchesBaseURLPrefix(fhirBaseURL string, prefix string) bool {
+	baseURL, err := url.Parse(fhirBaseURL)
+	if err != nil {
+		return false
+	}
+	prefixURL, err := url.Parse(prefix)
+	if err != nil || prefixURL.Host == "" {
+		return false
+	}
+	if !strings.EqualFold(baseURL.Scheme, prefixURL.Scheme) || !strings.EqualFold(baseURL.Host, prefixURL.Host) {
+		return false
+	}
+	prefixPath := strings.TrimSuffix(prefixURL.Path, "/")
+	return baseURL.Path == prefixPath || strings.HasPrefix(baseURL.Path, prefixPath+"/")
+}
+
+// newDirectoryHTTPClient builds the HTTP client for administration directories. It layers, from the bottom up:
+// an optional mTLS transport, OpenTelemetry tracing, retries and circuit breaking, then either OAuth2 client credentials or Nuts access tokens.
+func newDirectoryHTTPClient(credentials directoryCredentials, nutsConfig *httpauth.NutsTokenConfig, fhirBaseURL string) *http.Client {
+	var baseTransport http.RoundTripper = http.DefaultTransport
+	if credentials.tlsConfig != nil {
+		baseTransport = &http.Transport{TLSClientConfig: credentials.tlsConfig}
+	}
+	tracedTransport := resilience.WrapTransport(tracing.WrapTransport(baseTransport))
+	var client *http.Client
+	var err error
+	switch {
+	case credentials.config.OAuth2.IsConfigured():
+		client, err = httpauth.NewOAuth2HTTPClient(credentials.config.OAuth2, tracedTransport)
+	case nutsConfig != nil && nutsConfig.IsConfigured():
+		client, err = httpauth.NewNutsHTTPClient(*nutsConfig, tracedTransport)
+	case nutsConfig != nil:
+		slog.Warn("mCSD Directory advertises an authorization server, but no Nuts node, subject or scope is configured: not authenticating",
+			logging.FHIRServer(fhirBaseURL), slog.String("authorization_server", nutsConfig.AuthorizationServer))
+	}
+	if err != nil {
+		// Configuration is validated on startup, so this shouldn't happen
+		slog.Error("Failed to create authenticating HTTP client for mCSD Directory", logging.FHIRServer(fhirBaseURL), logging.Error(err))
+	}
+	if client == nil {
+		client = &http.Client{Transport: tracedTransport}
+	}
+	return client
+}
+
+// endpointAuthorizationServer returns the OAuth2 authorization server advertised by the Endpoint, or an empty string if there's none.
+func endpointAuthorizationServer(endpoint fhir.Endpoint) string {
+	for _, extension := range endpoint.Extension {
+		if extension.Url == coding.EndpointAuthorizationServerExtensionURL && extension.ValueUrl != nil {
+			return *extension.ValueUrl
+		}
+	}
+	return ""
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,255 @@
+package mcsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/httpauth"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/tlsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestComponent_directoryAuthentication(t *testing.T) {
+	// directory records the Authorization header of the requests, by path
+	authHeaders := map[string]string{}
+	authHeadersMux := sync.Mutex{}
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeadersMux.Lock()
+		authHeaders[r.URL.Path] = r.Header.Get("Authorization")
+		authHeadersMux.Unlock()
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_, _ = w.Write([]byte(`{"resourceType":"Organization","id":"1"}`))
+	}))
+	defer directory.Close()
+	authHeader := func(path string) string {
+		authHeadersMux.Lock()
+		defer authHeadersMux.Unlock()
+		return authHeaders[path]
+	}
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"oauth2-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer tokenServer.Close()
+	var nutsTokenRequest map[string]string
+	nutsNode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/internal/auth/v2/local-subject/request-service-access-token", r.URL.Path)
+		_ = json.NewDecoder(r.Body).Decode(&nutsTokenRequest)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"nuts-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer nutsNode.Close()
+	oauth2Config := httpauth.OAuth2Config{TokenEndpoint: tokenServer.URL, ClientID: "client", ClientSecret: "secret"}
+
+	read := func(t *testing.T, component *Component, fhirBaseURL string) {
+		baseURL, err := url.Parse(fhirBaseURL)
+		require.NoError(t, err)
+		var organization fhir.Organization
+		require.NoError(t, component.fhirAdminClientFn(baseURL).ReadWithContext(t.Context(), "Organization/1", &organization))
+	}
+
+	t.Run("credentials configured for root directory", func(t *testing.T) {
+		config := DefaultConfig()
+		config.AdministrationDirectories = map[string]DirectoryConfig{
+			"root": {FHIRBaseURL: directory.URL + "/root", Auth: "lrza"},
+		}
+		config.DirectoryAuth = map[string]DirectoryAuthConfig{"lrza": {OAuth2: oauth2Config}}
+		component, err := New(config)
+		require.NoError(t, err)
+
+		read(t, component, directory.URL+"/root")
+
+		assert.Equal(t, "Bearer oauth2-token", authHeader("/root/Organization/1"))
+	})
+	t.Run("credentials selected by FHIR base URL prefix", func(t *testing.T) {
+		config := DefaultConfig()
+		config.DirectoryAuth = map[string]DirectoryAuthConfig{
+			"peer":  {FHIRBaseURLs: []string{directory.URL + "/peer/"}, OAuth2: oauth2Config},
+			"other": {FHIRBaseURLs: []string{"https://example.com"}, OAuth2: oauth2Config},
+		}
+		component, err := New(config)
+		require.NoError(t, err)
+
+		read(t, component, directory.URL+"/peer/fhir")
+		read(t, component, directory.URL+"/unauthenticated")
+		read(t, component, directory.URL+"/peer-lookalike")
+
+		assert.Equal(t, "Bearer oauth2-token", authHeader("/peer/fhir/Organization/1"))
+		assert.Empty(t, authHeader("/unauthenticated/Organization/1"))
+		assert.Empty(t, authHeader("/peer-lookalike/Organization/1"), "prefix should only match on a path segment boundary")
+	})
+	t.Run("Nuts access token for authorization server of discovered Endpoint", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Nuts = NutsConfig{NodeURL: nutsNode.URL, Subject: "local-subject", Scope: "mcsd-update"}
+		component, err := New(config)
+		require.NoError(t, err)
+		require.NoError(t, component.registerDirectory(t.Context(), administrationDirectory{
+			fhirBaseURL:         directory.URL + "/discovered",
+			resourceTypes:       defaultDirectoryResourceTypes,
+			authorizationServer: "https://example.com/oauth2/peer",
+		}))
+
+		read(t, component, directory.URL+"/discovered")
+
+		assert.Equal(t, "Bearer nuts-token", authHeader("/discovered/Organization/1"))
+		assert.Equal(t, "https://example.com/oauth2/peer", nutsTokenRequest["authorization_server"])
+		assert.Equal(t, "mcsd-update", nutsTokenRequest["scope"])
+	})
+	t.Run("Nuts access token with configured authorization server", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Nuts = NutsConfig{NodeURL: nutsNode.URL, Subject: "local-subject"}
+		config.DirectoryAuth = map[string]DirectoryAuthConfig{
+			"peer": {
+				FHIRBaseURLs: []string{directory.URL + "/nuts"},
+				Nuts:         NutsAuthConfig{Scope: "peer-scope", AuthorizationServer: "https://example.com/oauth2/configured"},
+			},
+		}
+		component, err := New(config)
+		require.NoError(t, err)
+
+		read(t, component, directory.URL+"/nuts")
+
+		assert.Equal(t, "Bearer nuts-token", authHeader("/nuts/Organization/1"))
+		assert.Equal(t, "https://example.com/oauth2/configured", nutsTokenRequest["authorization_server"])
+		assert.Equal(t, "peer-scope", nutsTokenRequest["scope"])
+	})
+	t.Run("authorization server of discovered Endpoint is restored", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Nuts = NutsConfig{NodeURL: nutsNode.URL, Subject: "local-subject", Scope: "mcsd-update"}
+		config.StateFile = t.TempDir() + "/state.db"
+		component, err := New(config)
+		require.NoError(t, err)
+		require.NoError(t, component.registerDirectory(t.Context(), administrationDirectory{
+			fhirBaseURL:         directory.URL + "/restored",
+			resourceTypes:       defaultDirectoryResourceTypes,
+			sourceURL:           "http://example.com/fhir/Endpoint/1",
+			authorizationServer: "https://example.com/oauth2/restored",
+		}))
+		require.NoError(t, component.Stop(t.Context()))
+
+		component, err = New(config)
+		require.NoError(t, err)
+		read(t, component, directory.URL+"/restored")
+
+		assert.Equal(t, "Bearer nuts-token", authHeader("/restored/Organization/1"))
+		assert.Equal(t, "https://example.com/oauth2/restored", nutsTokenRequest["authorization_server"])
+	})
+	t.Run("authorization server advertised, but Nuts not configured", func(t *testing.T) {
+		component, err := New(DefaultConfig())
+		require.NoError(t, err)
+		require.NoError(t, component.registerDirectory(t.Context(), administrationDirectory{
+			fhirBaseURL:         directory.URL + "/no-nuts",
+			resourceTypes:       defaultDirectoryResourceTypes,
+			authorizationServer: "https://example.com/oauth2/peer",
+		}))
+
+		read(t, component, directory.URL+"/no-nuts")
+
+		assert.Empty(t, authHeader("/no-nuts/Organization/1"))
+	})
+	t.Run("invalid configuration", func(t *testing.T) {
+		testCases := []struct {
+			name     string
+			config   func(config *Config)
+			expected string
+		}{
+			{
+				name: "unknown credentials",
+				config: func(config *Config) {
+					config.AdministrationDirectories = map[string]DirectoryConfig{"root": {FHIRBaseURL: "https://example.com/fhir", Auth: "unknown"}}
+				},
+				expected: "root administration directory (url=https://example.com/fhir): unknown credentials: unknown",
+			},
+			{
+				name: "incomplete OAuth2",
+				config: func(config *Config) {
+					config.DirectoryAuth = map[string]DirectoryAuthConfig{"peer": {OAuth2: httpauth.OAuth2Config{ClientID: "client"}}}
+				},
+				expected: "mcsd.directoryauth.peer: oauth2 configuration is incomplete: tokenendpoint, clientid, and clientsecret are required",
+			},
+			{
+				name: "OAuth2 and Nuts",
+				config: func(config *Config) {
+					config.Nuts = NutsConfig{NodeURL: "http://localhost", Subject: "subject", Scope: "scope"}
+					config.DirectoryAuth = map[string]DirectoryAuthConfig{"peer": {OAuth2: oauth2Config, Nuts: NutsAuthConfig{Scope: "other"}}}
+				},
+				expected: "mcsd.directoryauth.peer: oauth2 and nuts can't both be configured",
+			},
+			{
+				name: "Nuts without Nuts node",
+				config: func(config *Config) {
+					config.DirectoryAuth = map[string]DirectoryAuthConfig{"peer": {Nuts: NutsAuthConfig{Subject: "subject", Scope: "scope"}}}
+				},
+				expected: "mcsd.directoryauth.peer: nuts is configured, but there's no Nuts node (mcsd.nuts.nodeurl)",
+			},
+			{
+				name: "Nuts without subject",
+				config: func(config *Config) {
+					config.Nuts = NutsConfig{NodeURL: "http://localhost"}
+					config.DirectoryAuth = map[string]DirectoryAuthConfig{"peer": {Nuts: NutsAuthConfig{Scope: "scope"}}}
+				},
+				expected: "mcsd.directoryauth.peer: nuts subject is not configured",
+			},
+			{
+				name: "unreadable client certificate",
+				config: func(config *Config) {
+					config.DirectoryAuth = map[string]DirectoryAuthConfig{"peer": {Config: tlsutil.Config{TLSCertFile: "does-not-exist.pem", TLSKeyFile: "does-not-exist.key"}}}
+				},
+				expected: "mcsd.directoryauth.peer: mTLS is configured but failed to load",
+			},
+		}
+		for _, testCase := range testCases {
+			t.Run(testCase.name, func(t *testing.T) {
+				config := DefaultConfig()
+				testCase.config(&config)
+
+				_, err := New(config)
+
+				assert.ErrorContains(t, err, testCase.expected)
+			})
+		}
+	})
+}
+
+func TestMatchesBaseURLPrefix(t *testing.T) {
+	testCases := []struct {
+		fhirBaseURL string
+		prefix      string
+		expected    bool
+	}{
+		{fhirBaseURL: "https://dir.example.com/fhir", prefix: "https://dir.example.com/fhir", expected: true},
+		{fhirBaseURL: "https://dir.example.com/fhir/tenant", prefix: "https://dir.example.com/fhir/", expected: true},
+		{fhirBaseURL: "https://dir.example.com/fhir", prefix: "https://dir.example.com", expected: true},
+		{fhirBaseURL: "https://DIR.example.com/fhir", prefix: "https://dir.example.com", expected: true},
+		{fhirBaseURL: "https://dir.example.com/fhir2", prefix: "https://dir.example.com/fhir", expected: false},
+		{fhirBaseURL: "https://dir.example.com.attacker.org/fhir", prefix: "https://dir.example.com", expected: false},
+		{fhirBaseURL: "https://dir.example.com-evil/fhir", prefix: "https://dir.example.com", expected: false},
+		{fhirBaseURL: "https://dir.example.com:8443/fhir", prefix: "https://dir.example.com", expected: false},
+		{fhirBaseURL: "https://dir.example.com@attacker.org/fhir", prefix: "https://dir.example.com", expected: false},
+		{fhirBaseURL: "http://dir.example.com/fhir", prefix: "https://dir.example.com", expected: false},
+		{fhirBaseURL: "https://dir.example.com/fhir", prefix: "dir.example.com", expected: false},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.fhirBaseURL+" "+testCase.prefix, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, matchesBaseURLPrefix(testCase.fhirBaseURL, testCase.prefix))
+		})
+	}
+}
+
+func TestEndpointAuthorizationServer(t *testing.T) {
+	assert.Equal(t, "https://example.com/oauth2/peer", endpointAuthorizationServer(fhir.Endpoint{
+		Extension: []fhir.Extension{
+			{Url: "http://example.com/other", ValueUrl: to.Ptr("https://example.com/other")},
+			{Url: coding.EndpointAuthorizationServerExtensionURL, ValueUrl: to.Ptr("https://example.com/oauth2/peer")},
+		},
+	}))
+	assert.Empty(t, endpointAuthorizationServer(fhir.Endpoint{}))
+}
@@ -3,6 +3,7 @@ package mcsd
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -17,9 +18,15 @@ import (
 	"github.com/nuts-foundation/nuts-knooppunt/component"
 	"github.com/nuts-foundation/nuts-knooppunt/component/tracing"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/fanout"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/fhirapi"
 	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/httpauth"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/profile"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/resilience"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/scheduler"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/statestore"
 	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
 	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
 )
@@ -36,8 +43,9 @@ type parentOrganizationMap map[*fhir.Organization][]*fhir.Organization
 // to account for potential clock differences between client and FHIR server
 var clockSkewBuffer = 2 * time.Second
 
-// maxUpdateEntries limits the number of entries processed in a single FHIR transaction to prevent excessive load on the FHIR server
-const maxUpdateEntries = 1000
+// defaultTransactionSize is the default maximum number of entries in a single FHIR transaction applied to the query directory,
+// to prevent excessive load on the FHIR server.
+const defaultTransactionSize = 1000
 
 // searchPageSize is an arbitrary FHIR search result limit (per page), so we have deterministic behavior across FHIR servers,
 // and don't rely on server defaults (which may be very high or very low (Azure FHIR's default is 10)).
@@ -68,16 +76,66 @@ type Component struct {
 	config            Config
 	fhirAdminClientFn func(baseURL *url.URL) fhirclient.Client
 	fhirQueryClient   fhirclient.Client
+	// queryTargets applies the changes made to the query directory to the configured query targets.
+	queryTargets *fanout.Replicator
+	// adminAuth provides the authenticating HTTP clients for the administration directories.
+	adminAuth *adminAuth
 
 	administrationDirectories []administrationDirectory
 	directoryResourceTypes    []string
 	lastUpdateTimes           map[string]string
-	updateMux                 *sync.RWMutex
+	// excludedDirectories holds the FHIR base URLs (without trailing slash) excluded through the directory management API,
+	// in addition to the ones excluded by configuration.
+	excludedDirectories map[string]bool
+	// syncStatuses holds the outcome of the last update from each administration directory, by directory key.
+	syncStatuses map[string]DirectorySyncStatus
+	// updateMux makes sure only 1 update runs at a time.
+	updateMux *sync.RWMutex
+	// stateMux guards administrationDirectories, lastUpdateTimes, excludedDirectories and syncStatuses, which are accessed by concurrent directory updates.
+	stateMux   *sync.Mutex
+	scheduler  *scheduler.Scheduler
+	stateStore statestore.Store
+	// reconcileScheduler runs reconciling updates, on a slower schedule than the regular updates
+	reconcileScheduler *scheduler.Scheduler
+	// updatePolicy validates the resources from the administration directories, if configured. Otherwise, the built-in rules are used.
+	updatePolicy *UpdatePolicy
+	// profileValidator validates resources against the nl-gf profiles, if profile validation is enabled.
+	profileValidator *profile.Validator
+	// trustAnchor is the register authoritative Organizations are cross-checked against, if enabled (see ValidationConfig.LRZA).
+	// It's also used to tell the LRZA's copies of Organizations apart when consolidating them (see Config.Consolidation).
+	trustAnchor TrustAnchor
+	// consolidationMux makes sure only 1 consolidation runs at a time.
+	consolidationMux *sync.Mutex
+	// subscriptions holds the FHIR Subscriptions created on administration directories, by directory key. Guarded by stateMux.
+	subscriptions map[string]directorySubscription
+	// pendingUpdates holds the directory keys of notification-triggered updates that haven't started yet. Guarded by stateMux.
+	pendingUpdates map[string]bool
+	// skippedDiscoveries holds the mCSD Directory Endpoints that weren't registered to prevent discovery loops,
+	// by directory key of the directory that listed them. Guarded by stateMux.
+	skippedDiscoveries map[string][]SkippedDiscovery
+	// backgroundCtx is cancelled when the component is stopped, backgroundTasks tracks the work started in the background.
+	backgroundCtx    context.Context
+	cancelBackground context.CancelFunc
+	backgroundTasks  *sync.WaitGroup
 }
 
 func DefaultConfig() Config {
 	return Config{
 		DirectoryResourceTypes: defaultDirectoryResourceTypes,
+		MaxDiscoveryDepth:      1,
+		Concurrency:            4,
+		TransactionSize:        defaultTransactionSize,
+		DirectoryTimeout:       5 * time.Minute,
+		Sync: scheduler.Config{
+			InitialDelay: 10 * time.Second,
+			Jitter:       30 * time.Second,
+			MaxBackoff:   time.Hour,
+		},
+		Reconcile: scheduler.Config{
+			InitialDelay: 10 * time.Minute,
+			Jitter:       10 * time.Minute,
+			MaxBackoff:   24 * time.Hour,
+		},
 	}
 }
 
@@ -87,10 +145,61 @@ type Config struct {
 	ExcludeAdminDirectories   []string                   `koanf:"adminexclude"`
 	DirectoryResourceTypes    []string                   `koanf:"directoryresourcetypes"`
 	Auth                      httpauth.OAuth2Config      `koanf:"auth"`
+	// QueryTargets are additional FHIR servers, by name, that receive the same changes as the query directory.
+	QueryTargets map[string]fanout.TargetConfig `koanf:"querytargets"`
+	// Sync configures the built-in schedule for updating from the administration directories.
+	// It is disabled when no interval is set, in which case updates are only triggered through the internal API.
+	Sync scheduler.Config `koanf:"sync"`
+	// Reconcile configures the schedule for reconciling the query directory with the administration directories,
+	// which repairs drift that incremental updates can't detect (e.g. expunged history). It is disabled when no interval is set.
+	Reconcile scheduler.Config `koanf:"reconcile"`
+	// MaxDiscoveryDepth is the maximum number of discovery steps from a root directory. At 1 (default), only the directories
+	// listed by root directories are registered; higher values also register the directories listed by discovered directories.
+	MaxDiscoveryDepth int `koanf:"maxdiscoverydepth"`
+	// Concurrency is the maximum number of administration directories that are updated in parallel.
+	Concurrency int `koanf:"concurrency"`
+	// DirectoryTimeout is the maximum duration of updating from a single administration directory. Zero means no timeout.
+	DirectoryTimeout time.Duration `koanf:"directorytimeout"`
+	// TransactionSize is the maximum number of entries in a single FHIR transaction applied to the query directory.
+	// Larger updates are applied in multiple transactions.
+	TransactionSize int `koanf:"transactionsize"`
+	// SyncStrategy is the default strategy for fetching the changes of administration directories: auto (default), history or search.
+	SyncStrategy string `koanf:"syncstrategy"`
+	// Subscriptions configures push-triggered updates through FHIR Subscriptions on the administration directories.
+	Subscriptions SubscriptionConfig `koanf:"subscriptions"`
+	// Validation configures how resources from the administration directories are validated before they're imported.
+	Validation ValidationConfig `koanf:"validation"`
+	// DirectoryAuth holds named credentials for authenticating to remote administration directories.
+	DirectoryAuth map[string]DirectoryAuthConfig `koanf:"directoryauth"`
+	// Nuts configures the Nuts node through which access tokens for administration directories are requested.
+	Nuts NutsConfig `koanf:"nuts"`
+	// Consolidation is the mode of consolidating the copies of a care provider's Organization that were imported from both the LRZA
+	// and administration directories: off (default), link (link them through a Linkage) or merge (merge the LRZA's name and identifiers
+	// into the administration directory's copy, and tag the other copies as alternate).
+	Consolidation string `koanf:"consolidation"`
+	// StateFile is the path of the file in which the sync state (timestamps, discovered directories and the progress of interrupted syncs) is persisted.
+	// It's also used to buffer the resources fetched during a sync. When not set, the state is kept in memory and every restart causes a full sync.
+	StateFile string `koanf:"statefile"`
+}
+
+type ValidationConfig struct {
+	// Policy is the path of a Rego policy file (or directory of policy and data files) that decides whether resources are imported,
+	// instead of the built-in rules. When not set, the built-in rules are used.
+	Policy string `koanf:"policy"`
+	// Profiles is the mode of validating resources against the nl-gf profiles (StructureDefinitions): off (default),
+	// warn (report resources that don't conform, but import them) or reject (don't import them).
+	Profiles string `koanf:"profiles"`
+	// LRZA is the mode of cross-checking the URA and name of authoritative Organizations against the LRZA: off (default),
+	// warn (report mismatches, but import the Organizations) or reject (don't accept them as authoritative Organizations).
+	LRZA string `koanf:"lrza"`
 }
 
 type DirectoryConfig struct {
 	FHIRBaseURL string `koanf:"fhirbaseurl"`
+	// SyncStrategy is the strategy for fetching the changes of the directory, overriding the default sync strategy.
+	SyncStrategy string `koanf:"syncstrategy"`
+	// Auth is the name of the credentials (see Config.DirectoryAuth) used to authenticate to the directory.
+	Auth string `koanf:"auth"`
 }
 
 type UpdateReport map[string]DirectoryUpdateReport
@@ -101,6 +210,14 @@ type administrationDirectory struct {
 	discover         bool
 	sourceURL        string // The fullUrl from the Bundle entry that created this Endpoint, used for unregistration on DELETE
 	authoritativeUra string // URA of the organization that is authoritative for this directory
+	manual           bool   // Added through the directory management API
+	syncStrategy     string // Strategy for fetching changes, empty for the default
+	auth             string // Name of the credentials configured for the directory, empty to select them by FHIR base URL
+	// authorizationServer is the OAuth2 authorization server advertised by the Endpoint the directory was discovered from
+	authorizationServer string
+	// discoveredThrough holds the FHIR base URLs of the directories through which the directory was discovered, root directory first.
+	// It's empty for root and manually added directories.
+	discoveredThrough []string
 }
 
 type DirectoryUpdateReport struct {
@@ -109,6 +226,26 @@ type DirectoryUpdateReport struct {
 	CountDeleted int      `json:"deleted"`
 	Warnings     []string `json:"warnings"`
 	Errors       []string `json:"errors"`
+	// Items holds the warnings and errors in machine-readable form.
+	Items []libfhir.ReportItem `json:"items"`
+	// ResourceTypes holds the created, updated and deleted counts per resource type.
+	ResourceTypes libfhir.ResourceTypeCounts `json:"resourceTypes"`
+	// DurationMs is how long the update took, in milliseconds.
+	DurationMs int64 `json:"durationMs"`
+	// Purged is set when the report is of removing the resources of an unregistered directory from the query directory.
+	Purged bool `json:"purged,omitempty"`
+	// Changes lists the changes that would be made to the query directory, only set for a dry run.
+	Changes []libfhir.TransactionChange `json:"changes,omitempty"`
+}
+
+// updateOptions alter the behavior of an update.
+type updateOptions struct {
+	// dryRun determines the changes to the query directory without making them. A dry run has no side effects:
+	// discovered directories aren't registered, and the sync state isn't changed.
+	dryRun bool
+	// reconcile fetches the complete history of the directories instead of the changes since the last update,
+	// and removes resources from the query directory that no longer exist in the directory they were imported from.
+	reconcile bool
 }
 
 func New(config Config) (*Component, error) {
@@ -117,12 +254,60 @@ func New(config Config) (*Component, error) {
 	var err error
 	if config.Auth.IsConfigured() {
 		slog.Info("mCSD: OAuth2 authentication configured", slog.String("token_endpoint", config.Auth.TokenEndpoint))
-		httpClient, err = httpauth.NewOAuth2HTTPClient(config.Auth, tracing.WrapTransport(nil))
+		httpClient, err = httpauth.NewOAuth2HTTPClient(config.Auth, resilience.WrapTransport(tracing.WrapTransport(nil)))
 		if err != nil {
 			return nil, fmt.Errorf("failed to create OAuth2 HTTP client for mCSD: %w", err)
 		}
 	} else {
-		httpClient = tracing.NewHTTPClient()
+		httpClient = &http.Client{Transport: resilience.WrapTransport(tracing.WrapTransport(nil))}
+	}
+
+	if err := validateSyncStrategy(config.SyncStrategy); err != nil {
+		return nil, err
+	}
+	if config.MaxDiscoveryDepth < 0 {
+		return nil, fmt.Errorf("mcsd.maxdiscoverydepth must not be negative (value=%d)", config.MaxDiscoveryDepth)
+	}
+	for _, rootDirectory := range config.AdministrationDirectories {
+		if err := validateSyncStrategy(rootDirectory.SyncStrategy); err != nil {
+			return nil, fmt.Errorf("root administration directory (url=%s): %w", rootDirectory.FHIRBaseURL, err)
+		}
+	}
+
+	var updatePolicy *UpdatePolicy
+	if config.Validation.Policy != "" {
+		if updatePolicy, err = LoadUpdatePolicy(context.Background(), config.Validation.Policy); err != nil {
+			return nil, err
+		}
+		slog.Info("mCSD: using update policy instead of built-in validation rules", slog.String("policy", config.Validation.Policy))
+	}
+	if config.Validation.Profiles, err = profile.ParseValidationMode(config.Validation.Profiles); err != nil {
+		return nil, fmt.Errorf("mcsd.validation.profiles: %w", err)
+	}
+	switch config.Validation.LRZA {
+	case "":
+		config.Validation.LRZA = profile.ValidationOff
+	case profile.ValidationOff, profile.ValidationWarn, profile.ValidationReject:
+	default:
+		return nil, fmt.Errorf("mcsd.validation.lrza: invalid mode %q (valid: %s, %s, %s)", config.Validation.LRZA, profile.ValidationOff, profile.ValidationWarn, profile.ValidationReject)
+	}
+	switch config.Consolidation {
+	case "":
+		config.Consolidation = consolidationOff
+	case consolidationOff, consolidationLink, consolidationMerge:
+	default:
+		return nil, fmt.Errorf("mcsd.consolidation: invalid mode %q (valid: %s, %s, %s)", config.Consolidation, consolidationOff, consolidationLink, consolidationMerge)
+	}
+	var profileValidator *profile.Validator
+	if config.Validation.Profiles != profile.ValidationOff {
+		if profileValidator, err = profile.NewValidator(); err != nil {
+			return nil, err
+		}
+	}
+
+	adminAuth, err := newAdminAuth(config)
+	if err != nil {
+		return nil, err
 	}
 
 	queryDirectoryFHIRBaseURL, err := url.Parse(config.QueryDirectory.FHIRBaseURL)
@@ -130,55 +315,225 @@ func New(config Config) (*Component, error) {
 		return nil, fmt.Errorf("invalid Query Directory FHIR base URL (url=%s): %w", config.QueryDirectory.FHIRBaseURL, err)
 	}
 
+	stateStore, err := statestore.Open(config.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mCSD state store: %w", err)
+	}
+
 	result := &Component{
 		config: config,
 		fhirAdminClientFn: func(baseURL *url.URL) fhirclient.Client {
-			return fhirclient.New(baseURL, tracing.NewHTTPClient(), &fhirclient.Config{
+			return fhirclient.New(baseURL, adminAuth.httpClient(baseURL.String()), &fhirclient.Config{
 				UsePostSearch: false,
 			})
 		},
+		adminAuth: adminAuth,
 		fhirQueryClient: fhirclient.New(queryDirectoryFHIRBaseURL, httpClient, &fhirclient.Config{
 			UsePostSearch: false,
 		}),
 		directoryResourceTypes: config.DirectoryResourceTypes,
+		updatePolicy:           updatePolicy,
+		profileValidator:       profileValidator,
 		lastUpdateTimes:        make(map[string]string),
+		excludedDirectories:    make(map[string]bool),
+		syncStatuses:           make(map[string]DirectorySyncStatus),
 		updateMux:              &sync.RWMutex{},
+		stateMux:               &sync.Mutex{},
+		consolidationMux:       &sync.Mutex{},
+		stateStore:             stateStore,
+		subscriptions:          make(map[string]directorySubscription),
+		pendingUpdates:         make(map[string]bool),
+		skippedDiscoveries:     make(map[string][]SkippedDiscovery),
+		backgroundTasks:        &sync.WaitGroup{},
+	}
+	result.backgroundCtx, result.cancelBackground = context.WithCancel(context.Background())
+	// Exclusions must be known before registering any directory
+	if err := result.restoreExclusions(); err != nil {
+		_ = stateStore.Close()
+		return nil, fmt.Errorf("failed to restore mCSD state: %w", err)
 	}
 	for _, rootDirectory := range config.AdministrationDirectories {
-		if err := result.registerAdministrationDirectory(context.Background(), rootDirectory.FHIRBaseURL, rootDirectoryResourceTypes, true, "", ""); err != nil {
+		if err := result.registerRootDirectory(context.Background(), rootDirectory); err != nil {
+			_ = stateStore.Close()
 			return nil, fmt.Errorf("register root administration directory (url=%s): %w", rootDirectory.FHIRBaseURL, err)
 		}
 	}
+	if err := result.restoreState(context.Background()); err != nil {
+		_ = stateStore.Close()
+		return nil, fmt.Errorf("failed to restore mCSD state: %w", err)
+	}
+	if err := result.restoreSubscriptions(context.Background()); err != nil {
+		_ = stateStore.Close()
+		return nil, fmt.Errorf("failed to restore mCSD subscriptions: %w", err)
+	}
+	if result.config.TransactionSize <= 0 {
+		result.config.TransactionSize = defaultTransactionSize
+	}
 	if result.config.DirectoryResourceTypes == nil || len(result.config.DirectoryResourceTypes) == 0 {
 		result.config.DirectoryResourceTypes = append([]string(nil), defaultDirectoryResourceTypes...)
 	}
+	// Query targets that missed changes are resynchronized from the query directory, with the resources of the registered directories
+	result.queryTargets, err = fanout.New(config.QueryTargets, resilience.WrapTransport(tracing.WrapTransport(nil)), fanout.Source{
+		Client:          result.fhirQueryClient,
+		ResourceTypes:   result.config.DirectoryResourceTypes,
+		Owns:            result.isSourceOfRegisteredDirectory,
+		TransactionSize: result.config.TransactionSize,
+	}, stateStore)
+	if err != nil {
+		_ = stateStore.Close()
+		return nil, fmt.Errorf("mcsd.querytargets: %w", err)
+	}
+	result.scheduler = scheduler.New("mCSD update", config.Sync, result.scheduledTask(updateOptions{}))
+	result.reconcileScheduler = scheduler.New("mCSD reconcile", config.Reconcile, result.scheduledTask(updateOptions{reconcile: true}))
 	return result, nil
 }
 
 func (c *Component) Start() error {
+	if c.config.Validation.LRZA != profile.ValidationOff && c.trustAnchor == nil {
+		return errors.New("mcsd.validation.lrza requires the LRZA sync client (lrza.lrzabaseurl)")
+	}
+	if c.config.Consolidation != consolidationOff && c.trustAnchor == nil {
+		return errors.New("mcsd.consolidation requires the LRZA sync client (lrza.lrzabaseurl)")
+	}
+	c.queryTargets.Start()
+	c.scheduler.Start()
+	c.reconcileScheduler.Start()
 	return nil
 }
 
 func (c *Component) Stop(ctx context.Context) error {
+	if err := c.scheduler.Stop(ctx); err != nil {
+		return err
+	}
+	if err := c.reconcileScheduler.Stop(ctx); err != nil {
+		return err
+	}
+	// Cancel notification-triggered updates and wait for them to finish
+	c.cancelBackground()
+	c.backgroundTasks.Wait()
+	// Wait for any manually triggered update to finish before closing the state store
+	c.updateMux.Lock()
+	defer c.updateMux.Unlock()
+	if err := c.queryTargets.Stop(ctx); err != nil {
+		slog.WarnContext(ctx, "Not all changes were applied to the mCSD query targets before stopping", logging.Error(err))
+	}
+	if c.updatePolicy != nil {
+		c.updatePolicy.Stop(ctx)
+	}
+	return c.stateStore.Close()
+}
+
+// applyToQueryDirectory applies the given transaction to the query directory. Once applied, it's queued for the query targets:
+// they're updated in the background, so a failing query target doesn't fail the update.
+func (c *Component) applyToQueryDirectory(ctx context.Context, tx fhir.Bundle, txResult *fhir.Bundle) error {
+	if err := c.fhirQueryClient.CreateWithContext(ctx, tx, txResult, fhirclient.AtPath("/")); err != nil {
+		return err
+	}
+	c.queryTargets.Apply(ctx, tx)
+	return nil
+}
+
+// scheduledTask returns the task run by the built-in update (or reconcile) schedule. The run only counts as failed (causing the scheduler to back off)
+// when every directory failed to update, e.g. because the query directory is unavailable:
+// a single unreachable peer directory shouldn't slow down updates from all others.
+func (c *Component) scheduledTask(options updateOptions) scheduler.Task {
+	return func(ctx context.Context) error {
+		return c.scheduledUpdate(ctx, options)
+	}
+}
+
+func (c *Component) scheduledUpdate(ctx context.Context, options updateOptions) error {
+	report, err := c.updateWithOptions(ctx, options)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, directoryReport := range report {
+		if len(directoryReport.Errors) > 0 {
+			failed++
+		}
+	}
+	if failed > 0 && failed == len(report) {
+		return fmt.Errorf("all %d mCSD Directories failed to update", failed)
+	}
+	slog.InfoContext(ctx, "Scheduled mCSD update completed", slog.Int("directories", len(report)), slog.Int("failed", failed), slog.Bool("reconcile", options.reconcile))
 	return nil
 }
 
 func (c *Component) RegisterHttpHandlers(publicMux, internalMux *http.ServeMux) {
 	internalMux.HandleFunc("POST /mcsd/update", func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		result, err := c.update(ctx)
+		var options updateOptions
+		for name, target := range map[string]*bool{"dryRun": &options.dryRun, "reconcile": &options.reconcile} {
+			value := r.URL.Query().Get(name)
+			if value == "" {
+				continue
+			}
+			var err error
+			if *target, err = strconv.ParseBool(value); err != nil {
+				http.Error(w, "Invalid "+name+" parameter: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		result, err := c.updateWithOptions(ctx, options)
 		if err != nil {
 			slog.ErrorContext(ctx, "mCSD update failed", logging.Error(err))
 			http.Error(w, "Failed to update mCSD: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if fhirapi.AcceptsFHIR(r) {
+			fhirapi.SendResponse(ctx, w, http.StatusOK, result.bundle())
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		_ = json.NewEncoder(w).Encode(result)
 	})
+	c.registerDirectoryHandlers(internalMux)
+	c.registerQuarantineHandlers(internalMux)
+	c.registerResolveHandlers(internalMux)
+	c.registerDiscoveryHandlers(internalMux)
+	internalMux.HandleFunc("GET /mcsd/querytargets", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.queryTargets.Statuses())
+	})
+	if c.config.Subscriptions.Enabled() {
+		publicMux.HandleFunc("POST /mcsd/notify/{id}", c.handleNotification)
+	}
 }
 
 func (c *Component) registerAdministrationDirectory(ctx context.Context, fhirBaseURL string, resourceTypes []string, discover bool, sourceURL string, authoritativeUra string) error {
+	err := c.registerDirectory(ctx, administrationDirectory{
+		resourceTypes:    resourceTypes,
+		fhirBaseURL:      fhirBaseURL,
+		discover:         discover,
+		sourceURL:        sourceURL,
+		authoritativeUra: authoritativeUra,
+	})
+	if errors.Is(err, errDirectoryExcluded) || errors.Is(err, errDirectoryExists) {
+		return nil
+	}
+	return err
+}
+
+// registerRootDirectory registers a root administration directory from configuration.
+func (c *Component) registerRootDirectory(ctx context.Context, config DirectoryConfig) error {
+	err := c.registerDirectory(ctx, administrationDirectory{
+		fhirBaseURL:   config.FHIRBaseURL,
+		resourceTypes: rootDirectoryResourceTypes,
+		discover:      true,
+		syncStrategy:  config.SyncStrategy,
+		auth:          config.Auth,
+	})
+	if errors.Is(err, errDirectoryExcluded) || errors.Is(err, errDirectoryExists) {
+		return nil
+	}
+	return err
+}
+
+// registerDirectory adds the given administration directory to the directories that are updated from.
+// It returns errDirectoryExcluded if its FHIR base URL is excluded, and errDirectoryExists if it's already registered.
+func (c *Component) registerDirectory(ctx context.Context, directory administrationDirectory) error {
+	fhirBaseURL := directory.fhirBaseURL
 	// Must be a valid http or https URL
 	parsedFHIRBaseURL, err := url.Parse(fhirBaseURL)
 	if err != nil {
@@ -189,29 +544,27 @@ func (c *Component) registerAdministrationDirectory(ctx context.Context, fhirBas
 		return fmt.Errorf("invalid FHIR base URL (url=%s)", fhirBaseURL)
 	}
 
-	// Check if the URL is in the exclusion list (also trim exclusion list entries for consistent matching)
-	trimmedFHIRBaseURL := strings.TrimRight(fhirBaseURL, "/")
-	for _, excludedURL := range c.config.ExcludeAdminDirectories {
-		if strings.TrimRight(excludedURL, "/") == trimmedFHIRBaseURL {
-			slog.InfoContext(ctx, "Skipping administration directory registration: excluded by configuration", logging.FHIRServer(fhirBaseURL))
-			return nil
-		}
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+
+	if c.isExcluded(fhirBaseURL) {
+		slog.InfoContext(ctx, "Skipping administration directory registration: excluded", logging.FHIRServer(fhirBaseURL))
+		return errDirectoryExcluded
 	}
 
-	exists := slices.ContainsFunc(c.administrationDirectories, func(directory administrationDirectory) bool {
-		return directory.fhirBaseURL == fhirBaseURL && directory.authoritativeUra == authoritativeUra
+	exists := slices.ContainsFunc(c.administrationDirectories, func(other administrationDirectory) bool {
+		return other.fhirBaseURL == fhirBaseURL && other.authoritativeUra == directory.authoritativeUra
 	})
 	if exists {
-		return nil
+		return errDirectoryExists
 	}
-	c.administrationDirectories = append(c.administrationDirectories, administrationDirectory{
-		resourceTypes:    resourceTypes,
-		fhirBaseURL:      fhirBaseURL,
-		discover:         discover,
-		sourceURL:        sourceURL,
-		authoritativeUra: authoritativeUra,
-	})
-	slog.InfoContext(ctx, "Registered mCSD Directory", logging.FHIRServer(fhirBaseURL), slog.Bool("discover", discover))
+	c.administrationDirectories = append(c.administrationDirectories, directory)
+	c.adminAuth.register(directory)
+	if directory.sourceURL != "" || directory.manual {
+		// Discovered or manually added directory (root directories are registered from configuration on every startup)
+		c.persistDirectory(ctx, directory)
+	}
+	slog.InfoContext(ctx, "Registered mCSD Directory", logging.FHIRServer(fhirBaseURL), slog.Bool("discover", directory.discover))
 	return nil
 }
 
@@ -219,12 +572,20 @@ func (c *Component) registerAdministrationDirectory(ctx context.Context, fhirBas
 // This is called when an Endpoint is deleted to prevent it from being fetched in future updates.
 // The fullUrl parameter is the Bundle entry fullUrl that was used when the Endpoint was registered.
 func (c *Component) unregisterAdministrationDirectory(ctx context.Context, fullUrl string) {
-	initialCount := len(c.administrationDirectories)
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	var unregistered []string
 	c.administrationDirectories = slices.DeleteFunc(c.administrationDirectories, func(dir administrationDirectory) bool {
-		return dir.sourceURL == fullUrl
-	})
-	if len(c.administrationDirectories) < initialCount {
+		if dir.sourceURL != fullUrl {
+			return false
+		}
+		c.forgetDirectory(ctx, dir)
+		unregistered = append(unregistered, dir.fhirBaseURL)
 		slog.InfoContext(ctx, "Unregistered mCSD Directory after Endpoint deletion", slog.String("full_url", fullUrl))
+		return true
+	})
+	for _, fhirBaseURL := range unregistered {
+		c.unregisterDiscoveredThrough(ctx, fhirBaseURL)
 	}
 }
 
@@ -244,36 +605,117 @@ func (c *Component) processEndpointDeletes(ctx context.Context, entries []fhir.B
 }
 
 func (c *Component) update(ctx context.Context) (UpdateReport, error) {
+	return c.updateWithOptions(ctx, updateOptions{})
+}
+
+func (c *Component) updateWithOptions(ctx context.Context, options updateOptions) (UpdateReport, error) {
 	c.updateMux.Lock()
 	defer c.updateMux.Unlock()
 
 	result := make(UpdateReport)
-	for i := 0; i < len(c.administrationDirectories); i++ {
-		adminDirectory := c.administrationDirectories[i]
-		report, err := c.updateFromDirectory(ctx, adminDirectory.fhirBaseURL, adminDirectory.resourceTypes, adminDirectory.discover, adminDirectory.authoritativeUra)
-		if err != nil {
-			slog.ErrorContext(ctx, "mCSD Directory update failed", logging.FHIRServer(adminDirectory.fhirBaseURL), logging.Error(err))
-			report.Errors = append(report.Errors, err.Error())
-		}
-		// Return empty slices instead of null ones, makes a nicer REST API
-		if report.Warnings == nil {
-			report.Warnings = []string{}
+	// Root directories are updated first, since they register the directories that are updated next.
+	c.updateDirectories(ctx, c.directoriesToUpdate(true), options, result)
+	// Purge the directories unregistered by the root directories' updates or through the directory management API
+	if !options.dryRun {
+		c.purgeDirectories(ctx, result)
+	}
+	// Directories discovered through the updated directories are updated next, until no new directories are discovered.
+	// The maximum discovery depth limits the number of rounds.
+	for {
+		directories := slices.DeleteFunc(c.directoriesToUpdate(false), func(directory administrationDirectory) bool {
+			_, updated := result[makeDirectoryKey(directory.fhirBaseURL, directory.authoritativeUra)]
+			return updated
+		})
+		if len(directories) == 0 {
+			break
 		}
-		if report.Errors == nil {
-			report.Errors = []string{}
+		c.updateDirectories(ctx, directories, options, result)
+	}
+	if !options.dryRun {
+		c.consolidateLinkedOrganizations(ctx)
+	}
+	return result, nil
+}
+
+// directoriesToUpdate returns a snapshot of the registered administration directories that are (discover=true) or aren't root directories.
+func (c *Component) directoriesToUpdate(discover bool) []administrationDirectory {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	var result []administrationDirectory
+	for _, directory := range c.administrationDirectories {
+		if directory.discover == discover {
+			result = append(result, directory)
 		}
+	}
+	return result
+}
+
+// updateDirectories updates from the given administration directories in parallel (limited by the configured concurrency),
+// and adds their reports to the given UpdateReport. It returns when all directories have been updated.
+// Every directory gets its own timeout, so a hanging directory doesn't delay the others.
+func (c *Component) updateDirectories(ctx context.Context, directories []administrationDirectory, options updateOptions, result UpdateReport) {
+	semaphore := make(chan struct{}, max(c.config.Concurrency, 1))
+	resultMux := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, adminDirectory := range directories {
 		directoryKey := makeDirectoryKey(adminDirectory.fhirBaseURL, adminDirectory.authoritativeUra)
-		result[directoryKey] = report
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			resultMux.Lock()
+			report := DirectoryUpdateReport{}
+			report.fail(libfhir.ReportCodeUpdateFailed, ctx.Err())
+			result[directoryKey] = report.finalized()
+			resultMux.Unlock()
+			continue
+		}
+		wg.Go(func() {
+			defer func() { <-semaphore }()
+			report := c.updateFromAdministrationDirectory(ctx, adminDirectory, options)
+			resultMux.Lock()
+			defer resultMux.Unlock()
+			result[directoryKey] = report
+		})
 	}
-	return result, nil
+	wg.Wait()
+}
+
+// updateFromAdministrationDirectory updates from a single administration directory, applying the configured timeout.
+// Errors are recorded in the returned report.
+func (c *Component) updateFromAdministrationDirectory(ctx context.Context, adminDirectory administrationDirectory, options updateOptions) DirectoryUpdateReport {
+	if c.config.DirectoryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.DirectoryTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	report, err := c.updateFromDirectory(ctx, adminDirectory.fhirBaseURL, adminDirectory.resourceTypes, adminDirectory.discover, adminDirectory.authoritativeUra, options)
+	if err != nil {
+		slog.ErrorContext(ctx, "mCSD Directory update failed", logging.FHIRServer(adminDirectory.fhirBaseURL), logging.Error(err))
+		report.fail(libfhir.ReportCodeUpdateFailed, err)
+	}
+	report.DurationMs = time.Since(start).Milliseconds()
+	if !options.dryRun {
+		c.recordSyncStatus(makeDirectoryKey(adminDirectory.fhirBaseURL, adminDirectory.authoritativeUra), report)
+		if len(report.Errors) == 0 && c.config.Subscriptions.Enabled() {
+			if fhirBaseURL, err := url.Parse(adminDirectory.fhirBaseURL); err == nil {
+				c.ensureSubscription(ctx, adminDirectory, c.fhirAdminClientFn(fhirBaseURL))
+			}
+		}
+	}
+	return report.finalized()
 }
 
 // discoverAndRegisterEndpoints processes endpoint discovery and registration for the given parent organizations.
 // It finds endpoints from the entries that match parent organization endpoint references and registers them.
-func (c *Component) discoverAndRegisterEndpoints(ctx context.Context, entries []fhir.BundleEntry, parentOrganizationsMap parentOrganizationMap, report DirectoryUpdateReport) DirectoryUpdateReport {
+// The discovery chain holds the FHIR base URLs of the discovering directory and the directories it was discovered through (root first):
+// Endpoints referring to one of them, or to our own query directory, aren't registered to prevent discovery loops: they're returned as skipped.
+func (c *Component) discoverAndRegisterEndpoints(ctx context.Context, entries []fhir.BundleEntry, parentOrganizationsMap parentOrganizationMap, discoveryChain []string, report DirectoryUpdateReport) (DirectoryUpdateReport, []SkippedDiscovery) {
 	if parentOrganizationsMap == nil {
-		return report
+		return report, nil
 	}
+	discoveredBy := discoveryChain[len(discoveryChain)-1]
+	var skipped []SkippedDiscovery
 
 	for parentOrg := range parentOrganizationsMap {
 		uraIdentifiers := libfhir.FilterIdentifiersBySystem(parentOrg.Identifier, coding.URANamingSystem)
@@ -321,88 +763,63 @@ func (c *Component) discoverAndRegisterEndpoints(ctx context.Context, entries []
 		for fullUrl, endpoint := range endpoints {
 			if coding.CodablesIncludesCode(endpoint.PayloadType, payloadCoding) {
 				slog.DebugContext(ctx, "Discovered mCSD Directory", slog.String("address", endpoint.Address))
+				if reason := c.detectDiscoveryLoop(endpoint.Address, discoveryChain); reason != "" {
+					slog.InfoContext(ctx, "Skipping discovered mCSD Directory to prevent a discovery loop", logging.FHIRServer(endpoint.Address), slog.String("discoveredBy", discoveredBy), slog.String("reason", reason))
+					skipped = append(skipped, SkippedDiscovery{
+						FHIRBaseURL:  endpoint.Address,
+						DiscoveredBy: discoveredBy,
+						SourceURL:    fullUrl,
+						Reason:       reason,
+					})
+					continue
+				}
 
-				err := c.registerAdministrationDirectory(ctx, endpoint.Address, c.directoryResourceTypes, false, fullUrl, authoritativeUra)
-				if err != nil {
-					report.Warnings = append(report.Warnings, fmt.Sprintf("failed to register discovered mCSD Directory at %s: %s", endpoint.Address, err.Error()))
+				err := c.registerDirectory(ctx, administrationDirectory{
+					fhirBaseURL:         endpoint.Address,
+					resourceTypes:       c.directoryResourceTypes,
+					sourceURL:           fullUrl,
+					authoritativeUra:    authoritativeUra,
+					authorizationServer: endpointAuthorizationServer(*endpoint),
+					discoveredThrough:   discoveryChain,
+				})
+				if err != nil && !errors.Is(err, errDirectoryExcluded) && !errors.Is(err, errDirectoryExists) {
+					report.warn(libfhir.ReportItem{
+						Code:         libfhir.ReportCodeDiscoveryFailed,
+						ResourceType: "Endpoint",
+						ResourceID:   to.Value(endpoint.Id),
+						FullURL:      fullUrl,
+						Message:      fmt.Sprintf("failed to register discovered mCSD Directory at %s: %s", endpoint.Address, err.Error()),
+					})
 				}
 			}
 		}
 	}
 
-	return report
+	return report, skipped
 }
 
-func (c *Component) updateFromDirectory(ctx context.Context, fhirBaseURLRaw string, allowedResourceTypes []string, allowDiscovery bool, authoritativeUra string) (DirectoryUpdateReport, error) {
-	slog.InfoContext(ctx, "Updating from mCSD Directory", logging.FHIRServer(fhirBaseURLRaw), slog.Bool("discover", allowDiscovery), slog.Any("resourceTypes", allowedResourceTypes))
+func (c *Component) updateFromDirectory(ctx context.Context, fhirBaseURLRaw string, allowedResourceTypes []string, allowDiscovery bool, authoritativeUra string, options updateOptions) (DirectoryUpdateReport, error) {
+	slog.InfoContext(ctx, "Updating from mCSD Directory", logging.FHIRServer(fhirBaseURLRaw), slog.Bool("discover", allowDiscovery), slog.Any("resourceTypes", allowedResourceTypes), slog.Bool("dryRun", options.dryRun), slog.Bool("reconcile", options.reconcile))
 	remoteAdminDirectoryFHIRBaseURL, err := url.Parse(fhirBaseURLRaw)
 	if err != nil {
 		return DirectoryUpdateReport{}, err
 	}
 	remoteAdminDirectoryFHIRClient := c.fhirAdminClientFn(remoteAdminDirectoryFHIRBaseURL)
 
-	queryDirectoryFHIRClient := c.fhirQueryClient
-
-	// Get last update time for incremental sync
-	directoryKey := makeDirectoryKey(fhirBaseURLRaw, authoritativeUra)
-	lastUpdate, hasLastUpdate := c.lastUpdateTimes[directoryKey]
-
-	// Capture query start time as fallback for servers that don't provide Bundle meta.lastUpdated.
-	queryStartTime := time.Now()
-
-	searchParams := url.Values{
-		"_count": []string{strconv.Itoa(searchPageSize)},
-	}
-	if hasLastUpdate {
-		searchParams.Set("_since", lastUpdate)
-		slog.DebugContext(ctx, "Using _since parameter for incremental sync from FHIR server", logging.FHIRServer(fhirBaseURLRaw), slog.String("_since", lastUpdate))
-	} else {
-		slog.InfoContext(ctx, "No last update time, doing full sync from FHIR server", logging.FHIRServer(fhirBaseURLRaw))
-	}
-
-	// Initial query
-	entries, firstSearchSet, err := c.queryAllResourceTypes(ctx, remoteAdminDirectoryFHIRClient, allowedResourceTypes, searchParams)
-	if err != nil {
+	run := c.newSyncRun(ctx, fhirBaseURLRaw, remoteAdminDirectoryFHIRClient, allowedResourceTypes, allowDiscovery, authoritativeUra, options)
+	if err := c.fetchHistory(ctx, run); err != nil {
 		return DirectoryUpdateReport{}, err
 	}
-
-	// Check if any Organization's URA identifier has changed between history versions
-	uraIdentifierChanged := checkForURAIdentifierChanges(entries)
-	if uraIdentifierChanged {
-		slog.WarnContext(ctx, "Detected URA identifier change in organization history. Rerunning history query without _since parameter.", logging.FHIRServer(fhirBaseURLRaw))
-
-		// Remove _since parameter and rerun the query
-		searchParams.Del("_since")
-		entries, firstSearchSet, err = c.queryAllResourceTypes(ctx, remoteAdminDirectoryFHIRClient, allowedResourceTypes, searchParams)
-		if err != nil {
-			return DirectoryUpdateReport{}, err
-		}
+	if err := c.collectHistory(ctx, run); err != nil {
+		return DirectoryUpdateReport{}, err
 	}
 
-	// Deduplicate resources from _history query - keep only the most recent version
-	// _history can return multiple versions of the same resource, but transaction bundles must have unique resources
-	deduplicatedEntries := libfhir.DeduplicateHistoryEntries(entries)
-
-	// Filter to only include HealthcareService resources. Use deduplicated
-	// history so older versions don't linger in the slice used by downstream
-	// validation (see #409): without this an HS version that historically
-	// referenced an Endpoint but no longer does would still keep that
-	// Endpoint "referenced" during validation.
-	var allHealthcareServices []fhir.HealthcareService
-	for _, entry := range deduplicatedEntries {
-		if entry.Resource == nil {
-			continue
-		}
-		var healthcareService fhir.HealthcareService
-		if err := json.Unmarshal(entry.Resource, &healthcareService); err == nil {
-			// Successfully unmarshaled as HealthcareService
-			allHealthcareServices = append(allHealthcareServices, healthcareService)
-		}
-	}
+	// Root directories discover, and discovered directories up to the maximum discovery depth
+	discoveryChain, discovers := c.discoveryChain(fhirBaseURLRaw, authoritativeUra, allowDiscovery)
 
 	// Pre-process Endpoint DELETEs to unregister administration directories
-	if allowDiscovery {
-		c.processEndpointDeletes(ctx, deduplicatedEntries)
+	if discovers && !options.dryRun {
+		c.processEndpointDeletes(ctx, run.endpointEntries)
 	}
 
 	// Find parent organizations with URA identifier and all organizations linked to them
@@ -417,86 +834,39 @@ func (c *Component) updateFromDirectory(ctx context.Context, fhirBaseURLRaw stri
 	if err := ValidateParentOrganizations(parentOrganizationsMap); err != nil {
 		return DirectoryUpdateReport{}, fmt.Errorf("parent organization (one that supposedly has ura identifier - and only only) validation failed: %w", err)
 	}
-
-	// Build transaction with deterministic conditional references
-	tx := fhir.Bundle{
-		Type:  fhir.BundleTypeTransaction,
-		Entry: make([]fhir.BundleEntry, 0, len(deduplicatedEntries)),
-	}
-
-	var report DirectoryUpdateReport
-	for i, entry := range deduplicatedEntries {
-		if entry.Request == nil {
-			msg := fmt.Sprintf("Skipping entry with no request: #%d", i)
-			report.Warnings = append(report.Warnings, msg)
-			continue
-		}
-		slog.DebugContext(ctx, "Processing entry", logging.FHIRServer(fhirBaseURLRaw), slog.String("url", entry.Request.Url))
-		_, err := buildUpdateTransaction(ctx, &tx, entry, ValidationRules{AllowedResourceTypes: allowedResourceTypes}, parentOrganizationsMap, allHealthcareServices, allowDiscovery, fhirBaseURLRaw)
-		if err != nil {
-			report.Warnings = append(report.Warnings, fmt.Sprintf("entry #%d: %s", i, err.Error()))
-			continue
-		}
+	if parentOrganizationsMap, err = c.crossCheckParentOrganizations(ctx, fhirBaseURLRaw, parentOrganizationsMap, &run.report); err != nil {
+		return DirectoryUpdateReport{}, err
 	}
 
-	// Handle Endpoint discovery and registration. Use the deduplicated entries
+	// Handle Endpoint discovery and registration. The spooled entries are deduplicated,
 	// so only the current version of each Endpoint (by meta.lastUpdated) is
 	// considered; otherwise older history versions with stale addresses can
 	// overwrite the current one in the per-fullUrl map and get registered
 	// instead (#409).
-	if allowDiscovery {
-		report = c.discoverAndRegisterEndpoints(ctx, deduplicatedEntries, parentOrganizationsMap, report)
-	}
-
-	slog.DebugContext(ctx, "Got mCSD entries", logging.FHIRServer(fhirBaseURLRaw), slog.Int("count", len(tx.Entry)))
-	if len(tx.Entry) == 0 {
-		return report, nil
+	if discovers && !options.dryRun {
+		var skipped []SkippedDiscovery
+		run.report, skipped = c.discoverAndRegisterEndpoints(ctx, run.endpointEntries, parentOrganizationsMap, discoveryChain, run.report)
+		c.recordSkippedDiscoveries(run.directoryKey, skipped)
 	}
 
-	var txResult fhir.Bundle
-	if err := queryDirectoryFHIRClient.CreateWithContext(ctx, tx, &txResult, fhirclient.AtPath("/")); err != nil {
-		return DirectoryUpdateReport{}, fmt.Errorf("failed to apply mCSD update to query directory: %w", err)
+	if err := c.applyHistory(ctx, run, parentOrganizationsMap); err != nil {
+		// Return what was applied before the failure: the sync resumes from there next time
+		return run.report, err
 	}
-
-	// Process result
-	for i, entry := range txResult.Entry {
-		if entry.Response == nil {
-			msg := fmt.Sprintf("Skipping entry with no response: #%d", i)
-			report.Warnings = append(report.Warnings, msg)
-			continue
-		}
-		switch {
-		case strings.HasPrefix(entry.Response.Status, "201"):
-			report.CountCreated++
-		case strings.HasPrefix(entry.Response.Status, "200"):
-			report.CountUpdated++
-		case strings.HasPrefix(entry.Response.Status, "204"):
-			report.CountDeleted++
-		default:
-			msg := fmt.Sprintf("Unknown HTTP response status %v (url=%v)", entry.Response.Status, entry.FullUrl)
-			report.Warnings = append(report.Warnings, msg)
-		}
+	if err := c.removeStaleResources(ctx, run); err != nil {
+		return run.report, err
 	}
-
-	// Update last sync timestamp on successful completion.
-	// Use the search result Bundle's meta.lastUpdated if available, otherwise fall back to query start time.
-	// This uses the FHIR server's own timestamp string, eliminating clock skew issues.
-	var nextSyncTime string
-	if firstSearchSet.Meta != nil && firstSearchSet.Meta.LastUpdated != nil {
-		nextSyncTime = *firstSearchSet.Meta.LastUpdated
-	} else {
-		// Fallback to local time with buffer to account for potential clock skew
-		nextSyncTime = queryStartTime.Add(-clockSkewBuffer).Format(time.RFC3339Nano)
-		slog.WarnContext(ctx, "Bundle meta.lastUpdated not available, using local time with buffer - may cause clock skew issues", logging.FHIRServer(fhirBaseURLRaw))
+	if !options.dryRun {
+		c.finishSyncRun(ctx, run)
+		c.consolidateParentOrganizations(ctx, parentOrganizationsMap, &run.report)
 	}
-	c.lastUpdateTimes[directoryKey] = nextSyncTime
-
-	return report, nil
+	return run.report, nil
 }
 
-// queryFHIR performs a FHIR search query with pagination and returns all matching entries.
+// queryFHIR performs a FHIR search query and calls visit for every page of results, following pagination.
+// It returns the first page of results.
 // If includeHistory is true, it queries the _history endpoint to get resource versions.
-func (c *Component) queryFHIR(ctx context.Context, client fhirclient.Client, resourceType string, searchParams url.Values, includeHistory bool) ([]fhir.BundleEntry, fhir.Bundle, error) {
+func (c *Component) queryFHIR(ctx context.Context, client fhirclient.Client, resourceType string, searchParams url.Values, includeHistory bool, visit func(page *fhir.Bundle) error) (fhir.Bundle, error) {
 	var searchSet fhir.Bundle
 	var path string
 	var searchErrMsg string
@@ -514,119 +884,48 @@ func (c *Component) queryFHIR(ctx context.Context, client fhirclient.Client, res
 
 	err := client.SearchWithContext(ctx, "", searchParams, &searchSet, fhirclient.AtPath(path))
 	if err != nil {
-		return nil, fhir.Bundle{}, fmt.Errorf("%s: %w", searchErrMsg, err)
+		return fhir.Bundle{}, fmt.Errorf("%s: %w", searchErrMsg, err)
 	}
 
-	var entries []fhir.BundleEntry
 	err = fhirclient.Paginate(ctx, client, searchSet, func(searchSet *fhir.Bundle) (bool, error) {
-		entries = append(entries, searchSet.Entry...)
-		if len(entries) >= maxUpdateEntries {
-			return false, fmt.Errorf("too many entries (%d), aborting update to prevent excessive memory usage", len(entries))
+		if err := visit(searchSet); err != nil {
+			return false, err
 		}
 		return true, nil
 	})
 	if err != nil {
-		return nil, fhir.Bundle{}, fmt.Errorf("%s: %w", paginationErrMsg, err)
+		return fhir.Bundle{}, fmt.Errorf("%s: %w", paginationErrMsg, err)
 	}
 
-	return entries, searchSet, nil
+	return searchSet, nil
 }
 
-func (c *Component) queryHistory(ctx context.Context, remoteAdminDirectoryFHIRClient fhirclient.Client, resourceType string, searchParams url.Values) ([]fhir.BundleEntry, fhir.Bundle, error) {
-	return c.queryFHIR(ctx, remoteAdminDirectoryFHIRClient, resourceType, searchParams, true)
+func (c *Component) queryHistory(ctx context.Context, remoteAdminDirectoryFHIRClient fhirclient.Client, resourceType string, searchParams url.Values, visit func(page *fhir.Bundle) error) (fhir.Bundle, error) {
+	return c.queryFHIR(ctx, remoteAdminDirectoryFHIRClient, resourceType, searchParams, true, visit)
 }
 
-func (c *Component) query(ctx context.Context, remoteAdminDirectoryFHIRClient fhirclient.Client, resourceType string, searchParams url.Values) ([]fhir.BundleEntry, fhir.Bundle, error) {
-	return c.queryFHIR(ctx, remoteAdminDirectoryFHIRClient, resourceType, searchParams, false)
-}
-
-// queryAllResourceTypes queries all specified resource types from the FHIR server and returns combined entries.
-func (c *Component) queryAllResourceTypes(ctx context.Context, fhirClient fhirclient.Client, resourceTypes []string, searchParams url.Values) ([]fhir.BundleEntry, fhir.Bundle, error) {
+// query performs a FHIR search query and returns all matching entries.
+func (c *Component) query(ctx context.Context, remoteAdminDirectoryFHIRClient fhirclient.Client, resourceType string, searchParams url.Values) ([]fhir.BundleEntry, error) {
 	var entries []fhir.BundleEntry
-	var firstSearchSet fhir.Bundle
-
-	for i, resourceType := range resourceTypes {
-		// Create a copy of searchParams for this resource type
-		params := make(url.Values)
-		for k, v := range searchParams {
-			params[k] = v
-		}
-
-		// Remove _single parameter for Organization resource type
-		if resourceType == "Organization" {
-			params.Del("_since")
-		}
-
-		currEntries, currSearchSet, err := c.queryHistory(ctx, fhirClient, resourceType, params)
-		if err != nil {
-			return nil, fhir.Bundle{}, fmt.Errorf("failed to query %s history: %w", resourceType, err)
-		}
-		entries = append(entries, currEntries...)
-		if i == 0 {
-			firstSearchSet = currSearchSet
-		}
-	}
-
-	return entries, firstSearchSet, nil
+	_, err := c.queryFHIR(ctx, remoteAdminDirectoryFHIRClient, resourceType, searchParams, false, func(page *fhir.Bundle) error {
+		entries = append(entries, page.Entry...)
+		return nil
+	})
+	return entries, err
 }
 
 // checkForURAIdentifierChanges detects if any Organization's URA identifier has changed between history versions
 func checkForURAIdentifierChanges(entries []fhir.BundleEntry) bool {
-	// Map to track URA identifiers per Organization ID
-	// We use empty string "" as a marker for "no URA identifier present"
-	orgURAMap := make(map[string]map[string]bool) // orgID -> set of URA values (or "" for no URA)
-
+	detector := newURAChangeDetector()
 	for _, entry := range entries {
-		if entry.Resource == nil {
-			continue
-		}
-
-		// Try to unmarshal as Organization
-		var org fhir.Organization
-		if err := json.Unmarshal(entry.Resource, &org); err != nil {
-			continue // Not an Organization, skip
-		}
-
-		if org.Id == nil {
-			continue
-		}
-
-		orgID := *org.Id
-
-		// Extract URA identifiers
-		uraIdentifiers := libfhir.FilterIdentifiersBySystem(org.Identifier, coding.URANamingSystem)
-
-		// Initialize map for this org if needed
-		if orgURAMap[orgID] == nil {
-			orgURAMap[orgID] = make(map[string]bool)
-		}
-
-		// Track all URA values seen for this organization
-		if len(uraIdentifiers) == 0 {
-			// No URA identifier - mark with empty string
-			orgURAMap[orgID][""] = true
-		} else {
-			for _, ura := range uraIdentifiers {
-				if ura.Value != nil {
-					orgURAMap[orgID][*ura.Value] = true
-				}
-			}
-		}
-	}
-
-	// Check if any organization has multiple different URA values (including presence/absence changes)
-	for _, uraSet := range orgURAMap {
-		if len(uraSet) > 1 {
-			return true // Found an organization with changed URA identifier
-		}
+		detector.add(entry)
 	}
-
-	return false
+	return detector.changed()
 }
 
 func (c *Component) ensureParentOrganizationsMap(ctx context.Context, fhirBaseURLRaw string, remoteAdminDirectoryFHIRClient fhirclient.Client, authoritativeUra string) (parentOrganizationMap, error) {
 	slog.DebugContext(ctx, "Querying organizations for authoritative check (parent organization map build)", logging.FHIRServer(fhirBaseURLRaw))
-	orgEntries, _, err := c.query(ctx, remoteAdminDirectoryFHIRClient, "Organization", url.Values{
+	orgEntries, err := c.query(ctx, remoteAdminDirectoryFHIRClient, "Organization", url.Values{
 		"_count": []string{strconv.Itoa(searchPageSize)},
 	})
 	if err != nil {
@@ -9,12 +9,15 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	fhirclient "github.com/SanteonNL/go-fhir-client"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/fanout"
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/httpauth"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/test"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/to"
@@ -584,7 +587,7 @@ func TestComponent_updateFromDirectory(t *testing.T) {
 		})
 		component, err := New(DefaultConfig())
 		require.NoError(t, err)
-		report, err := component.updateFromDirectory(ctx, server.URL+"/fhir", []string{"Organization"}, false, "")
+		report, err := component.updateFromDirectory(ctx, server.URL+"/fhir", []string{"Organization"}, false, "", updateOptions{})
 		require.NoError(t, err)
 		require.NotNil(t, report)
 		require.Len(t, report.Warnings, 1)
@@ -623,7 +626,7 @@ func TestComponent_updateFromDirectory(t *testing.T) {
 			return &test.StubFHIRClient{Error: errors.New("unknown URL")}
 		}
 
-		report, err := component.updateFromDirectory(ctx, server.URL+"/fhir", []string{"Organization", "Endpoint"}, false, "")
+		report, err := component.updateFromDirectory(ctx, server.URL+"/fhir", []string{"Organization", "Endpoint"}, false, "", updateOptions{})
 
 		require.NoError(t, err)
 		require.Empty(t, report.Errors, "Should not have errors after deduplication")
@@ -782,7 +785,7 @@ func TestComponent_updateFromDirectory(t *testing.T) {
 		}
 
 		// First update - should discover and register the Endpoint
-		report1, err := component.updateFromDirectory(ctx, server.URL+"/fhir", []string{"Endpoint", "Organization"}, true, "")
+		report1, err := component.updateFromDirectory(ctx, server.URL+"/fhir", []string{"Endpoint", "Organization"}, true, "", updateOptions{})
 		require.NoError(t, err)
 		require.Empty(t, report1.Errors)
 		require.Equal(t, 1, report1.CountCreated, "Should have created 1 Endpoint")
@@ -806,7 +809,7 @@ func TestComponent_updateFromDirectory(t *testing.T) {
 		assert.Equal(t, "http://test.example.org/fhir/Endpoint/test-endpoint", registeredFullUrl, "Registered Endpoint should have fullUrl from Bundle entry")
 
 		// Second update - should process DELETE and unregister the Endpoint
-		report2, err := component.updateFromDirectory(ctx, server.URL+"/fhir", []string{"Endpoint", "Organization"}, true, "")
+		report2, err := component.updateFromDirectory(ctx, server.URL+"/fhir", []string{"Endpoint", "Organization"}, true, "", updateOptions{})
 		require.NoError(t, err)
 		require.Empty(t, report2.Errors)
 
@@ -1009,7 +1012,7 @@ func TestComponent_updateFromDirectory(t *testing.T) {
 			return &test.StubFHIRClient{Error: errors.New("unknown URL")}
 		}
 
-		report, err := component.updateFromDirectory(ctx, server.URL+"/fhir", []string{"Endpoint", "Organization", "HealthcareService"}, true, "00005098")
+		report, err := component.updateFromDirectory(ctx, server.URL+"/fhir", []string{"Endpoint", "Organization", "HealthcareService"}, true, "00005098", updateOptions{})
 		require.NoError(t, err)
 
 		var currentRegistered, staleRegistered bool
@@ -1112,7 +1115,7 @@ func TestComponent_updateFromDirectory(t *testing.T) {
 
 		// Call updateFromDirectory with only Organization and Endpoint
 		allowedTypes := []string{"Organization", "Endpoint"}
-		report, err := component.updateFromDirectory(ctx, server.URL+"/fhir", allowedTypes, false, "")
+		report, err := component.updateFromDirectory(ctx, server.URL+"/fhir", allowedTypes, false, "", updateOptions{})
 
 		require.NoError(t, err)
 		require.Empty(t, report.Errors)
@@ -2480,3 +2483,537 @@ func TestComponent_authFlow(t *testing.T) {
 		require.Equal(t, 1, adminReport.CountCreated, "one organization should be created")
 	})
 }
+
+func TestComponent_scheduledUpdate(t *testing.T) {
+	newComponent := func(t *testing.T, adminClient fhirclient.Client) *Component {
+		config := DefaultConfig()
+		config.AdministrationDirectories = map[string]DirectoryConfig{
+			"rootDir": {FHIRBaseURL: "http://example.com/root/fhir"},
+		}
+		config.Sync.Interval = time.Millisecond
+		config.Sync.InitialDelay = 0
+		config.Sync.Jitter = 0
+		component, err := New(config)
+		require.NoError(t, err)
+		component.fhirQueryClient = &test.StubFHIRClient{}
+		component.fhirAdminClientFn = func(baseURL *url.URL) fhirclient.Client {
+			return adminClient
+		}
+		return component
+	}
+
+	t.Run("fails when all directories failed", func(t *testing.T) {
+		component := newComponent(t, &test.StubFHIRClient{Error: errors.New("connection refused")})
+
+		err := component.scheduledUpdate(context.Background(), updateOptions{})
+
+		require.EqualError(t, err, "all 1 mCSD Directories failed to update")
+	})
+	t.Run("succeeds when directories were updated", func(t *testing.T) {
+		component := newComponent(t, &test.StubFHIRClient{})
+
+		err := component.scheduledUpdate(context.Background(), updateOptions{})
+
+		require.NoError(t, err)
+	})
+	t.Run("Start() runs updates in the background until Stop()", func(t *testing.T) {
+		adminClient := &test.StubFHIRClient{}
+		component := newComponent(t, adminClient)
+
+		require.NoError(t, component.Start())
+		require.Eventually(t, func() bool {
+			component.updateMux.RLock()
+			defer component.updateMux.RUnlock()
+			return len(adminClient.Searches) > 0
+		}, time.Second, time.Millisecond)
+		require.NoError(t, component.Stop(context.Background()))
+	})
+}
+
+func TestComponent_state(t *testing.T) {
+	ctx := context.Background()
+	config := DefaultConfig()
+	config.StateFile = t.TempDir() + "/mcsd.db"
+	config.AdministrationDirectories = map[string]DirectoryConfig{
+		"rootDir": {FHIRBaseURL: "http://example.com/root/fhir"},
+	}
+
+	component, err := New(config)
+	require.NoError(t, err)
+	require.NoError(t, component.registerAdministrationDirectory(ctx, "http://example.com/org1/fhir", defaultDirectoryResourceTypes, false, "http://example.com/root/fhir/Endpoint/1", "111"))
+	require.NoError(t, component.registerAdministrationDirectory(ctx, "http://example.com/org2/fhir", defaultDirectoryResourceTypes, false, "http://example.com/root/fhir/Endpoint/2", "222"))
+	component.setLastUpdateTime(ctx, makeDirectoryKey("http://example.com/org1/fhir", "111"), "2026-01-01T00:00:00Z")
+	component.setLastUpdateTime(ctx, "http://example.com/root/fhir", "2026-01-02T00:00:00Z")
+	component.unregisterAdministrationDirectory(ctx, "http://example.com/root/fhir/Endpoint/2")
+	require.NoError(t, component.Stop(ctx))
+
+	t.Run("restores discovered directories and timestamps after restart", func(t *testing.T) {
+		component, err := New(config)
+		require.NoError(t, err)
+		defer component.Stop(ctx)
+
+		require.Len(t, component.administrationDirectories, 2)
+		assert.Equal(t, administrationDirectory{
+			fhirBaseURL:      "http://example.com/org1/fhir",
+			resourceTypes:    defaultDirectoryResourceTypes,
+			discover:         false,
+			sourceURL:        "http://example.com/root/fhir/Endpoint/1",
+			authoritativeUra: "111",
+		}, component.administrationDirectories[1])
+		assert.Equal(t, map[string]string{
+			makeDirectoryKey("http://example.com/org1/fhir", "111"): "2026-01-01T00:00:00Z",
+			"http://example.com/root/fhir":                          "2026-01-02T00:00:00Z",
+		}, component.lastUpdateTimes)
+	})
+	t.Run("restored directories are subject to the exclusion list", func(t *testing.T) {
+		config := config
+		config.ExcludeAdminDirectories = []string{"http://example.com/org1/fhir"}
+		component, err := New(config)
+		require.NoError(t, err)
+		defer component.Stop(ctx)
+
+		require.Len(t, component.administrationDirectories, 1)
+	})
+}
+
+func TestComponent_updateConcurrency(t *testing.T) {
+	emptyResponse, err := os.ReadFile("test/empty_bundle_response.json")
+	require.NoError(t, err)
+
+	// A directory that doesn't respond within the directory timeout
+	hangingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer hangingServer.Close()
+	// A directory that responds with empty results, recording the number of concurrent requests
+	var inFlight, maxInFlight int
+	inFlightMux := &sync.Mutex{}
+	healthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlightMux.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		inFlightMux.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		inFlightMux.Lock()
+		inFlight--
+		inFlightMux.Unlock()
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_, _ = w.Write(emptyResponse)
+	}))
+	defer healthyServer.Close()
+
+	newComponent := func(t *testing.T, concurrency int) *Component {
+		config := DefaultConfig()
+		config.Concurrency = concurrency
+		config.DirectoryTimeout = 200 * time.Millisecond
+		component, err := New(config)
+		require.NoError(t, err)
+		component.fhirQueryClient = &test.StubFHIRClient{}
+		component.fhirAdminClientFn = func(baseURL *url.URL) fhirclient.Client {
+			return fhirclient.New(baseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		}
+		return component
+	}
+	ctx := context.Background()
+
+	t.Run("hanging directory doesn't block other directories", func(t *testing.T) {
+		component := newComponent(t, 4)
+		require.NoError(t, component.registerAdministrationDirectory(ctx, hangingServer.URL, defaultDirectoryResourceTypes, false, "hanging", "1"))
+		require.NoError(t, component.registerAdministrationDirectory(ctx, healthyServer.URL, defaultDirectoryResourceTypes, false, "healthy", "2"))
+
+		report, err := component.update(ctx)
+
+		require.NoError(t, err)
+		require.Len(t, report, 2)
+		assert.Empty(t, report[makeDirectoryKey(healthyServer.URL, "2")].Errors)
+		hangingReport := report[makeDirectoryKey(hangingServer.URL, "1")]
+		require.Len(t, hangingReport.Errors, 1)
+		assert.Contains(t, hangingReport.Errors[0], "context deadline exceeded")
+	})
+	t.Run("number of parallel directory updates is limited", func(t *testing.T) {
+		inFlightMux.Lock()
+		maxInFlight = 0
+		inFlightMux.Unlock()
+		component := newComponent(t, 2)
+		for i := 0; i < 6; i++ {
+			require.NoError(t, component.registerAdministrationDirectory(ctx, healthyServer.URL, defaultDirectoryResourceTypes, false, strconv.Itoa(i), strconv.Itoa(i)))
+		}
+
+		report, err := component.update(ctx)
+
+		require.NoError(t, err)
+		require.Len(t, report, 6)
+		for _, directoryReport := range report {
+			assert.Empty(t, directoryReport.Errors)
+		}
+		inFlightMux.Lock()
+		defer inFlightMux.Unlock()
+		assert.Equal(t, 2, maxInFlight)
+	})
+	t.Run("cancelled update reports remaining directories as failed", func(t *testing.T) {
+		component := newComponent(t, 1)
+		require.NoError(t, component.registerAdministrationDirectory(ctx, healthyServer.URL, defaultDirectoryResourceTypes, false, "healthy", "2"))
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		report, err := component.update(cancelledCtx)
+
+		require.NoError(t, err)
+		assert.NotEmpty(t, report[makeDirectoryKey(healthyServer.URL, "2")].Errors)
+	})
+}
+
+// transactionRecordingClient is a StubFHIRClient that records the transactions applied to it.
+// The transaction with number failAt (1-based) fails, once.
+type transactionRecordingClient struct {
+	*test.StubFHIRClient
+	transactions []fhir.Bundle
+	failAt       int
+}
+
+func (c *transactionRecordingClient) CreateWithContext(ctx context.Context, resource any, result any, opts ...fhirclient.Option) error {
+	if tx, ok := resource.(fhir.Bundle); ok && tx.Type == fhir.BundleTypeTransaction {
+		if len(c.transactions)+1 == c.failAt {
+			c.failAt = 0
+			return errors.New("query directory unavailable")
+		}
+		c.transactions = append(c.transactions, tx)
+	}
+	return c.StubFHIRClient.CreateWithContext(ctx, resource, result, opts...)
+}
+
+func TestComponent_chunkedSync(t *testing.T) {
+	ctx := context.Background()
+	const childCount = 25
+
+	// Serve a parent organization with URA identifier and its child organizations, over 2 pages of history
+	var historyRequests int
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	baseURL := server.URL + "/fhir"
+	var entries []map[string]any
+	entries = append(entries, map[string]any{
+		"fullUrl": baseURL + "/Organization/parent",
+		"resource": map[string]any{
+			"resourceType": "Organization",
+			"id":           "parent",
+			"identifier":   []any{map[string]any{"system": "http://fhir.nl/fhir/NamingSystem/ura", "value": "1234"}},
+			"name":         "Parent",
+		},
+		"request": map[string]any{"method": "PUT", "url": "Organization/parent"},
+	})
+	for i := 0; i < childCount; i++ {
+		id := "child-" + strconv.Itoa(i)
+		entries = append(entries, map[string]any{
+			"fullUrl": baseURL + "/Organization/" + id,
+			"resource": map[string]any{
+				"resourceType": "Organization",
+				"id":           id,
+				"name":         "Child " + strconv.Itoa(i),
+				"partOf":       map[string]any{"reference": "Organization/parent"},
+			},
+			"request": map[string]any{"method": "PUT", "url": "Organization/" + id},
+		})
+	}
+	writeBundle := func(w http.ResponseWriter, bundleType string, entries []map[string]any, next string) {
+		bundle := map[string]any{"resourceType": "Bundle", "type": bundleType, "entry": entries}
+		if next != "" {
+			bundle["link"] = []any{map[string]any{"relation": "next", "url": next}}
+		}
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_ = json.NewEncoder(w).Encode(bundle)
+	}
+	mux.HandleFunc("/fhir/Organization/_history", func(w http.ResponseWriter, r *http.Request) {
+		historyRequests++
+		if r.URL.Query().Get("page") == "2" {
+			writeBundle(w, "history", entries[len(entries)/2:], "")
+			return
+		}
+		writeBundle(w, "history", entries[:len(entries)/2], baseURL+"/Organization/_history?page=2")
+	})
+	mux.HandleFunc("/fhir/Organization", func(w http.ResponseWriter, r *http.Request) {
+		writeBundle(w, "searchset", entries, "")
+	})
+
+	newComponent := func(t *testing.T, queryClient fhirclient.Client) *Component {
+		config := DefaultConfig()
+		config.QueryDirectory = DirectoryConfig{FHIRBaseURL: "http://example.com/local/fhir"}
+		config.TransactionSize = 10
+		component, err := New(config)
+		require.NoError(t, err)
+		component.fhirQueryClient = queryClient
+		component.fhirAdminClientFn = func(baseURL *url.URL) fhirclient.Client {
+			return fhirclient.New(baseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		}
+		return component
+	}
+
+	t.Run("history is applied in chunks of limited size", func(t *testing.T) {
+		historyRequests = 0
+		queryClient := &transactionRecordingClient{StubFHIRClient: &test.StubFHIRClient{}}
+		component := newComponent(t, queryClient)
+
+		report, err := component.updateFromDirectory(ctx, baseURL, []string{"Organization"}, false, "", updateOptions{})
+
+		require.NoError(t, err)
+		assert.Empty(t, report.Warnings)
+		assert.Equal(t, childCount+1, report.CountCreated)
+		assert.Equal(t, 2, historyRequests)
+		require.Len(t, queryClient.transactions, 3)
+		for _, tx := range queryClient.transactions {
+			assert.LessOrEqual(t, len(tx.Entry), 10)
+		}
+		// The parent organization is referenced by all others, so it must be created first
+		assert.Contains(t, queryClient.transactions[0].Entry[0].Request.Url, url.QueryEscape(baseURL+"/Organization/parent"))
+		_, hasLastUpdate := component.getLastUpdateTime(baseURL)
+		assert.True(t, hasLastUpdate)
+		_, hasCheckpoint := component.loadCheckpoint(ctx, baseURL)
+		assert.False(t, hasCheckpoint)
+	})
+	t.Run("interrupted sync resumes from its checkpoint", func(t *testing.T) {
+		historyRequests = 0
+		queryClient := &transactionRecordingClient{StubFHIRClient: &test.StubFHIRClient{}, failAt: 2}
+		component := newComponent(t, queryClient)
+
+		report, err := component.updateFromDirectory(ctx, baseURL, []string{"Organization"}, false, "", updateOptions{})
+
+		require.ErrorContains(t, err, "chunk 2 of 3")
+		assert.Equal(t, 10, report.CountCreated)
+		checkpoint, hasCheckpoint := component.loadCheckpoint(ctx, baseURL)
+		require.True(t, hasCheckpoint)
+		assert.Equal(t, 1, checkpoint.AppliedChunks)
+		assert.Equal(t, []string{"Organization"}, checkpoint.FetchedTypes)
+		_, hasLastUpdate := component.getLastUpdateTime(baseURL)
+		assert.False(t, hasLastUpdate)
+
+		report, err = component.updateFromDirectory(ctx, baseURL, []string{"Organization"}, false, "", updateOptions{})
+
+		require.NoError(t, err)
+		assert.Equal(t, childCount+1-10, report.CountCreated)
+		assert.Equal(t, 2, historyRequests, "history should not be fetched again")
+		assert.Len(t, queryClient.transactions, 3)
+		assert.Len(t, queryClient.CreatedResources["Organization"], childCount+1)
+		_, hasLastUpdate = component.getLastUpdateTime(baseURL)
+		assert.True(t, hasLastUpdate)
+		_, hasCheckpoint = component.loadCheckpoint(ctx, baseURL)
+		assert.False(t, hasCheckpoint)
+	})
+}
+
+func TestComponent_dryRun(t *testing.T) {
+	orgHistory := `{"resourceType":"Bundle","type":"history","entry":[
+		{"fullUrl":"http://example.org/fhir/Organization/parent","request":{"method":"PUT","url":"Organization/parent"},
+		 "resource":{"resourceType":"Organization","id":"parent","name":"Parent","identifier":[{"system":"http://fhir.nl/fhir/NamingSystem/ura","value":"1234"}]}},
+		{"fullUrl":"http://example.org/fhir/Organization/child","request":{"method":"PUT","url":"Organization/child"},
+		 "resource":{"resourceType":"Organization","id":"child","name":"Child","partOf":{"reference":"Organization/parent"}}},
+		{"fullUrl":"http://example.org/fhir/Organization/invalid","request":{"method":"PUT","url":"Organization/invalid"},
+		 "resource":{"resourceType":"Organization","id":"invalid","name":"Invalid"}}
+	]}`
+	mux := http.NewServeMux()
+	mockEndpoints(mux, map[string]*string{
+		"/fhir/Organization/_history": &orgHistory,
+		"/fhir/Organization":          &orgHistory,
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	baseURL := server.URL + "/fhir"
+
+	config := DefaultConfig()
+	config.QueryDirectory = DirectoryConfig{FHIRBaseURL: "http://example.com/local/fhir"}
+	config.AdministrationDirectories = map[string]DirectoryConfig{"root": {FHIRBaseURL: baseURL}}
+	config.DirectoryResourceTypes = []string{"Organization"}
+	component, err := New(config)
+	require.NoError(t, err)
+	// Make it a regular (non-discoverable) directory, of which the resources are synced
+	component.administrationDirectories[0].discover = false
+	component.administrationDirectories[0].resourceTypes = []string{"Organization"}
+	queryClient := &transactionRecordingClient{StubFHIRClient: &test.StubFHIRClient{
+		Resources: []any{
+			fhir.Organization{Id: to.Ptr("existing"), Meta: &fhir.Meta{Source: to.Ptr(baseURL + "/Organization/parent")}},
+		},
+	}}
+	component.fhirQueryClient = queryClient
+	component.fhirAdminClientFn = func(baseURL *url.URL) fhirclient.Client {
+		return fhirclient.New(baseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+	}
+	internalMux := http.NewServeMux()
+	component.RegisterHttpHandlers(http.NewServeMux(), internalMux)
+
+	t.Run("reports the planned changes without applying them", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		internalMux.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/mcsd/update?dryRun=true", nil))
+
+		require.Equal(t, http.StatusOK, response.Code)
+		var report UpdateReport
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &report))
+		directoryReport := report[baseURL]
+		assert.Equal(t, 1, directoryReport.CountCreated)
+		assert.Equal(t, 1, directoryReport.CountUpdated)
+		require.Len(t, directoryReport.Warnings, 1)
+		assert.Contains(t, directoryReport.Warnings[0], "entry #2")
+		require.Len(t, directoryReport.Changes, 2)
+		assert.Equal(t, "update", directoryReport.Changes[0].Action)
+		assert.Equal(t, baseURL+"/Organization/parent", directoryReport.Changes[0].Source)
+		assert.Equal(t, "create", directoryReport.Changes[1].Action)
+		assert.Equal(t, "Organization", directoryReport.Changes[1].ResourceType)
+		assert.NotEmpty(t, directoryReport.Changes[1].Resource)
+		// Nothing changed
+		assert.Empty(t, queryClient.transactions)
+		_, hasLastUpdate := component.getLastUpdateTime(baseURL)
+		assert.False(t, hasLastUpdate)
+		_, hasCheckpoint := component.loadCheckpoint(context.Background(), baseURL)
+		assert.False(t, hasCheckpoint)
+	})
+	t.Run("regular update doesn't report changes", func(t *testing.T) {
+		report, err := component.update(context.Background())
+
+		require.NoError(t, err)
+		assert.Nil(t, report[baseURL].Changes)
+		assert.Len(t, queryClient.transactions, 1)
+	})
+	t.Run("invalid dryRun parameter", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		internalMux.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/mcsd/update?dryRun=maybe", nil))
+
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+	})
+}
+
+func TestComponent_profileValidation(t *testing.T) {
+	// The child organization passes the built-in rules, but doesn't conform to the nl-gf-organization profile: it has no name
+	history := `{"resourceType":"Bundle","type":"history","entry":[
+		{"fullUrl":"http://example.org/fhir/Organization/parent","request":{"method":"PUT","url":"Organization/parent"},
+		 "resource":{"resourceType":"Organization","id":"parent","name":"Parent","identifier":[{"system":"http://fhir.nl/fhir/NamingSystem/ura","value":"1234"}]}},
+		{"fullUrl":"http://example.org/fhir/Organization/child","request":{"method":"PUT","url":"Organization/child"},
+		 "resource":{"resourceType":"Organization","id":"child","partOf":{"reference":"Organization/parent"}}}
+	]}`
+	mux := http.NewServeMux()
+	mockEndpoints(mux, map[string]*string{
+		"/fhir/Organization/_history": &history,
+		"/fhir/Organization":          &history,
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	baseURL := server.URL + "/fhir"
+
+	update := func(t *testing.T, mode string) (DirectoryUpdateReport, *transactionRecordingClient) {
+		config := DefaultConfig()
+		config.QueryDirectory = DirectoryConfig{FHIRBaseURL: "http://example.com/local/fhir"}
+		config.Validation.Profiles = mode
+		component, err := New(config)
+		require.NoError(t, err)
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), baseURL, []string{"Organization"}, false, "", ""))
+		queryClient := &transactionRecordingClient{StubFHIRClient: &test.StubFHIRClient{}}
+		component.fhirQueryClient = queryClient
+		component.fhirAdminClientFn = func(baseURL *url.URL) fhirclient.Client {
+			return fhirclient.New(baseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		}
+		report, err := component.update(t.Context())
+		require.NoError(t, err)
+		return report[baseURL], queryClient
+	}
+
+	t.Run("off", func(t *testing.T) {
+		report, queryClient := update(t, "")
+
+		assert.Empty(t, report.Warnings)
+		require.Len(t, queryClient.transactions, 1)
+		assert.Len(t, queryClient.transactions[0].Entry, 2)
+	})
+	t.Run("warn", func(t *testing.T) {
+		report, queryClient := update(t, "warn")
+
+		require.Len(t, report.Items, 1)
+		assert.Equal(t, libfhir.ReportCodeNonConformant, report.Items[0].Code)
+		assert.Equal(t, "child", report.Items[0].ResourceID)
+		assert.Contains(t, report.Items[0].Message, "Organization.name: minimum required = 1, but only found 0")
+		require.Len(t, queryClient.transactions, 1)
+		assert.Len(t, queryClient.transactions[0].Entry, 2, "non-conformant resource should still be imported")
+	})
+	t.Run("reject", func(t *testing.T) {
+		report, queryClient := update(t, "reject")
+
+		require.Len(t, report.Items, 1)
+		assert.Equal(t, libfhir.ReportCodeNonConformant, report.Items[0].Code)
+		require.Len(t, queryClient.transactions, 1)
+		assert.Len(t, queryClient.transactions[0].Entry, 1, "non-conformant resource shouldn't be imported")
+	})
+	t.Run("invalid mode", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Validation.Profiles = "strict"
+		_, err := New(config)
+		assert.ErrorContains(t, err, "mcsd.validation.profiles: invalid profile validation mode")
+	})
+}
+
+func TestComponent_applyToQueryDirectory(t *testing.T) {
+	var received []string
+	var mux sync.Mutex
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var tx fhir.Bundle
+		_ = json.NewDecoder(r.Body).Decode(&tx)
+		mux.Lock()
+		for _, entry := range tx.Entry {
+			received = append(received, entry.Request.Url)
+		}
+		mux.Unlock()
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_, _ = w.Write([]byte(`{"resourceType":"Bundle","type":"transaction-response"}`))
+	}))
+	defer target.Close()
+	config := DefaultConfig()
+	config.QueryTargets = map[string]fanout.TargetConfig{"other": {FHIRBaseURL: target.URL}}
+	tx := fhir.Bundle{
+		Type: fhir.BundleTypeTransaction,
+		Entry: []fhir.BundleEntry{{
+			Request: &fhir.BundleEntryRequest{Method: fhir.HTTPVerbDELETE, Url: "Organization?_source=http://example.com/fhir/Organization/1"},
+		}},
+	}
+
+	// newComponent creates a Component with a stubbed query directory, from which the query targets are resynchronized
+	newComponent := func(t *testing.T, queryDirectory *test.StubFHIRClient) *Component {
+		component, err := New(config)
+		require.NoError(t, err)
+		component.fhirQueryClient = queryDirectory
+		component.queryTargets, err = fanout.New(config.QueryTargets, nil, fanout.Source{
+			Client:        queryDirectory,
+			ResourceTypes: component.config.DirectoryResourceTypes,
+			Owns:          component.isSourceOfRegisteredDirectory,
+		}, component.stateStore)
+		require.NoError(t, err)
+		return component
+	}
+
+	t.Run("applied changes are applied to the query targets", func(t *testing.T) {
+		received = nil
+		component := newComponent(t, &test.StubFHIRClient{})
+		component.queryTargets.Start()
+		// The new target is resynchronized first
+		require.Eventually(t, func() bool {
+			return !component.queryTargets.Statuses()[0].ResyncNeeded
+		}, 5*time.Second, 10*time.Millisecond)
+
+		var txResult fhir.Bundle
+		require.NoError(t, component.applyToQueryDirectory(t.Context(), tx, &txResult))
+		require.NoError(t, component.queryTargets.Stop(t.Context()))
+
+		assert.Equal(t, []string{"Organization?_source=http://example.com/fhir/Organization/1"}, received)
+		assert.Equal(t, 1, component.queryTargets.Statuses()[0].Applied)
+	})
+	t.Run("changes that fail on the query directory aren't applied to the query targets", func(t *testing.T) {
+		received = nil
+		component := newComponent(t, &test.StubFHIRClient{Error: errors.New("unavailable")})
+		component.queryTargets.Start()
+
+		var txResult fhir.Bundle
+		err := component.applyToQueryDirectory(t.Context(), tx, &txResult)
+		require.NoError(t, component.queryTargets.Stop(t.Context()))
+
+		assert.EqualError(t, err, "unavailable")
+		assert.Empty(t, received)
+	})
+}
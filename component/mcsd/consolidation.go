@@ -0,0 +1,358 @@
+package mcsd
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// Consolidation modes, which determine how the copies of a care provider's Organization are consolidated,
+// when it's imported into the query directory from both the LRZA and administration directories.
+const (
+	consolidationOff = "off"
+	// consolidationLink links the copies through a Linkage, of which the LRZA's copy is the source.
+	consolidationLink = "link"
+	// consolidationMerge merges the LRZA's name and identifiers into the administration directory's copy (which holds the Endpoints),
+	// and tags the other copies as alternate, so consumers can leave them out. The copies are linked through a Linkage too.
+	consolidationMerge = "merge"
+)
+
+const (
+	// consolidationSourcePrefix prefixes the meta.source of the Linkages written by the consolidation, followed by the URA.
+	consolidationSourcePrefix = "urn:nuts-knooppunt:consolidation:ura:"
+	// consolidationLinkageCode is the tag (in coding.ConsolidationTagSystem) of the Linkages written by the consolidation.
+	consolidationLinkageCode = "linkage"
+	// consolidationAlternateCode is the tag (in coding.ConsolidationTagSystem) of the copies that were merged into another copy.
+	consolidationAlternateCode = "alternate"
+)
+
+// organizationCopy is a copy of a care provider's Organization in the query directory.
+type organizationCopy struct {
+	source   string
+	fromLRZA bool
+	resource map[string]any
+}
+
+// consolidateParentOrganizations consolidates the copies of the given authoritative Organizations in the query directory, if enabled.
+// Failing to consolidate doesn't fail the update: it's reported as warning, and retried after the next update.
+func (c *Component) consolidateParentOrganizations(ctx context.Context, parentOrganizationsMap parentOrganizationMap, report *DirectoryUpdateReport) {
+	if c.config.Consolidation == consolidationOff {
+		return
+	}
+	var uras []string
+	for organization := range parentOrganizationsMap {
+		for _, identifier := range libfhir.FilterIdentifiersBySystem(organization.Identifier, coding.URANamingSystem) {
+			if identifier.Value != nil {
+				uras = append(uras, *identifier.Value)
+			}
+		}
+	}
+	if err := c.consolidate(ctx, uras); err != nil {
+		report.warn(libfhir.ReportItem{
+			Code:    libfhir.ReportCodeConsolidationFailed,
+			Message: "copies of authoritative Organizations weren't consolidated: " + err.Error(),
+		})
+	}
+}
+
+// consolidateLinkedOrganizations consolidates the copies of the Organizations that were linked by earlier consolidations, if enabled.
+// This removes the Linkages of care providers that aren't listed by both the LRZA and an administration directory anymore,
+// e.g. because the directory was unregistered.
+func (c *Component) consolidateLinkedOrganizations(ctx context.Context) {
+	if c.config.Consolidation == consolidationOff {
+		return
+	}
+	entries, err := c.query(ctx, c.fhirQueryClient, "Linkage", url.Values{
+		"_tag":   []string{coding.ConsolidationTagSystem + "|" + consolidationLinkageCode},
+		"_count": []string{"100"},
+	})
+	if err == nil {
+		var uras []string
+		for _, entry := range entries {
+			var linkage fhir.Linkage
+			if json.Unmarshal(entry.Resource, &linkage) == nil && linkage.Meta != nil && linkage.Meta.Source != nil {
+				if ura, ok := strings.CutPrefix(*linkage.Meta.Source, consolidationSourcePrefix); ok {
+					uras = append(uras, ura)
+				}
+			}
+		}
+		err = c.consolidate(ctx, uras)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to consolidate linked Organizations", logging.Error(err))
+	}
+}
+
+// consolidate consolidates the copies of the Organizations with the given URAs in the query directory.
+// Consolidations don't run in parallel, since directories that list the same care provider would otherwise write the same Linkage.
+func (c *Component) consolidate(ctx context.Context, uras []string) error {
+	c.consolidationMux.Lock()
+	defer c.consolidationMux.Unlock()
+	slices.Sort(uras)
+	var errs []error
+	for _, ura := range slices.Compact(uras) {
+		if err := c.consolidateURA(ctx, ura); err != nil {
+			errs = append(errs, fmt.Errorf("URA %s: %w", ura, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// consolidateURA consolidates the copies of the Organizations with the given URA in the query directory.
+// The LRZA's copies are the ones the trust anchor returns; all others were imported from administration directories.
+func (c *Component) consolidateURA(ctx context.Context, ura string) error {
+	registered, err := c.trustAnchor.RegisteredOrganizations(ctx, ura)
+	if err != nil {
+		return err
+	}
+	registeredSources := make(map[string]bool, len(registered))
+	for _, organization := range registered {
+		if organization.Meta != nil && organization.Meta.Source != nil {
+			registeredSources[*organization.Meta.Source] = true
+		}
+	}
+	entries, err := c.query(ctx, c.fhirQueryClient, "Organization", url.Values{
+		"identifier": []string{coding.URANamingSystem + "|" + ura},
+		"_count":     []string{"100"},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to search Organizations in query directory: %w", err)
+	}
+	var copies []organizationCopy
+	for _, entry := range entries {
+		var resource map[string]any
+		if err := json.Unmarshal(entry.Resource, &resource); err != nil {
+			return fmt.Errorf("invalid Organization in query directory: %w", err)
+		}
+		if source := resourceSource(resource); source != "" {
+			copies = append(copies, organizationCopy{source: source, fromLRZA: registeredSources[source], resource: resource})
+		}
+	}
+	linkageEntries, err := c.query(ctx, c.fhirQueryClient, "Linkage", url.Values{"_source": []string{consolidationSourcePrefix + ura}})
+	if err != nil {
+		return fmt.Errorf("failed to search Linkage in query directory: %w", err)
+	}
+	var linkage map[string]any
+	if len(linkageEntries) > 0 {
+		if err := json.Unmarshal(linkageEntries[0].Resource, &linkage); err != nil {
+			return fmt.Errorf("invalid Linkage in query directory: %w", err)
+		}
+	}
+
+	tx := fhir.Bundle{Type: fhir.BundleTypeTransaction, Entry: planConsolidation(c.config.Consolidation, ura, copies, linkage)}
+	if len(tx.Entry) == 0 {
+		return nil
+	}
+	var txResult fhir.Bundle
+	if err := c.applyToQueryDirectory(ctx, tx, &txResult); err != nil {
+		return fmt.Errorf("failed to apply consolidation to query directory: %w", err)
+	}
+	slog.DebugContext(ctx, "Consolidated Organization copies", slog.String("ura", ura), slog.Int("copies", len(copies)), slog.Int("changes", len(tx.Entry)))
+	return nil
+}
+
+// planConsolidation returns the transaction entries that consolidate the given copies of the Organizations with the given URA,
+// given the Linkage of an earlier consolidation (nil if there is none). Copies are only consolidated if there's at least one copy
+// from the LRZA and one from an administration directory; otherwise, the Linkage and alternate tags of earlier consolidations are removed.
+// Only the copies and Linkage that change are written.
+func planConsolidation(mode string, ura string, copies []organizationCopy, linkage map[string]any) []fhir.BundleEntry {
+	copies = slices.Clone(copies)
+	slices.SortFunc(copies, func(a, b organizationCopy) int {
+		return cmp.Compare(a.source, b.source)
+	})
+	var lrzaCopies, directoryCopies []organizationCopy
+	for _, organization := range copies {
+		if organization.fromLRZA {
+			lrzaCopies = append(lrzaCopies, organization)
+		} else {
+			directoryCopies = append(directoryCopies, organization)
+		}
+	}
+	linked := len(lrzaCopies) > 0 && len(directoryCopies) > 0
+	merged := linked && mode == consolidationMerge
+
+	// Update the copies first, so the Linkage refers to them as they'll be
+	var entries []fhir.BundleEntry
+	updatedCopies := make([]organizationCopy, len(copies))
+	for i, organization := range copies {
+		updated := normalizeJSON(organization.resource).(map[string]any)
+		// When merging, the first copy of an administration directory is the primary copy
+		primary := merged && organization.source == directoryCopies[0].source
+		setConsolidationTag(updated, consolidationAlternateCode, merged && !primary)
+		if primary {
+			mergeRegisteredOrganization(updated, lrzaCopies[0].resource)
+		}
+		if !reflect.DeepEqual(updated, normalizeJSON(organization.resource)) {
+			entries = append(entries, conditionalPut("Organization", organization.source, updated))
+		}
+		updatedCopies[i] = organizationCopy{source: organization.source, fromLRZA: organization.fromLRZA, resource: updated}
+	}
+
+	linkageSource := consolidationSourcePrefix + ura
+	if !linked {
+		if linkage != nil {
+			entries = append(entries, fhir.BundleEntry{
+				Request: &fhir.BundleEntryRequest{
+					Method: fhir.HTTPVerbDELETE,
+					Url:    "Linkage?" + url.Values{"_source": []string{linkageSource}}.Encode(),
+				},
+			})
+		}
+		return entries
+	}
+	// The primary copy is the one consumers should use: the LRZA's when linking, the directory's (merged with the LRZA's) when merging.
+	primaryIndex := slices.IndexFunc(updatedCopies, func(organization organizationCopy) bool {
+		return organization.fromLRZA
+	})
+	if merged {
+		primaryIndex = slices.IndexFunc(updatedCopies, func(organization organizationCopy) bool {
+			return !organization.fromLRZA
+		})
+	}
+	alternates := slices.Delete(slices.Clone(updatedCopies), primaryIndex, primaryIndex+1)
+	desired := newConsolidationLinkage(linkageSource, updatedCopies[primaryIndex], alternates)
+	if linkage == nil || !reflect.DeepEqual(normalizeJSON(linkage["item"]), desired["item"]) {
+		entries = append(entries, conditionalPut("Linkage", linkageSource, desired))
+	}
+	return entries
+}
+
+// newConsolidationLinkage returns a Linkage that links the primary copy (as source) to the alternate copies.
+// The copies are referred to by their meta.source, instead of their id in the query directory: a literal reference would keep
+// the query directory from deleting a copy when its directory or the LRZA deletes it.
+func newConsolidationLinkage(source string, primary organizationCopy, alternates []organizationCopy) map[string]any {
+	item := func(itemType string, organization organizationCopy) map[string]any {
+		reference := map[string]any{
+			"type":       "Organization",
+			"identifier": map[string]any{"system": "urn:ietf:rfc:3986", "value": organization.source},
+		}
+		if name, ok := organization.resource["name"].(string); ok && name != "" {
+			reference["display"] = name
+		}
+		return map[string]any{"type": itemType, "resource": reference}
+	}
+	items := []any{item("source", primary)}
+	for _, alternate := range alternates {
+		items = append(items, item("alternate", alternate))
+	}
+	linkage := map[string]any{
+		"resourceType": "Linkage",
+		"meta": map[string]any{
+			"source": source,
+			"tag":    []any{map[string]any{"system": coding.ConsolidationTagSystem, "code": consolidationLinkageCode}},
+		},
+		"active": true,
+		"item":   items,
+	}
+	return normalizeJSON(linkage).(map[string]any)
+}
+
+// mergeRegisteredOrganization merges the LRZA's name and identifiers into the given copy of an administration directory:
+// the LRZA's name replaces the copy's name, which is kept as alias, and the LRZA's aliases and identifiers the copy doesn't have are added.
+// Everything else, including the Endpoints, is kept as the administration directory lists it.
+func mergeRegisteredOrganization(organization map[string]any, registered map[string]any) {
+	aliases, _ := organization["alias"].([]any)
+	addAlias := func(alias any) {
+		if name, ok := alias.(string); ok && name != "" && name != registered["name"] && !slices.Contains(aliases, alias) {
+			aliases = append(aliases, alias)
+		}
+	}
+	if name, ok := registered["name"].(string); ok && name != "" {
+		addAlias(organization["name"])
+		organization["name"] = name
+	}
+	registeredAliases, _ := registered["alias"].([]any)
+	for _, alias := range registeredAliases {
+		addAlias(alias)
+	}
+	if len(aliases) > 0 {
+		organization["alias"] = aliases
+	}
+
+	identifiers, _ := organization["identifier"].([]any)
+	registeredIdentifiers, _ := registered["identifier"].([]any)
+	for _, registeredIdentifier := range registeredIdentifiers {
+		if !slices.ContainsFunc(identifiers, func(identifier any) bool {
+			return sameIdentifier(identifier, registeredIdentifier)
+		}) {
+			identifiers = append(identifiers, registeredIdentifier)
+		}
+	}
+	if len(identifiers) > 0 {
+		organization["identifier"] = identifiers
+	}
+}
+
+// sameIdentifier returns whether the given identifiers (as JSON objects) have the same system and value.
+func sameIdentifier(a any, b any) bool {
+	left, _ := a.(map[string]any)
+	right, _ := b.(map[string]any)
+	return left != nil && right != nil && left["system"] == right["system"] && left["value"] == right["value"]
+}
+
+// setConsolidationTag adds (or removes, if set is false) the tag with the given code in coding.ConsolidationTagSystem to the resource.
+func setConsolidationTag(resource map[string]any, code string, set bool) {
+	meta, _ := resource["meta"].(map[string]any)
+	if meta == nil {
+		if !set {
+			return
+		}
+		meta = map[string]any{}
+		resource["meta"] = meta
+	}
+	tags, _ := meta["tag"].([]any)
+	tags = slices.DeleteFunc(slices.Clone(tags), func(tag any) bool {
+		tagCoding, _ := tag.(map[string]any)
+		return tagCoding != nil && tagCoding["system"] == coding.ConsolidationTagSystem && tagCoding["code"] == code
+	})
+	if set {
+		tags = append(tags, map[string]any{"system": coding.ConsolidationTagSystem, "code": code})
+	}
+	if len(tags) > 0 {
+		meta["tag"] = tags
+	} else {
+		delete(meta, "tag")
+	}
+}
+
+// conditionalPut returns a transaction entry that creates or updates the given resource, identified by its meta.source.
+func conditionalPut(resourceType string, source string, resource map[string]any) fhir.BundleEntry {
+	// Marshalling a map of JSON values can't fail
+	data, _ := json.Marshal(resource)
+	return fhir.BundleEntry{
+		Resource: data,
+		Request: &fhir.BundleEntryRequest{
+			Method: fhir.HTTPVerbPUT,
+			Url:    resourceType + "?" + url.Values{"_source": []string{source}}.Encode(),
+		},
+	}
+}
+
+// resourceSource returns the meta.source of the given resource, or an empty string if it has none.
+func resourceSource(resource map[string]any) string {
+	meta, _ := resource["meta"].(map[string]any)
+	source, _ := meta["source"].(string)
+	return source
+}
+
+// normalizeJSON returns a deep copy of the given JSON value, with the types encoding/json unmarshals into (e.g. []any instead of []map[string]any),
+// so values can be compared with reflect.DeepEqual.
+func normalizeJSON(value any) any {
+	// Marshalling a JSON value can't fail
+	data, _ := json.Marshal(value)
+	var result any
+	_ = json.Unmarshal(data, &result)
+	return result
+}
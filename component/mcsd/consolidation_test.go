@@ -0,0 +1,189 @@
+package mcsd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestPlanConsolidation(t *testing.T) {
+	const ura = "1234"
+	const lrzaSource = "https://lrza.example.com/fhir/Organization/1"
+	const directorySource = "https://directory.example.com/fhir/Organization/a"
+	newCopy := func(source string, fromLRZA bool, name string, identifiers ...string) organizationCopy {
+		resource := map[string]any{
+			"resourceType": "Organization",
+			"name":         name,
+			"meta":         map[string]any{"source": source},
+		}
+		var identifierValues []any
+		for _, identifier := range append([]string{coding.URANamingSystem + "|" + ura}, identifiers...) {
+			system, value, _ := strings.Cut(identifier, "|")
+			identifierValues = append(identifierValues, map[string]any{"system": system, "value": value})
+		}
+		resource["identifier"] = identifierValues
+		return organizationCopy{source: source, fromLRZA: fromLRZA, resource: resource}
+	}
+	// apply returns the copies and Linkage as they are after applying the given entries
+	apply := func(t *testing.T, copies []organizationCopy, linkage map[string]any, entries []fhir.BundleEntry) ([]organizationCopy, map[string]any) {
+		copies = append([]organizationCopy(nil), copies...)
+		for _, entry := range entries {
+			requestURL, err := url.Parse(entry.Request.Url)
+			require.NoError(t, err)
+			source := requestURL.Query().Get("_source")
+			switch {
+			case entry.Request.Method == fhir.HTTPVerbDELETE:
+				linkage = nil
+			case requestURL.Path == "Linkage":
+				require.NoError(t, json.Unmarshal(entry.Resource, &linkage))
+			default:
+				for i, organization := range copies {
+					if organization.source == source {
+						copies[i].resource = nil
+						require.NoError(t, json.Unmarshal(entry.Resource, &copies[i].resource))
+					}
+				}
+			}
+		}
+		return copies, linkage
+	}
+	linkageItems := func(linkage map[string]any) []string {
+		var result []string
+		for _, item := range linkage["item"].([]any) {
+			item := item.(map[string]any)
+			reference := item["resource"].(map[string]any)
+			result = append(result, item["type"].(string)+" "+reference["identifier"].(map[string]any)["value"].(string))
+		}
+		return result
+	}
+	alternate := func(organization organizationCopy) bool {
+		meta, _ := organization.resource["meta"].(map[string]any)
+		tags, _ := meta["tag"].([]any)
+		for _, tag := range tags {
+			if tag.(map[string]any)["code"] == consolidationAlternateCode {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("link", func(t *testing.T) {
+		copies := []organizationCopy{
+			newCopy(directorySource, false, "Zorgaanbieder B.V."),
+			newCopy(lrzaSource, true, "Zorgaanbieder"),
+		}
+
+		entries := planConsolidation(consolidationLink, ura, copies, nil)
+
+		require.Len(t, entries, 1, "only the Linkage should be written")
+		assert.Equal(t, "Linkage?_source=urn%3Anuts-knooppunt%3Aconsolidation%3Aura%3A1234", entries[0].Request.Url)
+		_, linkage := apply(t, copies, nil, entries)
+		assert.Equal(t, []string{"source " + lrzaSource, "alternate " + directorySource}, linkageItems(linkage))
+		assert.Equal(t, "urn:nuts-knooppunt:consolidation:ura:1234", resourceSource(linkage))
+
+		t.Run("already consolidated", func(t *testing.T) {
+			assert.Empty(t, planConsolidation(consolidationLink, ura, copies, linkage))
+		})
+	})
+	t.Run("merge", func(t *testing.T) {
+		copies := []organizationCopy{
+			newCopy(lrzaSource, true, "Zorgaanbieder", "http://fhir.nl/fhir/NamingSystem/agb-z|5678"),
+			newCopy(directorySource, false, "Zorgaanbieder B.V."),
+		}
+
+		entries := planConsolidation(consolidationMerge, ura, copies, nil)
+
+		require.Len(t, entries, 3)
+		copies, linkage := apply(t, copies, nil, entries)
+		assert.Equal(t, []string{"source " + directorySource, "alternate " + lrzaSource}, linkageItems(linkage))
+		merged := copies[1].resource
+		assert.Equal(t, "Zorgaanbieder", merged["name"])
+		assert.Equal(t, []any{"Zorgaanbieder B.V."}, merged["alias"])
+		assert.Len(t, merged["identifier"], 2)
+		assert.False(t, alternate(copies[1]))
+		assert.True(t, alternate(copies[0]))
+
+		t.Run("already consolidated", func(t *testing.T) {
+			assert.Empty(t, planConsolidation(consolidationMerge, ura, copies, linkage))
+		})
+		t.Run("directory copy removed", func(t *testing.T) {
+			entries := planConsolidation(consolidationMerge, ura, copies[:1], linkage)
+
+			require.Len(t, entries, 2)
+			remaining, linkage := apply(t, copies[:1], linkage, entries)
+			assert.Nil(t, linkage)
+			assert.False(t, alternate(remaining[0]))
+		})
+	})
+	t.Run("only copies of the LRZA", func(t *testing.T) {
+		assert.Empty(t, planConsolidation(consolidationMerge, ura, []organizationCopy{newCopy(lrzaSource, true, "Zorgaanbieder")}, nil))
+	})
+}
+
+func TestComponent_consolidateParentOrganizations(t *testing.T) {
+	history := `{"resourceType":"Bundle","type":"history","entry":[
+		{"fullUrl":"http://example.org/fhir/Organization/parent","request":{"method":"PUT","url":"Organization/parent"},
+		 "resource":{"resourceType":"Organization","id":"parent","name":"Zorgaanbieder","identifier":[{"system":"http://fhir.nl/fhir/NamingSystem/ura","value":"1234"}]}}
+	]}`
+	mux := http.NewServeMux()
+	mockEndpoints(mux, map[string]*string{
+		"/fhir/Organization/_history": &history,
+		"/fhir/Organization":          &history,
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	baseURL := server.URL + "/fhir"
+
+	t.Run("LRZA unavailable", func(t *testing.T) {
+		config := DefaultConfig()
+		config.QueryDirectory = DirectoryConfig{FHIRBaseURL: "http://example.com/local/fhir"}
+		config.Consolidation = consolidationLink
+		component, err := New(config)
+		require.NoError(t, err)
+		component.SetTrustAnchor(&stubTrustAnchor{err: errors.New("LRZA hasn't been synchronized yet")})
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), baseURL, []string{"Organization"}, false, "", ""))
+		component.fhirQueryClient = &test.StubFHIRClient{}
+		component.fhirAdminClientFn = func(baseURL *url.URL) fhirclient.Client {
+			return fhirclient.New(baseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		}
+
+		reports, err := component.update(t.Context())
+
+		require.NoError(t, err)
+		report := reports[baseURL]
+		require.Len(t, report.Items, 1)
+		assert.Equal(t, libfhir.ReportCodeConsolidationFailed, report.Items[0].Code)
+		assert.Contains(t, report.Items[0].Message, "URA 1234: LRZA hasn't been synchronized yet")
+		assert.Equal(t, 1, report.CountCreated, "failing to consolidate shouldn't fail the update")
+	})
+	t.Run("invalid mode", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Consolidation = "other"
+
+		_, err := New(config)
+
+		assert.EqualError(t, err, `mcsd.consolidation: invalid mode "other" (valid: off, link, merge)`)
+	})
+	t.Run("enabled without LRZA", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Consolidation = consolidationMerge
+		component, err := New(config)
+		require.NoError(t, err)
+
+		err = component.Start()
+
+		assert.EqualError(t, err, "mcsd.consolidation requires the LRZA sync client (lrza.lrzabaseurl)")
+	})
+}
@@ -0,0 +1,344 @@
+package mcsd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+)
+
+var errDirectoryExcluded = errors.New("mCSD Directory is excluded")
+var errDirectoryExists = errors.New("mCSD Directory is already registered")
+var errDirectoryNotRegistered = errors.New("mCSD Directory is not registered")
+
+// Origins of a registered administration directory or exclusion, as reported by the directory management API.
+const (
+	originConfigured = "configured"
+	originDiscovered = "discovered"
+	originManual     = "manual"
+)
+
+// DirectoryInfo describes a registered administration directory.
+type DirectoryInfo struct {
+	FHIRBaseURL      string   `json:"fhirBaseURL"`
+	ResourceTypes    []string `json:"resourceTypes"`
+	Discover         bool     `json:"discover"`
+	AuthoritativeUra string   `json:"authoritativeUra,omitempty"`
+	// SourceURL is the fullUrl of the Endpoint through which the directory was discovered.
+	SourceURL string `json:"sourceURL,omitempty"`
+	// Origin is how the directory was registered: configured, discovered or manual.
+	Origin string `json:"origin"`
+	// SyncStrategy is the strategy for fetching the changes of the directory, if it overrides the default.
+	SyncStrategy string `json:"syncStrategy,omitempty"`
+	// LastUpdate is the _since value of the next incremental update, if any update completed.
+	LastUpdate string `json:"lastUpdate,omitempty"`
+	// LastSync is the outcome of the last update since startup, if any.
+	LastSync *DirectorySyncStatus `json:"lastSync,omitempty"`
+}
+
+// DirectorySyncStatus is the outcome of the last update from an administration directory.
+type DirectorySyncStatus struct {
+	Time         time.Time `json:"time"`
+	Error        string    `json:"error,omitempty"`
+	CountCreated int       `json:"created"`
+	CountUpdated int       `json:"updated"`
+	CountDeleted int       `json:"deleted"`
+	CountWarning int       `json:"warnings"`
+	DurationMs   int64     `json:"durationMs"`
+}
+
+// ExcludedDirectory describes a FHIR base URL that is excluded from being registered as administration directory.
+type ExcludedDirectory struct {
+	FHIRBaseURL string `json:"fhirBaseURL"`
+	// Origin is how the directory was excluded: configured (mcsd.adminexclude) or manual.
+	Origin string `json:"origin"`
+}
+
+// DirectoriesResponse is the response of the directory management API's list operation.
+type DirectoriesResponse struct {
+	Directories []DirectoryInfo     `json:"directories"`
+	Excluded    []ExcludedDirectory `json:"excluded"`
+}
+
+// directoryRequest is the request body for adding a directory or exclusion through the directory management API.
+type directoryRequest struct {
+	FHIRBaseURL      string   `json:"fhirBaseURL"`
+	ResourceTypes    []string `json:"resourceTypes"`
+	Discover         bool     `json:"discover"`
+	AuthoritativeUra string   `json:"authoritativeUra"`
+	SyncStrategy     string   `json:"syncStrategy"`
+}
+
+// registerDirectoryHandlers registers the directory management API, which lists the administration directories and
+// allows adding, removing and excluding them at runtime. Changes are persisted in the state store.
+// Changes wait for a running update to finish, so they don't interfere with it.
+func (c *Component) registerDirectoryHandlers(internalMux *http.ServeMux) {
+	internalMux.HandleFunc("GET /mcsd/directories", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.listDirectories())
+	})
+	internalMux.HandleFunc("POST /mcsd/directories", func(w http.ResponseWriter, r *http.Request) {
+		var request directoryRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		directory, err := c.addDirectory(r.Context(), request)
+		switch {
+		case errors.Is(err, errDirectoryExcluded) || errors.Is(err, errDirectoryExists):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			writeJSON(w, http.StatusCreated, directory)
+		}
+	})
+	internalMux.HandleFunc("DELETE /mcsd/directories", func(w http.ResponseWriter, r *http.Request) {
+		fhirBaseURL := r.URL.Query().Get("fhirBaseURL")
+		if fhirBaseURL == "" {
+			http.Error(w, "Missing fhirBaseURL parameter", http.StatusBadRequest)
+			return
+		}
+		if !c.removeDirectory(r.Context(), fhirBaseURL, r.URL.Query().Get("authoritativeUra")) {
+			http.Error(w, errDirectoryNotRegistered.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	internalMux.HandleFunc("POST /mcsd/directories/excluded", func(w http.ResponseWriter, r *http.Request) {
+		var request directoryRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if request.FHIRBaseURL == "" {
+			http.Error(w, "Missing fhirBaseURL", http.StatusBadRequest)
+			return
+		}
+		c.excludeDirectory(r.Context(), request.FHIRBaseURL)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	internalMux.HandleFunc("DELETE /mcsd/directories/excluded", func(w http.ResponseWriter, r *http.Request) {
+		fhirBaseURL := r.URL.Query().Get("fhirBaseURL")
+		if fhirBaseURL == "" {
+			http.Error(w, "Missing fhirBaseURL parameter", http.StatusBadRequest)
+			return
+		}
+		if err := c.unexcludeDirectory(r.Context(), fhirBaseURL); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// listDirectories returns the registered administration directories and exclusions.
+func (c *Component) listDirectories() DirectoriesResponse {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	result := DirectoriesResponse{
+		Directories: make([]DirectoryInfo, 0, len(c.administrationDirectories)),
+		Excluded:    []ExcludedDirectory{},
+	}
+	for _, directory := range c.administrationDirectories {
+		directoryKey := makeDirectoryKey(directory.fhirBaseURL, directory.authoritativeUra)
+		info := DirectoryInfo{
+			FHIRBaseURL:      directory.fhirBaseURL,
+			ResourceTypes:    directory.resourceTypes,
+			Discover:         directory.discover,
+			AuthoritativeUra: directory.authoritativeUra,
+			SourceURL:        directory.sourceURL,
+			Origin:           directory.origin(),
+			SyncStrategy:     directory.syncStrategy,
+			LastUpdate:       c.lastUpdateTimes[directoryKey],
+		}
+		if status, ok := c.syncStatuses[directoryKey]; ok {
+			info.LastSync = &status
+		}
+		result.Directories = append(result.Directories, info)
+	}
+	for _, excludedURL := range c.config.ExcludeAdminDirectories {
+		result.Excluded = append(result.Excluded, ExcludedDirectory{FHIRBaseURL: strings.TrimRight(excludedURL, "/"), Origin: originConfigured})
+	}
+	for excludedURL := range c.excludedDirectories {
+		result.Excluded = append(result.Excluded, ExcludedDirectory{FHIRBaseURL: excludedURL, Origin: originManual})
+	}
+	slices.SortFunc(result.Excluded, func(a, b ExcludedDirectory) int {
+		return strings.Compare(a.FHIRBaseURL, b.FHIRBaseURL)
+	})
+	return result
+}
+
+func (d administrationDirectory) origin() string {
+	switch {
+	case d.sourceURL != "":
+		return originDiscovered
+	case d.manual:
+		return originManual
+	default:
+		return originConfigured
+	}
+}
+
+// addDirectory registers an administration directory through the directory management API.
+// When no resource types are given, the defaults for a root directory (discover=true) or regular directory are used.
+func (c *Component) addDirectory(ctx context.Context, request directoryRequest) (DirectoryInfo, error) {
+	if request.FHIRBaseURL == "" {
+		return DirectoryInfo{}, errors.New("missing fhirBaseURL")
+	}
+	if err := validateSyncStrategy(request.SyncStrategy); err != nil {
+		return DirectoryInfo{}, err
+	}
+	resourceTypes := request.ResourceTypes
+	if len(resourceTypes) == 0 {
+		if request.Discover {
+			resourceTypes = rootDirectoryResourceTypes
+		} else {
+			resourceTypes = c.config.DirectoryResourceTypes
+		}
+	}
+	c.updateMux.Lock()
+	defer c.updateMux.Unlock()
+	directory := administrationDirectory{
+		fhirBaseURL:      request.FHIRBaseURL,
+		resourceTypes:    resourceTypes,
+		discover:         request.Discover,
+		authoritativeUra: request.AuthoritativeUra,
+		manual:           true,
+		syncStrategy:     request.SyncStrategy,
+	}
+	if err := c.registerDirectory(ctx, directory); err != nil {
+		return DirectoryInfo{}, err
+	}
+	return DirectoryInfo{
+		FHIRBaseURL:      directory.fhirBaseURL,
+		ResourceTypes:    directory.resourceTypes,
+		Discover:         directory.discover,
+		AuthoritativeUra: directory.authoritativeUra,
+		Origin:           directory.origin(),
+		SyncStrategy:     directory.syncStrategy,
+	}, nil
+}
+
+// removeDirectory unregisters the administration directory with the given FHIR base URL and authoritative URA,
+// and removes its sync state. It returns false if no such directory is registered.
+// A removed root or discovered directory is registered again on restart or rediscovery; exclude it to prevent that.
+func (c *Component) removeDirectory(ctx context.Context, fhirBaseURL string, authoritativeUra string) bool {
+	c.updateMux.Lock()
+	defer c.updateMux.Unlock()
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	removed := false
+	c.administrationDirectories = slices.DeleteFunc(c.administrationDirectories, func(directory administrationDirectory) bool {
+		if directory.fhirBaseURL != fhirBaseURL || directory.authoritativeUra != authoritativeUra {
+			return false
+		}
+		c.forgetDirectory(ctx, directory)
+		removed = true
+		return true
+	})
+	if removed {
+		slog.InfoContext(ctx, "Removed mCSD Directory", logging.FHIRServer(fhirBaseURL), slog.String("authoritativeUra", authoritativeUra))
+	}
+	return removed
+}
+
+// excludeDirectory excludes the given FHIR base URL from being registered as administration directory,
+// and unregisters the directories with that FHIR base URL.
+func (c *Component) excludeDirectory(ctx context.Context, fhirBaseURL string) {
+	c.updateMux.Lock()
+	defer c.updateMux.Unlock()
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	trimmedFHIRBaseURL := strings.TrimRight(fhirBaseURL, "/")
+	c.excludedDirectories[trimmedFHIRBaseURL] = true
+	if err := c.stateStore.Put(excludedDirectoriesBucket, trimmedFHIRBaseURL, true); err != nil {
+		slog.ErrorContext(ctx, "Failed to persist mCSD Directory exclusion", logging.FHIRServer(fhirBaseURL), logging.Error(err))
+	}
+	c.administrationDirectories = slices.DeleteFunc(c.administrationDirectories, func(directory administrationDirectory) bool {
+		if strings.TrimRight(directory.fhirBaseURL, "/") != trimmedFHIRBaseURL {
+			return false
+		}
+		c.forgetDirectory(ctx, directory)
+		return true
+	})
+	slog.InfoContext(ctx, "Excluded mCSD Directory", logging.FHIRServer(fhirBaseURL))
+}
+
+// unexcludeDirectory removes an exclusion added through the directory management API.
+// Configured root directories with the FHIR base URL are registered again; discovered directories are registered again
+// on the next update of the root directory that lists them. Exclusions from configuration can't be removed.
+func (c *Component) unexcludeDirectory(ctx context.Context, fhirBaseURL string) error {
+	c.updateMux.Lock()
+	defer c.updateMux.Unlock()
+	trimmedFHIRBaseURL := strings.TrimRight(fhirBaseURL, "/")
+	c.stateMux.Lock()
+	if !c.excludedDirectories[trimmedFHIRBaseURL] {
+		c.stateMux.Unlock()
+		if c.isExcludedByConfig(trimmedFHIRBaseURL) {
+			return errors.New("mCSD Directory is excluded by configuration (mcsd.adminexclude)")
+		}
+		return errors.New("mCSD Directory is not excluded")
+	}
+	delete(c.excludedDirectories, trimmedFHIRBaseURL)
+	if err := c.stateStore.Delete(excludedDirectoriesBucket, trimmedFHIRBaseURL); err != nil {
+		slog.ErrorContext(ctx, "Failed to remove mCSD Directory exclusion from state", logging.FHIRServer(fhirBaseURL), logging.Error(err))
+	}
+	c.stateMux.Unlock()
+	slog.InfoContext(ctx, "Removed mCSD Directory exclusion", logging.FHIRServer(fhirBaseURL))
+
+	for _, rootDirectory := range c.config.AdministrationDirectories {
+		if strings.TrimRight(rootDirectory.FHIRBaseURL, "/") != trimmedFHIRBaseURL {
+			continue
+		}
+		if err := c.registerRootDirectory(ctx, rootDirectory); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isExcluded returns whether the given FHIR base URL is excluded by configuration or through the directory management API.
+// Trailing slashes are ignored. The caller must hold stateMux.
+func (c *Component) isExcluded(fhirBaseURL string) bool {
+	trimmedFHIRBaseURL := strings.TrimRight(fhirBaseURL, "/")
+	return c.excludedDirectories[trimmedFHIRBaseURL] || c.isExcludedByConfig(trimmedFHIRBaseURL)
+}
+
+func (c *Component) isExcludedByConfig(trimmedFHIRBaseURL string) bool {
+	for _, excludedURL := range c.config.ExcludeAdminDirectories {
+		if strings.TrimRight(excludedURL, "/") == trimmedFHIRBaseURL {
+			return true
+		}
+	}
+	return false
+}
+
+// recordSyncStatus records the outcome of an update from an administration directory.
+func (c *Component) recordSyncStatus(directoryKey string, report DirectoryUpdateReport) {
+	status := DirectorySyncStatus{
+		Time:         time.Now(),
+		CountCreated: report.CountCreated,
+		CountUpdated: report.CountUpdated,
+		CountDeleted: report.CountDeleted,
+		CountWarning: len(report.Warnings),
+		DurationMs:   report.DurationMs,
+	}
+	if len(report.Errors) > 0 {
+		status.Error = strings.Join(report.Errors, "; ")
+	}
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	c.syncStatuses[directoryKey] = status
+}
@@ -0,0 +1,133 @@
+package mcsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComponent_directoryManagement(t *testing.T) {
+	newComponent := func(t *testing.T, stateFile string) (*Component, *http.ServeMux) {
+		config := DefaultConfig()
+		config.AdministrationDirectories = map[string]DirectoryConfig{"root": {FHIRBaseURL: "http://example.com/root/fhir"}}
+		config.ExcludeAdminDirectories = []string{"http://example.com/self/fhir/"}
+		config.StateFile = stateFile
+		component, err := New(config)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = component.stateStore.Close()
+		})
+		internalMux := http.NewServeMux()
+		component.RegisterHttpHandlers(http.NewServeMux(), internalMux)
+		return component, internalMux
+	}
+	do := func(mux *http.ServeMux, method string, target string, body any) *httptest.ResponseRecorder {
+		var requestBody bytes.Buffer
+		if body != nil {
+			_ = json.NewEncoder(&requestBody).Encode(body)
+		}
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, httptest.NewRequest(method, target, &requestBody))
+		return response
+	}
+	list := func(t *testing.T, mux *http.ServeMux) DirectoriesResponse {
+		response := do(mux, http.MethodGet, "/mcsd/directories", nil)
+		require.Equal(t, http.StatusOK, response.Code)
+		var result DirectoriesResponse
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+		return result
+	}
+
+	t.Run("list", func(t *testing.T) {
+		component, mux := newComponent(t, "")
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), "http://example.com/org/fhir", defaultDirectoryResourceTypes, false, "http://example.com/root/fhir/Endpoint/1", "1234"))
+		component.setLastUpdateTime(t.Context(), makeDirectoryKey("http://example.com/org/fhir", "1234"), "2026-01-01T00:00:00Z")
+		component.recordSyncStatus(makeDirectoryKey("http://example.com/org/fhir", "1234"), DirectoryUpdateReport{CountCreated: 2, Errors: []string{"failed"}})
+
+		result := list(t, mux)
+
+		require.Len(t, result.Directories, 2)
+		assert.Equal(t, "http://example.com/root/fhir", result.Directories[0].FHIRBaseURL)
+		assert.Equal(t, originConfigured, result.Directories[0].Origin)
+		assert.True(t, result.Directories[0].Discover)
+		assert.Nil(t, result.Directories[0].LastSync)
+		discovered := result.Directories[1]
+		assert.Equal(t, originDiscovered, discovered.Origin)
+		assert.Equal(t, "1234", discovered.AuthoritativeUra)
+		assert.Equal(t, "http://example.com/root/fhir/Endpoint/1", discovered.SourceURL)
+		assert.Equal(t, "2026-01-01T00:00:00Z", discovered.LastUpdate)
+		require.NotNil(t, discovered.LastSync)
+		assert.Equal(t, 2, discovered.LastSync.CountCreated)
+		assert.Equal(t, "failed", discovered.LastSync.Error)
+		assert.Equal(t, []ExcludedDirectory{{FHIRBaseURL: "http://example.com/self/fhir", Origin: originConfigured}}, result.Excluded)
+	})
+	t.Run("add and remove", func(t *testing.T) {
+		stateFile := filepath.Join(t.TempDir(), "state.db")
+		component, mux := newComponent(t, stateFile)
+
+		response := do(mux, http.MethodPost, "/mcsd/directories", map[string]any{"fhirBaseURL": "http://example.com/manual/fhir"})
+		require.Equal(t, http.StatusCreated, response.Code)
+		t.Run("is persisted", func(t *testing.T) {
+			require.NoError(t, component.stateStore.Close())
+			_, mux := newComponent(t, stateFile)
+			directories := list(t, mux).Directories
+			require.Len(t, directories, 2)
+			assert.Equal(t, originManual, directories[1].Origin)
+			assert.Equal(t, defaultDirectoryResourceTypes, directories[1].ResourceTypes)
+			assert.False(t, directories[1].Discover)
+
+			response = do(mux, http.MethodDelete, "/mcsd/directories?fhirBaseURL=http://example.com/manual/fhir", nil)
+			require.Equal(t, http.StatusNoContent, response.Code)
+			assert.Len(t, list(t, mux).Directories, 1)
+		})
+	})
+	t.Run("add existing directory", func(t *testing.T) {
+		_, mux := newComponent(t, "")
+		response := do(mux, http.MethodPost, "/mcsd/directories", map[string]any{"fhirBaseURL": "http://example.com/root/fhir", "discover": true})
+		assert.Equal(t, http.StatusConflict, response.Code)
+	})
+	t.Run("add invalid directory", func(t *testing.T) {
+		_, mux := newComponent(t, "")
+		response := do(mux, http.MethodPost, "/mcsd/directories", map[string]any{"fhirBaseURL": "ftp://example.com"})
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+	})
+	t.Run("remove unknown directory", func(t *testing.T) {
+		_, mux := newComponent(t, "")
+		response := do(mux, http.MethodDelete, "/mcsd/directories?fhirBaseURL=http://example.com/other/fhir", nil)
+		assert.Equal(t, http.StatusNotFound, response.Code)
+	})
+	t.Run("exclude and unexclude", func(t *testing.T) {
+		stateFile := filepath.Join(t.TempDir(), "state.db")
+		component, mux := newComponent(t, stateFile)
+
+		response := do(mux, http.MethodPost, "/mcsd/directories/excluded", map[string]any{"fhirBaseURL": "http://example.com/root/fhir/"})
+		require.Equal(t, http.StatusNoContent, response.Code)
+		assert.Empty(t, list(t, mux).Directories, "excluded directory should be unregistered")
+		response = do(mux, http.MethodPost, "/mcsd/directories", map[string]any{"fhirBaseURL": "http://example.com/root/fhir"})
+		assert.Equal(t, http.StatusConflict, response.Code, "excluded directory can't be added")
+
+		t.Run("is persisted", func(t *testing.T) {
+			require.NoError(t, component.stateStore.Close())
+			_, mux := newComponent(t, stateFile)
+			result := list(t, mux)
+			assert.Empty(t, result.Directories, "excluded root directory shouldn't be registered on startup")
+			assert.Contains(t, result.Excluded, ExcludedDirectory{FHIRBaseURL: "http://example.com/root/fhir", Origin: originManual})
+
+			response = do(mux, http.MethodDelete, "/mcsd/directories/excluded?fhirBaseURL=http://example.com/root/fhir", nil)
+			require.Equal(t, http.StatusNoContent, response.Code)
+			assert.Len(t, list(t, mux).Directories, 1, "configured root directory should be registered again")
+		})
+	})
+	t.Run("configured exclusion can't be removed", func(t *testing.T) {
+		_, mux := newComponent(t, "")
+		response := do(mux, http.MethodDelete, "/mcsd/directories/excluded?fhirBaseURL=http://example.com/self/fhir", nil)
+		assert.Equal(t, http.StatusConflict, response.Code)
+		assert.Contains(t, response.Body.String(), "mcsd.adminexclude")
+	})
+}
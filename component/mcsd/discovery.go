@@ -0,0 +1,168 @@
+package mcsd
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+)
+
+// Reasons for not registering a discovered mCSD Directory Endpoint, as reported in the discovery graph.
+const (
+	discoverySkipCycle          = "cycle"
+	discoverySkipQueryDirectory = "query-directory"
+)
+
+// DiscoveryGraph describes how the registered administration directories were discovered.
+// Every directory is a node that refers to the directory it was discovered by; root directories are the roots of the graph.
+type DiscoveryGraph struct {
+	// MaxDepth is the configured maximum discovery depth (mcsd.maxdiscoverydepth).
+	MaxDepth    int             `json:"maxDepth"`
+	Directories []DiscoveryNode `json:"directories"`
+	// Skipped holds the mCSD Directory Endpoints that were found during the last updates, but not registered to prevent discovery loops.
+	Skipped []SkippedDiscovery `json:"skipped"`
+}
+
+// DiscoveryNode describes a registered administration directory and how it was discovered.
+type DiscoveryNode struct {
+	FHIRBaseURL      string `json:"fhirBaseURL"`
+	AuthoritativeUra string `json:"authoritativeUra,omitempty"`
+	// Origin is how the directory was registered: configured, discovered or manual.
+	Origin string `json:"origin"`
+	// Root is the FHIR base URL of the root directory the discovery started at. For root directories, it's their own FHIR base URL.
+	Root string `json:"root,omitempty"`
+	// DiscoveredBy is the FHIR base URL of the directory that listed the Endpoint the directory was discovered through.
+	DiscoveredBy string `json:"discoveredBy,omitempty"`
+	// SourceURL is the fullUrl of the Endpoint through which the directory was discovered.
+	SourceURL string `json:"sourceURL,omitempty"`
+	// Depth is the number of discovery steps from the root directory: 0 for root and manually added directories.
+	Depth int `json:"depth"`
+	// Discovers is set if the directory's mCSD Directory Endpoints are registered, which is limited by the maximum discovery depth.
+	Discovers bool `json:"discovers"`
+}
+
+// SkippedDiscovery describes a mCSD Directory Endpoint that wasn't registered to prevent a discovery loop.
+type SkippedDiscovery struct {
+	FHIRBaseURL  string `json:"fhirBaseURL"`
+	DiscoveredBy string `json:"discoveredBy"`
+	SourceURL    string `json:"sourceURL"`
+	// Reason is why the Endpoint was skipped: cycle (it refers to a directory it was discovered through) or query-directory (it refers to our own query directory).
+	Reason string `json:"reason"`
+}
+
+// registerDiscoveryHandlers registers the API for inspecting the discovery graph.
+func (c *Component) registerDiscoveryHandlers(internalMux *http.ServeMux) {
+	internalMux.HandleFunc("GET /mcsd/discovery", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.discoveryGraph())
+	})
+}
+
+// discoveryGraph returns the discovery relationships of the registered administration directories.
+func (c *Component) discoveryGraph() DiscoveryGraph {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	result := DiscoveryGraph{
+		MaxDepth:    c.maxDiscoveryDepth(),
+		Directories: make([]DiscoveryNode, 0, len(c.administrationDirectories)),
+		Skipped:     []SkippedDiscovery{},
+	}
+	for _, directory := range c.administrationDirectories {
+		node := DiscoveryNode{
+			FHIRBaseURL:      directory.fhirBaseURL,
+			AuthoritativeUra: directory.authoritativeUra,
+			Origin:           directory.origin(),
+			SourceURL:        directory.sourceURL,
+			Depth:            len(directory.discoveredThrough),
+			Discovers:        c.discovers(directory),
+		}
+		if len(directory.discoveredThrough) > 0 {
+			node.Root = directory.discoveredThrough[0]
+			node.DiscoveredBy = directory.discoveredThrough[len(directory.discoveredThrough)-1]
+		} else if directory.discover {
+			node.Root = directory.fhirBaseURL
+		}
+		result.Directories = append(result.Directories, node)
+	}
+	for _, skipped := range c.skippedDiscoveries {
+		result.Skipped = append(result.Skipped, skipped...)
+	}
+	slices.SortFunc(result.Skipped, func(a, b SkippedDiscovery) int {
+		return strings.Compare(a.SourceURL, b.SourceURL)
+	})
+	return result
+}
+
+// maxDiscoveryDepth returns the configured maximum discovery depth. Root directories always discover, so it's at least 1.
+func (c *Component) maxDiscoveryDepth() int {
+	return max(c.config.MaxDiscoveryDepth, 1)
+}
+
+// discovers returns whether the mCSD Directory Endpoints of the given directory are registered:
+// root directories always discover, discovered directories only if they're less deep than the maximum discovery depth.
+func (c *Component) discovers(directory administrationDirectory) bool {
+	if directory.discover {
+		return true
+	}
+	depth := len(directory.discoveredThrough)
+	return depth > 0 && depth < c.maxDiscoveryDepth()
+}
+
+// discoveryChain returns the discovery path of directories discovered through the given directory,
+// and whether the directory discovers at all. A directory that isn't registered only discovers if it's a root directory.
+func (c *Component) discoveryChain(fhirBaseURL string, authoritativeUra string, isRoot bool) ([]string, bool) {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	directory := administrationDirectory{fhirBaseURL: fhirBaseURL, discover: isRoot}
+	for _, registered := range c.administrationDirectories {
+		if registered.fhirBaseURL == fhirBaseURL && registered.authoritativeUra == authoritativeUra {
+			directory = registered
+			break
+		}
+	}
+	if !c.discovers(directory) {
+		return nil, false
+	}
+	return append(slices.Clone(directory.discoveredThrough), fhirBaseURL), true
+}
+
+// detectDiscoveryLoop returns why a mCSD Directory Endpoint with the given address must not be registered,
+// when it refers to a directory in its own discovery chain or to our own query directory. It returns an empty string otherwise.
+func (c *Component) detectDiscoveryLoop(address string, chain []string) string {
+	trimmedAddress := strings.TrimRight(address, "/")
+	if queryDirectory := strings.TrimRight(c.config.QueryDirectory.FHIRBaseURL, "/"); queryDirectory != "" && strings.EqualFold(trimmedAddress, queryDirectory) {
+		return discoverySkipQueryDirectory
+	}
+	if slices.ContainsFunc(chain, func(fhirBaseURL string) bool {
+		return strings.EqualFold(strings.TrimRight(fhirBaseURL, "/"), trimmedAddress)
+	}) {
+		return discoverySkipCycle
+	}
+	return ""
+}
+
+// recordSkippedDiscoveries replaces the skipped mCSD Directory Endpoints of the given discovering directory.
+func (c *Component) recordSkippedDiscoveries(directoryKey string, skipped []SkippedDiscovery) {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	if len(skipped) == 0 {
+		delete(c.skippedDiscoveries, directoryKey)
+		return
+	}
+	c.skippedDiscoveries[directoryKey] = skipped
+}
+
+// unregisterDiscoveredThrough removes the directories that were discovered through the given directory,
+// since the Endpoint they were discovered through can't be followed anymore. The caller must hold stateMux.
+func (c *Component) unregisterDiscoveredThrough(ctx context.Context, fhirBaseURL string) {
+	c.administrationDirectories = slices.DeleteFunc(c.administrationDirectories, func(directory administrationDirectory) bool {
+		if !slices.Contains(directory.discoveredThrough, fhirBaseURL) {
+			return false
+		}
+		c.forgetDirectory(ctx, directory)
+		slog.InfoContext(ctx, "Unregistered mCSD Directory discovered through an unregistered directory", logging.FHIRServer(directory.fhirBaseURL), slog.String("discoveredBy", fhirBaseURL))
+		return true
+	})
+}
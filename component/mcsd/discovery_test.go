@@ -0,0 +1,161 @@
+package mcsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestComponent_discoverAndRegisterEndpoints(t *testing.T) {
+	const rootURL = "http://example.com/root/fhir"
+	const orgURL = "http://example.com/org/fhir"
+	const queryURL = "http://example.com/query/fhir"
+	// discoveryInput returns the entries and parent organizations of a directory that lists the given mCSD Directory Endpoints (id -> address)
+	discoveryInput := func(t *testing.T, directoryURL string, addresses map[string]string) ([]fhir.BundleEntry, parentOrganizationMap) {
+		organization := &fhir.Organization{
+			Id:         to.Ptr("org"),
+			Identifier: []fhir.Identifier{{System: to.Ptr(coding.URANamingSystem), Value: to.Ptr("1234")}},
+		}
+		var entries []fhir.BundleEntry
+		for id, address := range addresses {
+			organization.Endpoint = append(organization.Endpoint, fhir.Reference{Reference: to.Ptr("Endpoint/" + id)})
+			resource, err := json.Marshal(fhir.Endpoint{
+				Id:          to.Ptr(id),
+				Status:      fhir.EndpointStatusActive,
+				Address:     address,
+				PayloadType: []fhir.CodeableConcept{{Coding: []fhir.Coding{{System: to.Ptr(coding.MCSDPayloadTypeSystem), Code: to.Ptr(coding.MCSDPayloadTypeDirectoryCode)}}}},
+			})
+			require.NoError(t, err)
+			entries = append(entries, fhir.BundleEntry{FullUrl: to.Ptr(directoryURL + "/Endpoint/" + id), Resource: resource})
+		}
+		return entries, parentOrganizationMap{organization: nil}
+	}
+	newComponent := func(t *testing.T, maxDepth int) *Component {
+		config := DefaultConfig()
+		config.QueryDirectory = DirectoryConfig{FHIRBaseURL: queryURL}
+		config.MaxDiscoveryDepth = maxDepth
+		component, err := New(config)
+		require.NoError(t, err)
+		return component
+	}
+
+	t.Run("records discovery chain", func(t *testing.T) {
+		component := newComponent(t, 1)
+		entries, parentOrganizations := discoveryInput(t, rootURL, map[string]string{"1": orgURL})
+
+		report, skipped := component.discoverAndRegisterEndpoints(t.Context(), entries, parentOrganizations, []string{rootURL}, DirectoryUpdateReport{})
+
+		assert.Empty(t, report.Warnings)
+		assert.Empty(t, skipped)
+		require.Len(t, component.administrationDirectories, 1)
+		assert.Equal(t, []string{rootURL}, component.administrationDirectories[0].discoveredThrough)
+		assert.Equal(t, "1234", component.administrationDirectories[0].authoritativeUra)
+	})
+	t.Run("directory that refers back to a directory in its chain", func(t *testing.T) {
+		component := newComponent(t, 3)
+		entries, parentOrganizations := discoveryInput(t, orgURL, map[string]string{"1": rootURL + "/", "2": orgURL})
+
+		_, skipped := component.discoverAndRegisterEndpoints(t.Context(), entries, parentOrganizations, []string{rootURL, orgURL}, DirectoryUpdateReport{})
+
+		assert.Empty(t, component.administrationDirectories)
+		assert.ElementsMatch(t, []SkippedDiscovery{
+			{FHIRBaseURL: rootURL + "/", DiscoveredBy: orgURL, SourceURL: orgURL + "/Endpoint/1", Reason: discoverySkipCycle},
+			{FHIRBaseURL: orgURL, DiscoveredBy: orgURL, SourceURL: orgURL + "/Endpoint/2", Reason: discoverySkipCycle},
+		}, skipped)
+	})
+	t.Run("directory that refers to our own query directory", func(t *testing.T) {
+		component := newComponent(t, 1)
+		entries, parentOrganizations := discoveryInput(t, rootURL, map[string]string{"1": queryURL})
+
+		_, skipped := component.discoverAndRegisterEndpoints(t.Context(), entries, parentOrganizations, []string{rootURL}, DirectoryUpdateReport{})
+
+		assert.Empty(t, component.administrationDirectories)
+		require.Len(t, skipped, 1)
+		assert.Equal(t, discoverySkipQueryDirectory, skipped[0].Reason)
+	})
+}
+
+func TestComponent_discoveryChain(t *testing.T) {
+	const rootURL = "http://example.com/root/fhir"
+	const orgURL = "http://example.com/org/fhir"
+	const subURL = "http://example.com/sub/fhir"
+	newComponent := func(t *testing.T, maxDepth int) *Component {
+		config := DefaultConfig()
+		config.MaxDiscoveryDepth = maxDepth
+		component, err := New(config)
+		require.NoError(t, err)
+		require.NoError(t, component.registerDirectory(t.Context(), administrationDirectory{fhirBaseURL: rootURL, discover: true}))
+		require.NoError(t, component.registerDirectory(t.Context(), administrationDirectory{fhirBaseURL: orgURL, sourceURL: rootURL + "/Endpoint/1", authoritativeUra: "1", discoveredThrough: []string{rootURL}}))
+		require.NoError(t, component.registerDirectory(t.Context(), administrationDirectory{fhirBaseURL: subURL, sourceURL: orgURL + "/Endpoint/2", authoritativeUra: "2", discoveredThrough: []string{rootURL, orgURL}}))
+		return component
+	}
+
+	t.Run("root directory", func(t *testing.T) {
+		chain, discovers := newComponent(t, 1).discoveryChain(rootURL, "", true)
+
+		assert.True(t, discovers)
+		assert.Equal(t, []string{rootURL}, chain)
+	})
+	t.Run("discovered directory at maximum depth", func(t *testing.T) {
+		_, discovers := newComponent(t, 1).discoveryChain(orgURL, "1", false)
+
+		assert.False(t, discovers)
+	})
+	t.Run("discovered directory below maximum depth", func(t *testing.T) {
+		component := newComponent(t, 2)
+
+		chain, discovers := component.discoveryChain(orgURL, "1", false)
+		assert.True(t, discovers)
+		assert.Equal(t, []string{rootURL, orgURL}, chain)
+
+		_, discovers = component.discoveryChain(subURL, "2", false)
+		assert.False(t, discovers)
+	})
+	t.Run("unregistering a directory unregisters the directories discovered through it", func(t *testing.T) {
+		component := newComponent(t, 2)
+
+		component.unregisterAdministrationDirectory(t.Context(), rootURL+"/Endpoint/1")
+
+		require.Len(t, component.administrationDirectories, 1)
+		assert.Equal(t, rootURL, component.administrationDirectories[0].fhirBaseURL)
+	})
+	t.Run("HTTP API", func(t *testing.T) {
+		component := newComponent(t, 2)
+		component.recordSkippedDiscoveries(makeDirectoryKey(subURL, "2"), []SkippedDiscovery{
+			{FHIRBaseURL: rootURL, DiscoveredBy: subURL, SourceURL: subURL + "/Endpoint/3", Reason: discoverySkipCycle},
+		})
+		mux := http.NewServeMux()
+		component.registerDiscoveryHandlers(mux)
+
+		httpResponse := httptest.NewRecorder()
+		mux.ServeHTTP(httpResponse, httptest.NewRequest(http.MethodGet, "/mcsd/discovery", nil))
+
+		require.Equal(t, http.StatusOK, httpResponse.Code)
+		var graph DiscoveryGraph
+		require.NoError(t, json.Unmarshal(httpResponse.Body.Bytes(), &graph))
+		assert.Equal(t, 2, graph.MaxDepth)
+		assert.Equal(t, []DiscoveryNode{
+			{FHIRBaseURL: rootURL, Origin: originConfigured, Root: rootURL, Discovers: true},
+			{FHIRBaseURL: orgURL, AuthoritativeUra: "1", Origin: originDiscovered, Root: rootURL, DiscoveredBy: rootURL, SourceURL: rootURL + "/Endpoint/1", Depth: 1, Discovers: true},
+			{FHIRBaseURL: subURL, AuthoritativeUra: "2", Origin: originDiscovered, Root: rootURL, DiscoveredBy: orgURL, SourceURL: orgURL + "/Endpoint/2", Depth: 2},
+		}, graph.Directories)
+		require.Len(t, graph.Skipped, 1)
+		assert.Equal(t, discoverySkipCycle, graph.Skipped[0].Reason)
+	})
+}
+
+func TestNew_maxDiscoveryDepth(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxDiscoveryDepth = -1
+
+	_, err := New(config)
+
+	assert.EqualError(t, err, "mcsd.maxdiscoverydepth must not be negative (value=-1)")
+}
@@ -0,0 +1,106 @@
+# The built-in rules for resources from mCSD Administration Directories, which protect against spoofing
+# (see https://nuts-foundation.github.io/nl-generic-functions-ig/care-services.html#update-client).
+# reasons holds the rules the resource violates. Update policies can extend the rules through data.mcsd.builtin.reasons.
+package mcsd.builtin
+
+import rego.v1
+
+ura_system := "http://fhir.nl/fhir/NamingSystem/ura"
+
+resource := input.resource
+
+# run is the data of the directory the resource comes from, which is derived once for all resources of a sync:
+# the ids of its (authoritative) Organizations, the URAs of the authoritative ones, the ids of the Organizations
+# every Organization is part of, and the ids of the Endpoints they or their HealthcareServices refer to.
+run := data.mcsd.runs[input.run]
+
+ura_identifiers(organization) := [identifier |
+	some identifier in object.get(organization, "identifier", [])
+	identifier.system == ura_system
+]
+
+# reference_id returns the id of the resource the given Reference refers to, e.g. "123" for "Organization/123".
+reference_id(reference) := id if {
+	parts := split(object.get(reference, "reference", ""), "/")
+	id := parts[count(parts) - 1]
+}
+
+references_organization(reference) if run.organizationIds[reference_id(reference)]
+
+# Organizations must have the URA of an authoritative Organization, or be part of one.
+reasons contains sprintf("organization can't have multiple identifiers with system %s", [ura_system]) if {
+	resource.resourceType == "Organization"
+	count(ura_identifiers(resource)) > 1
+}
+
+reasons contains "organization has a URA identifier with no value" if {
+	resource.resourceType == "Organization"
+	identifiers := ura_identifiers(resource)
+	count(identifiers) == 1
+	not identifiers[0].value
+}
+
+reasons contains "organization's URA identifier must match one of the authoritative parent organizations" if {
+	resource.resourceType == "Organization"
+	identifiers := ura_identifiers(resource)
+	count(identifiers) == 1
+	ura := identifiers[0].value
+	not run.authoritativeUras[ura]
+}
+
+reasons contains sprintf("organization must have an identifier with system %s or refer to another organization through 'partOf'", [ura_system]) if {
+	resource.resourceType == "Organization"
+	count(ura_identifiers(resource)) == 0
+	not resource.partOf
+}
+
+reasons contains sprintf("organization's partOf reference could not be validated (organization %s not found within authoritative organizations)", [reference_id(resource.partOf)]) if {
+	resource.resourceType == "Organization"
+	count(ura_identifiers(resource)) == 0
+	resource.partOf
+	not run.organizationIds[reference_id(resource.partOf)]
+}
+
+reasons contains "reached end of partOf chain without finding an authoritative organization" if {
+	resource.resourceType == "Organization"
+	count(ura_identifiers(resource)) == 0
+	run.organizationIds[reference_id(resource.partOf)]
+	not part_of_authoritative_organization
+}
+
+part_of_authoritative_organization if {
+	some id in graph.reachable(run.partOf, {reference_id(resource.partOf)})
+	run.authoritativeOrganizationIds[id]
+}
+
+# Locations, PractitionerRoles and HealthcareServices must refer to one of the directory's Organizations.
+organization_reference := {
+	"Location": "managingOrganization",
+	"PractitionerRole": "organization",
+	"HealthcareService": "providedBy",
+}
+
+reasons contains sprintf("%s must have a '%s' referencing an Organization", [resource.resourceType, field]) if {
+	field := organization_reference[resource.resourceType]
+	not resource[field]
+}
+
+reasons contains sprintf("%s.%s must reference a valid organization (got %s)", [resource.resourceType, field, reference_id(resource[field])]) if {
+	field := organization_reference[resource.resourceType]
+	resource[field]
+	not references_organization(resource[field])
+}
+
+# Endpoints must be referenced by one of the directory's Organizations, or by a HealthcareService of one of them.
+reasons contains "endpoint must have an ID" if {
+	resource.resourceType == "Endpoint"
+	not resource.id
+}
+
+reasons contains sprintf("endpoint must be referenced in at least one organization's or valid healthcare service's endpoint field (endpoint ID: %s)", [resource.id]) if {
+	resource.resourceType == "Endpoint"
+	resource.id
+	not endpoint_referenced
+}
+
+endpoint_referenced if run.referencedEndpointIds[resource.id]
@@ -0,0 +1,257 @@
+package mcsd
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/opa"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/to"
+	"github.com/open-policy-agent/opa/v1/loader"
+	"github.com/open-policy-agent/opa/v1/sdk"
+	"github.com/open-policy-agent/opa/v1/storage"
+	"github.com/open-policy-agent/opa/v1/storage/inmem"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// updatePolicyPath is the decision evaluated by update policies: the policy must be in package mcsd.update.
+const updatePolicyPath = "/mcsd/update"
+
+// policyRunsPath is where the data of the directories that are being validated is stored, by run (see preparePolicy).
+var policyRunsPath = storage.MustParsePath("/mcsd/runs")
+
+// policies holds the built-in rules (package mcsd.builtin), which are loaded along with every update policy.
+//
+//go:embed policies/*.rego
+var policies embed.FS
+
+// UpdatePolicy is an Open Policy Agent (Rego) policy that decides whether a resource from a mCSD Administration Directory
+// may be imported into the query directory. It's evaluated by the same embedded Open Policy Agent as the PDP's policies.
+type UpdatePolicy struct {
+	service *sdk.OPA
+	store   storage.Store
+}
+
+// PolicySource describes the administration directory a validated resource comes from.
+type PolicySource struct {
+	FHIRBaseURL      string `json:"fhirBaseURL"`
+	AuthoritativeUra string `json:"authoritativeUra"`
+	Discover         bool   `json:"discover"`
+}
+
+// UpdatePolicyInput is the input of an UpdatePolicy.
+type UpdatePolicyInput struct {
+	// Resource is the resource that is created or updated.
+	Resource map[string]any `json:"resource"`
+	// Directory is the administration directory the resource comes from.
+	Directory PolicySource `json:"directory"`
+	// Run identifies the data of the directory (data.mcsd.runs[run]) the built-in rules use.
+	Run string `json:"run"`
+}
+
+// UpdatePolicyDecision is the outcome of validating a resource. Reasons explain why it was rejected.
+type UpdatePolicyDecision struct {
+	Allow   bool     `json:"allow"`
+	Reasons []string `json:"reasons"`
+}
+
+// policyRunData is the data of the directory the built-in rules look up resources' references in.
+// It's derived once per run, instead of passing the directory's Organizations and HealthcareServices with every resource.
+type policyRunData struct {
+	// OrganizationIDs are the IDs of the authoritative Organizations and the Organizations that are part of them.
+	OrganizationIDs map[string]bool `json:"organizationIds"`
+	// AuthoritativeOrganizationIDs are the IDs of the Organizations that have a URA identifier.
+	AuthoritativeOrganizationIDs map[string]bool `json:"authoritativeOrganizationIds"`
+	// AuthoritativeURAs are the URAs of the authoritative Organizations.
+	AuthoritativeURAs map[string]bool `json:"authoritativeUras"`
+	// PartOf maps the ID of every Organization to the IDs of the Organizations it's part of (the edges of a graph.reachable graph).
+	PartOf map[string][]string `json:"partOf"`
+	// ReferencedEndpointIDs are the IDs of the Endpoints the Organizations refer to,
+	// and those of the HealthcareServices that are provided by one of them.
+	ReferencedEndpointIDs map[string]bool `json:"referencedEndpointIds"`
+}
+
+func newPolicyRunData(parentOrganizationMap map[*fhir.Organization][]*fhir.Organization, allHealthcareServices []fhir.HealthcareService) policyRunData {
+	result := policyRunData{
+		OrganizationIDs:              map[string]bool{},
+		AuthoritativeOrganizationIDs: map[string]bool{},
+		AuthoritativeURAs:            map[string]bool{},
+		PartOf:                       map[string][]string{},
+		ReferencedEndpointIDs:        map[string]bool{},
+	}
+	addOrganization := func(organization *fhir.Organization) {
+		if organization == nil {
+			return
+		}
+		for _, endpoint := range organization.Endpoint {
+			result.ReferencedEndpointIDs[referenceID(endpoint)] = true
+		}
+		if organization.Id == nil || *organization.Id == "" {
+			return
+		}
+		id := *organization.Id
+		result.OrganizationIDs[id] = true
+		if len(fhirutil.FilterIdentifiersBySystem(organization.Identifier, coding.URANamingSystem)) > 0 {
+			result.AuthoritativeOrganizationIDs[id] = true
+		}
+		// Every Organization needs an entry, even if it isn't part of another, for graph.reachable to visit it.
+		if result.PartOf[id] == nil {
+			result.PartOf[id] = []string{}
+		}
+		if organization.PartOf != nil {
+			result.PartOf[id] = append(result.PartOf[id], referenceID(*organization.PartOf))
+		}
+	}
+	for parentOrganization, organizations := range parentOrganizationMap {
+		addOrganization(parentOrganization)
+		for _, organization := range organizations {
+			addOrganization(organization)
+		}
+		if parentOrganization == nil {
+			continue
+		}
+		for _, identifier := range fhirutil.FilterIdentifiersBySystem(parentOrganization.Identifier, coding.URANamingSystem) {
+			if identifier.Value != nil {
+				result.AuthoritativeURAs[*identifier.Value] = true
+			}
+		}
+	}
+	for _, healthcareService := range allHealthcareServices {
+		if healthcareService.ProvidedBy == nil || !result.OrganizationIDs[referenceID(*healthcareService.ProvidedBy)] {
+			continue
+		}
+		for _, endpoint := range healthcareService.Endpoint {
+			result.ReferencedEndpointIDs[referenceID(endpoint)] = true
+		}
+	}
+	return result
+}
+
+// referenceID returns the ID of the resource the given Reference refers to, e.g. "123" for "Organization/123".
+func referenceID(reference fhir.Reference) string {
+	if reference.Reference == nil {
+		return ""
+	}
+	parts := strings.Split(*reference.Reference, "/")
+	return parts[len(parts)-1]
+}
+
+// LoadUpdatePolicy loads an update policy from the given Rego file, or directory of Rego (and data) files.
+// The policy must define package mcsd.update with an allow rule, and optionally a reasons rule (a set or array of strings)
+// explaining why a resource is rejected. The built-in rules (package mcsd.builtin) are loaded along with it,
+// so it can extend them instead of reimplementing them.
+func LoadUpdatePolicy(ctx context.Context, path string) (*UpdatePolicy, error) {
+	files, err := loader.NewFileLoader().WithFS(policies).All([]string{"policies/builtin.rego"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load built-in mCSD update rules: %w", err)
+	}
+	policyFiles, err := loader.NewFileLoader().Filtered([]string{path}, func(_ string, info fs.FileInfo, _ int) bool {
+		return !info.IsDir() && strings.HasSuffix(info.Name(), "_test.rego")
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load mCSD update policy (path=%s): %w", path, err)
+	}
+	files.Documents = policyFiles.Documents
+	for name, module := range policyFiles.Modules {
+		files.Modules[name] = module
+	}
+	store := inmem.New()
+	service, err := opa.NewService(ctx, "knooppunt-mcsd-update", map[string]any{}, files, store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load mCSD update policy (path=%s): %w", path, err)
+	}
+	return &UpdatePolicy{service: service, store: store}, nil
+}
+
+// Evaluate evaluates the policy for the given input.
+func (p *UpdatePolicy) Evaluate(ctx context.Context, input UpdatePolicyInput) (*UpdatePolicyDecision, error) {
+	allow, resultMap, err := opa.Decide(ctx, p.service, updatePolicyPath, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate mCSD update policy: %w", err)
+	}
+	result := UpdatePolicyDecision{Allow: allow}
+	if reasons, ok := resultMap["reasons"].([]any); ok {
+		for _, reason := range reasons {
+			if s, ok := reason.(string); ok {
+				result.Reasons = append(result.Reasons, s)
+			} else {
+				result.Reasons = append(result.Reasons, fmt.Sprintf("%v", reason))
+			}
+		}
+	}
+	return &result, nil
+}
+
+// Stop stops the Open Policy Agent instance that evaluates the policy.
+func (p *UpdatePolicy) Stop(ctx context.Context) {
+	p.service.Stop(ctx)
+}
+
+// preparePolicy stores the data of the directory that the built-in rules of the Policy use, so it's derived and passed to
+// Open Policy Agent once for all resources of a run, rather than for every resource. It returns the rules to validate the run's
+// resources with, and a function that removes the data when the run is done. Without a Policy, there's nothing to prepare.
+func (r ValidationRules) preparePolicy(ctx context.Context, parentOrganizationMap map[*fhir.Organization][]*fhir.Organization, allHealthcareServices []fhir.HealthcareService) (ValidationRules, func(), error) {
+	if r.Policy == nil {
+		return r, func() {}, nil
+	}
+	data, err := to.JSONMap(newPolicyRunData(parentOrganizationMap, allHealthcareServices))
+	if err != nil {
+		return r, nil, fmt.Errorf("failed to convert update policy data to map: %w", err)
+	}
+	store := r.Policy.store
+	r.policyRun = uuid.NewString()
+	path := append(slices.Clone(policyRunsPath), r.policyRun)
+	err = storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+		if err := storage.MakeDir(ctx, store, txn, policyRunsPath); err != nil {
+			return err
+		}
+		return store.Write(ctx, txn, storage.AddOp, path, data)
+	})
+	if err != nil {
+		return r, nil, fmt.Errorf("failed to store update policy data: %w", err)
+	}
+	return r, func() {
+		// Use a context that isn't cancelled with the run, so its data is always removed.
+		if err := storage.WriteOne(context.WithoutCancel(ctx), store, storage.RemoveOp, path, nil); err != nil {
+			slog.WarnContext(ctx, "Failed to remove update policy data", slog.String("run", r.policyRun), logging.Error(err))
+		}
+	}, nil
+}
+
+// validateWithPolicy validates a resource using the update policy of the given rules.
+// A rejection is returned as error, of which the message holds the policy's reasons.
+func validateWithPolicy(ctx context.Context, rules ValidationRules, resourceAsMap map[string]any, parentOrganizationMap map[*fhir.Organization][]*fhir.Organization, allHealthcareServices []fhir.HealthcareService) error {
+	if rules.policyRun == "" {
+		// Not validated as part of a run (see preparePolicy), so the data is only used for this resource.
+		var release func()
+		var err error
+		if rules, release, err = rules.preparePolicy(ctx, parentOrganizationMap, allHealthcareServices); err != nil {
+			return err
+		}
+		defer release()
+	}
+	decision, err := rules.Policy.Evaluate(ctx, UpdatePolicyInput{
+		Resource:  resourceAsMap,
+		Directory: rules.Source,
+		Run:       rules.policyRun,
+	})
+	if err != nil {
+		return err
+	}
+	if decision.Allow {
+		return nil
+	}
+	if len(decision.Reasons) == 0 {
+		return errors.New("rejected by update policy")
+	}
+	return fmt.Errorf("rejected by update policy: %s", strings.Join(decision.Reasons, "; "))
+}
@@ -0,0 +1,123 @@
+package mcsd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/open-policy-agent/opa/v1/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestUpdatePolicy(t *testing.T) {
+	policy, err := LoadUpdatePolicy(t.Context(), "test/update_policy.rego")
+	require.NoError(t, err)
+	parentOrganization := &fhir.Organization{
+		Id:         to.Ptr("org"),
+		Identifier: []fhir.Identifier{{System: to.Ptr("http://fhir.nl/fhir/NamingSystem/ura"), Value: to.Ptr("1234")}},
+		Endpoint:   []fhir.Reference{{Reference: to.Ptr("Endpoint/endpoint")}},
+	}
+	parentOrganizationMap := parentOrganizationMap{parentOrganization: nil}
+	rules := ValidationRules{
+		AllowedResourceTypes: defaultDirectoryResourceTypes,
+		Policy:               policy,
+		Source:               PolicySource{FHIRBaseURL: "http://example.com/fhir", AuthoritativeUra: "1234"},
+	}
+	validate := func(t *testing.T, rules ValidationRules, resource any) error {
+		resourceJSON, err := json.Marshal(resource)
+		require.NoError(t, err)
+		return ValidateUpdate(t.Context(), rules, resourceJSON, parentOrganizationMap, nil)
+	}
+	endpoint := func(connectionType string) fhir.Endpoint {
+		return fhir.Endpoint{
+			Id:             to.Ptr("endpoint"),
+			Address:        "https://example.com/fhir",
+			ConnectionType: fhir.Coding{Code: to.Ptr(connectionType)},
+		}
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		assert.NoError(t, validate(t, rules, endpoint("hl7-fhir-rest")))
+		assert.NoError(t, validate(t, rules, *parentOrganization))
+	})
+	t.Run("rejected by policy", func(t *testing.T) {
+		err := validate(t, rules, endpoint("direct-project"))
+		assert.EqualError(t, err, "rejected by update policy: Endpoint.connectionType must be hl7-fhir-rest")
+		assert.NoError(t, validate(t, ValidationRules{AllowedResourceTypes: defaultDirectoryResourceTypes}, endpoint("direct-project")),
+			"built-in rules should accept the Endpoint")
+	})
+	t.Run("policy gets the directory", func(t *testing.T) {
+		rules := rules
+		rules.Source.AuthoritativeUra = ""
+		err := validate(t, rules, *parentOrganization)
+		assert.EqualError(t, err, "rejected by update policy: Organization must be from an authoritative directory")
+	})
+	t.Run("rejected by built-in rules", func(t *testing.T) {
+		unreferenced := endpoint("hl7-fhir-rest")
+		unreferenced.Id = to.Ptr("other")
+		err := validate(t, rules, unreferenced)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "rejected by update policy: endpoint must be referenced in at least one organization's")
+	})
+	t.Run("resource type not allowed", func(t *testing.T) {
+		rules := rules
+		rules.AllowedResourceTypes = []string{"Organization"}
+		assert.EqualError(t, validate(t, rules, endpoint("hl7-fhir-rest")), "resource type Endpoint not allowed")
+	})
+	t.Run("prepared run", func(t *testing.T) {
+		department := &fhir.Organization{
+			Id:     to.Ptr("department"),
+			PartOf: &fhir.Reference{Reference: to.Ptr("Organization/org")},
+		}
+		organizations := map[*fhir.Organization][]*fhir.Organization{parentOrganization: {department}}
+		healthcareServices := []fhir.HealthcareService{{
+			ProvidedBy: &fhir.Reference{Reference: to.Ptr("Organization/department")},
+			Endpoint:   []fhir.Reference{{Reference: to.Ptr("Endpoint/hcs-endpoint")}},
+		}}
+		rules, release, err := rules.preparePolicy(t.Context(), organizations, healthcareServices)
+		require.NoError(t, err)
+		validate := func(resource any) error {
+			resourceJSON, err := json.Marshal(resource)
+			require.NoError(t, err)
+			return ValidateUpdate(t.Context(), rules, resourceJSON, organizations, healthcareServices)
+		}
+		hcsEndpoint := endpoint("hl7-fhir-rest")
+		hcsEndpoint.Id = to.Ptr("hcs-endpoint")
+		location := fhir.Location{ManagingOrganization: &fhir.Reference{Reference: to.Ptr("Organization/department")}}
+		unknownLocation := fhir.Location{ManagingOrganization: &fhir.Reference{Reference: to.Ptr("Organization/unknown")}}
+
+		assert.NoError(t, validate(*department))
+		assert.NoError(t, validate(hcsEndpoint))
+		assert.NoError(t, validate(location))
+		assert.EqualError(t, validate(unknownLocation), "rejected by update policy: Location.managingOrganization must reference a valid organization (got unknown)")
+
+		release()
+		_, err = storage.ReadOne(t.Context(), policy.store, append(slices.Clone(policyRunsPath), rules.policyRun))
+		assert.True(t, storage.IsNotFound(err), "data of the run should be removed")
+	})
+	t.Run("policy without package mcsd.update", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "other.rego")
+		require.NoError(t, os.WriteFile(path, []byte("package other\n\nallow := true\n"), 0o600))
+		policy, err := LoadUpdatePolicy(t.Context(), path)
+		require.NoError(t, err)
+		defer policy.Stop(t.Context())
+		rules := rules
+		rules.Policy = policy
+
+		assert.ErrorContains(t, validate(t, rules, endpoint("hl7-fhir-rest")), "failed to evaluate mCSD update policy")
+	})
+	t.Run("invalid policy", func(t *testing.T) {
+		_, err := LoadUpdatePolicy(t.Context(), filepath.Join(t.TempDir(), "missing.rego"))
+		assert.ErrorContains(t, err, "failed to load mCSD update policy")
+
+		config := DefaultConfig()
+		config.Validation.Policy = filepath.Join(t.TempDir(), "missing.rego")
+		_, err = New(config)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,191 @@
+package mcsd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// pendingPurge is an unregistered administration directory of which the resources still need to be removed from the query directory.
+type pendingPurge struct {
+	FHIRBaseURL   string   `json:"fhirBaseURL"`
+	ResourceTypes []string `json:"resourceTypes"`
+}
+
+// schedulePurge records that the resources imported from the given (unregistered) administration directory must be removed
+// from the query directory. The purge is done by the next update, so it's retried when it fails.
+// Directories with the same FHIR base URL share their resources, so their purges are merged.
+func (c *Component) schedulePurge(ctx context.Context, directory administrationDirectory) {
+	fhirBaseURL := strings.TrimRight(directory.fhirBaseURL, "/")
+	var purge pendingPurge
+	if _, err := c.stateStore.Get(purgeBucket, fhirBaseURL, &purge); err != nil {
+		slog.WarnContext(ctx, "Failed to read scheduled purge of mCSD Directory, overwriting it", logging.FHIRServer(fhirBaseURL), logging.Error(err))
+	}
+	purge.FHIRBaseURL = fhirBaseURL
+	for _, resourceType := range directory.resourceTypes {
+		if !slices.Contains(purge.ResourceTypes, resourceType) {
+			purge.ResourceTypes = append(purge.ResourceTypes, resourceType)
+		}
+	}
+	if err := c.stateStore.Put(purgeBucket, fhirBaseURL, purge); err != nil {
+		slog.ErrorContext(ctx, "Failed to schedule purge of mCSD Directory resources", logging.FHIRServer(fhirBaseURL), logging.Error(err))
+	}
+}
+
+// purgeDirectories removes the resources of unregistered administration directories from the query directory,
+// and adds a report per purged directory (keyed by its FHIR base URL) to the given UpdateReport.
+// A directory isn't purged when another directory with the same FHIR base URL is (still or again) registered,
+// since that directory owns the same resources. Failed purges are retried by the next update.
+func (c *Component) purgeDirectories(ctx context.Context, result UpdateReport) {
+	var purges []pendingPurge
+	err := c.stateStore.Walk(purgeBucket, func(key string, value []byte) error {
+		var purge pendingPurge
+		if err := json.Unmarshal(value, &purge); err != nil {
+			slog.WarnContext(ctx, "Invalid scheduled purge of mCSD Directory, removing it", slog.String("directory", key), logging.Error(err))
+			return c.stateStore.Delete(purgeBucket, key)
+		}
+		purges = append(purges, purge)
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read scheduled purges of mCSD Directories", logging.Error(err))
+		return
+	}
+	for _, purge := range purges {
+		if c.isRegisteredBaseURL(purge.FHIRBaseURL) {
+			slog.InfoContext(ctx, "Not purging resources of unregistered mCSD Directory: FHIR base URL is registered by another directory", logging.FHIRServer(purge.FHIRBaseURL))
+		} else {
+			report := c.purgeDirectory(ctx, purge)
+			result[purge.FHIRBaseURL] = report
+			if len(report.Errors) > 0 {
+				continue
+			}
+		}
+		if err := c.stateStore.Delete(purgeBucket, purge.FHIRBaseURL); err != nil {
+			slog.ErrorContext(ctx, "Failed to remove scheduled purge of mCSD Directory", logging.FHIRServer(purge.FHIRBaseURL), logging.Error(err))
+		}
+	}
+}
+
+// purgeDirectory removes the resources imported from the given directory from the query directory.
+// They're found by searching for meta.source values below the directory's FHIR base URL, and deleted with conditional deletes on _source.
+// Resources that fall under the FHIR base URL of a registered directory (e.g. https://example.com/fhir/tenant when purging
+// https://example.com/fhir) are kept.
+func (c *Component) purgeDirectory(ctx context.Context, purge pendingPurge) DirectoryUpdateReport {
+	report := DirectoryUpdateReport{Purged: true}
+	start := time.Now()
+	slog.InfoContext(ctx, "Purging resources of unregistered mCSD Directory from query directory", logging.FHIRServer(purge.FHIRBaseURL), slog.Any("resourceTypes", purge.ResourceTypes))
+	for _, resourceType := range purge.ResourceTypes {
+		sources, err := c.findSourcesBelow(ctx, resourceType, purge.FHIRBaseURL)
+		if err != nil {
+			report.fail(libfhir.ReportCodeUpdateFailed, err)
+			continue
+		}
+		for chunk := range slices.Chunk(sources, c.config.TransactionSize) {
+			tx := conditionalDeleteTransaction(resourceType, chunk)
+			var txResult fhir.Bundle
+			if err := c.applyToQueryDirectory(ctx, tx, &txResult); err != nil {
+				report.fail(libfhir.ReportCodeUpdateFailed, fmt.Errorf("failed to purge %s resources from query directory: %w", resourceType, err))
+				break
+			}
+			for range chunk {
+				report.count(resourceType, libfhir.ChangeDelete)
+			}
+		}
+	}
+	report.DurationMs = time.Since(start).Milliseconds()
+	slog.InfoContext(ctx, "Purged resources of unregistered mCSD Directory from query directory", logging.FHIRServer(purge.FHIRBaseURL), slog.Int("deleted", report.CountDeleted), slog.Int("errors", len(report.Errors)))
+	return report.finalized()
+}
+
+// findSourcesBelow returns the meta.source values of the resources of the given type in the query directory
+// that were imported from the given FHIR base URL. Resources of registered directories with a FHIR base URL below the given one
+// (e.g. https://example.com/fhir/tenant for https://example.com/fhir) are excluded.
+func (c *Component) findSourcesBelow(ctx context.Context, resourceType string, fhirBaseURL string) ([]string, error) {
+	prefix := fhirBaseURL + "/"
+	params := url.Values{
+		"_source:below": []string{fhirBaseURL},
+		"_count":        []string{strconv.Itoa(searchPageSize)},
+	}
+	var searchSet fhir.Bundle
+	if err := c.fhirQueryClient.SearchWithContext(ctx, resourceType, params, &searchSet); err != nil {
+		return nil, fmt.Errorf("failed to search imported %s resources in query directory: %w", resourceType, err)
+	}
+	var result []string
+	err := fhirclient.Paginate(ctx, c.fhirQueryClient, searchSet, func(searchSet *fhir.Bundle) (bool, error) {
+		for _, entry := range searchSet.Entry {
+			var resource struct {
+				Meta *fhir.Meta `json:"meta"`
+			}
+			if entry.Resource == nil || json.Unmarshal(entry.Resource, &resource) != nil || resource.Meta == nil || resource.Meta.Source == nil {
+				continue
+			}
+			source := *resource.Meta.Source
+			// Don't rely on the FHIR server supporting the :below modifier: never delete resources from other sources
+			if !strings.HasPrefix(source, prefix) || c.isSourceOfDirectoryBelow(source, fhirBaseURL) {
+				continue
+			}
+			result = append(result, source)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search imported %s resources in query directory: %w", resourceType, err)
+	}
+	slices.Sort(result)
+	return slices.Compact(result), nil
+}
+
+// isRegisteredBaseURL returns whether an administration directory with the given FHIR base URL (ignoring trailing slashes) is registered.
+func (c *Component) isRegisteredBaseURL(fhirBaseURL string) bool {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	return slices.ContainsFunc(c.administrationDirectories, func(directory administrationDirectory) bool {
+		return strings.TrimRight(directory.fhirBaseURL, "/") == fhirBaseURL
+	})
+}
+
+// isSourceOfRegisteredDirectory returns whether the given meta.source falls under the FHIR base URL of a registered administration directory.
+func (c *Component) isSourceOfRegisteredDirectory(source string) bool {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	return slices.ContainsFunc(c.administrationDirectories, func(directory administrationDirectory) bool {
+		return strings.HasPrefix(source, strings.TrimRight(directory.fhirBaseURL, "/")+"/")
+	})
+}
+
+// isSourceOfDirectoryBelow returns whether the given meta.source falls under the FHIR base URL of a registered administration directory,
+// of which the FHIR base URL is below the given one.
+func (c *Component) isSourceOfDirectoryBelow(source string, fhirBaseURL string) bool {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	return slices.ContainsFunc(c.administrationDirectories, func(directory administrationDirectory) bool {
+		directoryBaseURL := strings.TrimRight(directory.fhirBaseURL, "/")
+		return strings.HasPrefix(directoryBaseURL, fhirBaseURL+"/") && strings.HasPrefix(source, directoryBaseURL+"/")
+	})
+}
+
+// conditionalDeleteTransaction builds a transaction that deletes the resources of the given type with the given meta.source values.
+func conditionalDeleteTransaction(resourceType string, sources []string) fhir.Bundle {
+	tx := fhir.Bundle{Type: fhir.BundleTypeTransaction}
+	for _, source := range sources {
+		tx.Entry = append(tx.Entry, fhir.BundleEntry{
+			Request: &fhir.BundleEntryRequest{
+				Method: fhir.HTTPVerbDELETE,
+				Url:    resourceType + "?" + url.Values{"_source": []string{source}}.Encode(),
+			},
+		})
+	}
+	return tx
+}
@@ -0,0 +1,123 @@
+package mcsd
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestComponent_purgeDirectories(t *testing.T) {
+	const directoryURL = "http://example.com/org/fhir"
+	organization := func(id string, source string) fhir.Organization {
+		return fhir.Organization{Id: to.Ptr(id), Meta: &fhir.Meta{Source: to.Ptr(source)}}
+	}
+	newComponent := func(t *testing.T, stateFile string) (*Component, *test.StubFHIRClient) {
+		config := DefaultConfig()
+		config.StateFile = stateFile
+		component, err := New(config)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = component.stateStore.Close()
+		})
+		queryClient := &test.StubFHIRClient{
+			Resources: []any{
+				organization("1", directoryURL+"/Organization/1"),
+				organization("2", directoryURL+"/Organization/2"),
+				organization("3", "http://example.com/other/fhir/Organization/1"),
+				organization("4", "http://example.com/org/fhir-test/Organization/1"),
+				organization("5", directoryURL+"/tenant/Organization/1"),
+			},
+		}
+		component.fhirQueryClient = queryClient
+		return component, queryClient
+	}
+	remainingIDs := func(client *test.StubFHIRClient) []string {
+		var result []string
+		for _, resource := range client.Resources {
+			result = append(result, *resource.(fhir.Organization).Id)
+		}
+		return result
+	}
+
+	t.Run("removes resources of unregistered directory", func(t *testing.T) {
+		component, queryClient := newComponent(t, "")
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), directoryURL, []string{"Organization", "Endpoint"}, false, "http://example.com/root/fhir/Endpoint/1", "1234"))
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), directoryURL+"/tenant", []string{"Organization"}, false, "http://example.com/root/fhir/Endpoint/2", "5678"))
+		component.unregisterAdministrationDirectory(t.Context(), "http://example.com/root/fhir/Endpoint/1")
+
+		result := make(UpdateReport)
+		component.purgeDirectories(t.Context(), result)
+
+		report := result[directoryURL]
+		assert.True(t, report.Purged)
+		assert.Equal(t, 2, report.CountDeleted)
+		assert.Empty(t, report.Errors)
+		// Resources of other sources, including registered directory below the purged one, are kept
+		assert.Equal(t, []string{"3", "4", "5"}, remainingIDs(queryClient))
+		assert.Contains(t, queryClient.Searches, "Endpoint?_count=100&_source%3Abelow=http%3A%2F%2Fexample.com%2Forg%2Ffhir")
+
+		t.Run("purge is done once", func(t *testing.T) {
+			result := make(UpdateReport)
+			component.purgeDirectories(t.Context(), result)
+			assert.Empty(t, result)
+		})
+	})
+	t.Run("directory with the same FHIR base URL is still registered", func(t *testing.T) {
+		component, queryClient := newComponent(t, "")
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), directoryURL, []string{"Organization"}, false, "http://example.com/root/fhir/Endpoint/1", "1234"))
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), directoryURL, []string{"Organization"}, false, "http://example.com/root/fhir/Endpoint/2", "5678"))
+		component.unregisterAdministrationDirectory(t.Context(), "http://example.com/root/fhir/Endpoint/1")
+
+		result := make(UpdateReport)
+		component.purgeDirectories(t.Context(), result)
+
+		assert.Empty(t, result)
+		assert.Len(t, queryClient.Resources, 5)
+		found, err := component.stateStore.Get(purgeBucket, directoryURL, &pendingPurge{})
+		require.NoError(t, err)
+		assert.False(t, found, "purge should be discarded")
+	})
+	t.Run("failed purge is retried", func(t *testing.T) {
+		component, queryClient := newComponent(t, "")
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), directoryURL, []string{"Organization"}, false, "http://example.com/root/fhir/Endpoint/1", "1234"))
+		component.unregisterAdministrationDirectory(t.Context(), "http://example.com/root/fhir/Endpoint/1")
+		queryClient.Error = assert.AnError
+
+		result := make(UpdateReport)
+		component.purgeDirectories(t.Context(), result)
+		require.Len(t, result[directoryURL].Errors, 1)
+
+		queryClient.Error = nil
+		result = make(UpdateReport)
+		component.purgeDirectories(t.Context(), result)
+		assert.Equal(t, 3, result[directoryURL].CountDeleted)
+		assert.Equal(t, []string{"3", "4"}, remainingIDs(queryClient))
+	})
+	t.Run("discovered directory that is excluded after restart", func(t *testing.T) {
+		stateFile := filepath.Join(t.TempDir(), "state.db")
+		component, _ := newComponent(t, stateFile)
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), directoryURL, []string{"Organization"}, false, "http://example.com/root/fhir/Endpoint/1", "1234"))
+		require.NoError(t, component.stateStore.Close())
+
+		config := DefaultConfig()
+		config.StateFile = stateFile
+		config.ExcludeAdminDirectories = []string{directoryURL}
+		component, err := New(config)
+		require.NoError(t, err)
+		defer component.stateStore.Close()
+		queryClient := &test.StubFHIRClient{Resources: []any{organization("1", directoryURL+"/Organization/1")}}
+		component.fhirQueryClient = queryClient
+
+		result := make(UpdateReport)
+		component.purgeDirectories(t.Context(), result)
+
+		assert.Empty(t, component.administrationDirectories)
+		assert.Equal(t, 1, result[directoryURL].CountDeleted)
+		assert.Empty(t, queryClient.Resources)
+	})
+}
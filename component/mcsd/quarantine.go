@@ -0,0 +1,359 @@
+package mcsd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+var errQuarantineNotFound = errors.New("quarantined resource not found")
+
+// QuarantinedResource is a resource from an administration directory that was rejected by validation,
+// and therefore wasn't imported into the query directory.
+type QuarantinedResource struct {
+	// ID identifies the quarantined resource in the quarantine API. It's derived from the directory (FHIR base URL and authoritative URA)
+	// and the resource's source URL, so a later (still invalid) version of the resource replaces the earlier one,
+	// but directories with the same FHIR base URL don't replace each other's quarantined resources.
+	ID               string `json:"id"`
+	FHIRBaseURL      string `json:"fhirBaseURL"`
+	AuthoritativeUra string `json:"authoritativeUra,omitempty"`
+	ResourceType     string `json:"resourceType"`
+	ResourceID       string `json:"resourceId"`
+	// FullURL is the fullUrl of the resource's entry in the directory's history.
+	FullURL string `json:"fullUrl,omitempty"`
+	// Reason is the validation rule that rejected the resource.
+	Reason string `json:"reason"`
+	// Time is when the resource was (last) rejected.
+	Time time.Time `json:"time"`
+	// Resource is the rejected resource. It's left out when listing quarantined resources.
+	Resource json.RawMessage `json:"resource,omitempty"`
+}
+
+// RevalidationResult is the outcome of validating a quarantined resource again.
+type RevalidationResult struct {
+	// Released is set when the resource is now valid, in which case it was imported and removed from quarantine.
+	Released bool `json:"released"`
+	// Reason is the validation rule that still rejects the resource.
+	Reason string `json:"reason,omitempty"`
+}
+
+// quarantineID returns the ID of the quarantined resource with the given source URL, from the directory with the given key (see makeDirectoryKey).
+func quarantineID(directoryKey string, sourceURL string) string {
+	hash := sha256.Sum256([]byte(directoryKey + "\n" + sourceURL))
+	return hex.EncodeToString(hash[:16])
+}
+
+// entrySourceURL returns the resource type, ID and source URL (as set in meta.source in the query directory) of a history entry.
+func entrySourceURL(fhirBaseURL string, entry fhir.BundleEntry) (string, string, string, bool) {
+	var resourceType, resourceID string
+	if entry.Resource != nil {
+		info, err := libfhir.ExtractResourceInfo(entry.Resource)
+		if err != nil {
+			return "", "", "", false
+		}
+		resourceType, resourceID = info.ResourceType, info.ID
+	} else if entry.Request != nil {
+		parts := strings.Split(entry.Request.Url, "/")
+		if len(parts) >= 2 {
+			resourceType, resourceID = parts[0], parts[1]
+		}
+	}
+	if resourceType == "" || resourceID == "" {
+		return "", "", "", false
+	}
+	sourceURL, err := libfhir.BuildSourceURL(fhirBaseURL, resourceType, resourceID)
+	if err != nil {
+		return "", "", "", false
+	}
+	return resourceType, resourceID, sourceURL, true
+}
+
+// quarantine keeps a resource that was rejected by validation, so it can be inspected, validated again or released through the quarantine API.
+// Entries without resource (deletes) aren't quarantined.
+func (c *Component) quarantine(ctx context.Context, run *syncRun, entry fhir.BundleEntry, reason error) {
+	if entry.Resource == nil {
+		return
+	}
+	resourceType, resourceID, sourceURL, ok := entrySourceURL(run.fhirBaseURL, entry)
+	if !ok {
+		return
+	}
+	quarantined := QuarantinedResource{
+		ID:               quarantineID(run.directoryKey, sourceURL),
+		FHIRBaseURL:      run.fhirBaseURL,
+		AuthoritativeUra: run.authoritativeUra,
+		ResourceType:     resourceType,
+		ResourceID:       resourceID,
+		Reason:           reason.Error(),
+		Time:             time.Now().UTC(),
+		Resource:         entry.Resource,
+	}
+	if entry.FullUrl != nil {
+		quarantined.FullURL = *entry.FullUrl
+	}
+	if err := c.stateStore.Put(quarantineBucket, quarantined.ID, quarantined); err != nil {
+		slog.ErrorContext(ctx, "Failed to quarantine rejected mCSD resource", logging.FHIRServer(run.fhirBaseURL), slog.String("source", sourceURL), logging.Error(err))
+	}
+}
+
+// unquarantine removes a resource from quarantine after a valid version of it was imported, or it was deleted from the directory.
+func (c *Component) unquarantine(ctx context.Context, run *syncRun, entry fhir.BundleEntry) {
+	_, _, sourceURL, ok := entrySourceURL(run.fhirBaseURL, entry)
+	if !ok {
+		return
+	}
+	id := quarantineID(run.directoryKey, sourceURL)
+	var quarantined QuarantinedResource
+	if found, err := c.stateStore.Get(quarantineBucket, id, &quarantined); err != nil || !found {
+		return
+	}
+	slog.InfoContext(ctx, "Removing mCSD resource from quarantine: superseded by the directory", logging.FHIRServer(run.fhirBaseURL), slog.String("source", sourceURL))
+	if err := c.stateStore.Delete(quarantineBucket, id); err != nil {
+		slog.ErrorContext(ctx, "Failed to remove mCSD resource from quarantine", logging.FHIRServer(run.fhirBaseURL), slog.String("source", sourceURL), logging.Error(err))
+	}
+}
+
+// forgetQuarantine removes the quarantined resources of an unregistered administration directory.
+func (c *Component) forgetQuarantine(ctx context.Context, directoryKey string) {
+	var ids []string
+	err := c.stateStore.Walk(quarantineBucket, func(key string, value []byte) error {
+		var quarantined QuarantinedResource
+		if json.Unmarshal(value, &quarantined) != nil || makeDirectoryKey(quarantined.FHIRBaseURL, quarantined.AuthoritativeUra) == directoryKey {
+			ids = append(ids, key)
+		}
+		return nil
+	})
+	for _, id := range ids {
+		if err == nil {
+			err = c.stateStore.Delete(quarantineBucket, id)
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to remove quarantined resources of unregistered mCSD Directory", slog.String("directory", directoryKey), logging.Error(err))
+	}
+}
+
+// listQuarantine returns the quarantined resources (without the resources themselves), optionally filtered by directory and resource type,
+// sorted by directory and source.
+func (c *Component) listQuarantine(fhirBaseURL string, resourceType string) ([]QuarantinedResource, error) {
+	result := []QuarantinedResource{}
+	err := c.stateStore.Walk(quarantineBucket, func(_ string, value []byte) error {
+		var quarantined QuarantinedResource
+		if err := json.Unmarshal(value, &quarantined); err != nil {
+			return err
+		}
+		if (fhirBaseURL != "" && quarantined.FHIRBaseURL != fhirBaseURL) || (resourceType != "" && quarantined.ResourceType != resourceType) {
+			return nil
+		}
+		quarantined.Resource = nil
+		result = append(result, quarantined)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(result, func(a, b QuarantinedResource) int {
+		return strings.Compare(a.FHIRBaseURL+"/"+a.ResourceType+"/"+a.ResourceID, b.FHIRBaseURL+"/"+b.ResourceType+"/"+b.ResourceID)
+	})
+	return result, nil
+}
+
+// getQuarantined returns the quarantined resource with the given ID.
+func (c *Component) getQuarantined(id string) (QuarantinedResource, error) {
+	var quarantined QuarantinedResource
+	found, err := c.stateStore.Get(quarantineBucket, id, &quarantined)
+	if err != nil {
+		return QuarantinedResource{}, err
+	}
+	if !found {
+		return QuarantinedResource{}, errQuarantineNotFound
+	}
+	return quarantined, nil
+}
+
+// revalidateQuarantined validates a quarantined resource again, against the current state of its directory (e.g. after the directory added
+// the Organization it refers to, or the update policy changed). If it's valid now, it's imported and removed from quarantine.
+// Otherwise, its reason is updated.
+func (c *Component) revalidateQuarantined(ctx context.Context, id string) (RevalidationResult, error) {
+	c.updateMux.Lock()
+	defer c.updateMux.Unlock()
+	quarantined, err := c.getQuarantined(id)
+	if err != nil {
+		return RevalidationResult{}, err
+	}
+	directory, ok := c.registeredDirectory(makeDirectoryKey(quarantined.FHIRBaseURL, quarantined.AuthoritativeUra))
+	if !ok {
+		return RevalidationResult{}, errDirectoryNotRegistered
+	}
+	baseURL, err := url.Parse(directory.fhirBaseURL)
+	if err != nil {
+		return RevalidationResult{}, err
+	}
+	client := c.fhirAdminClientFn(baseURL)
+	parentOrganizationsMap, err := c.ensureParentOrganizationsMap(ctx, directory.fhirBaseURL, client, directory.authoritativeUra)
+	if err != nil {
+		return RevalidationResult{}, fmt.Errorf("failed to build parent organization map: %w", err)
+	}
+	if parentOrganizationsMap, err = c.crossCheckParentOrganizations(ctx, directory.fhirBaseURL, parentOrganizationsMap, &DirectoryUpdateReport{}); err != nil {
+		return RevalidationResult{}, err
+	}
+	var healthcareServices []fhir.HealthcareService
+	if quarantined.ResourceType == "Endpoint" {
+		// Endpoints may be referenced by HealthcareServices instead of Organizations
+		entries, err := c.query(ctx, client, "HealthcareService", url.Values{"_count": []string{strconv.Itoa(searchPageSize)}})
+		if err != nil {
+			return RevalidationResult{}, fmt.Errorf("failed to query HealthcareServices: %w", err)
+		}
+		for _, entry := range entries {
+			var healthcareService fhir.HealthcareService
+			if json.Unmarshal(entry.Resource, &healthcareService) == nil {
+				healthcareServices = append(healthcareServices, healthcareService)
+			}
+		}
+	}
+	rules := c.validationRules(directory.resourceTypes, PolicySource{
+		FHIRBaseURL:      directory.fhirBaseURL,
+		AuthoritativeUra: directory.authoritativeUra,
+		Discover:         directory.discover,
+	})
+	var tx fhir.Bundle
+	if _, err := buildUpdateTransaction(ctx, &tx, quarantined.entry(), rules, parentOrganizationsMap, healthcareServices, directory.discover, directory.fhirBaseURL); err != nil {
+		quarantined.Reason = err.Error()
+		if err := c.stateStore.Put(quarantineBucket, id, quarantined); err != nil {
+			return RevalidationResult{}, err
+		}
+		return RevalidationResult{Reason: quarantined.Reason}, nil
+	}
+	if err := c.importQuarantined(ctx, tx, quarantined); err != nil {
+		return RevalidationResult{}, err
+	}
+	return RevalidationResult{Released: true}, nil
+}
+
+// releaseQuarantined imports a quarantined resource without validating it, and removes it from quarantine.
+// It's meant for resources that were rejected incorrectly: they're imported as if they passed validation.
+func (c *Component) releaseQuarantined(ctx context.Context, id string) error {
+	c.updateMux.Lock()
+	defer c.updateMux.Unlock()
+	quarantined, err := c.getQuarantined(id)
+	if err != nil {
+		return err
+	}
+	var resource map[string]any
+	if err := json.Unmarshal(quarantined.Resource, &resource); err != nil {
+		return fmt.Errorf("invalid quarantined resource: %w", err)
+	}
+	var tx fhir.Bundle
+	discover := false
+	if directory, ok := c.registeredDirectory(makeDirectoryKey(quarantined.FHIRBaseURL, quarantined.AuthoritativeUra)); ok {
+		discover = directory.discover
+	}
+	if _, err := appendUpdateEntry(ctx, &tx, quarantined.entry(), resource, quarantined.ResourceType, discover, quarantined.FHIRBaseURL); err != nil {
+		return err
+	}
+	return c.importQuarantined(ctx, tx, quarantined)
+}
+
+// importQuarantined applies the transaction that imports a quarantined resource to the query directory, and removes it from quarantine.
+func (c *Component) importQuarantined(ctx context.Context, tx fhir.Bundle, quarantined QuarantinedResource) error {
+	if len(tx.Entry) > 0 {
+		tx.Type = fhir.BundleTypeTransaction
+		var txResult fhir.Bundle
+		if err := c.applyToQueryDirectory(ctx, tx, &txResult); err != nil {
+			return fmt.Errorf("failed to import quarantined resource into query directory: %w", err)
+		}
+	}
+	slog.InfoContext(ctx, "Released mCSD resource from quarantine", logging.FHIRServer(quarantined.FHIRBaseURL), slog.String("resource", quarantined.ResourceType+"/"+quarantined.ResourceID))
+	return c.stateStore.Delete(quarantineBucket, quarantined.ID)
+}
+
+// discardQuarantined removes a resource from quarantine, without importing it.
+func (c *Component) discardQuarantined(id string) error {
+	c.updateMux.Lock()
+	defer c.updateMux.Unlock()
+	if _, err := c.getQuarantined(id); err != nil {
+		return err
+	}
+	return c.stateStore.Delete(quarantineBucket, id)
+}
+
+// entry returns the history entry of the quarantined resource.
+func (q QuarantinedResource) entry() fhir.BundleEntry {
+	entry := fhir.BundleEntry{
+		Resource: q.Resource,
+		Request:  &fhir.BundleEntryRequest{Method: fhir.HTTPVerbPUT, Url: q.ResourceType + "/" + q.ResourceID},
+	}
+	if q.FullURL != "" {
+		entry.FullUrl = &q.FullURL
+	} else {
+		entry.FullUrl = &q.ResourceID
+	}
+	return entry
+}
+
+// registerQuarantineHandlers registers the quarantine API, which lists the resources rejected by validation,
+// and allows inspecting, validating again, releasing and discarding them.
+func (c *Component) registerQuarantineHandlers(internalMux *http.ServeMux) {
+	writeError := func(w http.ResponseWriter, err error) {
+		switch {
+		case errors.Is(err, errQuarantineNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, errDirectoryNotRegistered):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+	internalMux.HandleFunc("GET /mcsd/quarantine", func(w http.ResponseWriter, r *http.Request) {
+		result, err := c.listQuarantine(r.URL.Query().Get("fhirBaseURL"), r.URL.Query().Get("resourceType"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+	internalMux.HandleFunc("GET /mcsd/quarantine/{id}", func(w http.ResponseWriter, r *http.Request) {
+		result, err := c.getQuarantined(r.PathValue("id"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+	internalMux.HandleFunc("POST /mcsd/quarantine/{id}/revalidate", func(w http.ResponseWriter, r *http.Request) {
+		result, err := c.revalidateQuarantined(r.Context(), r.PathValue("id"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+	internalMux.HandleFunc("POST /mcsd/quarantine/{id}/release", func(w http.ResponseWriter, r *http.Request) {
+		if err := c.releaseQuarantined(r.Context(), r.PathValue("id")); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	internalMux.HandleFunc("DELETE /mcsd/quarantine/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := c.discardQuarantined(r.PathValue("id")); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,213 @@
+package mcsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestComponent_quarantine(t *testing.T) {
+	const parent = `{"resourceType":"Organization","id":"parent","name":"Parent","identifier":[{"system":"http://fhir.nl/fhir/NamingSystem/ura","value":"1234"}]}`
+	const invalid = `{"resourceType":"Organization","id":"invalid","name":"Invalid"}`
+	const orphan = `{"resourceType":"Organization","id":"orphan","name":"Orphan","partOf":{"reference":"Organization/department"}}`
+	const department = `{"resourceType":"Organization","id":"department","name":"Department","partOf":{"reference":"Organization/parent"}}`
+	bundle := func(bundleType string, resources ...string) string {
+		var entries []string
+		for _, resource := range resources {
+			var info struct{ ID string }
+			_ = json.Unmarshal([]byte(resource), &info)
+			entries = append(entries, `{"fullUrl":"http://example.org/fhir/Organization/`+info.ID+`","request":{"method":"PUT","url":"Organization/`+info.ID+`"},"resource":`+resource+`}`)
+		}
+		return `{"resourceType":"Bundle","type":"` + bundleType + `","entry":[` + strings.Join(entries, ",") + `]}`
+	}
+
+	newComponent := func(t *testing.T) (*Component, string, *transactionRecordingClient, *http.ServeMux, *string, *string) {
+		history := bundle("history", parent, invalid, orphan)
+		search := bundle("searchset", parent, invalid, orphan)
+		mux := http.NewServeMux()
+		mockEndpoints(mux, map[string]*string{
+			"/fhir/Organization/_history": &history,
+			"/fhir/Organization":          &search,
+		})
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		baseURL := server.URL + "/fhir"
+
+		config := DefaultConfig()
+		config.QueryDirectory = DirectoryConfig{FHIRBaseURL: "http://example.com/local/fhir"}
+		component, err := New(config)
+		require.NoError(t, err)
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), baseURL, []string{"Organization"}, false, "", ""))
+		queryClient := &transactionRecordingClient{StubFHIRClient: &test.StubFHIRClient{}}
+		component.fhirQueryClient = queryClient
+		component.fhirAdminClientFn = func(baseURL *url.URL) fhirclient.Client {
+			return fhirclient.New(baseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		}
+		internalMux := http.NewServeMux()
+		component.RegisterHttpHandlers(http.NewServeMux(), internalMux)
+		return component, baseURL, queryClient, internalMux, &history, &search
+	}
+	do := func(mux *http.ServeMux, method string, target string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, httptest.NewRequest(method, target, nil))
+		return response
+	}
+	list := func(t *testing.T, mux *http.ServeMux) map[string]QuarantinedResource {
+		response := do(mux, http.MethodGet, "/mcsd/quarantine")
+		require.Equal(t, http.StatusOK, response.Code)
+		var items []QuarantinedResource
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &items))
+		result := make(map[string]QuarantinedResource)
+		for _, item := range items {
+			result[item.ResourceID] = item
+		}
+		return result
+	}
+
+	t.Run("rejected resources are quarantined", func(t *testing.T) {
+		component, baseURL, _, mux, _, _ := newComponent(t)
+		report, err := component.update(t.Context())
+		require.NoError(t, err)
+		require.Len(t, report[baseURL].Warnings, 2)
+
+		quarantined := list(t, mux)
+
+		require.Len(t, quarantined, 2)
+		item := quarantined["invalid"]
+		assert.Equal(t, baseURL, item.FHIRBaseURL)
+		assert.Equal(t, "Organization", item.ResourceType)
+		assert.Equal(t, "http://example.org/fhir/Organization/invalid", item.FullURL)
+		assert.Contains(t, item.Reason, "organization must have an identifier")
+		assert.False(t, item.Time.IsZero())
+		assert.Empty(t, item.Resource, "list shouldn't contain the resources")
+		t.Run("inspect", func(t *testing.T) {
+			response := do(mux, http.MethodGet, "/mcsd/quarantine/"+item.ID)
+			require.Equal(t, http.StatusOK, response.Code)
+			var result QuarantinedResource
+			require.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+			assert.JSONEq(t, invalid, string(result.Resource))
+		})
+		t.Run("filter", func(t *testing.T) {
+			response := do(mux, http.MethodGet, "/mcsd/quarantine?fhirBaseURL="+url.QueryEscape("http://example.com/other"))
+			assert.JSONEq(t, "[]", response.Body.String())
+		})
+		t.Run("unknown", func(t *testing.T) {
+			assert.Equal(t, http.StatusNotFound, do(mux, http.MethodGet, "/mcsd/quarantine/unknown").Code)
+			assert.Equal(t, http.StatusNotFound, do(mux, http.MethodPost, "/mcsd/quarantine/unknown/release").Code)
+		})
+	})
+	t.Run("dry run doesn't quarantine", func(t *testing.T) {
+		component, _, _, mux, _, _ := newComponent(t)
+		_, err := component.updateWithOptions(t.Context(), updateOptions{dryRun: true})
+		require.NoError(t, err)
+		assert.Empty(t, list(t, mux))
+	})
+	t.Run("revalidate", func(t *testing.T) {
+		component, _, queryClient, mux, _, search := newComponent(t)
+		_, err := component.update(t.Context())
+		require.NoError(t, err)
+		quarantined := list(t, mux)
+		transactions := len(queryClient.transactions)
+
+		t.Run("still invalid", func(t *testing.T) {
+			response := do(mux, http.MethodPost, "/mcsd/quarantine/"+quarantined["orphan"].ID+"/revalidate")
+			require.Equal(t, http.StatusOK, response.Code)
+			var result RevalidationResult
+			require.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+			assert.False(t, result.Released)
+			assert.Contains(t, result.Reason, "department not found")
+			assert.Len(t, list(t, mux), 2)
+		})
+		t.Run("valid after the directory added the referenced organization", func(t *testing.T) {
+			*search = bundle("searchset", parent, department, orphan)
+
+			response := do(mux, http.MethodPost, "/mcsd/quarantine/"+quarantined["orphan"].ID+"/revalidate")
+
+			require.Equal(t, http.StatusOK, response.Code)
+			var result RevalidationResult
+			require.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+			assert.True(t, result.Released)
+			require.Len(t, queryClient.transactions, transactions+1)
+			assert.Equal(t, "Organization?_source="+url.QueryEscape(quarantined["orphan"].FHIRBaseURL+"/Organization/orphan"), queryClient.transactions[transactions].Entry[0].Request.Url)
+			assert.NotContains(t, list(t, mux), "orphan")
+		})
+	})
+	t.Run("release and discard", func(t *testing.T) {
+		component, _, queryClient, mux, _, _ := newComponent(t)
+		_, err := component.update(t.Context())
+		require.NoError(t, err)
+		quarantined := list(t, mux)
+		transactions := len(queryClient.transactions)
+
+		require.Equal(t, http.StatusNoContent, do(mux, http.MethodPost, "/mcsd/quarantine/"+quarantined["invalid"].ID+"/release").Code)
+		require.Len(t, queryClient.transactions, transactions+1, "released resource should be imported")
+		assert.Equal(t, fhir.HTTPVerbPUT, queryClient.transactions[transactions].Entry[0].Request.Method)
+
+		require.Equal(t, http.StatusNoContent, do(mux, http.MethodDelete, "/mcsd/quarantine/"+quarantined["orphan"].ID).Code)
+		assert.Len(t, queryClient.transactions, transactions+1, "discarded resource shouldn't be imported")
+		assert.Empty(t, list(t, mux))
+	})
+	t.Run("superseded by the directory", func(t *testing.T) {
+		component, baseURL, _, mux, history, _ := newComponent(t)
+		_, err := component.update(t.Context())
+		require.NoError(t, err)
+		require.Len(t, list(t, mux), 2)
+
+		// The invalid organization is fixed, and the orphan deleted
+		*history = `{"resourceType":"Bundle","type":"history","entry":[
+			{"fullUrl":"http://example.org/fhir/Organization/invalid","request":{"method":"PUT","url":"Organization/invalid"},
+			 "resource":{"resourceType":"Organization","id":"invalid","name":"Invalid","partOf":{"reference":"Organization/parent"}}},
+			{"fullUrl":"http://example.org/fhir/Organization/orphan","request":{"method":"DELETE","url":"Organization/orphan"}}
+		]}`
+		report, err := component.update(t.Context())
+		require.NoError(t, err)
+		require.Empty(t, report[baseURL].Warnings)
+
+		assert.Empty(t, list(t, mux))
+	})
+	t.Run("removed with the directory", func(t *testing.T) {
+		component, baseURL, _, mux, _, _ := newComponent(t)
+		_, err := component.update(t.Context())
+		require.NoError(t, err)
+
+		require.True(t, component.removeDirectory(t.Context(), baseURL, ""))
+
+		assert.Empty(t, list(t, mux))
+	})
+	t.Run("directories with the same FHIR base URL", func(t *testing.T) {
+		component, baseURL, _, mux, _, _ := newComponent(t)
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), baseURL, []string{"Organization"}, false, "", "1234"))
+		_, err := component.update(t.Context())
+		require.NoError(t, err)
+
+		response := do(mux, http.MethodGet, "/mcsd/quarantine")
+		require.Equal(t, http.StatusOK, response.Code)
+		var items []QuarantinedResource
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &items))
+		ids := make(map[string]string)
+		for _, item := range items {
+			if item.ResourceID == "invalid" {
+				ids[item.AuthoritativeUra] = item.ID
+			}
+		}
+		require.Len(t, ids, 2, "each directory should keep its own quarantined resource")
+		assert.NotEqual(t, ids[""], ids["1234"])
+
+		t.Run("removing one directory keeps the other's", func(t *testing.T) {
+			require.True(t, component.removeDirectory(t.Context(), baseURL, "1234"))
+
+			quarantined := list(t, mux)
+			require.Contains(t, quarantined, "invalid")
+			assert.Equal(t, ids[""], quarantined["invalid"].ID)
+		})
+	})
+}
@@ -0,0 +1,95 @@
+package mcsd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// addExistingSource records the meta.source the resource of the given (deduplicated) history entry has in the query directory,
+// unless the entry is a delete.
+func (run *syncRun) addExistingSource(entry fhir.BundleEntry) {
+	if entry.Resource == nil || (entry.Request != nil && entry.Request.Method == fhir.HTTPVerbDELETE) {
+		return
+	}
+	info, err := libfhir.ExtractResourceInfo(entry.Resource)
+	if err != nil || info.ResourceType == "" || info.ID == "" {
+		return
+	}
+	if run.allowDiscovery && (info.ResourceType != "Endpoint" || !isDirectoryEndpoint(entry.Resource)) {
+		// Only the mCSD directory Endpoints of directories for discovery are imported
+		return
+	}
+	if source, err := libfhir.BuildSourceURL(run.fhirBaseURL, info.ResourceType, info.ID); err == nil {
+		run.existingSources[source] = true
+	}
+}
+
+// removeStaleResources completes a reconciling sync: it removes the resources imported from the directory from the query directory,
+// that don't exist in the directory anymore. Incremental syncs miss these removals when the directory's history is incomplete,
+// e.g. because it was expunged or restored from a backup. The resources of the directory that do exist were repaired
+// by applying the complete history.
+func (c *Component) removeStaleResources(ctx context.Context, run *syncRun) error {
+	if !run.checkpoint.Reconcile {
+		return nil
+	}
+	fhirBaseURL := strings.TrimRight(run.fhirBaseURL, "/")
+	removed := 0
+	for _, resourceType := range importedResourceTypes(run) {
+		sources, err := c.findSourcesBelow(ctx, resourceType, fhirBaseURL)
+		if err != nil {
+			return err
+		}
+		sources = slices.DeleteFunc(sources, func(source string) bool {
+			return run.existingSources[source]
+		})
+		for chunk := range slices.Chunk(sources, run.checkpoint.ChunkSize) {
+			tx := conditionalDeleteTransaction(resourceType, chunk)
+			if run.dryRun {
+				changes, err := libfhir.DescribeTransaction(ctx, c.fhirQueryClient, tx)
+				if err != nil {
+					return fmt.Errorf("failed to determine stale %s resources to remove: %w", resourceType, err)
+				}
+				run.tallyChanges(changes)
+				continue
+			}
+			var txResult fhir.Bundle
+			if err := c.applyToQueryDirectory(ctx, tx, &txResult); err != nil {
+				return fmt.Errorf("failed to remove stale %s resources from query directory: %w", resourceType, err)
+			}
+			run.applied += len(tx.Entry)
+			run.tallyTransactionResult(tx, txResult)
+		}
+		removed += len(sources)
+	}
+	slog.InfoContext(ctx, "Reconciled query directory with mCSD Directory", logging.FHIRServer(run.fhirBaseURL), slog.Int("staleResources", removed), slog.Bool("dryRun", run.dryRun))
+	return nil
+}
+
+// importedResourceTypes returns the resource types of the given sync run that are imported into the query directory.
+// Of directories for discovery, only the mCSD directory Endpoints are imported (see appendUpdateEntry).
+func importedResourceTypes(run *syncRun) []string {
+	if !run.allowDiscovery {
+		return run.resourceTypes
+	}
+	return slices.DeleteFunc(slices.Clone(run.resourceTypes), func(resourceType string) bool {
+		return resourceType != "Endpoint"
+	})
+}
+
+// isDirectoryEndpoint returns whether the given Endpoint is an mCSD directory Endpoint.
+func isDirectoryEndpoint(resource json.RawMessage) bool {
+	var endpoint fhir.Endpoint
+	if err := json.Unmarshal(resource, &endpoint); err != nil {
+		return false
+	}
+	return coding.CodablesIncludesCode(endpoint.PayloadType, coding.PayloadCoding)
+}
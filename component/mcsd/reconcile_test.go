@@ -0,0 +1,163 @@
+package mcsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestComponent_reconcile(t *testing.T) {
+	// The directory's history only contains the parent and child organization: the history of organization "expunged" was expunged
+	orgHistory := `{"resourceType":"Bundle","type":"history","entry":[
+		{"fullUrl":"http://example.org/fhir/Organization/parent","request":{"method":"PUT","url":"Organization/parent"},
+		 "resource":{"resourceType":"Organization","id":"parent","name":"Parent","identifier":[{"system":"http://fhir.nl/fhir/NamingSystem/ura","value":"1234"}]}},
+		{"fullUrl":"http://example.org/fhir/Organization/child","request":{"method":"PUT","url":"Organization/child"},
+		 "resource":{"resourceType":"Organization","id":"child","name":"Child","partOf":{"reference":"Organization/parent"}}}
+	]}`
+	var historyQueries []url.Values
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fhir/Organization/_history", func(w http.ResponseWriter, r *http.Request) {
+		historyQueries = append(historyQueries, r.URL.Query())
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_, _ = w.Write([]byte(orgHistory))
+	})
+	mockEndpoints(mux, map[string]*string{"/fhir/Organization": &orgHistory})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	baseURL := server.URL + "/fhir"
+
+	newComponent := func(t *testing.T) (*Component, *transactionRecordingClient) {
+		config := DefaultConfig()
+		config.QueryDirectory = DirectoryConfig{FHIRBaseURL: "http://example.com/local/fhir"}
+		component, err := New(config)
+		require.NoError(t, err)
+		component.fhirAdminClientFn = func(baseURL *url.URL) fhirclient.Client {
+			return fhirclient.New(baseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		}
+		queryClient := &transactionRecordingClient{StubFHIRClient: &test.StubFHIRClient{
+			Resources: []any{
+				fhir.Organization{Id: to.Ptr("local-1"), Meta: &fhir.Meta{Source: to.Ptr(baseURL + "/Organization/expunged")}},
+				fhir.Organization{Id: to.Ptr("local-2"), Meta: &fhir.Meta{Source: to.Ptr("http://example.com/other/fhir/Organization/expunged")}},
+			},
+		}}
+		component.fhirQueryClient = queryClient
+		component.setLastUpdateTime(t.Context(), baseURL, "2026-01-01T00:00:00Z")
+		return component, queryClient
+	}
+	sources := func(client *transactionRecordingClient) []string {
+		var result []string
+		for _, resource := range client.Resources {
+			var baseResource test.BaseResource
+			data, _ := json.Marshal(resource)
+			_ = json.Unmarshal(data, &baseResource)
+			if baseResource.Meta != nil && baseResource.Meta.Source != nil {
+				result = append(result, *baseResource.Meta.Source)
+			}
+		}
+		return result
+	}
+
+	t.Run("removes stale resources", func(t *testing.T) {
+		component, queryClient := newComponent(t)
+		historyQueries = nil
+
+		report, err := component.updateFromDirectory(t.Context(), baseURL, []string{"Organization"}, false, "", updateOptions{reconcile: true})
+
+		require.NoError(t, err)
+		assert.Empty(t, report.Errors)
+		assert.Equal(t, 1, report.CountDeleted)
+		require.Len(t, historyQueries, 1)
+		assert.False(t, historyQueries[0].Has("_since"), "reconciling should fetch the complete history")
+		assert.NotContains(t, sources(queryClient), baseURL+"/Organization/expunged")
+		assert.Contains(t, sources(queryClient), "http://example.com/other/fhir/Organization/expunged", "resources of other sources must be kept")
+		assert.Contains(t, sources(queryClient), baseURL+"/Organization/parent")
+		_, hasCheckpoint := component.loadCheckpoint(t.Context(), baseURL)
+		assert.False(t, hasCheckpoint)
+	})
+	t.Run("dry run", func(t *testing.T) {
+		component, queryClient := newComponent(t)
+
+		report, err := component.updateFromDirectory(t.Context(), baseURL, []string{"Organization"}, false, "", updateOptions{reconcile: true, dryRun: true})
+
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.CountDeleted)
+		assert.Contains(t, report.Changes, libfhir.TransactionChange{Action: libfhir.ChangeDelete, ResourceType: "Organization", Source: baseURL + "/Organization/expunged"})
+		assert.Empty(t, queryClient.transactions)
+	})
+	t.Run("incremental update doesn't remove resources", func(t *testing.T) {
+		component, queryClient := newComponent(t)
+		historyQueries = nil
+
+		report, err := component.updateFromDirectory(t.Context(), baseURL, []string{"Organization"}, false, "", updateOptions{})
+
+		require.NoError(t, err)
+		assert.Zero(t, report.CountDeleted)
+		assert.Contains(t, sources(queryClient), baseURL+"/Organization/expunged")
+	})
+	t.Run("doesn't resume an interrupted incremental update", func(t *testing.T) {
+		component, queryClient := newComponent(t)
+		require.NoError(t, component.stateStore.Put(syncCheckpointBucket, baseURL, syncCheckpoint{
+			Since:        "2026-01-01T00:00:00Z",
+			FetchedTypes: []string{"Organization"},
+			ChunkSize:    defaultTransactionSize,
+		}))
+		historyQueries = nil
+
+		report, err := component.updateFromDirectory(t.Context(), baseURL, []string{"Organization"}, false, "", updateOptions{reconcile: true})
+
+		require.NoError(t, err)
+		assert.Len(t, historyQueries, 1, "history should be fetched again")
+		assert.Equal(t, 1, report.CountDeleted)
+		assert.NotContains(t, sources(queryClient), baseURL+"/Organization/expunged")
+	})
+	t.Run("root directory", func(t *testing.T) {
+		// The root directory lists an mCSD directory Endpoint and another Endpoint, which isn't imported
+		endpointHistory := `{"resourceType":"Bundle","type":"history","entry":[
+			{"fullUrl":"http://example.org/fhir/Endpoint/dir","request":{"method":"PUT","url":"Endpoint/dir"},
+			 "resource":{"resourceType":"Endpoint","id":"dir","status":"active","address":"https://dir.example.org/fhir",
+			  "payloadType":[{"coding":[{"system":"http://nuts-foundation.github.io/nl-generic-functions-ig/CodeSystem/nl-gf-data-exchange-capabilities",
+			   "code":"http://nuts-foundation.github.io/nl-generic-functions-ig/CapabilityStatement/nl-gf-admin-directory-update-client"}]}]}},
+			{"fullUrl":"http://example.org/fhir/Endpoint/other","request":{"method":"PUT","url":"Endpoint/other"},
+			 "resource":{"resourceType":"Endpoint","id":"other","status":"active","address":"https://other.example.org/fhir",
+			  "payloadType":[{"coding":[{"system":"http://example.org","code":"other"}]}]}}
+		]}`
+		emptyHistory := `{"resourceType":"Bundle","type":"history"}`
+		rootMux := http.NewServeMux()
+		mockEndpoints(rootMux, map[string]*string{
+			"/fhir/Endpoint/_history":     &endpointHistory,
+			"/fhir/Endpoint":              &endpointHistory,
+			"/fhir/Organization/_history": &emptyHistory,
+			"/fhir/Organization":          &emptyHistory,
+		})
+		rootServer := httptest.NewServer(rootMux)
+		defer rootServer.Close()
+		rootURL := rootServer.URL + "/fhir"
+		component, queryClient := newComponent(t)
+		queryClient.Resources = []any{
+			fhir.Endpoint{Id: to.Ptr("local-1"), Meta: &fhir.Meta{Source: to.Ptr(rootURL + "/Endpoint/dir")}},
+			fhir.Endpoint{Id: to.Ptr("local-2"), Meta: &fhir.Meta{Source: to.Ptr(rootURL + "/Endpoint/expunged")}},
+			fhir.Endpoint{Id: to.Ptr("local-3"), Meta: &fhir.Meta{Source: to.Ptr(rootURL + "/Endpoint/other")}},
+			fhir.Organization{Id: to.Ptr("local-4"), Meta: &fhir.Meta{Source: to.Ptr(rootURL + "/Organization/expunged")}},
+		}
+
+		report, err := component.updateFromDirectory(t.Context(), rootURL, rootDirectoryResourceTypes, true, "", updateOptions{reconcile: true})
+
+		require.NoError(t, err)
+		assert.Empty(t, report.Errors)
+		assert.Equal(t, 2, report.CountDeleted)
+		assert.Contains(t, sources(queryClient), rootURL+"/Endpoint/dir")
+		assert.NotContains(t, sources(queryClient), rootURL+"/Endpoint/expunged")
+		assert.NotContains(t, sources(queryClient), rootURL+"/Endpoint/other", "Endpoints that aren't imported from root directories are stale too")
+		assert.Contains(t, sources(queryClient), rootURL+"/Organization/expunged", "only the resource types imported from root directories are reconciled")
+	})
+}
@@ -0,0 +1,82 @@
+package mcsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// warn records a warning in the report.
+func (r *DirectoryUpdateReport) warn(item libfhir.ReportItem) {
+	item.Severity = libfhir.SeverityWarning
+	r.Warnings = append(r.Warnings, item.Message)
+	r.Items = append(r.Items, item)
+}
+
+// fail records an error in the report.
+func (r *DirectoryUpdateReport) fail(code string, err error) {
+	r.Errors = append(r.Errors, err.Error())
+	r.Items = append(r.Items, libfhir.ReportItem{Code: code, Severity: libfhir.SeverityError, Message: err.Error()})
+}
+
+// count records a change (libfhir.ChangeCreate, ChangeUpdate or ChangeDelete) of a resource of the given type in the report.
+func (r *DirectoryUpdateReport) count(resourceType string, action string) {
+	switch action {
+	case libfhir.ChangeCreate:
+		r.CountCreated++
+	case libfhir.ChangeUpdate:
+		r.CountUpdated++
+	case libfhir.ChangeDelete:
+		r.CountDeleted++
+	}
+	if r.ResourceTypes == nil {
+		r.ResourceTypes = make(libfhir.ResourceTypeCounts)
+	}
+	r.ResourceTypes.Add(resourceType, action)
+}
+
+// finalized returns the report with nil slices and maps replaced by empty ones, which makes a nicer REST API.
+func (r DirectoryUpdateReport) finalized() DirectoryUpdateReport {
+	if r.Warnings == nil {
+		r.Warnings = []string{}
+	}
+	if r.Errors == nil {
+		r.Errors = []string{}
+	}
+	if r.Items == nil {
+		r.Items = []libfhir.ReportItem{}
+	}
+	if r.ResourceTypes == nil {
+		r.ResourceTypes = libfhir.ResourceTypeCounts{}
+	}
+	return r
+}
+
+// outcome represents the report as FHIR OperationOutcome, of which the issues are the report's items.
+func (r DirectoryUpdateReport) outcome(directoryKey string) fhir.OperationOutcome {
+	summary := fmt.Sprintf("mCSD Directory %s: %d created, %d updated, %d deleted, %d warnings, %d errors (took %dms)",
+		directoryKey, r.CountCreated, r.CountUpdated, r.CountDeleted, len(r.Warnings), len(r.Errors), r.DurationMs)
+	return libfhir.ReportOutcome(directoryKey, summary, r.Items)
+}
+
+// bundle represents the report as FHIR Bundle (of type collection), containing an OperationOutcome per directory.
+func (r UpdateReport) bundle() fhir.Bundle {
+	result := fhir.Bundle{
+		Type:  fhir.BundleTypeCollection,
+		Entry: make([]fhir.BundleEntry, 0, len(r)),
+	}
+	directoryKeys := make([]string, 0, len(r))
+	for directoryKey := range r {
+		directoryKeys = append(directoryKeys, directoryKey)
+	}
+	slices.Sort(directoryKeys)
+	for _, directoryKey := range directoryKeys {
+		// Marshalling an OperationOutcome can't fail
+		resource, _ := json.Marshal(r[directoryKey].outcome(directoryKey))
+		result.Entry = append(result.Entry, fhir.BundleEntry{Resource: resource})
+	}
+	return result
+}
@@ -0,0 +1,115 @@
+package mcsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestComponent_updateReport(t *testing.T) {
+	history := `{"resourceType":"Bundle","type":"history","entry":[
+		{"fullUrl":"http://example.org/fhir/Organization/parent","request":{"method":"PUT","url":"Organization/parent"},
+		 "resource":{"resourceType":"Organization","id":"parent","name":"Parent","identifier":[{"system":"http://fhir.nl/fhir/NamingSystem/ura","value":"1234"}]}},
+		{"fullUrl":"http://example.org/fhir/Organization/invalid","request":{"method":"PUT","url":"Organization/invalid"},
+		 "resource":{"resourceType":"Organization","id":"invalid","name":"Invalid"}},
+		{"fullUrl":"http://example.org/fhir/Organization/noid","request":{"method":"PUT","url":"Organization/noid"},
+		 "resource":{"resourceType":"Organization","name":"No ID","partOf":{"reference":"Organization/parent"}}}
+	]}`
+	mux := http.NewServeMux()
+	mockEndpoints(mux, map[string]*string{
+		"/fhir/Organization/_history": &history,
+		"/fhir/Organization":          &history,
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	baseURL := server.URL + "/fhir"
+
+	newComponent := func(t *testing.T) (*Component, *http.ServeMux) {
+		config := DefaultConfig()
+		config.QueryDirectory = DirectoryConfig{FHIRBaseURL: "http://example.com/local/fhir"}
+		component, err := New(config)
+		require.NoError(t, err)
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), baseURL, []string{"Organization"}, false, "", ""))
+		component.fhirQueryClient = &test.StubFHIRClient{}
+		component.fhirAdminClientFn = func(baseURL *url.URL) fhirclient.Client {
+			return fhirclient.New(baseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		}
+		internalMux := http.NewServeMux()
+		component.RegisterHttpHandlers(http.NewServeMux(), internalMux)
+		return component, internalMux
+	}
+
+	t.Run("structured items and counts per resource type", func(t *testing.T) {
+		component, _ := newComponent(t)
+
+		report, err := component.update(t.Context())
+
+		require.NoError(t, err)
+		directoryReport := report[baseURL]
+		assert.Equal(t, libfhir.ResourceTypeCounts{"Organization": {Created: 1}}, directoryReport.ResourceTypes)
+		assert.GreaterOrEqual(t, directoryReport.DurationMs, int64(0))
+		require.Len(t, directoryReport.Items, 2)
+		assert.Equal(t, libfhir.ReportItem{
+			Code:         libfhir.ReportCodeRejected,
+			Severity:     libfhir.SeverityWarning,
+			ResourceType: "Organization",
+			ResourceID:   "invalid",
+			FullURL:      "http://example.org/fhir/Organization/invalid",
+			Message:      directoryReport.Warnings[0],
+		}, directoryReport.Items[0])
+		assert.Equal(t, libfhir.ReportCodeInvalidEntry, directoryReport.Items[1].Code, "an entry that can't be processed isn't a validation rejection")
+		assert.Contains(t, directoryReport.Items[1].Message, "resource missing ID field")
+		assert.Equal(t, "Organization", directoryReport.Items[1].ResourceType)
+		assert.Empty(t, directoryReport.Items[1].ResourceID)
+	})
+	t.Run("failed update", func(t *testing.T) {
+		component, _ := newComponent(t)
+		component.fhirQueryClient = &transactionRecordingClient{StubFHIRClient: &test.StubFHIRClient{}, failAt: 1}
+
+		report, err := component.update(t.Context())
+
+		require.NoError(t, err)
+		items := report[baseURL].Items
+		require.NotEmpty(t, items)
+		last := items[len(items)-1]
+		assert.Equal(t, libfhir.ReportCodeUpdateFailed, last.Code)
+		assert.Equal(t, libfhir.SeverityError, last.Severity)
+		assert.Equal(t, report[baseURL].Errors[0], last.Message)
+	})
+	t.Run("as FHIR OperationOutcome", func(t *testing.T) {
+		_, internalMux := newComponent(t)
+		request := httptest.NewRequest(http.MethodPost, "/mcsd/update", nil)
+		request.Header.Set("Accept", "application/fhir+json")
+		response := httptest.NewRecorder()
+
+		internalMux.ServeHTTP(response, request)
+
+		require.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, "application/fhir+json", response.Header().Get("Content-Type"))
+		var bundle fhir.Bundle
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &bundle))
+		assert.Equal(t, fhir.BundleTypeCollection, bundle.Type)
+		require.Len(t, bundle.Entry, 1)
+		var outcome fhir.OperationOutcome
+		require.NoError(t, json.Unmarshal(bundle.Entry[0].Resource, &outcome))
+		require.Len(t, outcome.Extension, 1)
+		assert.Equal(t, baseURL, *outcome.Extension[0].ValueUri)
+		require.Len(t, outcome.Issue, 3)
+		assert.Equal(t, fhir.IssueTypeInformational, outcome.Issue[0].Code)
+		assert.Contains(t, *outcome.Issue[0].Diagnostics, "1 created")
+		rejected := outcome.Issue[1]
+		assert.Equal(t, fhir.IssueSeverityWarning, rejected.Severity)
+		assert.Equal(t, fhir.IssueTypeBusinessRule, rejected.Code)
+		assert.Equal(t, libfhir.ReportCodeRejected, *rejected.Details.Coding[0].Code)
+		assert.Equal(t, "http://example.org/fhir/Organization/invalid", *rejected.Extension[0].ValueReference.Reference)
+	})
+}
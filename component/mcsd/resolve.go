@@ -0,0 +1,383 @@
+package mcsd
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// maxResolveDepth limits how many partOf levels below the organization with the requested URA are searched for Endpoints.
+const maxResolveDepth = 10
+
+// resolveSearchBatchSize limits the number of references or IDs searched for in a single query (as comma-separated values).
+const resolveSearchBatchSize = 50
+
+var errResolveOrganizationNotFound = errors.New("no Organization with the given URA found in the query directory")
+
+// ResolveRequest holds the criteria of the endpoint resolution API.
+type ResolveRequest struct {
+	// Ura is the URA of the organization to send data to.
+	Ura string `json:"ura"`
+	// PayloadType is the (system|)code the Endpoint's payloadType must contain, if set.
+	PayloadType string `json:"payloadType,omitempty"`
+	// ConnectionType is the (system|)code of the Endpoint's connectionType, if set.
+	ConnectionType string `json:"connectionType,omitempty"`
+	// ServiceType is the (system|)code the type of the HealthcareService must contain, if set.
+	// Endpoints of HealthcareServices that provide it are preferred over the Endpoints of the organizations themselves.
+	ServiceType string `json:"serviceType,omitempty"`
+}
+
+// ResolveResult is the response of the endpoint resolution API.
+type ResolveResult struct {
+	ResolveRequest
+	// Endpoints are the matching Endpoints, best match first.
+	Endpoints []ResolvedEndpoint `json:"endpoints"`
+	// Discarded are the Endpoints that were found, but don't match, with the reason why.
+	Discarded []DiscardedEndpoint `json:"discarded"`
+}
+
+// ResolvedEndpoint is an Endpoint that matches the resolution criteria.
+type ResolvedEndpoint struct {
+	Rank int `json:"rank"`
+	endpointPath
+	Address  string        `json:"address"`
+	Endpoint fhir.Endpoint `json:"endpoint"`
+}
+
+// DiscardedEndpoint is an Endpoint that doesn't match the resolution criteria.
+type DiscardedEndpoint struct {
+	endpointPath
+	Reason string `json:"reason"`
+}
+
+// endpointPath describes how an Endpoint was found, starting from the organization with the requested URA.
+type endpointPath struct {
+	// Reference is the reference to the Endpoint, e.g. Endpoint/1.
+	Reference string `json:"reference"`
+	// Organization is the Organization that references the Endpoint, directly or through its HealthcareService.
+	Organization string `json:"organization"`
+	// HealthcareService is the HealthcareService that references the Endpoint, if it's not referenced by the Organization itself.
+	HealthcareService string `json:"healthcareService,omitempty"`
+	// Depth is the number of partOf levels between Organization and the organization with the requested URA.
+	Depth int `json:"depth"`
+}
+
+// endpointCandidate is an Endpoint found while walking the organizations, and why it doesn't match (if it doesn't).
+type endpointCandidate struct {
+	endpointPath
+	reason string
+}
+
+// registerResolveHandlers registers the endpoint resolution API, which answers "where do I send this to?" for an organization (URA).
+func (c *Component) registerResolveHandlers(internalMux *http.ServeMux) {
+	internalMux.HandleFunc("GET /mcsd/resolve", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		request := ResolveRequest{
+			Ura:            query.Get("ura"),
+			PayloadType:    query.Get("payloadType"),
+			ConnectionType: query.Get("connectionType"),
+			ServiceType:    query.Get("serviceType"),
+		}
+		if request.Ura == "" {
+			http.Error(w, "Missing ura parameter", http.StatusBadRequest)
+			return
+		}
+		result, err := c.resolveEndpoints(r.Context(), request)
+		switch {
+		case errors.Is(err, errResolveOrganizationNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, "Failed to resolve endpoints: "+err.Error(), http.StatusInternalServerError)
+		default:
+			writeJSON(w, http.StatusOK, result)
+		}
+	})
+}
+
+// resolveEndpoints finds the Endpoints in the query directory to send data to the organization with the requested URA.
+// It walks the organization, the organizations that are partOf it (recursively), their HealthcareServices and the Endpoints they reference.
+// The Endpoints are ranked:
+//  1. when a service type is requested, Endpoints of HealthcareServices providing it before Endpoints of organizations, and the other way around otherwise,
+//  2. Endpoints of the organization itself before those of the organizations that are part of it (fewer partOf levels first),
+//  3. by reference, to keep the order stable.
+func (c *Component) resolveEndpoints(ctx context.Context, request ResolveRequest) (*ResolveResult, error) {
+	organizations, depths, err := c.resolveOrganizations(ctx, request.Ura)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []endpointCandidate
+	organizationRefs := make([]string, 0, len(organizations))
+	for _, organization := range organizations {
+		reference := "Organization/" + *organization.Id
+		organizationRefs = append(organizationRefs, reference)
+		var reason string
+		if organization.Active != nil && !*organization.Active {
+			reason = reference + " is inactive"
+		}
+		for _, endpointRef := range organization.Endpoint {
+			candidates = append(candidates, newEndpointCandidate(endpointRef, reference, "", depths[reference], reason))
+		}
+	}
+
+	services, err := c.searchByReferences(ctx, "HealthcareService", "organization", organizationRefs)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range services {
+		var service fhir.HealthcareService
+		if err := json.Unmarshal(entry.Resource, &service); err != nil || service.Id == nil || service.ProvidedBy == nil || service.ProvidedBy.Reference == nil {
+			continue
+		}
+		organizationRef := *service.ProvidedBy.Reference
+		serviceRef := "HealthcareService/" + *service.Id
+		var reason string
+		switch {
+		case service.Active != nil && !*service.Active:
+			reason = serviceRef + " is inactive"
+		case request.ServiceType != "" && !slices.ContainsFunc(service.Type, func(concept fhir.CodeableConcept) bool { return codingsMatchToken(concept.Coding, request.ServiceType) }):
+			reason = serviceRef + " doesn't provide service type " + request.ServiceType
+		}
+		for _, endpointRef := range service.Endpoint {
+			candidates = append(candidates, newEndpointCandidate(endpointRef, organizationRef, serviceRef, depths[organizationRef], reason))
+		}
+	}
+
+	endpoints, err := c.readEndpoints(ctx, candidates)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i, candidate := range candidates {
+		if candidate.reason != "" {
+			continue
+		}
+		endpoint, ok := endpoints[candidate.Reference]
+		if !ok {
+			candidates[i].reason = "not found in the query directory"
+			continue
+		}
+		candidates[i].reason = endpointMismatch(endpoint, request, now)
+	}
+	return rankEndpoints(request, candidates, endpoints), nil
+}
+
+// resolveOrganizations returns the organizations with the given URA and the organizations that are part of them (recursively),
+// with their depth (number of partOf levels) by reference.
+func (c *Component) resolveOrganizations(ctx context.Context, ura string) ([]fhir.Organization, map[string]int, error) {
+	entries, err := c.query(ctx, c.fhirQueryClient, "Organization", url.Values{
+		"identifier": []string{coding.URANamingSystem + "|" + ura},
+		"_count":     []string{strconv.Itoa(searchPageSize)},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to search Organization in query directory: %w", err)
+	}
+	var result []fhir.Organization
+	depths := make(map[string]int)
+	level := addOrganizations(entries, 0, depths, &result)
+	if len(level) == 0 {
+		return nil, nil, errResolveOrganizationNotFound
+	}
+	for depth := 1; depth <= maxResolveDepth && len(level) > 0; depth++ {
+		children, err := c.searchByReferences(ctx, "Organization", "partof", level)
+		if err != nil {
+			return nil, nil, err
+		}
+		level = addOrganizations(children, depth, depths, &result)
+	}
+	return result, depths, nil
+}
+
+// addOrganizations adds the Organizations of the entries that weren't seen before to the result, and returns their references.
+func addOrganizations(entries []fhir.BundleEntry, depth int, depths map[string]int, result *[]fhir.Organization) []string {
+	var added []string
+	for _, entry := range entries {
+		var organization fhir.Organization
+		if err := json.Unmarshal(entry.Resource, &organization); err != nil || organization.Id == nil {
+			continue
+		}
+		reference := "Organization/" + *organization.Id
+		if _, seen := depths[reference]; seen {
+			// Circular partOf references, or included through multiple searches
+			continue
+		}
+		depths[reference] = depth
+		*result = append(*result, organization)
+		added = append(added, reference)
+	}
+	return added
+}
+
+// searchByReferences searches the query directory for resources of which the search parameter references one of the given references.
+func (c *Component) searchByReferences(ctx context.Context, resourceType string, searchParam string, references []string) ([]fhir.BundleEntry, error) {
+	var result []fhir.BundleEntry
+	for batch := range slices.Chunk(references, resolveSearchBatchSize) {
+		entries, err := c.query(ctx, c.fhirQueryClient, resourceType, url.Values{
+			searchParam: []string{strings.Join(batch, ",")},
+			"_count":    []string{strconv.Itoa(searchPageSize)},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to search %s in query directory: %w", resourceType, err)
+		}
+		result = append(result, entries...)
+	}
+	return result, nil
+}
+
+// readEndpoints reads the Endpoints of the candidates that are still in the running from the query directory, by reference.
+func (c *Component) readEndpoints(ctx context.Context, candidates []endpointCandidate) (map[string]fhir.Endpoint, error) {
+	var ids []string
+	for _, candidate := range candidates {
+		if candidate.reason == "" {
+			ids = append(ids, strings.TrimPrefix(candidate.Reference, "Endpoint/"))
+		}
+	}
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	entries, err := c.searchByReferences(ctx, "Endpoint", "_id", ids)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]fhir.Endpoint, len(entries))
+	for _, entry := range entries {
+		var endpoint fhir.Endpoint
+		if err := json.Unmarshal(entry.Resource, &endpoint); err != nil || endpoint.Id == nil {
+			continue
+		}
+		result["Endpoint/"+*endpoint.Id] = endpoint
+	}
+	return result, nil
+}
+
+func newEndpointCandidate(endpointRef fhir.Reference, organizationRef string, serviceRef string, depth int, reason string) endpointCandidate {
+	result := endpointCandidate{
+		endpointPath: endpointPath{
+			Organization:      organizationRef,
+			HealthcareService: serviceRef,
+			Depth:             depth,
+		},
+		reason: reason,
+	}
+	if endpointRef.Reference == nil || !libfhir.ReferencesType(*endpointRef.Reference, "Endpoint") {
+		result.reason = "not a local reference to an Endpoint"
+		if endpointRef.Reference != nil {
+			result.Reference = *endpointRef.Reference
+		}
+		return result
+	}
+	result.Reference = "Endpoint/" + libfhir.IDFromReference(*endpointRef.Reference, "Endpoint")
+	return result
+}
+
+// endpointMismatch returns why the Endpoint doesn't match the request, or an empty string if it does.
+func endpointMismatch(endpoint fhir.Endpoint, request ResolveRequest, now time.Time) string {
+	if endpoint.Status != fhir.EndpointStatusActive {
+		return "status is " + endpoint.Status.String()
+	}
+	if endpoint.Period != nil && endpoint.Period.End != nil && periodEnded(*endpoint.Period.End, now) {
+		return "period ended at " + *endpoint.Period.End
+	}
+	if request.PayloadType != "" && !slices.ContainsFunc(endpoint.PayloadType, func(concept fhir.CodeableConcept) bool { return codingsMatchToken(concept.Coding, request.PayloadType) }) {
+		return "payload type " + request.PayloadType + " not supported"
+	}
+	if request.ConnectionType != "" && !codingsMatchToken([]fhir.Coding{endpoint.ConnectionType}, request.ConnectionType) {
+		return "connection type is " + to.EmptyString(endpoint.ConnectionType.Code) + ", not " + request.ConnectionType
+	}
+	if endpoint.Address == "" {
+		return "no address"
+	}
+	return ""
+}
+
+// periodEnded returns whether the end of a period (a FHIR dateTime, of which the precision can be a day) lies before now.
+// Unparseable values are ignored.
+func periodEnded(end string, now time.Time) bool {
+	if endTime, err := time.Parse(time.RFC3339, end); err == nil {
+		return endTime.Before(now)
+	}
+	if endDate, err := time.Parse(time.DateOnly, end); err == nil {
+		// The period includes the whole day
+		return endDate.AddDate(0, 0, 1).Before(now)
+	}
+	return false
+}
+
+// rankEndpoints orders the matching candidates (see resolveEndpoints), keeping the best path per Endpoint.
+// Endpoints without any matching path are discarded, with the reason of their first path.
+func rankEndpoints(request ResolveRequest, candidates []endpointCandidate, endpoints map[string]fhir.Endpoint) *ResolveResult {
+	preferServices := request.ServiceType != ""
+	var matches []endpointCandidate
+	for _, candidate := range candidates {
+		if candidate.reason == "" {
+			matches = append(matches, candidate)
+		}
+	}
+	slices.SortStableFunc(matches, func(a, b endpointCandidate) int {
+		aViaService, bViaService := a.HealthcareService != "", b.HealthcareService != ""
+		if aViaService != bViaService {
+			if aViaService == preferServices {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Or(cmp.Compare(a.Depth, b.Depth), strings.Compare(a.Reference, b.Reference))
+	})
+
+	result := &ResolveResult{
+		ResolveRequest: request,
+		Endpoints:      []ResolvedEndpoint{},
+		Discarded:      []DiscardedEndpoint{},
+	}
+	resolved := make(map[string]bool)
+	for _, match := range matches {
+		if resolved[match.Reference] {
+			continue
+		}
+		resolved[match.Reference] = true
+		endpoint := endpoints[match.Reference]
+		result.Endpoints = append(result.Endpoints, ResolvedEndpoint{
+			Rank:         len(result.Endpoints) + 1,
+			endpointPath: match.endpointPath,
+			Address:      endpoint.Address,
+			Endpoint:     endpoint,
+		})
+	}
+	for _, candidate := range candidates {
+		if resolved[candidate.Reference] {
+			continue
+		}
+		resolved[candidate.Reference] = true
+		result.Discarded = append(result.Discarded, DiscardedEndpoint{
+			endpointPath: candidate.endpointPath,
+			Reason:       candidate.reason,
+		})
+	}
+	return result
+}
+
+// codingsMatchToken returns whether one of the codings matches the FHIR token, which is either a code or system|code.
+func codingsMatchToken(codings []fhir.Coding, token string) bool {
+	system, code, hasSystem := strings.Cut(token, "|")
+	if !hasSystem {
+		code, system = system, ""
+	}
+	for _, curr := range codings {
+		if to.EmptyString(curr.Code) == code && (!hasSystem || to.EmptyString(curr.System) == system) {
+			return true
+		}
+	}
+	return false
+}
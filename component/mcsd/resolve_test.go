@@ -0,0 +1,201 @@
+package mcsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestComponent_resolveEndpoints(t *testing.T) {
+	const payloadSystem = "http://nuts-foundation.github.io/nl-generic-functions-ig/CodeSystem/nl-gf-data-exchange-capabilities"
+	endpointRef := func(id string) fhir.Reference {
+		return fhir.Reference{Reference: to.Ptr("Endpoint/" + id)}
+	}
+	endpoint := func(id string, payloadType string) fhir.Endpoint {
+		return fhir.Endpoint{
+			Id:             to.Ptr(id),
+			Status:         fhir.EndpointStatusActive,
+			Address:        "https://example.com/" + id,
+			ConnectionType: fhir.Coding{System: to.Ptr("http://terminology.hl7.org/CodeSystem/endpoint-connection-type"), Code: to.Ptr("hl7-fhir-rest")},
+			PayloadType:    []fhir.CodeableConcept{{Coding: []fhir.Coding{{System: to.Ptr(payloadSystem), Code: to.Ptr(payloadType)}}}},
+		}
+	}
+	suspended := endpoint("suspended", "eOverdracht-receiver")
+	suspended.Status = fhir.EndpointStatusSuspended
+	expired := endpoint("expired", "eOverdracht-receiver")
+	expired.Period = &fhir.Period{End: to.Ptr(time.Now().AddDate(0, 0, -2).Format(time.DateOnly))}
+	resources := []any{
+		fhir.Organization{
+			Id:         to.Ptr("hospital"),
+			Identifier: []fhir.Identifier{{System: to.Ptr(coding.URANamingSystem), Value: to.Ptr("1234")}},
+			Endpoint:   []fhir.Reference{endpointRef("hospital-notify"), endpointRef("hospital-receiver"), endpointRef("suspended"), endpointRef("missing")},
+		},
+		fhir.Organization{
+			Id:       to.Ptr("department"),
+			PartOf:   &fhir.Reference{Reference: to.Ptr("Organization/hospital")},
+			Endpoint: []fhir.Reference{endpointRef("department-receiver"), endpointRef("expired")},
+		},
+		fhir.Organization{
+			Id:       to.Ptr("ward"),
+			PartOf:   &fhir.Reference{Reference: to.Ptr("Organization/department")},
+			Active:   to.Ptr(false),
+			Endpoint: []fhir.Reference{endpointRef("ward-receiver")},
+		},
+		fhir.Organization{
+			Id:         to.Ptr("other"),
+			Identifier: []fhir.Identifier{{System: to.Ptr(coding.URANamingSystem), Value: to.Ptr("5678")}},
+			Endpoint:   []fhir.Reference{endpointRef("other-receiver")},
+		},
+		fhir.HealthcareService{
+			Id:         to.Ptr("cardiology"),
+			ProvidedBy: &fhir.Reference{Reference: to.Ptr("Organization/department")},
+			Type:       []fhir.CodeableConcept{{Coding: []fhir.Coding{{System: to.Ptr("http://snomed.info/sct"), Code: to.Ptr("394579002")}}}},
+			Endpoint:   []fhir.Reference{endpointRef("cardiology-receiver")},
+		},
+		fhir.HealthcareService{
+			Id:         to.Ptr("radiology"),
+			ProvidedBy: &fhir.Reference{Reference: to.Ptr("Organization/hospital")},
+			Type:       []fhir.CodeableConcept{{Coding: []fhir.Coding{{System: to.Ptr("http://snomed.info/sct"), Code: to.Ptr("394914008")}}}},
+			Endpoint:   []fhir.Reference{endpointRef("radiology-receiver")},
+		},
+		endpoint("hospital-notify", "consent-notify"),
+		endpoint("hospital-receiver", "eOverdracht-receiver"),
+		endpoint("department-receiver", "eOverdracht-receiver"),
+		endpoint("ward-receiver", "eOverdracht-receiver"),
+		endpoint("other-receiver", "eOverdracht-receiver"),
+		endpoint("cardiology-receiver", "eOverdracht-receiver"),
+		endpoint("radiology-receiver", "eOverdracht-receiver"),
+		suspended,
+		expired,
+	}
+	newComponent := func(t *testing.T) *Component {
+		component, err := New(DefaultConfig())
+		require.NoError(t, err)
+		component.fhirQueryClient = &test.StubFHIRClient{Resources: resources}
+		return component
+	}
+	references := func(endpoints []ResolvedEndpoint) []string {
+		var result []string
+		for _, endpoint := range endpoints {
+			result = append(result, endpoint.Reference)
+		}
+		return result
+	}
+	discardReasons := func(discarded []DiscardedEndpoint) map[string]string {
+		result := make(map[string]string)
+		for _, endpoint := range discarded {
+			result[endpoint.Reference] = endpoint.Reason
+		}
+		return result
+	}
+
+	t.Run("by payload type", func(t *testing.T) {
+		result, err := newComponent(t).resolveEndpoints(t.Context(), ResolveRequest{Ura: "1234", PayloadType: payloadSystem + "|eOverdracht-receiver"})
+
+		require.NoError(t, err)
+		// Organization endpoints first, then by depth
+		assert.Equal(t, []string{"Endpoint/hospital-receiver", "Endpoint/department-receiver", "Endpoint/radiology-receiver", "Endpoint/cardiology-receiver"}, references(result.Endpoints))
+		assert.Equal(t, 1, result.Endpoints[0].Rank)
+		assert.Equal(t, "https://example.com/hospital-receiver", result.Endpoints[0].Address)
+		assert.Equal(t, "Organization/department", result.Endpoints[1].Organization)
+		assert.Equal(t, 1, result.Endpoints[1].Depth)
+		assert.Equal(t, "HealthcareService/radiology", result.Endpoints[2].HealthcareService)
+		assert.Equal(t, map[string]string{
+			"Endpoint/hospital-notify": "payload type " + payloadSystem + "|eOverdracht-receiver not supported",
+			"Endpoint/suspended":       "status is suspended",
+			"Endpoint/missing":         "not found in the query directory",
+			"Endpoint/expired":         "period ended at " + *expired.Period.End,
+			"Endpoint/ward-receiver":   "Organization/ward is inactive",
+		}, discardReasons(result.Discarded))
+	})
+	t.Run("by service type", func(t *testing.T) {
+		result, err := newComponent(t).resolveEndpoints(t.Context(), ResolveRequest{Ura: "1234", PayloadType: "eOverdracht-receiver", ServiceType: "http://snomed.info/sct|394579002"})
+
+		require.NoError(t, err)
+		// Endpoints of HealthcareServices providing the service first
+		assert.Equal(t, []string{"Endpoint/cardiology-receiver", "Endpoint/hospital-receiver", "Endpoint/department-receiver"}, references(result.Endpoints))
+		assert.Equal(t, "HealthcareService/radiology doesn't provide service type http://snomed.info/sct|394579002", discardReasons(result.Discarded)["Endpoint/radiology-receiver"])
+	})
+	t.Run("by connection type", func(t *testing.T) {
+		result, err := newComponent(t).resolveEndpoints(t.Context(), ResolveRequest{Ura: "5678", ConnectionType: "hl7-fhir-msg"})
+
+		require.NoError(t, err)
+		assert.Empty(t, result.Endpoints)
+		assert.Equal(t, "connection type is hl7-fhir-rest, not hl7-fhir-msg", discardReasons(result.Discarded)["Endpoint/other-receiver"])
+	})
+	t.Run("circular partOf references", func(t *testing.T) {
+		component := newComponent(t)
+		component.fhirQueryClient = &test.StubFHIRClient{Resources: []any{
+			fhir.Organization{
+				Id:         to.Ptr("a"),
+				Identifier: []fhir.Identifier{{System: to.Ptr(coding.URANamingSystem), Value: to.Ptr("1234")}},
+				PartOf:     &fhir.Reference{Reference: to.Ptr("Organization/b")},
+				Endpoint:   []fhir.Reference{endpointRef("hospital-receiver")},
+			},
+			fhir.Organization{
+				Id:       to.Ptr("b"),
+				PartOf:   &fhir.Reference{Reference: to.Ptr("Organization/a")},
+				Endpoint: []fhir.Reference{endpointRef("hospital-receiver")},
+			},
+			endpoint("hospital-receiver", "eOverdracht-receiver"),
+		}}
+
+		result, err := component.resolveEndpoints(t.Context(), ResolveRequest{Ura: "1234"})
+
+		require.NoError(t, err)
+		require.Len(t, result.Endpoints, 1)
+		assert.Equal(t, "Organization/a", result.Endpoints[0].Organization)
+		assert.Empty(t, result.Discarded)
+	})
+	t.Run("unknown URA", func(t *testing.T) {
+		_, err := newComponent(t).resolveEndpoints(t.Context(), ResolveRequest{Ura: "0000"})
+
+		assert.ErrorIs(t, err, errResolveOrganizationNotFound)
+	})
+	t.Run("HTTP API", func(t *testing.T) {
+		mux := http.NewServeMux()
+		newComponent(t).registerResolveHandlers(mux)
+
+		t.Run("ok", func(t *testing.T) {
+			httpResponse := httptest.NewRecorder()
+			mux.ServeHTTP(httpResponse, httptest.NewRequest(http.MethodGet, "/mcsd/resolve?ura=5678&payloadType=eOverdracht-receiver", nil))
+
+			require.Equal(t, http.StatusOK, httpResponse.Code)
+			var result ResolveResult
+			require.NoError(t, json.Unmarshal(httpResponse.Body.Bytes(), &result))
+			assert.Equal(t, "5678", result.Ura)
+			assert.Equal(t, []string{"Endpoint/other-receiver"}, references(result.Endpoints))
+			assert.Equal(t, "https://example.com/other-receiver", result.Endpoints[0].Endpoint.Address)
+		})
+		t.Run("missing URA", func(t *testing.T) {
+			httpResponse := httptest.NewRecorder()
+			mux.ServeHTTP(httpResponse, httptest.NewRequest(http.MethodGet, "/mcsd/resolve", nil))
+
+			assert.Equal(t, http.StatusBadRequest, httpResponse.Code)
+		})
+		t.Run("unknown URA", func(t *testing.T) {
+			httpResponse := httptest.NewRecorder()
+			mux.ServeHTTP(httpResponse, httptest.NewRequest(http.MethodGet, "/mcsd/resolve?ura=0000", nil))
+
+			assert.Equal(t, http.StatusNotFound, httpResponse.Code)
+		})
+	})
+}
+
+func TestCodingsMatchToken(t *testing.T) {
+	codings := []fhir.Coding{{System: to.Ptr("http://example.com"), Code: to.Ptr("a")}}
+	assert.True(t, codingsMatchToken(codings, "a"))
+	assert.True(t, codingsMatchToken(codings, "http://example.com|a"))
+	assert.False(t, codingsMatchToken(codings, "http://example.org|a"))
+	assert.False(t, codingsMatchToken(codings, "b"))
+	assert.False(t, codingsMatchToken(nil, "a"))
+}
@@ -0,0 +1,199 @@
+package mcsd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// Sync strategies, which determine how the changes of an administration directory are fetched.
+const (
+	// syncStrategyAuto uses the search strategy for resource types of which the directory's CapabilityStatement
+	// doesn't list the history-type interaction, and the history strategy for all others.
+	syncStrategyAuto = "auto"
+	// syncStrategyHistory fetches the changes from the _history of the resource types.
+	syncStrategyHistory = "history"
+	// syncStrategySearch fetches the changes by searching with _lastUpdated, and detects deletions by comparing a snapshot
+	// of the resources in the directory with the query directory. It's meant for directories that don't support _history,
+	// e.g. FHIR façades over existing systems.
+	syncStrategySearch = "search"
+)
+
+var syncStrategies = []string{syncStrategyAuto, syncStrategyHistory, syncStrategySearch}
+
+// validateSyncStrategy returns an error if the given sync strategy isn't supported. An empty strategy means auto.
+func validateSyncStrategy(strategy string) error {
+	if strategy != "" && !slices.Contains(syncStrategies, strategy) {
+		return fmt.Errorf("invalid sync strategy %q (supported: %s)", strategy, strings.Join(syncStrategies, ", "))
+	}
+	return nil
+}
+
+// syncStrategy returns the configured sync strategy of the given administration directory,
+// falling back to the default sync strategy.
+func (c *Component) syncStrategy(fhirBaseURL string, authoritativeUra string) string {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	for _, directory := range c.administrationDirectories {
+		if directory.fhirBaseURL == fhirBaseURL && directory.authoritativeUra == authoritativeUra && directory.syncStrategy != "" {
+			return directory.syncStrategy
+		}
+	}
+	if c.config.SyncStrategy != "" {
+		return c.config.SyncStrategy
+	}
+	return syncStrategyAuto
+}
+
+// searchResourceTypes returns the resource types of the run that must be synced using the search strategy.
+// For the auto strategy, it reads the directory's CapabilityStatement. If that fails, _history is assumed to be supported.
+func (c *Component) searchResourceTypes(ctx context.Context, run *syncRun, strategy string) []string {
+	switch strategy {
+	case syncStrategyHistory:
+		return []string{}
+	case syncStrategySearch:
+		return slices.Clone(run.resourceTypes)
+	}
+	var capabilityStatement fhir.CapabilityStatement
+	if err := run.client.ReadWithContext(ctx, "metadata", &capabilityStatement); err != nil {
+		slog.WarnContext(ctx, "Failed to read CapabilityStatement of mCSD Directory, assuming it supports _history", logging.FHIRServer(run.fhirBaseURL), logging.Error(err))
+		return []string{}
+	}
+	result := []string{}
+	for _, resourceType := range run.resourceTypes {
+		if !supportsHistory(capabilityStatement, resourceType) {
+			result = append(result, resourceType)
+		}
+	}
+	if len(result) > 0 {
+		slog.InfoContext(ctx, "mCSD Directory doesn't support _history for some resource types, using search instead", logging.FHIRServer(run.fhirBaseURL), slog.Any("resourceTypes", result))
+	}
+	return result
+}
+
+// supportsHistory returns whether the CapabilityStatement lists the history-type interaction for the given resource type.
+// Resource types that aren't listed at all are assumed to support it, so they're synced as before.
+func supportsHistory(capabilityStatement fhir.CapabilityStatement, resourceType string) bool {
+	listed := false
+	for _, rest := range capabilityStatement.Rest {
+		if rest.Mode != fhir.RestfulCapabilityModeServer {
+			continue
+		}
+		for _, resource := range rest.Resource {
+			if resource.Type.Code() != resourceType {
+				continue
+			}
+			listed = true
+			for _, interaction := range resource.Interaction {
+				if interaction.Code == fhir.TypeRestfulInteractionHistoryType {
+					return true
+				}
+			}
+		}
+	}
+	return !listed
+}
+
+// fetchBySearch fetches the changes of a resource type using the search strategy, and passes them to spool as history entries.
+// Changed resources are searched with _lastUpdated, and become updates. Deleted resources are detected by comparing the ids
+// of all resources in the directory (a snapshot) with the ones known locally, and become deletes.
+// It returns the first page of the search, which holds the server's time for the next sync.
+func (c *Component) fetchBySearch(ctx context.Context, run *syncRun, resourceType string, spool func(entries []fhir.BundleEntry) error) (fhir.Bundle, error) {
+	incremental := run.checkpoint.Since != "" && !run.checkpoint.FullHistory
+	searchParams := url.Values{
+		"_count": []string{strconv.Itoa(searchPageSize)},
+	}
+	if incremental {
+		searchParams.Set("_lastUpdated", "gt"+run.checkpoint.Since)
+	}
+	snapshot := make(map[string]bool)
+	firstPage, err := c.queryFHIR(ctx, run.client, resourceType, searchParams, false, func(page *fhir.Bundle) error {
+		entries := make([]fhir.BundleEntry, 0, len(page.Entry))
+		for _, entry := range page.Entry {
+			info, err := libfhir.ExtractResourceInfo(entry.Resource)
+			if err != nil || info.ResourceType != resourceType || info.ID == "" {
+				// e.g. included resources or OperationOutcomes
+				continue
+			}
+			snapshot[info.ID] = true
+			entry.Request = &fhir.BundleEntryRequest{Method: fhir.HTTPVerbPUT, Url: resourceType + "/" + info.ID}
+			entries = append(entries, entry)
+		}
+		return spool(entries)
+	})
+	if err != nil {
+		return fhir.Bundle{}, err
+	}
+	if incremental {
+		// The changes don't include the unchanged resources, so take a separate snapshot of the ids of all resources
+		snapshot = make(map[string]bool)
+		_, err = c.queryFHIR(ctx, run.client, resourceType, url.Values{
+			"_count":    []string{strconv.Itoa(searchPageSize)},
+			"_elements": []string{"id"},
+		}, false, func(page *fhir.Bundle) error {
+			for _, entry := range page.Entry {
+				if info, err := libfhir.ExtractResourceInfo(entry.Resource); err == nil && info.ResourceType == resourceType && info.ID != "" {
+					snapshot[info.ID] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fhir.Bundle{}, fmt.Errorf("snapshot failed: %w", err)
+		}
+	}
+	deletes, err := c.findDeletedResources(ctx, run, resourceType, snapshot)
+	if err != nil {
+		return fhir.Bundle{}, err
+	}
+	if err := spool(deletes); err != nil {
+		return fhir.Bundle{}, err
+	}
+	return firstPage, nil
+}
+
+// findDeletedResources returns delete entries for the resources of the given type that are known locally, but aren't in the directory's snapshot.
+// Resources are known locally when they were imported into the query directory, and Endpoints of root directories
+// when a directory was discovered through them.
+func (c *Component) findDeletedResources(ctx context.Context, run *syncRun, resourceType string, snapshot map[string]bool) ([]fhir.BundleEntry, error) {
+	fhirBaseURL := strings.TrimRight(run.fhirBaseURL, "/")
+	prefix := fhirBaseURL + "/" + resourceType + "/"
+	var known []string
+	if run.allowDiscovery {
+		// Resources of directories for discovery aren't imported, but deleted Endpoints must unregister the directories discovered through them
+		if resourceType == "Endpoint" {
+			c.stateMux.Lock()
+			for _, directory := range c.administrationDirectories {
+				if strings.HasPrefix(directory.sourceURL, prefix) {
+					known = append(known, directory.sourceURL)
+				}
+			}
+			c.stateMux.Unlock()
+		}
+	} else {
+		var err error
+		if known, err = c.findSourcesBelow(ctx, resourceType, fhirBaseURL); err != nil {
+			return nil, err
+		}
+	}
+	var result []fhir.BundleEntry
+	for _, source := range known {
+		id, ok := strings.CutPrefix(source, prefix)
+		if !ok || id == "" || strings.Contains(id, "/") || snapshot[id] {
+			continue
+		}
+		result = append(result, fhir.BundleEntry{
+			FullUrl: &source,
+			Request: &fhir.BundleEntryRequest{Method: fhir.HTTPVerbDELETE, Url: resourceType + "/" + id},
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,121 @@
+package mcsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestComponent_searchStrategy(t *testing.T) {
+	// A directory that doesn't support _history for Organization
+	capabilityStatement := `{"resourceType":"CapabilityStatement","rest":[{"mode":"server","resource":[
+		{"type":"Organization","interaction":[{"code":"read"},{"code":"search-type"}]}
+	]}]}`
+	searchSet := `{"resourceType":"Bundle","type":"searchset","meta":{"lastUpdated":"2026-02-01T00:00:00Z"},"entry":[
+		{"fullUrl":"http://example.org/fhir/Organization/parent","search":{"mode":"match"},
+		 "resource":{"resourceType":"Organization","id":"parent","name":"Parent","identifier":[{"system":"http://fhir.nl/fhir/NamingSystem/ura","value":"1234"}]}},
+		{"fullUrl":"http://example.org/fhir/Organization/child","search":{"mode":"match"},
+		 "resource":{"resourceType":"Organization","id":"child","name":"Child","partOf":{"reference":"Organization/parent"}}},
+		{"search":{"mode":"outcome"},"resource":{"resourceType":"OperationOutcome","id":"warning"}}
+	]}`
+	var searches []url.Values
+	historyRequests := 0
+	mux := http.NewServeMux()
+	mockEndpoints(mux, map[string]*string{"/fhir/metadata": &capabilityStatement})
+	mux.HandleFunc("/fhir/Organization", func(w http.ResponseWriter, r *http.Request) {
+		searches = append(searches, r.URL.Query())
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_, _ = w.Write([]byte(searchSet))
+	})
+	mux.HandleFunc("/fhir/Organization/_history", func(w http.ResponseWriter, r *http.Request) {
+		historyRequests++
+		http.Error(w, "not supported", http.StatusNotImplemented)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	baseURL := server.URL + "/fhir"
+
+	newComponent := func(t *testing.T, syncStrategy string) (*Component, *test.StubFHIRClient) {
+		config := DefaultConfig()
+		config.QueryDirectory = DirectoryConfig{FHIRBaseURL: "http://example.com/local/fhir"}
+		config.SyncStrategy = syncStrategy
+		component, err := New(config)
+		require.NoError(t, err)
+		component.fhirAdminClientFn = func(baseURL *url.URL) fhirclient.Client {
+			return fhirclient.New(baseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		}
+		queryClient := &test.StubFHIRClient{
+			Resources: []any{
+				fhir.Organization{Id: to.Ptr("local-1"), Meta: &fhir.Meta{Source: to.Ptr(baseURL + "/Organization/deleted")}},
+			},
+		}
+		component.fhirQueryClient = queryClient
+		component.setLastUpdateTime(t.Context(), baseURL, "2026-01-01T00:00:00Z")
+		searches = nil
+		historyRequests = 0
+		return component, queryClient
+	}
+
+	t.Run("auto: uses search when _history isn't supported", func(t *testing.T) {
+		component, queryClient := newComponent(t, "")
+
+		report, err := component.updateFromDirectory(t.Context(), baseURL, []string{"Organization"}, false, "", updateOptions{})
+
+		require.NoError(t, err)
+		assert.Empty(t, report.Errors)
+		assert.Zero(t, historyRequests)
+		require.GreaterOrEqual(t, len(searches), 2)
+		assert.Equal(t, "gt2026-01-01T00:00:00Z", searches[0].Get("_lastUpdated"), "changes should be searched with _lastUpdated")
+		assert.Equal(t, "id", searches[1].Get("_elements"), "snapshot should only contain ids")
+		assert.Equal(t, 2, report.CountCreated)
+		assert.Equal(t, 1, report.CountDeleted, "resource that is no longer in the directory should be deleted")
+		var sources []string
+		for _, resource := range queryClient.Resources {
+			data, _ := json.Marshal(resource)
+			var baseResource test.BaseResource
+			_ = json.Unmarshal(data, &baseResource)
+			if baseResource.Meta != nil && baseResource.Meta.Source != nil {
+				sources = append(sources, *baseResource.Meta.Source)
+			}
+		}
+		assert.NotContains(t, sources, baseURL+"/Organization/deleted")
+		lastUpdate, _ := component.getLastUpdateTime(baseURL)
+		assert.Equal(t, "2026-02-01T00:00:00Z", lastUpdate)
+	})
+	t.Run("configured history strategy", func(t *testing.T) {
+		component, _ := newComponent(t, syncStrategyHistory)
+
+		_, err := component.updateFromDirectory(t.Context(), baseURL, []string{"Organization"}, false, "", updateOptions{})
+
+		require.Error(t, err)
+		assert.Equal(t, 1, historyRequests)
+	})
+	t.Run("invalid sync strategy", func(t *testing.T) {
+		config := DefaultConfig()
+		config.AdministrationDirectories = map[string]DirectoryConfig{"root": {FHIRBaseURL: baseURL, SyncStrategy: "changes"}}
+		_, err := New(config)
+		assert.ErrorContains(t, err, `invalid sync strategy "changes"`)
+	})
+}
+
+func TestSupportsHistory(t *testing.T) {
+	capabilityStatement := fhir.CapabilityStatement{Rest: []fhir.CapabilityStatementRest{{
+		Mode: fhir.RestfulCapabilityModeServer,
+		Resource: []fhir.CapabilityStatementRestResource{
+			{Type: fhir.ResourceTypeOrganization, Interaction: []fhir.CapabilityStatementRestResourceInteraction{{Code: fhir.TypeRestfulInteractionHistoryType}}},
+			{Type: fhir.ResourceTypeEndpoint, Interaction: []fhir.CapabilityStatementRestResourceInteraction{{Code: fhir.TypeRestfulInteractionSearchType}}},
+		},
+	}}}
+	assert.True(t, supportsHistory(capabilityStatement, "Organization"))
+	assert.False(t, supportsHistory(capabilityStatement, "Endpoint"))
+	assert.True(t, supportsHistory(capabilityStatement, "Location"), "unlisted resource types are assumed to support _history")
+}
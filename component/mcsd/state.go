@@ -0,0 +1,232 @@
+package mcsd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+)
+
+// State store buckets used by the mCSD Update Client.
+const (
+	// lastUpdateBucket holds the _since timestamp for the next incremental sync, per directory key.
+	lastUpdateBucket = "mcsd_lastupdate"
+	// discoveredDirectoriesBucket holds the administration directories discovered through a root directory, per directory key.
+	discoveredDirectoriesBucket = "mcsd_directories"
+	// syncCheckpointBucket holds the progress of a sync that hasn't completed yet, per directory key.
+	syncCheckpointBucket = "mcsd_checkpoint"
+	// excludedDirectoriesBucket holds the FHIR base URLs excluded through the directory management API.
+	excludedDirectoriesBucket = "mcsd_excluded"
+	// purgeBucket holds the unregistered directories of which the resources still need to be removed from the query directory,
+	// by FHIR base URL.
+	purgeBucket = "mcsd_purge"
+	// subscriptionsBucket holds the FHIR Subscriptions created on administration directories, per directory key.
+	subscriptionsBucket = "mcsd_subscriptions"
+	// quarantineBucket holds the resources rejected by validation, by quarantine ID (derived from their directory and source URL).
+	quarantineBucket = "mcsd_quarantine"
+	// spoolBucketPrefix prefixes the buckets that hold the history entries fetched by a sync that hasn't completed yet,
+	// one bucket per directory key and resource type.
+	spoolBucketPrefix = "mcsd_spool|"
+)
+
+// syncCheckpoint records the progress of a sync from an administration directory, so an interrupted sync can be resumed.
+type syncCheckpoint struct {
+	// Since is the _since value of the sync, empty for a full sync.
+	Since string `json:"since"`
+	// NextSyncTime is the _since value for the next sync, once this sync completes.
+	NextSyncTime string `json:"nextSyncTime"`
+	// FullHistory is set when a URA identifier change was detected, after which all history is fetched without _since.
+	FullHistory bool `json:"fullHistory"`
+	// FetchedTypes are the resource types of which the history has been fetched and spooled.
+	FetchedTypes []string `json:"fetchedTypes"`
+	// ChunkSize is the transaction size the sync was planned with.
+	ChunkSize int `json:"chunkSize"`
+	// AppliedChunks is the number of transaction chunks that have been applied to the query directory.
+	AppliedChunks int `json:"appliedChunks"`
+	// SearchTypes are the resource types that are synced using the search strategy (instead of _history).
+	SearchTypes []string `json:"searchTypes"`
+	// Reconcile is set for a reconciling sync, which fetches the complete history and removes stale resources from the query directory.
+	Reconcile bool `json:"reconcile"`
+}
+
+// persistedDirectory is the stored form of a discovered administrationDirectory.
+type persistedDirectory struct {
+	FHIRBaseURL      string   `json:"fhirBaseURL"`
+	ResourceTypes    []string `json:"resourceTypes"`
+	Discover         bool     `json:"discover"`
+	SourceURL        string   `json:"sourceURL"`
+	AuthoritativeUra string   `json:"authoritativeUra"`
+	Manual           bool     `json:"manual"`
+	SyncStrategy     string   `json:"syncStrategy,omitempty"`
+	// AuthorizationServer is the OAuth2 authorization server advertised by the Endpoint the directory was discovered from.
+	AuthorizationServer string `json:"authorizationServer,omitempty"`
+	// DiscoveredThrough holds the FHIR base URLs of the directories through which the directory was discovered, root directory first.
+	DiscoveredThrough []string `json:"discoveredThrough,omitempty"`
+}
+
+// restoreExclusions loads the FHIR base URLs excluded through the directory management API from the state store.
+func (c *Component) restoreExclusions() error {
+	err := c.stateStore.Walk(excludedDirectoriesBucket, func(key string, _ []byte) error {
+		c.stateMux.Lock()
+		defer c.stateMux.Unlock()
+		c.excludedDirectories[key] = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("restore excluded directories: %w", err)
+	}
+	return nil
+}
+
+// restoreState loads the sync timestamps and discovered administration directories from the state store,
+// so synchronization continues incrementally after a restart instead of starting over.
+// Restored directories are registered again, so they're subject to the current exclusion list.
+func (c *Component) restoreState(ctx context.Context) error {
+	err := c.stateStore.Walk(lastUpdateBucket, func(key string, value []byte) error {
+		var lastUpdate string
+		if err := json.Unmarshal(value, &lastUpdate); err != nil {
+			return fmt.Errorf("invalid last update time (directory=%s): %w", key, err)
+		}
+		c.stateMux.Lock()
+		defer c.stateMux.Unlock()
+		c.lastUpdateTimes[key] = lastUpdate
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("restore last update times: %w", err)
+	}
+	count := 0
+	err = c.stateStore.Walk(discoveredDirectoriesBucket, func(key string, value []byte) error {
+		var directory persistedDirectory
+		if err := json.Unmarshal(value, &directory); err != nil {
+			return fmt.Errorf("invalid discovered directory (directory=%s): %w", key, err)
+		}
+		err := c.registerDirectory(ctx, administrationDirectory{
+			fhirBaseURL:         directory.FHIRBaseURL,
+			resourceTypes:       directory.ResourceTypes,
+			discover:            directory.Discover,
+			sourceURL:           directory.SourceURL,
+			authoritativeUra:    directory.AuthoritativeUra,
+			manual:              directory.Manual,
+			syncStrategy:        directory.SyncStrategy,
+			authorizationServer: directory.AuthorizationServer,
+			discoveredThrough:   directory.DiscoveredThrough,
+		})
+		if errors.Is(err, errDirectoryExcluded) {
+			// Excluded after it was discovered: remove it and the resources imported from it
+			slog.InfoContext(ctx, "Discovered mCSD Directory is excluded, removing it", logging.FHIRServer(directory.FHIRBaseURL))
+			c.schedulePurge(ctx, administrationDirectory{fhirBaseURL: directory.FHIRBaseURL, resourceTypes: directory.ResourceTypes})
+			return c.stateStore.Delete(discoveredDirectoriesBucket, key)
+		}
+		if err != nil && !errors.Is(err, errDirectoryExists) {
+			slog.WarnContext(ctx, "Failed to restore discovered mCSD Directory, removing it", logging.FHIRServer(directory.FHIRBaseURL), logging.Error(err))
+			return c.stateStore.Delete(discoveredDirectoriesBucket, key)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("restore discovered directories: %w", err)
+	}
+	slog.InfoContext(ctx, "Restored mCSD Update Client state", slog.Int("directories", count), slog.Int("timestamps", len(c.lastUpdateTimes)))
+	return nil
+}
+
+// setLastUpdateTime records the _since timestamp for the next incremental sync of the given directory.
+// Failing to persist it isn't fatal: the next sync after a restart will then be a full sync.
+func (c *Component) setLastUpdateTime(ctx context.Context, directoryKey string, lastUpdate string) {
+	c.stateMux.Lock()
+	c.lastUpdateTimes[directoryKey] = lastUpdate
+	c.stateMux.Unlock()
+	if err := c.stateStore.Put(lastUpdateBucket, directoryKey, lastUpdate); err != nil {
+		slog.ErrorContext(ctx, "Failed to persist mCSD Directory last update time", slog.String("directory", directoryKey), logging.Error(err))
+	}
+}
+
+// getLastUpdateTime returns the _since timestamp for the next incremental sync of the given directory, if known.
+func (c *Component) getLastUpdateTime(directoryKey string) (string, bool) {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	lastUpdate, ok := c.lastUpdateTimes[directoryKey]
+	return lastUpdate, ok
+}
+
+// persistDirectory stores a discovered or manually added administration directory, so it's known again after a restart.
+func (c *Component) persistDirectory(ctx context.Context, directory administrationDirectory) {
+	err := c.stateStore.Put(discoveredDirectoriesBucket, makeDirectoryKey(directory.fhirBaseURL, directory.authoritativeUra), persistedDirectory{
+		FHIRBaseURL:         directory.fhirBaseURL,
+		ResourceTypes:       directory.resourceTypes,
+		Discover:            directory.discover,
+		SourceURL:           directory.sourceURL,
+		AuthoritativeUra:    directory.authoritativeUra,
+		Manual:              directory.manual,
+		SyncStrategy:        directory.syncStrategy,
+		AuthorizationServer: directory.authorizationServer,
+		DiscoveredThrough:   directory.discoveredThrough,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to persist discovered mCSD Directory", logging.FHIRServer(directory.fhirBaseURL), logging.Error(err))
+	}
+}
+
+// loadCheckpoint returns the checkpoint of an interrupted sync of the given directory, if there is one.
+// An unreadable checkpoint is discarded, causing the sync to start over.
+func (c *Component) loadCheckpoint(ctx context.Context, directoryKey string) (syncCheckpoint, bool) {
+	var checkpoint syncCheckpoint
+	found, err := c.stateStore.Get(syncCheckpointBucket, directoryKey, &checkpoint)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to read mCSD sync checkpoint, starting over", slog.String("directory", directoryKey), logging.Error(err))
+		return syncCheckpoint{}, false
+	}
+	return checkpoint, found
+}
+
+func (run *syncRun) saveCheckpoint() error {
+	if err := run.store.Put(syncCheckpointBucket, run.directoryKey, run.checkpoint); err != nil {
+		return fmt.Errorf("failed to save mCSD sync checkpoint: %w", err)
+	}
+	return nil
+}
+
+// clearSyncProgress removes the checkpoint and spooled history of a sync from the state store.
+func (c *Component) clearSyncProgress(ctx context.Context, directoryKey string, resourceTypes []string) {
+	for _, resourceType := range resourceTypes {
+		if err := c.stateStore.DeleteBucket(spoolBucket(directoryKey, resourceType)); err != nil {
+			slog.ErrorContext(ctx, "Failed to remove spooled mCSD history", slog.String("directory", directoryKey), logging.Error(err))
+		}
+	}
+	if err := c.stateStore.Delete(syncCheckpointBucket, directoryKey); err != nil {
+		slog.ErrorContext(ctx, "Failed to remove mCSD sync checkpoint", slog.String("directory", directoryKey), logging.Error(err))
+	}
+}
+
+// spoolBucket returns the name of the bucket holding the spooled history of the given resource type, for the given directory.
+func spoolBucket(directoryKey string, resourceType string) string {
+	return spoolBucketPrefix + directoryKey + "|" + resourceType
+}
+
+// spoolKey returns the key of the n-th spooled history entry, zero-padded to keep the entries in order.
+func spoolKey(n int) string {
+	return fmt.Sprintf("%010d", n)
+}
+
+// forgetDirectory removes an unregistered administration directory, its sync timestamp, sync progress, subscription and quarantined resources
+// from the state store, and schedules the removal of its resources from the query directory. The caller must hold stateMux.
+func (c *Component) forgetDirectory(ctx context.Context, directory administrationDirectory) {
+	directoryKey := makeDirectoryKey(directory.fhirBaseURL, directory.authoritativeUra)
+	delete(c.lastUpdateTimes, directoryKey)
+	delete(c.syncStatuses, directoryKey)
+	delete(c.skippedDiscoveries, directoryKey)
+	for _, bucket := range []string{discoveredDirectoriesBucket, lastUpdateBucket} {
+		if err := c.stateStore.Delete(bucket, directoryKey); err != nil {
+			slog.ErrorContext(ctx, "Failed to remove unregistered mCSD Directory from state", logging.FHIRServer(directory.fhirBaseURL), logging.Error(err))
+		}
+	}
+	c.clearSyncProgress(ctx, directoryKey, directory.resourceTypes)
+	c.forgetSubscription(ctx, directoryKey)
+	c.forgetQuarantine(ctx, directoryKey)
+	c.schedulePurge(ctx, directory)
+}
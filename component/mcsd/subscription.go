@@ -0,0 +1,336 @@
+package mcsd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// SubscriptionConfig configures push-triggered updates: the mCSD Update Client creates a FHIR Subscription on every
+// administration directory that supports it, and updates from that directory when it's notified of a change.
+type SubscriptionConfig struct {
+	// NotificationBaseURL is the public base URL of the knooppunt, to which notifications are sent (at /mcsd/notify/{id}).
+	// Subscriptions are disabled when it isn't set.
+	NotificationBaseURL string `koanf:"notificationbaseurl"`
+}
+
+// Enabled returns whether subscriptions are enabled.
+func (c SubscriptionConfig) Enabled() bool {
+	return c.NotificationBaseURL != ""
+}
+
+// directorySubscription is the (persisted) state of the FHIR Subscriptions created on an administration directory.
+type directorySubscription struct {
+	// ID identifies the directory in the notification URL.
+	ID string `json:"id"`
+	// Secret is sent by the directory in the Authorization header of every notification.
+	Secret           string `json:"secret"`
+	FHIRBaseURL      string `json:"fhirBaseURL"`
+	AuthoritativeUra string `json:"authoritativeUra"`
+	// RemoteIDs holds the IDs of the Subscription resources on the directory, by resource type.
+	RemoteIDs map[string]string `json:"remoteIDs"`
+}
+
+// restoreSubscriptions loads the subscriptions of the registered administration directories from the state store.
+// Subscriptions of directories that are no longer registered are removed.
+func (c *Component) restoreSubscriptions(ctx context.Context) error {
+	var stale []string
+	err := c.stateStore.Walk(subscriptionsBucket, func(key string, value []byte) error {
+		var subscription directorySubscription
+		if err := json.Unmarshal(value, &subscription); err != nil || !c.isRegistered(key) {
+			stale = append(stale, key)
+			return nil
+		}
+		c.stateMux.Lock()
+		defer c.stateMux.Unlock()
+		c.subscriptions[key] = subscription
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		slog.InfoContext(ctx, "Removing subscription of unregistered mCSD Directory", slog.String("directory", key))
+		if err := c.stateStore.Delete(subscriptionsBucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRegistered returns whether the administration directory with the given directory key is registered.
+func (c *Component) isRegistered(directoryKey string) bool {
+	_, ok := c.registeredDirectory(directoryKey)
+	return ok
+}
+
+// registeredDirectory returns the registered administration directory with the given directory key.
+func (c *Component) registeredDirectory(directoryKey string) (administrationDirectory, bool) {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	for _, directory := range c.administrationDirectories {
+		if makeDirectoryKey(directory.fhirBaseURL, directory.authoritativeUra) == directoryKey {
+			return directory, true
+		}
+	}
+	return administrationDirectory{}, false
+}
+
+// ensureSubscription makes sure the given administration directory has an active FHIR Subscription for each of its resource types,
+// if it supports them. It's called after every successful update, so subscriptions that were removed or disabled by the directory
+// are recreated. Failures are only logged: the scheduled updates keep polling the directory regardless.
+func (c *Component) ensureSubscription(ctx context.Context, directory administrationDirectory, client fhirclient.Client) {
+	directoryKey := makeDirectoryKey(directory.fhirBaseURL, directory.authoritativeUra)
+	c.stateMux.Lock()
+	subscription, exists := c.subscriptions[directoryKey]
+	c.stateMux.Unlock()
+	if !exists {
+		subscription = directorySubscription{
+			ID:               randomToken(),
+			Secret:           randomToken(),
+			FHIRBaseURL:      directory.fhirBaseURL,
+			AuthoritativeUra: directory.authoritativeUra,
+		}
+	}
+	remoteIDs := make(map[string]string, len(directory.resourceTypes))
+	var missing []string
+	for _, resourceType := range directory.resourceTypes {
+		remoteID := subscription.RemoteIDs[resourceType]
+		if remoteID != "" && c.isSubscriptionActive(ctx, client, directory.fhirBaseURL, remoteID) {
+			remoteIDs[resourceType] = remoteID
+		} else {
+			missing = append(missing, resourceType)
+		}
+	}
+	if len(missing) > 0 {
+		var capabilityStatement fhir.CapabilityStatement
+		if err := client.ReadWithContext(ctx, "metadata", &capabilityStatement); err != nil {
+			slog.WarnContext(ctx, "Failed to read CapabilityStatement of mCSD Directory, not subscribing", logging.FHIRServer(directory.fhirBaseURL), logging.Error(err))
+			return
+		}
+		if !supportsSubscriptions(capabilityStatement) {
+			slog.DebugContext(ctx, "mCSD Directory doesn't support Subscriptions, relying on polling", logging.FHIRServer(directory.fhirBaseURL))
+			return
+		}
+	}
+	for _, resourceType := range missing {
+		remoteID, err := c.createSubscription(ctx, client, subscription, resourceType)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to create Subscription on mCSD Directory", logging.FHIRServer(directory.fhirBaseURL), slog.String("resourceType", resourceType), logging.Error(err))
+			continue
+		}
+		slog.InfoContext(ctx, "Created Subscription on mCSD Directory", logging.FHIRServer(directory.fhirBaseURL), slog.String("resourceType", resourceType), slog.String("id", remoteID))
+		remoteIDs[resourceType] = remoteID
+	}
+	if len(remoteIDs) == 0 && !exists {
+		return
+	}
+	subscription.RemoteIDs = remoteIDs
+
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	if !c.isRegisteredLocked(directoryKey) {
+		// Unregistered during the update
+		c.cancelSubscription(subscription)
+		return
+	}
+	c.subscriptions[directoryKey] = subscription
+	if err := c.stateStore.Put(subscriptionsBucket, directoryKey, subscription); err != nil {
+		slog.ErrorContext(ctx, "Failed to persist subscription of mCSD Directory", logging.FHIRServer(directory.fhirBaseURL), logging.Error(err))
+	}
+}
+
+// isRegisteredLocked is isRegistered for callers holding stateMux.
+func (c *Component) isRegisteredLocked(directoryKey string) bool {
+	for _, directory := range c.administrationDirectories {
+		if makeDirectoryKey(directory.fhirBaseURL, directory.authoritativeUra) == directoryKey {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubscriptionActive returns whether the Subscription with the given ID exists on the directory and isn't in error or switched off.
+// If it can't be determined (e.g. the directory is temporarily unavailable), it's assumed to be active, to avoid duplicate subscriptions.
+func (c *Component) isSubscriptionActive(ctx context.Context, client fhirclient.Client, fhirBaseURL string, remoteID string) bool {
+	var subscription fhir.Subscription
+	err := client.ReadWithContext(ctx, "Subscription/"+remoteID, &subscription)
+	var outcomeErr fhirclient.OperationOutcomeError
+	if errors.As(err, &outcomeErr) && (outcomeErr.HttpStatusCode == http.StatusNotFound || outcomeErr.HttpStatusCode == http.StatusGone) {
+		slog.InfoContext(ctx, "Subscription on mCSD Directory no longer exists, recreating it", logging.FHIRServer(fhirBaseURL), slog.String("id", remoteID))
+		return false
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to read Subscription on mCSD Directory", logging.FHIRServer(fhirBaseURL), slog.String("id", remoteID), logging.Error(err))
+		return true
+	}
+	if subscription.Status == fhir.SubscriptionStatusError || subscription.Status == fhir.SubscriptionStatusOff {
+		slog.InfoContext(ctx, "Subscription on mCSD Directory is inactive, recreating it", logging.FHIRServer(fhirBaseURL), slog.String("id", remoteID), slog.String("status", subscription.Status.Code()))
+		if err := client.DeleteWithContext(ctx, "Subscription/"+remoteID); err != nil {
+			slog.WarnContext(ctx, "Failed to delete inactive Subscription on mCSD Directory", logging.FHIRServer(fhirBaseURL), slog.String("id", remoteID), logging.Error(err))
+		}
+		return false
+	}
+	return true
+}
+
+// createSubscription creates an R4 rest-hook Subscription for the given resource type on the directory, and returns its ID.
+// Notifications carry no payload: they only trigger an update, which fetches the changes as usual.
+func (c *Component) createSubscription(ctx context.Context, client fhirclient.Client, subscription directorySubscription, resourceType string) (string, error) {
+	resource := fhir.Subscription{
+		Status:   fhir.SubscriptionStatusRequested,
+		Reason:   "mCSD Update Client: update query directory on changes",
+		Criteria: resourceType + "?",
+		Channel: fhir.SubscriptionChannel{
+			Type:     fhir.SubscriptionChannelTypeRestHook,
+			Endpoint: to.Ptr(c.notificationURL(subscription.ID)),
+			Header:   []string{"Authorization: Bearer " + subscription.Secret},
+		},
+	}
+	var result fhir.Subscription
+	if err := client.CreateWithContext(ctx, resource, &result); err != nil {
+		return "", err
+	}
+	if result.Id == nil || *result.Id == "" {
+		return "", errors.New("created Subscription has no id")
+	}
+	return *result.Id, nil
+}
+
+// notificationURL returns the URL to which the directory with the given subscription ID sends its notifications.
+func (c *Component) notificationURL(id string) string {
+	return strings.TrimRight(c.config.Subscriptions.NotificationBaseURL, "/") + "/mcsd/notify/" + url.PathEscape(id)
+}
+
+// supportsSubscriptions returns whether the CapabilityStatement lists the create interaction for Subscription.
+func supportsSubscriptions(capabilityStatement fhir.CapabilityStatement) bool {
+	for _, rest := range capabilityStatement.Rest {
+		if rest.Mode != fhir.RestfulCapabilityModeServer {
+			continue
+		}
+		for _, resource := range rest.Resource {
+			if resource.Type != fhir.ResourceTypeSubscription {
+				continue
+			}
+			for _, interaction := range resource.Interaction {
+				if interaction.Code == fhir.TypeRestfulInteractionCreate {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// forgetSubscription removes the subscription of an unregistered administration directory, and deletes its Subscriptions
+// on the directory in the background. The caller must hold stateMux.
+func (c *Component) forgetSubscription(ctx context.Context, directoryKey string) {
+	subscription, exists := c.subscriptions[directoryKey]
+	if !exists {
+		return
+	}
+	delete(c.subscriptions, directoryKey)
+	if err := c.stateStore.Delete(subscriptionsBucket, directoryKey); err != nil {
+		slog.ErrorContext(ctx, "Failed to remove subscription of unregistered mCSD Directory", logging.FHIRServer(subscription.FHIRBaseURL), logging.Error(err))
+	}
+	c.cancelSubscription(subscription)
+}
+
+// cancelSubscription deletes the Subscriptions on the directory in the background. It's best-effort:
+// once forgotten, notifications for the subscription are rejected anyway.
+func (c *Component) cancelSubscription(subscription directorySubscription) {
+	if len(subscription.RemoteIDs) == 0 {
+		return
+	}
+	baseURL, err := url.Parse(subscription.FHIRBaseURL)
+	if err != nil {
+		return
+	}
+	client := c.fhirAdminClientFn(baseURL)
+	c.backgroundTasks.Go(func() {
+		for _, remoteID := range subscription.RemoteIDs {
+			if err := client.DeleteWithContext(c.backgroundCtx, "Subscription/"+remoteID); err != nil {
+				slog.WarnContext(c.backgroundCtx, "Failed to delete Subscription on unregistered mCSD Directory", logging.FHIRServer(subscription.FHIRBaseURL), slog.String("id", remoteID), logging.Error(err))
+			}
+		}
+	})
+}
+
+// handleNotification handles a Subscription notification from an administration directory. It verifies the secret
+// the directory was given when subscribing, and triggers an update from only that directory in the background.
+func (c *Component) handleNotification(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+	var subscription directorySubscription
+	var directoryKey string
+	c.stateMux.Lock()
+	for key, candidate := range c.subscriptions {
+		if candidate.ID == id {
+			subscription, directoryKey = candidate, key
+			break
+		}
+	}
+	c.stateMux.Unlock()
+	if directoryKey == "" {
+		http.Error(w, "Unknown subscription", http.StatusNotFound)
+		return
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(subscription.Secret)) != 1 {
+		slog.WarnContext(ctx, "Rejected mCSD Subscription notification: invalid credentials", logging.FHIRServer(subscription.FHIRBaseURL))
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	slog.DebugContext(ctx, "Received mCSD Subscription notification", logging.FHIRServer(subscription.FHIRBaseURL))
+	c.triggerUpdate(directoryKey)
+	w.WriteHeader(http.StatusOK)
+}
+
+// triggerUpdate updates from the administration directory with the given directory key in the background.
+// Notifications that arrive before the triggered update starts are coalesced into it.
+func (c *Component) triggerUpdate(directoryKey string) {
+	c.stateMux.Lock()
+	if c.pendingUpdates[directoryKey] || c.backgroundCtx.Err() != nil {
+		c.stateMux.Unlock()
+		return
+	}
+	c.pendingUpdates[directoryKey] = true
+	c.stateMux.Unlock()
+	c.backgroundTasks.Go(func() {
+		c.updateMux.Lock()
+		defer c.updateMux.Unlock()
+		c.stateMux.Lock()
+		delete(c.pendingUpdates, directoryKey)
+		c.stateMux.Unlock()
+		ctx := c.backgroundCtx
+		if ctx.Err() != nil {
+			return
+		}
+		directory, ok := c.registeredDirectory(directoryKey)
+		if !ok {
+			return
+		}
+		report := c.updateFromAdministrationDirectory(ctx, directory, updateOptions{})
+		slog.InfoContext(ctx, "Notification-triggered mCSD update completed", logging.FHIRServer(directory.fhirBaseURL),
+			slog.Int("created", report.CountCreated), slog.Int("updated", report.CountUpdated), slog.Int("deleted", report.CountDeleted), slog.Int("errors", len(report.Errors)))
+	})
+}
+
+// randomToken returns a random, URL-safe token.
+func randomToken() string {
+	buf := make([]byte, 32)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
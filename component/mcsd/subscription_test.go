@@ -0,0 +1,233 @@
+package mcsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// subscriptionServer is a minimal FHIR server that supports creating, reading and deleting Subscriptions.
+type subscriptionServer struct {
+	mux             sync.Mutex
+	supported       bool
+	subscriptions   map[string]fhir.Subscription
+	deleted         []string
+	historyRequests int
+}
+
+func (s *subscriptionServer) start(t *testing.T) string {
+	s.subscriptions = make(map[string]fhir.Subscription)
+	mux := http.NewServeMux()
+	write := func(w http.ResponseWriter, status int, resource any) {
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(resource)
+	}
+	mux.HandleFunc("GET /fhir/metadata", func(w http.ResponseWriter, r *http.Request) {
+		capabilityStatement := `{"resourceType":"CapabilityStatement","rest":[{"mode":"server","resource":[]}]}`
+		if s.supported {
+			capabilityStatement = `{"resourceType":"CapabilityStatement","rest":[{"mode":"server","resource":[
+				{"type":"Subscription","interaction":[{"code":"create"},{"code":"read"},{"code":"delete"}]}
+			]}]}`
+		}
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_, _ = w.Write([]byte(capabilityStatement))
+	})
+	mux.HandleFunc("POST /fhir/Subscription", func(w http.ResponseWriter, r *http.Request) {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		var subscription fhir.Subscription
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&subscription))
+		id := strconv.Itoa(len(s.subscriptions) + len(s.deleted) + 1)
+		subscription.Id = &id
+		s.subscriptions[id] = subscription
+		write(w, http.StatusCreated, subscription)
+	})
+	mux.HandleFunc("GET /fhir/Subscription/{id}", func(w http.ResponseWriter, r *http.Request) {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		subscription, ok := s.subscriptions[r.PathValue("id")]
+		if !ok {
+			write(w, http.StatusNotFound, fhir.OperationOutcome{})
+			return
+		}
+		write(w, http.StatusOK, subscription)
+	})
+	mux.HandleFunc("DELETE /fhir/Subscription/{id}", func(w http.ResponseWriter, r *http.Request) {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		delete(s.subscriptions, r.PathValue("id"))
+		s.deleted = append(s.deleted, r.PathValue("id"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for _, resourceType := range []string{"Organization", "Endpoint"} {
+		mux.HandleFunc("GET /fhir/"+resourceType+"/_history", func(w http.ResponseWriter, r *http.Request) {
+			s.mux.Lock()
+			s.historyRequests++
+			s.mux.Unlock()
+			w.Header().Set("Content-Type", "application/fhir+json")
+			_, _ = w.Write([]byte(`{"resourceType":"Bundle","type":"history"}`))
+		})
+	}
+	mux.HandleFunc("GET /fhir/Organization", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_, _ = w.Write([]byte(`{"resourceType":"Bundle","type":"searchset"}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server.URL + "/fhir"
+}
+
+func TestComponent_subscriptions(t *testing.T) {
+	newComponent := func(t *testing.T, server *subscriptionServer) (*Component, string, *http.ServeMux) {
+		baseURL := server.start(t)
+		config := DefaultConfig()
+		config.QueryDirectory = DirectoryConfig{FHIRBaseURL: "http://example.com/local/fhir"}
+		config.Subscriptions.NotificationBaseURL = "https://knooppunt.example.com/"
+		component, err := New(config)
+		require.NoError(t, err)
+		component.fhirAdminClientFn = func(baseURL *url.URL) fhirclient.Client {
+			return fhirclient.New(baseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		}
+		component.fhirQueryClient = &test.StubFHIRClient{}
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), baseURL, []string{"Organization", "Endpoint"}, false, "", ""))
+		publicMux := http.NewServeMux()
+		component.RegisterHttpHandlers(publicMux, http.NewServeMux())
+		t.Cleanup(func() {
+			_ = component.Stop(t.Context())
+		})
+		return component, baseURL, publicMux
+	}
+	notify := func(mux *http.ServeMux, path string, secret string) int {
+		request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"resourceType":"Bundle","type":"history"}`))
+		if secret != "" {
+			request.Header.Set("Authorization", "Bearer "+secret)
+		}
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	t.Run("subscribes after update", func(t *testing.T) {
+		server := &subscriptionServer{supported: true}
+		component, baseURL, _ := newComponent(t, server)
+
+		_, err := component.update(t.Context())
+		require.NoError(t, err)
+
+		require.Len(t, server.subscriptions, 2)
+		subscription := component.subscriptions[baseURL]
+		assert.Len(t, subscription.RemoteIDs, 2)
+		for _, created := range server.subscriptions {
+			assert.Equal(t, fhir.SubscriptionStatusRequested, created.Status)
+			assert.Equal(t, fhir.SubscriptionChannelTypeRestHook, created.Channel.Type)
+			assert.Equal(t, "https://knooppunt.example.com/mcsd/notify/"+subscription.ID, *created.Channel.Endpoint)
+			assert.Equal(t, []string{"Authorization: Bearer " + subscription.Secret}, created.Channel.Header)
+			assert.Nil(t, created.Channel.Payload)
+		}
+		assert.Equal(t, subscription.RemoteIDs["Organization"], *server.subscriptions[subscription.RemoteIDs["Organization"]].Id)
+		assert.Equal(t, "Organization?", server.subscriptions[subscription.RemoteIDs["Organization"]].Criteria)
+
+		t.Run("existing subscriptions are kept", func(t *testing.T) {
+			_, err := component.update(t.Context())
+			require.NoError(t, err)
+			assert.Len(t, server.subscriptions, 2)
+			assert.Empty(t, server.deleted)
+			assert.Equal(t, subscription, component.subscriptions[baseURL])
+		})
+		t.Run("inactive subscription is recreated", func(t *testing.T) {
+			remoteID := subscription.RemoteIDs["Endpoint"]
+			server.mux.Lock()
+			inactive := server.subscriptions[remoteID]
+			inactive.Status = fhir.SubscriptionStatusError
+			server.subscriptions[remoteID] = inactive
+			server.mux.Unlock()
+
+			_, err := component.update(t.Context())
+			require.NoError(t, err)
+
+			assert.Equal(t, []string{remoteID}, server.deleted)
+			assert.Len(t, server.subscriptions, 2)
+			assert.NotEqual(t, remoteID, component.subscriptions[baseURL].RemoteIDs["Endpoint"])
+		})
+		t.Run("subscriptions are cancelled when the directory is removed", func(t *testing.T) {
+			remoteIDs := component.subscriptions[baseURL].RemoteIDs
+			require.True(t, component.removeDirectory(t.Context(), baseURL, ""))
+			component.backgroundTasks.Wait()
+
+			assert.Empty(t, server.subscriptions)
+			for _, remoteID := range remoteIDs {
+				assert.Contains(t, server.deleted, remoteID)
+			}
+			assert.NotContains(t, component.subscriptions, baseURL)
+		})
+	})
+	t.Run("directory doesn't support subscriptions", func(t *testing.T) {
+		server := &subscriptionServer{}
+		component, baseURL, _ := newComponent(t, server)
+
+		_, err := component.update(t.Context())
+		require.NoError(t, err)
+
+		assert.Empty(t, server.subscriptions)
+		assert.NotContains(t, component.subscriptions, baseURL)
+	})
+	t.Run("notification", func(t *testing.T) {
+		server := &subscriptionServer{supported: true}
+		component, baseURL, publicMux := newComponent(t, server)
+		_, err := component.update(t.Context())
+		require.NoError(t, err)
+		subscription := component.subscriptions[baseURL]
+		server.historyRequests = 0
+
+		t.Run("unknown subscription", func(t *testing.T) {
+			assert.Equal(t, http.StatusNotFound, notify(publicMux, "/mcsd/notify/unknown", subscription.Secret))
+		})
+		t.Run("invalid secret", func(t *testing.T) {
+			assert.Equal(t, http.StatusUnauthorized, notify(publicMux, "/mcsd/notify/"+subscription.ID, "invalid"))
+			assert.Equal(t, http.StatusUnauthorized, notify(publicMux, "/mcsd/notify/"+subscription.ID, ""))
+			component.backgroundTasks.Wait()
+			assert.Zero(t, server.historyRequests)
+		})
+		t.Run("triggers update of the directory", func(t *testing.T) {
+			assert.Equal(t, http.StatusOK, notify(publicMux, "/mcsd/notify/"+subscription.ID, subscription.Secret))
+			component.backgroundTasks.Wait()
+			assert.Equal(t, 2, server.historyRequests, "history of both resource types should be fetched")
+		})
+	})
+	t.Run("subscriptions are restored", func(t *testing.T) {
+		server := &subscriptionServer{supported: true}
+		baseURL := server.start(t)
+		config := DefaultConfig()
+		config.QueryDirectory = DirectoryConfig{FHIRBaseURL: "http://example.com/local/fhir"}
+		config.Subscriptions.NotificationBaseURL = "https://knooppunt.example.com"
+		config.AdministrationDirectories = map[string]DirectoryConfig{"root": {FHIRBaseURL: baseURL}}
+		config.StateFile = t.TempDir() + "/state.db"
+		component, err := New(config)
+		require.NoError(t, err)
+		subscription := directorySubscription{ID: "1", Secret: "secret", FHIRBaseURL: baseURL, RemoteIDs: map[string]string{"Endpoint": "1"}}
+		require.NoError(t, component.stateStore.Put(subscriptionsBucket, baseURL, subscription))
+		require.NoError(t, component.stateStore.Put(subscriptionsBucket, "http://example.com/unregistered/fhir", subscription))
+		require.NoError(t, component.Stop(t.Context()))
+
+		component, err = New(config)
+		require.NoError(t, err)
+		defer component.Stop(t.Context())
+
+		assert.Equal(t, map[string]directorySubscription{baseURL: subscription}, component.subscriptions)
+		found, err := component.stateStore.Get(subscriptionsBucket, "http://example.com/unregistered/fhir", &subscription)
+		require.NoError(t, err)
+		assert.False(t, found, "subscription of unregistered directory should be removed")
+	})
+}
@@ -0,0 +1,441 @@
+package mcsd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/profile"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/statestore"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// syncRun holds the state of a single sync from an administration directory, threaded through its steps
+// (fetch -> collect -> apply -> finish). The history fetched from the directory isn't kept in memory, but spooled to the state store:
+// this allows syncing directories of any size. The progress is recorded in a checkpoint, so a sync that fails part-way through
+// resumes where it stopped instead of starting over.
+type syncRun struct {
+	// configuration, set at construction
+	directoryKey     string
+	fhirBaseURL      string
+	client           fhirclient.Client
+	resourceTypes    []string // in fetch order
+	allowDiscovery   bool
+	authoritativeUra string
+	queryStart       time.Time
+	dryRun           bool
+	// store holds the spooled history and checkpoint. For a dry run, it's a temporary store,
+	// so the dry run doesn't interfere with the state of regular syncs.
+	store statestore.Store
+
+	// working state, filled as the run progresses
+	checkpoint syncCheckpoint
+	// planner plans the transaction chunks for the spooled entries
+	planner *libfhir.TransactionPlanner
+	// spooled holds the location of every spooled entry in the state store, by position in the planner
+	spooled []spoolLocation
+	// healthcareServices holds the spooled HealthcareService resources, which are needed to validate Endpoints
+	healthcareServices []fhir.HealthcareService
+	// endpointEntries holds the spooled Endpoint entries, which are needed for discovery
+	endpointEntries []fhir.BundleEntry
+	// existingSources holds the meta.source of every resource that exists in the directory, only collected for a reconciling sync
+	existingSources map[string]bool
+	// applied is the number of transaction entries applied to the query directory
+	applied int
+	report  DirectoryUpdateReport
+}
+
+// spoolLocation is the location of a spooled history entry in the state store.
+type spoolLocation struct {
+	bucket string
+	key    string
+}
+
+// newSyncRun prepares the sync of an administration directory. If a previous sync of the directory didn't complete,
+// the run resumes from its checkpoint, using the same _since as the interrupted sync. A dry run always starts from the last completed sync.
+// A reconciling run ignores the last update time, and only resumes an interrupted reconciling sync.
+func (c *Component) newSyncRun(ctx context.Context, fhirBaseURL string, client fhirclient.Client, resourceTypes []string, allowDiscovery bool, authoritativeUra string, options updateOptions) *syncRun {
+	run := &syncRun{
+		directoryKey:     makeDirectoryKey(fhirBaseURL, authoritativeUra),
+		fhirBaseURL:      fhirBaseURL,
+		client:           client,
+		resourceTypes:    syncOrder(resourceTypes),
+		allowDiscovery:   allowDiscovery,
+		authoritativeUra: authoritativeUra,
+		queryStart:       time.Now(),
+		dryRun:           options.dryRun,
+		store:            c.stateStore,
+	}
+	if run.dryRun {
+		run.store = statestore.NewMemoryStore()
+	} else if checkpoint, ok := c.loadCheckpoint(ctx, run.directoryKey); ok && (checkpoint.Reconcile || !options.reconcile) {
+		slog.InfoContext(ctx, "Resuming interrupted sync from mCSD Directory", logging.FHIRServer(fhirBaseURL),
+			slog.Any("fetchedResourceTypes", checkpoint.FetchedTypes), slog.Int("appliedChunks", checkpoint.AppliedChunks))
+		run.checkpoint = checkpoint
+		return run
+	}
+	run.checkpoint.ChunkSize = c.config.TransactionSize
+	if options.reconcile {
+		run.checkpoint.Reconcile = true
+		slog.InfoContext(ctx, "Reconciling with mCSD Directory, doing full sync from FHIR server", logging.FHIRServer(fhirBaseURL))
+	} else if lastUpdate, ok := c.getLastUpdateTime(run.directoryKey); ok {
+		run.checkpoint.Since = lastUpdate
+		slog.DebugContext(ctx, "Using _since parameter for incremental sync from FHIR server", logging.FHIRServer(fhirBaseURL), slog.String("_since", lastUpdate))
+	} else {
+		slog.InfoContext(ctx, "No last update time, doing full sync from FHIR server", logging.FHIRServer(fhirBaseURL))
+	}
+	run.checkpoint.SearchTypes = c.searchResourceTypes(ctx, run, c.syncStrategy(fhirBaseURL, authoritativeUra))
+	return run
+}
+
+// syncOrder returns the resource types in the order their history is fetched: Organization first,
+// since a URA identifier change in its history means the other resource types need to be fetched without _since.
+func syncOrder(resourceTypes []string) []string {
+	result := make([]string, 0, len(resourceTypes))
+	if slices.Contains(resourceTypes, "Organization") {
+		result = append(result, "Organization")
+	}
+	for _, resourceType := range resourceTypes {
+		if resourceType != "Organization" {
+			result = append(result, resourceType)
+		}
+	}
+	return result
+}
+
+// fetchHistory pages through the _history of every resource type and spools the most recent version of every resource.
+// Resource types that were already fetched by an interrupted sync are skipped.
+func (c *Component) fetchHistory(ctx context.Context, run *syncRun) error {
+	for _, resourceType := range run.resourceTypes {
+		if slices.Contains(run.checkpoint.FetchedTypes, resourceType) {
+			continue
+		}
+		bucket := spoolBucket(run.directoryKey, resourceType)
+		// Discard what an interrupted fetch of this resource type left behind
+		if err := run.store.DeleteBucket(bucket); err != nil {
+			return fmt.Errorf("failed to clear spooled %s history: %w", resourceType, err)
+		}
+
+		searchParams := url.Values{
+			"_count": []string{strconv.Itoa(searchPageSize)},
+		}
+		// Organization history is always fetched completely, to detect URA identifier changes
+		if run.checkpoint.Since != "" && !run.checkpoint.FullHistory && resourceType != "Organization" {
+			searchParams.Set("_since", run.checkpoint.Since)
+		}
+		// _history is sorted newest-first, so keeping the first occurrence of each resource keeps the most recent version.
+		// A transaction bundle can't contain the same resource multiple times.
+		deduplicator := libfhir.NewHistoryDeduplicator()
+		uraChanges := newURAChangeDetector()
+		count := 0
+		spool := func(entries []fhir.BundleEntry) error {
+			values := make(map[string]any, len(entries))
+			for _, entry := range entries {
+				if resourceType == "Organization" {
+					uraChanges.add(entry)
+				}
+				if !deduplicator.Keep(entry) {
+					continue
+				}
+				values[spoolKey(count)] = entry
+				count++
+			}
+			if err := run.store.PutAll(bucket, values); err != nil {
+				return fmt.Errorf("failed to spool %s history: %w", resourceType, err)
+			}
+			return nil
+		}
+		var firstPage fhir.Bundle
+		var err error
+		if slices.Contains(run.checkpoint.SearchTypes, resourceType) {
+			// Without history, URA identifier changes can't be detected
+			firstPage, err = c.fetchBySearch(ctx, run, resourceType, spool)
+			if err != nil {
+				return fmt.Errorf("failed to search %s changes: %w", resourceType, err)
+			}
+		} else {
+			firstPage, err = c.queryHistory(ctx, run.client, resourceType, searchParams, func(page *fhir.Bundle) error {
+				return spool(page.Entry)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to query %s history: %w", resourceType, err)
+			}
+		}
+		slog.DebugContext(ctx, "Fetched mCSD history", logging.FHIRServer(run.fhirBaseURL), slog.String("resourceType", resourceType), slog.Int("count", count))
+
+		if run.checkpoint.NextSyncTime == "" {
+			run.checkpoint.NextSyncTime = nextSyncTime(ctx, firstPage, run.queryStart, run.fhirBaseURL)
+		}
+		if uraChanges.changed() && run.checkpoint.Since != "" && !run.checkpoint.FullHistory {
+			slog.WarnContext(ctx, "Detected URA identifier change in organization history. Querying history of other resource types without _since parameter.", logging.FHIRServer(run.fhirBaseURL))
+			run.checkpoint.FullHistory = true
+		}
+		run.checkpoint.FetchedTypes = append(run.checkpoint.FetchedTypes, resourceType)
+		if err := run.saveCheckpoint(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextSyncTime determines the _since value for the next incremental sync.
+// It uses the search result Bundle's meta.lastUpdated if available, otherwise falls back to the query start time.
+// The first uses the FHIR server's own timestamp string, eliminating clock skew issues.
+func nextSyncTime(ctx context.Context, firstPage fhir.Bundle, queryStart time.Time, fhirBaseURL string) string {
+	if firstPage.Meta != nil && firstPage.Meta.LastUpdated != nil {
+		return *firstPage.Meta.LastUpdated
+	}
+	// Fallback to local time with buffer to account for potential clock skew
+	slog.WarnContext(ctx, "Bundle meta.lastUpdated not available, using local time with buffer - may cause clock skew issues", logging.FHIRServer(fhirBaseURL))
+	return queryStart.Add(-clockSkewBuffer).Format(time.RFC3339Nano)
+}
+
+// collectHistory reads back the spooled history, to plan the transaction chunks and collect the resources needed for validation and discovery.
+func (c *Component) collectHistory(ctx context.Context, run *syncRun) error {
+	run.planner = libfhir.NewTransactionPlanner()
+	if run.checkpoint.Reconcile {
+		run.existingSources = make(map[string]bool)
+	}
+	for _, resourceType := range run.resourceTypes {
+		bucket := spoolBucket(run.directoryKey, resourceType)
+		err := run.store.Walk(bucket, func(key string, value []byte) error {
+			var entry fhir.BundleEntry
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return fmt.Errorf("invalid spooled entry (key=%s): %w", key, err)
+			}
+			run.planner.Add(entry)
+			run.spooled = append(run.spooled, spoolLocation{bucket: bucket, key: key})
+			if run.existingSources != nil {
+				run.addExistingSource(entry)
+			}
+			switch resourceType {
+			case "HealthcareService":
+				var healthcareService fhir.HealthcareService
+				if entry.Resource != nil && json.Unmarshal(entry.Resource, &healthcareService) == nil {
+					run.healthcareServices = append(run.healthcareServices, healthcareService)
+				}
+			case "Endpoint":
+				run.endpointEntries = append(run.endpointEntries, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read spooled %s history: %w", resourceType, err)
+		}
+	}
+	slog.DebugContext(ctx, "Got mCSD entries", logging.FHIRServer(run.fhirBaseURL), slog.Int("count", run.planner.Len()))
+	return nil
+}
+
+// applyHistory validates the spooled history and applies it to the query directory, in chunks of transactions planned by the TransactionPlanner,
+// so every transaction is of bounded size while references between resources still resolve.
+// The checkpoint is updated after every chunk, so chunks applied by an interrupted sync aren't applied again.
+// Invalid entries are recorded as warnings, rather than failing the whole sync.
+func (c *Component) applyHistory(ctx context.Context, run *syncRun, parentOrganizationsMap parentOrganizationMap) error {
+	validationRules := c.validationRules(run.resourceTypes, PolicySource{
+		FHIRBaseURL:      run.fhirBaseURL,
+		AuthoritativeUra: run.authoritativeUra,
+		Discover:         run.allowDiscovery,
+	})
+	validationRules, releasePolicy, err := validationRules.preparePolicy(ctx, parentOrganizationsMap, run.healthcareServices)
+	if err != nil {
+		return err
+	}
+	defer releasePolicy()
+	chunks := run.planner.Chunks(run.checkpoint.ChunkSize)
+	for i, chunk := range chunks {
+		if i < run.checkpoint.AppliedChunks {
+			continue
+		}
+		// Build transaction with deterministic conditional references
+		tx := fhir.Bundle{
+			Type:  fhir.BundleTypeTransaction,
+			Entry: make([]fhir.BundleEntry, 0, len(chunk)),
+		}
+		for _, position := range chunk {
+			var entry fhir.BundleEntry
+			location := run.spooled[position]
+			if _, err := run.store.Get(location.bucket, location.key, &entry); err != nil {
+				return fmt.Errorf("failed to read spooled entry: %w", err)
+			}
+			if entry.Request == nil {
+				run.report.warn(libfhir.EntryReportItem(entry, libfhir.ReportCodeInvalidEntry, libfhir.SeverityWarning, fmt.Sprintf("Skipping entry with no request: #%d", position)))
+				continue
+			}
+			slog.DebugContext(ctx, "Processing entry", logging.FHIRServer(run.fhirBaseURL), slog.String("url", entry.Request.Url))
+			_, err := buildUpdateTransaction(ctx, &tx, entry, validationRules, parentOrganizationsMap, run.healthcareServices, run.allowDiscovery, run.fhirBaseURL)
+			if err != nil {
+				code := libfhir.ReportCodeInvalidEntry
+				if errors.As(err, new(profile.ConformanceError)) {
+					code = libfhir.ReportCodeNonConformant
+				} else if errors.As(err, new(rejectedError)) {
+					code = libfhir.ReportCodeRejected
+				}
+				run.report.warn(libfhir.EntryReportItem(entry, code, libfhir.SeverityWarning, fmt.Sprintf("entry #%d: %s", position, err.Error())))
+			} else if conformanceErr := c.checkConformance(entry); conformanceErr != nil {
+				// Profile validation in warn mode: the resource is imported, but reported
+				run.report.warn(libfhir.EntryReportItem(entry, libfhir.ReportCodeNonConformant, libfhir.SeverityWarning, fmt.Sprintf("entry #%d: %s", position, conformanceErr.Error())))
+			}
+			if !run.dryRun {
+				// Keep rejected resources for inspection, and release the ones that are now valid or deleted
+				if err != nil {
+					c.quarantine(ctx, run, entry, err)
+				} else {
+					c.unquarantine(ctx, run, entry)
+				}
+			}
+		}
+		if len(tx.Entry) > 0 && run.dryRun {
+			changes, err := libfhir.DescribeTransaction(ctx, c.fhirQueryClient, tx)
+			if err != nil {
+				return fmt.Errorf("failed to determine mCSD update changes (chunk %d of %d): %w", i+1, len(chunks), err)
+			}
+			run.tallyChanges(changes)
+		} else if len(tx.Entry) > 0 {
+			slog.DebugContext(ctx, "Applying mCSD update to query directory", logging.FHIRServer(run.fhirBaseURL), slog.Int("chunk", i+1), slog.Int("chunks", len(chunks)), slog.Int("count", len(tx.Entry)))
+			var txResult fhir.Bundle
+			if err := c.applyToQueryDirectory(ctx, tx, &txResult); err != nil {
+				return fmt.Errorf("failed to apply mCSD update to query directory (chunk %d of %d): %w", i+1, len(chunks), err)
+			}
+			run.applied += len(tx.Entry)
+			run.tallyTransactionResult(tx, txResult)
+		}
+		run.checkpoint.AppliedChunks = i + 1
+		if err := run.saveCheckpoint(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validationRules returns the rules for validating resources of an administration directory.
+// Resources that don't conform to their profile are only rejected when profile validation is in reject mode.
+func (c *Component) validationRules(resourceTypes []string, source PolicySource) ValidationRules {
+	rules := ValidationRules{
+		AllowedResourceTypes: resourceTypes,
+		Policy:               c.updatePolicy,
+		Source:               source,
+	}
+	if c.config.Validation.Profiles == profile.ValidationReject {
+		rules.Profiles = c.profileValidator
+	}
+	return rules
+}
+
+// checkConformance validates a created or updated resource against its profile when profile validation is in warn mode.
+// It returns the reason the resource doesn't conform, if it doesn't.
+func (c *Component) checkConformance(entry fhir.BundleEntry) error {
+	if c.config.Validation.Profiles != profile.ValidationWarn || entry.Resource == nil || entry.Request == nil || entry.Request.Method == fhir.HTTPVerbDELETE {
+		return nil
+	}
+	return c.profileValidator.Validate(entry.Resource)
+}
+
+// tallyTransactionResult counts the per-entry outcomes of an applied transaction into the run's report.
+// The resource type of an outcome is taken from the request at the same index, since transaction responses preserve request order.
+func (run *syncRun) tallyTransactionResult(tx fhir.Bundle, txResult fhir.Bundle) {
+	for i, entry := range txResult.Entry {
+		var request fhir.BundleEntry
+		if i < len(tx.Entry) {
+			request = tx.Entry[i]
+		}
+		if entry.Response == nil {
+			msg := fmt.Sprintf("Skipping entry with no response: #%d", i)
+			run.report.warn(libfhir.EntryReportItem(request, libfhir.ReportCodeMissingResponse, libfhir.SeverityWarning, msg))
+			continue
+		}
+		resourceType := libfhir.EntryReportItem(request, "", "", "").ResourceType
+		switch {
+		case strings.HasPrefix(entry.Response.Status, "201"):
+			run.report.count(resourceType, libfhir.ChangeCreate)
+		case strings.HasPrefix(entry.Response.Status, "200"):
+			run.report.count(resourceType, libfhir.ChangeUpdate)
+		case strings.HasPrefix(entry.Response.Status, "204"):
+			run.report.count(resourceType, libfhir.ChangeDelete)
+		default:
+			msg := fmt.Sprintf("Unknown HTTP response status %v (url=%v)", entry.Response.Status, entry.FullUrl)
+			item := libfhir.EntryReportItem(request, libfhir.ReportCodeUnexpectedStatus, libfhir.SeverityWarning, msg)
+			item.FullURL = to.EmptyString(entry.FullUrl)
+			run.report.warn(item)
+		}
+	}
+}
+
+// tallyChanges records the changes a dry run would make in the run's report.
+func (run *syncRun) tallyChanges(changes []libfhir.TransactionChange) {
+	for _, change := range changes {
+		run.report.count(change.ResourceType, change.Action)
+	}
+	run.report.Changes = append(run.report.Changes, changes...)
+}
+
+// finishSyncRun completes a successful sync: it records the timestamp for the next incremental sync and discards the spooled history and checkpoint.
+// The timestamp is only updated when something was applied to the query directory.
+func (c *Component) finishSyncRun(ctx context.Context, run *syncRun) {
+	if run.applied > 0 {
+		c.setLastUpdateTime(ctx, run.directoryKey, run.checkpoint.NextSyncTime)
+	}
+	c.clearSyncProgress(ctx, run.directoryKey, run.resourceTypes)
+}
+
+// uraChangeDetector detects whether any Organization's URA identifier has changed between history versions,
+// fed one history entry at a time.
+type uraChangeDetector struct {
+	// orgURAs tracks URA identifiers per Organization ID. The empty string is a marker for "no URA identifier present".
+	orgURAs map[string]map[string]bool
+}
+
+func newURAChangeDetector() *uraChangeDetector {
+	return &uraChangeDetector{orgURAs: make(map[string]map[string]bool)}
+}
+
+func (d *uraChangeDetector) add(entry fhir.BundleEntry) {
+	if entry.Resource == nil {
+		return
+	}
+	// Try to unmarshal as Organization
+	var org fhir.Organization
+	if err := json.Unmarshal(entry.Resource, &org); err != nil {
+		return // Not an Organization, skip
+	}
+	if org.Id == nil {
+		return
+	}
+	orgID := *org.Id
+	uraIdentifiers := libfhir.FilterIdentifiersBySystem(org.Identifier, coding.URANamingSystem)
+	if d.orgURAs[orgID] == nil {
+		d.orgURAs[orgID] = make(map[string]bool)
+	}
+	// Track all URA values seen for this organization
+	if len(uraIdentifiers) == 0 {
+		d.orgURAs[orgID][""] = true
+	} else {
+		for _, ura := range uraIdentifiers {
+			if ura.Value != nil {
+				d.orgURAs[orgID][*ura.Value] = true
+			}
+		}
+	}
+}
+
+// changed reports whether any organization had multiple different URA values (including presence/absence changes).
+func (d *uraChangeDetector) changed() bool {
+	for _, uraSet := range d.orgURAs {
+		if len(uraSet) > 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package mcsd.update
+
+import rego.v1
+
+# Accept what the built-in rules accept, but require Endpoints to use the FHIR REST connection type.
+default allow := false
+
+allow if {
+	count(reasons) == 0
+}
+
+reasons contains reason if {
+	some reason in data.mcsd.builtin.reasons
+}
+
+reasons contains "Endpoint.connectionType must be hl7-fhir-rest" if {
+	input.resource.resourceType == "Endpoint"
+	input.resource.connectionType.code != "hl7-fhir-rest"
+}
+
+reasons contains "Organization must be from an authoritative directory" if {
+	input.resource.resourceType == "Organization"
+	input.directory.authoritativeUra == ""
+}
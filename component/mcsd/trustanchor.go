@@ -0,0 +1,104 @@
+package mcsd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/profile"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// TrustAnchor is a trusted register of care providers (the LRZA), which the authoritative Organizations of the administration directories
+// are cross-checked against. It keeps other directories from claiming URAs the register doesn't list, or claiming them under another name.
+type TrustAnchor interface {
+	// RegisteredOrganizations returns the Organizations the register lists with the given URA, or an empty slice if it doesn't list it.
+	RegisteredOrganizations(ctx context.Context, ura string) ([]fhir.Organization, error)
+}
+
+// SetTrustAnchor sets the register that authoritative Organizations are cross-checked against, if enabled by mcsd.validation.lrza.
+// It must be called before the component is started.
+func (c *Component) SetTrustAnchor(trustAnchor TrustAnchor) {
+	c.trustAnchor = trustAnchor
+}
+
+// crossCheckParentOrganizations cross-checks the URA and name of the given authoritative Organizations against the trust anchor,
+// and reports mismatches as warnings. In reject mode, the mismatching Organizations are left out of the returned map:
+// they aren't accepted as authoritative, so they and the resources that belong to them are rejected.
+// If the trust anchor can't be consulted, the update fails in reject mode, and the Organizations aren't cross-checked otherwise.
+func (c *Component) crossCheckParentOrganizations(ctx context.Context, fhirBaseURL string, parentOrganizationsMap parentOrganizationMap, report *DirectoryUpdateReport) (parentOrganizationMap, error) {
+	if c.trustAnchor == nil || c.config.Validation.LRZA == profile.ValidationOff {
+		return parentOrganizationsMap, nil
+	}
+	reject := c.config.Validation.LRZA == profile.ValidationReject
+	result := make(parentOrganizationMap, len(parentOrganizationsMap))
+	for organization, linkedOrganizations := range parentOrganizationsMap {
+		code, reason, err := c.crossCheckOrganization(ctx, organization)
+		if err != nil {
+			if reject {
+				return nil, fmt.Errorf("failed to cross-check authoritative Organizations against the LRZA: %w", err)
+			}
+			report.warn(libfhir.ReportItem{
+				Code:    libfhir.ReportCodeCrossCheckFailed,
+				Message: "authoritative Organizations weren't cross-checked against the LRZA: " + err.Error(),
+			})
+			return parentOrganizationsMap, nil
+		}
+		if code != "" {
+			item := libfhir.ReportItem{Code: code, ResourceType: "Organization", Message: reason}
+			if organization.Id != nil {
+				item.ResourceID = *organization.Id
+				item.FullURL, _ = libfhir.BuildSourceURL(fhirBaseURL, "Organization", *organization.Id)
+			}
+			report.warn(item)
+			slog.WarnContext(ctx, "Authoritative Organization doesn't match the LRZA", logging.FHIRServer(fhirBaseURL), slog.String("code", code), slog.String("reason", reason))
+			if reject {
+				continue
+			}
+		}
+		result[organization] = linkedOrganizations
+	}
+	return result, nil
+}
+
+// crossCheckOrganization checks whether the LRZA lists the URA of the given authoritative Organization, under the Organization's name.
+// If it doesn't, it returns the report code and reason of the mismatch. An Organization without name is only checked by its URA.
+func (c *Component) crossCheckOrganization(ctx context.Context, organization *fhir.Organization) (string, string, error) {
+	// Authoritative Organizations have exactly one URA identifier (see ValidateParentOrganizations)
+	uraIdentifiers := libfhir.FilterIdentifiersBySystem(organization.Identifier, coding.URANamingSystem)
+	if len(uraIdentifiers) == 0 || uraIdentifiers[0].Value == nil {
+		return "", "", nil
+	}
+	ura := *uraIdentifiers[0].Value
+	registered, err := c.trustAnchor.RegisteredOrganizations(ctx, ura)
+	if err != nil {
+		return "", "", err
+	}
+	if len(registered) == 0 {
+		return libfhir.ReportCodeUnregisteredURA, fmt.Sprintf("organization's URA %s isn't registered in the LRZA", ura), nil
+	}
+	if organization.Name == nil {
+		return "", "", nil
+	}
+	var registeredNames []string
+	for _, registeredOrganization := range registered {
+		if registeredOrganization.Name != nil {
+			registeredNames = append(registeredNames, *registeredOrganization.Name)
+		}
+		registeredNames = append(registeredNames, registeredOrganization.Alias...)
+	}
+	if len(registeredNames) == 0 {
+		return "", "", nil
+	}
+	for _, registeredName := range registeredNames {
+		if strings.EqualFold(strings.TrimSpace(registeredName), strings.TrimSpace(*organization.Name)) {
+			return "", "", nil
+		}
+	}
+	return libfhir.ReportCodeNameMismatch, fmt.Sprintf("organization's name %q doesn't match the name registered in the LRZA for URA %s (%s)",
+		*organization.Name, ura, strings.Join(registeredNames, ", ")), nil
+}
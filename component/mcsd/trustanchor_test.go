@@ -0,0 +1,163 @@
+package mcsd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/test"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/to"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// stubTrustAnchor is a TrustAnchor that lists the given Organizations, by URA.
+type stubTrustAnchor struct {
+	organizations map[string][]fhir.Organization
+	err           error
+	lookups       int
+}
+
+func (s *stubTrustAnchor) RegisteredOrganizations(_ context.Context, ura string) ([]fhir.Organization, error) {
+	s.lookups++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.organizations[ura], nil
+}
+
+func TestComponent_crossCheckParentOrganizations(t *testing.T) {
+	history := `{"resourceType":"Bundle","type":"history","entry":[
+		{"fullUrl":"http://example.org/fhir/Organization/parent","request":{"method":"PUT","url":"Organization/parent"},
+		 "resource":{"resourceType":"Organization","id":"parent","name":"Zorgaanbieder","identifier":[{"system":"http://fhir.nl/fhir/NamingSystem/ura","value":"1234"}]}},
+		{"fullUrl":"http://example.org/fhir/Organization/child","request":{"method":"PUT","url":"Organization/child"},
+		 "resource":{"resourceType":"Organization","id":"child","name":"Afdeling","partOf":{"reference":"Organization/parent"}}}
+	]}`
+	mux := http.NewServeMux()
+	mockEndpoints(mux, map[string]*string{
+		"/fhir/Organization/_history": &history,
+		"/fhir/Organization":          &history,
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	baseURL := server.URL + "/fhir"
+	registered := func(name string, aliases ...string) map[string][]fhir.Organization {
+		return map[string][]fhir.Organization{"1234": {{
+			Name:       to.Ptr(name),
+			Alias:      aliases,
+			Identifier: []fhir.Identifier{{System: to.Ptr(coding.URANamingSystem), Value: to.Ptr("1234")}},
+		}}}
+	}
+
+	update := func(t *testing.T, mode string, trustAnchor *stubTrustAnchor) (DirectoryUpdateReport, *transactionRecordingClient, error) {
+		config := DefaultConfig()
+		config.QueryDirectory = DirectoryConfig{FHIRBaseURL: "http://example.com/local/fhir"}
+		config.Validation.LRZA = mode
+		component, err := New(config)
+		require.NoError(t, err)
+		component.SetTrustAnchor(trustAnchor)
+		require.NoError(t, component.registerAdministrationDirectory(t.Context(), baseURL, []string{"Organization"}, false, "", ""))
+		queryClient := &transactionRecordingClient{StubFHIRClient: &test.StubFHIRClient{}}
+		component.fhirQueryClient = queryClient
+		component.fhirAdminClientFn = func(baseURL *url.URL) fhirclient.Client {
+			return fhirclient.New(baseURL, http.DefaultClient, &fhirclient.Config{UsePostSearch: false})
+		}
+		report, err := component.update(t.Context())
+		return report[baseURL], queryClient, err
+	}
+	importedEntries := func(queryClient *transactionRecordingClient) int {
+		var result int
+		for _, tx := range queryClient.transactions {
+			result += len(tx.Entry)
+		}
+		return result
+	}
+
+	t.Run("off", func(t *testing.T) {
+		trustAnchor := &stubTrustAnchor{}
+		report, queryClient, err := update(t, "", trustAnchor)
+
+		require.NoError(t, err)
+		assert.Empty(t, report.Warnings)
+		assert.Equal(t, 2, importedEntries(queryClient))
+		assert.Zero(t, trustAnchor.lookups)
+	})
+	t.Run("registered under the same name", func(t *testing.T) {
+		report, queryClient, err := update(t, "reject", &stubTrustAnchor{organizations: registered("Other name", " zorgaanbieder")})
+
+		require.NoError(t, err)
+		assert.Empty(t, report.Warnings)
+		assert.Equal(t, 2, importedEntries(queryClient))
+	})
+	t.Run("warn", func(t *testing.T) {
+		t.Run("unregistered URA", func(t *testing.T) {
+			report, queryClient, err := update(t, "warn", &stubTrustAnchor{})
+
+			require.NoError(t, err)
+			require.Len(t, report.Items, 1)
+			assert.Equal(t, libfhir.ReportCodeUnregisteredURA, report.Items[0].Code)
+			assert.Equal(t, "parent", report.Items[0].ResourceID)
+			assert.Equal(t, baseURL+"/Organization/parent", report.Items[0].FullURL)
+			assert.Equal(t, "organization's URA 1234 isn't registered in the LRZA", report.Items[0].Message)
+			assert.Equal(t, 2, importedEntries(queryClient), "mismatching organization should still be imported")
+		})
+		t.Run("other name", func(t *testing.T) {
+			report, _, err := update(t, "warn", &stubTrustAnchor{organizations: registered("Other name")})
+
+			require.NoError(t, err)
+			require.Len(t, report.Items, 1)
+			assert.Equal(t, libfhir.ReportCodeNameMismatch, report.Items[0].Code)
+			assert.Equal(t, `organization's name "Zorgaanbieder" doesn't match the name registered in the LRZA for URA 1234 (Other name)`, report.Items[0].Message)
+		})
+		t.Run("LRZA unavailable", func(t *testing.T) {
+			report, queryClient, err := update(t, "warn", &stubTrustAnchor{err: errors.New("LRZA hasn't been synchronized yet")})
+
+			require.NoError(t, err)
+			require.Len(t, report.Items, 1)
+			assert.Equal(t, libfhir.ReportCodeCrossCheckFailed, report.Items[0].Code)
+			assert.Equal(t, 2, importedEntries(queryClient))
+		})
+	})
+	t.Run("reject", func(t *testing.T) {
+		t.Run("unregistered URA", func(t *testing.T) {
+			report, queryClient, err := update(t, "reject", &stubTrustAnchor{})
+
+			require.NoError(t, err)
+			assert.Equal(t, libfhir.ReportCodeUnregisteredURA, report.Items[0].Code)
+			assert.Zero(t, importedEntries(queryClient), "organization and its sub-organizations shouldn't be imported")
+		})
+		t.Run("LRZA unavailable", func(t *testing.T) {
+			report, queryClient, err := update(t, "reject", &stubTrustAnchor{err: errors.New("LRZA hasn't been synchronized yet")})
+
+			require.NoError(t, err)
+			require.Len(t, report.Errors, 1)
+			assert.Contains(t, report.Errors[0], "failed to cross-check authoritative Organizations against the LRZA")
+			assert.Zero(t, importedEntries(queryClient))
+		})
+	})
+	t.Run("invalid mode", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Validation.LRZA = "strict"
+
+		_, err := New(config)
+
+		assert.EqualError(t, err, `mcsd.validation.lrza: invalid mode "strict" (valid: off, warn, reject)`)
+	})
+	t.Run("enabled without LRZA", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Validation.LRZA = "warn"
+		component, err := New(config)
+		require.NoError(t, err)
+
+		err = component.Start()
+
+		assert.EqualError(t, err, "mcsd.validation.lrza requires the LRZA sync client (lrza.lrzabaseurl)")
+	})
+}
@@ -85,9 +85,14 @@ func buildUpdateTransaction(ctx context.Context, tx *fhir.Bundle, entry fhir.Bun
 	}
 
 	if err := ValidateUpdate(ctx, validationRules, entry.Resource, parentOrganizationMap, allHealthcareServices); err != nil {
-		return "", err
+		return "", rejectedError{err}
 	}
+	return appendUpdateEntry(ctx, tx, entry, resource, resourceType, isDiscoverableDirectory, sourceBaseURL)
+}
 
+// appendUpdateEntry adds the transaction entry that creates or updates the given (validated) resource in the query directory.
+// Resources from discoverable directories are skipped, except for mCSD directory Endpoints.
+func appendUpdateEntry(ctx context.Context, tx *fhir.Bundle, entry fhir.BundleEntry, resource map[string]any, resourceType string, isDiscoverableDirectory bool, sourceBaseURL string) (string, error) {
 	// Only sync resources from non-discoverable directories to the query directory
 	// Exception: mCSD directory endpoints are synced even from discoverable directories for resilience (e.g. if the root directory is down)
 	var doSync = true
@@ -10,12 +10,21 @@ import (
 
 	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/profile"
 	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
 )
 
 type ValidationRules struct {
 	// AllowedResourceTypes is a list of FHIR resource types that are allowed to be created/updated.
 	AllowedResourceTypes []string
+	// Policy decides whether a resource is accepted, if set. Otherwise, the built-in rules decide.
+	Policy *UpdatePolicy
+	// Source is the administration directory the resources come from, which is passed to the Policy.
+	Source PolicySource
+	// Profiles rejects resources that don't conform to their nl-gf profile, if set.
+	Profiles *profile.Validator
+	// policyRun identifies the data of the directory that the Policy's built-in rules use (see preparePolicy).
+	policyRun string
 }
 
 // ValidateParentOrganizations validates all parent organizations in the map.
@@ -28,8 +37,19 @@ func ValidateParentOrganizations(parentOrganizationMap map[*fhir.Organization][]
 	return nil
 }
 
+// rejectedError marks an error as the rejection of a resource by validation,
+// as opposed to an entry that couldn't be processed at all.
+type rejectedError struct {
+	error
+}
+
+func (e rejectedError) Unwrap() error {
+	return e.error
+}
+
 // ValidateUpdate validates a FHIR resource create/update from a mCSD Administration Directory,
 // according to the rules specified by https://nuts-foundation.github.io/nl-generic-functions-ig/care-services.html#update-client
+// If the rules have a Policy, it makes the decision instead. Resources that don't conform to their profile are rejected either way, if the rules have Profiles.
 func ValidateUpdate(ctx context.Context, rules ValidationRules, resourceJSON []byte, parentOrganizationMap map[*fhir.Organization][]*fhir.Organization, allHealthcareServices []fhir.HealthcareService) error {
 	resourceAsMap := map[string]any{}
 	if err := json.Unmarshal(resourceJSON, &resourceAsMap); err != nil {
@@ -45,6 +65,23 @@ func ValidateUpdate(ctx context.Context, rules ValidationRules, resourceJSON []b
 		return fmt.Errorf("resource type %s not allowed", resourceType)
 	}
 
+	if rules.Policy == nil {
+		err := validateBuiltinRules(ctx, resourceType, resourceJSON, parentOrganizationMap, allHealthcareServices)
+		if err == nil && rules.Profiles != nil {
+			err = rules.Profiles.Validate(resourceJSON)
+		}
+		return err
+	}
+	if rules.Profiles != nil {
+		if err := rules.Profiles.Validate(resourceJSON); err != nil {
+			return err
+		}
+	}
+	return validateWithPolicy(ctx, rules, resourceAsMap, parentOrganizationMap, allHealthcareServices)
+}
+
+// validateBuiltinRules validates a resource using the built-in (anti-spoofing) rules.
+func validateBuiltinRules(ctx context.Context, resourceType string, resourceJSON []byte, parentOrganizationMap map[*fhir.Organization][]*fhir.Organization, allHealthcareServices []fhir.HealthcareService) error {
 	switch resourceType {
 	case "Organization":
 		return unmarshalAndVisitOrganizationResource(resourceJSON, parentOrganizationMap)
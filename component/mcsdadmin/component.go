@@ -25,6 +25,7 @@ import (
 	"github.com/nuts-foundation/nuts-knooppunt/lib/httpauth"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/profile"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/resilience"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/to"
 	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel"
 	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
@@ -55,13 +56,13 @@ func New(config Config) *Component {
 	var httpClient *http.Client
 	if config.Auth.IsConfigured() {
 		slog.Info("MCSD admin: OAuth2 authentication configured", slog.String("token_endpoint", config.Auth.TokenEndpoint))
-		httpClient, err = httpauth.NewOAuth2HTTPClient(config.Auth, tracing.WrapTransport(nil))
+		httpClient, err = httpauth.NewOAuth2HTTPClient(config.Auth, resilience.WrapTransport(tracing.WrapTransport(nil)))
 		if err != nil {
 			slog.Error("Failed to create OAuth2 HTTP client for MCSD admin", logging.Error(err))
 			return nil
 		}
 	} else {
-		httpClient = tracing.NewHTTPClient()
+		httpClient = &http.Client{Transport: resilience.WrapTransport(tracing.WrapTransport(nil))}
 	}
 
 	client = fhirclient.New(baseURL, httpClient, fhirutil.ClientConfig())
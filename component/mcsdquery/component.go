@@ -0,0 +1,320 @@
+// Package mcsdquery provides a read-only FHIR API on the public interface for the mCSD Query Directory,
+// so peers can query it without a separately deployed Policy Enforcement Point (PEP).
+// Access tokens are introspected through the Nuts node and requests are authorized by the PDP's mcsd_query policy,
+// before they're proxied to the Query Directory.
+package mcsdquery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nuts-foundation/nuts-knooppunt/component"
+	"github.com/nuts-foundation/nuts-knooppunt/component/pdp"
+	"github.com/nuts-foundation/nuts-knooppunt/component/pdp/policies"
+	"github.com/nuts-foundation/nuts-knooppunt/component/tracing"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/fhirapi"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/resilience"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+var _ component.Lifecycle = (*Component)(nil)
+
+// policyName is the PDP policy that authorizes requests to the query API.
+const policyName = "mcsd_query"
+
+// basePath is the path of the query API on the public interface.
+const basePath = "/mcsd/fhir"
+
+// maxSearchBodySize limits the size of form-encoded search requests (POST [type]/_search).
+const maxSearchBodySize = 1 << 20
+
+// forwardedHeaders are the request headers that are passed on to the Query Directory.
+var forwardedHeaders = []string{"Accept", "Content-Type", "Prefer"}
+
+// returnedHeaders are the response headers of the Query Directory that are returned to the client.
+var returnedHeaders = []string{"Content-Type", "ETag", "Last-Modified"}
+
+type Config struct {
+	Enabled bool `koanf:"enabled"`
+	// NutsNodeURL is the base URL of the internal API of the Nuts node that introspects the access tokens.
+	// It defaults to the embedded Nuts node, if enabled.
+	NutsNodeURL string `koanf:"nutsnodeurl"`
+}
+
+// PolicyDecider decides whether a request is allowed by the given (normalized) policies. It's implemented by the PDP component.
+type PolicyDecider interface {
+	Decide(ctx context.Context, request pdp.APIRequest, policyNames []string) pdp.APIResponse
+}
+
+var _ PolicyDecider = (*pdp.Component)(nil)
+
+type Component struct {
+	queryDirectoryURL *url.URL
+	publicBaseURL     string
+	introspector      *introspector
+	decider           PolicyDecider
+	httpClient        *http.Client
+}
+
+// New creates the mCSD query API, which proxies authorized requests to the Query Directory at the given FHIR base URL.
+// The public URL is the base URL of the public interface, used to rewrite the URLs in the Query Directory's responses.
+func New(config Config, queryDirectoryURL string, publicURL *url.URL, decider PolicyDecider) (*Component, error) {
+	if queryDirectoryURL == "" {
+		return nil, errors.New("mCSD Query Directory is not configured (mcsd.query.fhirbaseurl)")
+	}
+	parsedQueryDirectoryURL, err := url.Parse(strings.TrimSuffix(queryDirectoryURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Query Directory FHIR base URL (url=%s): %w", queryDirectoryURL, err)
+	}
+	if config.NutsNodeURL == "" {
+		return nil, errors.New("no Nuts node to introspect access tokens (mcsdquery.nutsnodeurl)")
+	}
+	if decider == nil {
+		return nil, errors.New("the PDP must be enabled to authorize requests")
+	}
+	return &Component{
+		queryDirectoryURL: parsedQueryDirectoryURL,
+		publicBaseURL:     strings.TrimSuffix(publicURL.String(), "/") + basePath,
+		introspector:      newIntrospector(config.NutsNodeURL),
+		decider:           decider,
+		httpClient:        &http.Client{Transport: resilience.WrapTransport(tracing.WrapTransport(nil))},
+	}, nil
+}
+
+func (c *Component) Start() error {
+	return nil
+}
+
+func (c *Component) Stop(_ context.Context) error {
+	return nil
+}
+
+func (c *Component) RegisterHttpHandlers(publicMux *http.ServeMux, _ *http.ServeMux) {
+	// Which resource types and interactions are allowed is up to the mcsd_query policy (and its CapabilityStatement)
+	publicMux.HandleFunc("GET "+basePath+"/{resourceType}", c.handleRequest)
+	publicMux.HandleFunc("POST "+basePath+"/{resourceType}/_search", c.handleRequest)
+	publicMux.HandleFunc("GET "+basePath+"/{resourceType}/{id}", c.handleRequest)
+}
+
+func (c *Component) handleRequest(httpResponse http.ResponseWriter, httpRequest *http.Request) {
+	ctx := httpRequest.Context()
+	pathSegments, err := fhirPathSegments(httpRequest)
+	if err != nil {
+		fhirapi.SendErrorResponse(ctx, httpResponse, fhirapi.BadRequestError(err.Error(), nil))
+		return
+	}
+	fhirPath := "/" + strings.Join(pathSegments, "/")
+	var body []byte
+	if httpRequest.Method == http.MethodPost {
+		body, err = io.ReadAll(http.MaxBytesReader(httpResponse, httpRequest.Body, maxSearchBodySize))
+		if err != nil {
+			fhirapi.SendErrorResponse(ctx, httpResponse, fhirapi.BadRequestError("unable to read request body", err))
+			return
+		}
+	}
+	if err := c.authorize(ctx, httpRequest, fhirPath, body); err != nil {
+		var fhirError *fhirapi.Error
+		if errors.As(err, &fhirError) && fhirError.IssueType == fhir.IssueTypeLogin {
+			httpResponse.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		fhirapi.SendErrorResponse(ctx, httpResponse, err)
+		return
+	}
+	if err := c.forward(httpResponse, httpRequest, pathSegments, body); err != nil {
+		fhirapi.SendErrorResponse(ctx, httpResponse, &fhirapi.Error{
+			Message:   "mCSD Query Directory request failed",
+			Cause:     err,
+			IssueType: fhir.IssueTypeTransient,
+		})
+	}
+}
+
+// fhirPathSegments returns the (escaped) path segments of the FHIR interaction the request is for, relative to the FHIR base URL.
+// They're built from the request's path values rather than its path, so the request that's authorized is the request
+// that's forwarded: a value that contains a slash or is a relative path segment ("." or "..") could make the Query Directory
+// resolve another path than the one the policy allowed.
+func fhirPathSegments(httpRequest *http.Request) ([]string, error) {
+	var result []string
+	for _, name := range []string{"resourceType", "id"} {
+		value := httpRequest.PathValue(name)
+		if value == "" {
+			continue
+		}
+		if value == "." || value == ".." || strings.Contains(value, "/") {
+			return nil, fmt.Errorf("invalid %s in request path", name)
+		}
+		result = append(result, url.PathEscape(value))
+	}
+	if httpRequest.Method == http.MethodPost {
+		result = append(result, "_search")
+	}
+	return result, nil
+}
+
+// authorize checks whether the request is allowed: the access token must be active, issued for the mcsd_query scope,
+// and the request must be allowed by the mcsd_query policy.
+func (c *Component) authorize(ctx context.Context, httpRequest *http.Request, fhirPath string, body []byte) error {
+	accessToken, ok := bearerToken(httpRequest)
+	if !ok {
+		return fhirapi.UnauthorizedError("missing bearer access token", nil)
+	}
+	subject, err := c.introspector.introspect(ctx, accessToken)
+	if err != nil {
+		return &fhirapi.Error{
+			Message:   "unable to introspect access token",
+			Cause:     err,
+			IssueType: fhir.IssueTypeTransient,
+		}
+	}
+	if !subject.Active {
+		return fhirapi.UnauthorizedError("access token is invalid or expired", nil)
+	}
+	if !hasScope(subject.Scope, policyName) {
+		return fhirapi.ForbiddenError("access token wasn't issued for scope "+policyName, nil)
+	}
+
+	header := httpRequest.Header.Clone()
+	// The access token isn't input for the policy, and shouldn't end up in decision logs
+	header.Del("Authorization")
+	decision := c.decider.Decide(ctx, pdp.APIRequest{
+		Input: pdp.APIInput{
+			Subject: subject,
+			Request: pdp.HTTPRequest{
+				Method:   httpRequest.Method,
+				Protocol: httpRequest.Proto,
+				Path:     fhirPath,
+				Query:    httpRequest.URL.RawQuery,
+				Header:   header,
+				Body:     string(body),
+			},
+			Context: pdp.APIContext{
+				ConnectionTypeCode: "hl7-fhir-rest",
+			},
+		},
+	}, []string{policyName})
+	if decision.Allow {
+		return nil
+	}
+	var reasons []string
+	if decision.Error != "" {
+		reasons = append(reasons, decision.Error)
+	}
+	for _, reason := range decision.Policies[policyName].Reasons {
+		if reason.Code != pdp.TypeResultCodeInformational {
+			reasons = append(reasons, reason.Description)
+		}
+	}
+	slog.InfoContext(ctx, "mCSD query request denied",
+		slog.String("client_id", subject.ClientId),
+		slog.String("method", httpRequest.Method),
+		slog.String("path", fhirPath),
+		slog.String("reasons", strings.Join(reasons, "; ")))
+	message := "access denied by policy " + policyName
+	if len(reasons) > 0 {
+		message += ": " + strings.Join(reasons, "; ")
+	}
+	return fhirapi.ForbiddenError(message, nil)
+}
+
+// forward sends the (authorized) request to the Query Directory and writes its response.
+// URLs in the response that point to the Query Directory are rewritten to point to the query API.
+func (c *Component) forward(httpResponse http.ResponseWriter, httpRequest *http.Request, pathSegments []string, body []byte) error {
+	ctx := httpRequest.Context()
+	targetURL := c.queryDirectoryURL.JoinPath(pathSegments...)
+	targetURL.RawQuery = httpRequest.URL.RawQuery
+	var requestBody io.Reader
+	if body != nil {
+		requestBody = bytes.NewReader(body)
+	}
+	upstreamRequest, err := http.NewRequestWithContext(ctx, httpRequest.Method, targetURL.String(), requestBody)
+	if err != nil {
+		return err
+	}
+	for _, name := range forwardedHeaders {
+		if value := httpRequest.Header.Get(name); value != "" {
+			upstreamRequest.Header.Set(name, value)
+		}
+	}
+	upstreamResponse, err := c.httpClient.Do(upstreamRequest)
+	if err != nil {
+		return err
+	}
+	defer upstreamResponse.Body.Close()
+	responseBody, err := io.ReadAll(upstreamResponse.Body)
+	if err != nil {
+		return err
+	}
+	responseBody = c.rewriteURLs(ctx, responseBody)
+
+	for _, name := range returnedHeaders {
+		if value := upstreamResponse.Header.Get(name); value != "" {
+			httpResponse.Header().Set(name, value)
+		}
+	}
+	httpResponse.WriteHeader(upstreamResponse.StatusCode)
+	if _, err := httpResponse.Write(responseBody); err != nil {
+		slog.ErrorContext(ctx, "Failed to write mCSD query response", logging.Error(err))
+	}
+	return nil
+}
+
+// rewriteURLs rewrites the links and entry URLs of a Bundle that point to the Query Directory, to point to the query API instead.
+// Other responses are returned as-is.
+func (c *Component) rewriteURLs(ctx context.Context, responseBody []byte) []byte {
+	var bundle map[string]any
+	if err := json.Unmarshal(responseBody, &bundle); err != nil || bundle["resourceType"] != "Bundle" {
+		return responseBody
+	}
+	upstreamBaseURL := c.queryDirectoryURL.String()
+	rewrite := func(object any, key string) {
+		properties, ok := object.(map[string]any)
+		if !ok {
+			return
+		}
+		if value, ok := properties[key].(string); ok && strings.HasPrefix(value, upstreamBaseURL) {
+			properties[key] = c.publicBaseURL + strings.TrimPrefix(value, upstreamBaseURL)
+		}
+	}
+	links, _ := bundle["link"].([]any)
+	for _, link := range links {
+		rewrite(link, "url")
+	}
+	entries, _ := bundle["entry"].([]any)
+	for _, entry := range entries {
+		rewrite(entry, "fullUrl")
+	}
+	result, err := json.Marshal(bundle)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to rewrite URLs of mCSD query response", logging.Error(err))
+		return responseBody
+	}
+	return result
+}
+
+// bearerToken returns the access token of the request's Authorization header, if it holds a bearer token.
+func bearerToken(httpRequest *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(httpRequest.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// hasScope returns whether the space-separated scopes contain the given scope (compared as normalized policy names).
+func hasScope(scopes string, scope string) bool {
+	for _, curr := range strings.Fields(scopes) {
+		if policies.NormalizePolicyName(curr) == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,253 @@
+package mcsdquery
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/nuts-foundation/nuts-knooppunt/component/pdp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubDecider allows requests when allow is set, and records the last request it decided on.
+type stubDecider struct {
+	allow       bool
+	reasons     []pdp.ResultReason
+	request     pdp.APIRequest
+	policyNames []string
+}
+
+func (s *stubDecider) Decide(_ context.Context, request pdp.APIRequest, policyNames []string) pdp.APIResponse {
+	s.request = request
+	s.policyNames = policyNames
+	return pdp.APIResponse{
+		Allow: s.allow,
+		Policies: map[string]pdp.PolicyResult{
+			policyName: {Allow: s.allow, Reasons: s.reasons},
+		},
+	}
+}
+
+// newNutsNode returns a Nuts node that introspects the given tokens to the given introspection responses.
+func newNutsNode(t *testing.T, tokens map[string]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/internal/auth/v2/accesstoken/introspect", r.URL.Path)
+		response, ok := tokens[r.FormValue("token")]
+		if !ok {
+			response = `{"active":false}`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestComponent_handleRequest(t *testing.T) {
+	const activeToken = `{"active":true,"client_id":"https://example.com/oauth2/peer","scope":"mcsd_query","organization_ura":"00000001"}`
+	var upstreamRequest *http.Request
+	var upstreamBody string
+	queryDirectory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequest = r
+		body, _ := io.ReadAll(r.Body)
+		upstreamBody = string(body)
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.Header().Set("X-Internal", "secret")
+		if r.URL.Path == "/fhir/Organization/1" {
+			_, _ = w.Write([]byte(`{"resourceType":"Organization","id":"1"}`))
+			return
+		}
+		baseURL := "http://" + r.Host + "/fhir"
+		_, _ = w.Write([]byte(`{"resourceType":"Bundle","type":"searchset",` +
+			`"link":[{"relation":"self","url":"` + baseURL + `/Organization?name=Care"}],` +
+			`"entry":[{"fullUrl":"` + baseURL + `/Organization/1","resource":{"resourceType":"Organization","id":"1"}}]}`))
+	}))
+	defer queryDirectory.Close()
+	nutsNode := newNutsNode(t, map[string]string{
+		"valid":       activeToken,
+		"other-scope": `{"active":true,"client_id":"https://example.com/oauth2/peer","scope":"mcsd_update"}`,
+	})
+
+	setup := func(t *testing.T, decider *stubDecider) *httptest.Server {
+		publicURL, _ := url.Parse("https://knooppunt.example.com")
+		component, err := New(Config{Enabled: true, NutsNodeURL: nutsNode.URL}, queryDirectory.URL+"/fhir/", publicURL, decider)
+		require.NoError(t, err)
+		mux := http.NewServeMux()
+		component.RegisterHttpHandlers(mux, http.NewServeMux())
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		return server
+	}
+	doRequest := func(t *testing.T, method string, requestURL string, token string, body string) (*http.Response, string) {
+		var requestBody io.Reader
+		if body != "" {
+			requestBody = strings.NewReader(body)
+		}
+		httpRequest, _ := http.NewRequest(method, requestURL, requestBody)
+		if token != "" {
+			httpRequest.Header.Set("Authorization", "Bearer "+token)
+		}
+		if body != "" {
+			httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		httpResponse, err := http.DefaultClient.Do(httpRequest)
+		require.NoError(t, err)
+		defer httpResponse.Body.Close()
+		responseBody, _ := io.ReadAll(httpResponse.Body)
+		return httpResponse, string(responseBody)
+	}
+
+	t.Run("read", func(t *testing.T) {
+		decider := &stubDecider{allow: true}
+		server := setup(t, decider)
+
+		httpResponse, body := doRequest(t, http.MethodGet, server.URL+"/mcsd/fhir/Organization/1", "valid", "")
+
+		assert.Equal(t, http.StatusOK, httpResponse.StatusCode)
+		assert.JSONEq(t, `{"resourceType":"Organization","id":"1"}`, body)
+		assert.Equal(t, "application/fhir+json", httpResponse.Header.Get("Content-Type"))
+		assert.Empty(t, httpResponse.Header.Get("X-Internal"))
+		assert.Empty(t, upstreamRequest.Header.Get("Authorization"), "access token must not be passed on")
+		// Policy input
+		assert.Equal(t, []string{"mcsd_query"}, decider.policyNames)
+		input := decider.request.Input
+		assert.Equal(t, "/Organization/1", input.Request.Path)
+		assert.Equal(t, http.MethodGet, input.Request.Method)
+		assert.Equal(t, "hl7-fhir-rest", input.Context.ConnectionTypeCode)
+		assert.Equal(t, "00000001", input.Subject.OrganizationUra)
+		assert.Empty(t, input.Request.Header.Get("Authorization"))
+	})
+	t.Run("search rewrites Bundle URLs", func(t *testing.T) {
+		decider := &stubDecider{allow: true}
+		server := setup(t, decider)
+
+		httpResponse, body := doRequest(t, http.MethodGet, server.URL+"/mcsd/fhir/Organization?name=Care", "valid", "")
+
+		assert.Equal(t, http.StatusOK, httpResponse.StatusCode)
+		assert.Equal(t, "/fhir/Organization", upstreamRequest.URL.Path)
+		assert.Equal(t, "name=Care", upstreamRequest.URL.RawQuery)
+		assert.Equal(t, "name=Care", decider.request.Input.Request.Query)
+		var bundle struct {
+			Link []struct {
+				URL string `json:"url"`
+			} `json:"link"`
+			Entry []struct {
+				FullURL string `json:"fullUrl"`
+			} `json:"entry"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(body), &bundle))
+		assert.Equal(t, "https://knooppunt.example.com/mcsd/fhir/Organization?name=Care", bundle.Link[0].URL)
+		assert.Equal(t, "https://knooppunt.example.com/mcsd/fhir/Organization/1", bundle.Entry[0].FullURL)
+	})
+	t.Run("search using POST", func(t *testing.T) {
+		decider := &stubDecider{allow: true}
+		server := setup(t, decider)
+
+		httpResponse, _ := doRequest(t, http.MethodPost, server.URL+"/mcsd/fhir/Organization/_search", "valid", "name=Care")
+
+		assert.Equal(t, http.StatusOK, httpResponse.StatusCode)
+		assert.Equal(t, "/fhir/Organization/_search", upstreamRequest.URL.Path)
+		assert.Equal(t, "name=Care", upstreamBody)
+		assert.Equal(t, "name=Care", decider.request.Input.Request.Body)
+	})
+	t.Run("denied by policy", func(t *testing.T) {
+		upstreamRequest = nil
+		decider := &stubDecider{reasons: []pdp.ResultReason{
+			{Code: pdp.TypeResultCodeNotAllowed, Description: "search parameter [identifier] not allowed"},
+			{Code: pdp.TypeResultCodeInformational, Description: "capability_checked: false"},
+		}}
+		server := setup(t, decider)
+
+		httpResponse, body := doRequest(t, http.MethodGet, server.URL+"/mcsd/fhir/Organization?identifier=1", "valid", "")
+
+		assert.Equal(t, http.StatusForbidden, httpResponse.StatusCode)
+		assert.Contains(t, body, "access denied by policy mcsd_query: search parameter [identifier] not allowed")
+		assert.NotContains(t, body, "capability_checked")
+		assert.Nil(t, upstreamRequest)
+	})
+	t.Run("missing access token", func(t *testing.T) {
+		server := setup(t, &stubDecider{allow: true})
+
+		httpResponse, body := doRequest(t, http.MethodGet, server.URL+"/mcsd/fhir/Organization", "", "")
+
+		assert.Equal(t, http.StatusUnauthorized, httpResponse.StatusCode)
+		assert.Equal(t, "Bearer", httpResponse.Header.Get("WWW-Authenticate"))
+		assert.Contains(t, body, "missing bearer access token")
+	})
+	t.Run("inactive access token", func(t *testing.T) {
+		decider := &stubDecider{allow: true}
+		server := setup(t, decider)
+
+		httpResponse, _ := doRequest(t, http.MethodGet, server.URL+"/mcsd/fhir/Organization", "expired", "")
+
+		assert.Equal(t, http.StatusUnauthorized, httpResponse.StatusCode)
+		assert.Nil(t, decider.policyNames)
+	})
+	t.Run("access token for other scope", func(t *testing.T) {
+		decider := &stubDecider{allow: true}
+		server := setup(t, decider)
+
+		httpResponse, body := doRequest(t, http.MethodGet, server.URL+"/mcsd/fhir/Organization", "other-scope", "")
+
+		assert.Equal(t, http.StatusForbidden, httpResponse.StatusCode)
+		assert.Contains(t, body, "access token wasn't issued for scope mcsd_query")
+		assert.Nil(t, decider.policyNames)
+	})
+	t.Run("path traversal", func(t *testing.T) {
+		for _, requestPath := range []string{
+			"/mcsd/fhir/Organization/..%2F..%2Fdefault%2FPatient",
+			"/mcsd/fhir/Organization/%2E%2E",
+			"/mcsd/fhir/Organization/%2E",
+			"/mcsd/fhir/..%2Fdefault%2FPatient",
+			"/mcsd/fhir/%2E%2E/Patient",
+		} {
+			t.Run(requestPath, func(t *testing.T) {
+				upstreamRequest = nil
+				server := setup(t, &stubDecider{allow: true})
+
+				httpResponse, _ := doRequest(t, http.MethodGet, server.URL+requestPath, "valid", "")
+
+				assert.GreaterOrEqual(t, httpResponse.StatusCode, 400)
+				assert.Less(t, httpResponse.StatusCode, 500)
+				assert.Nil(t, upstreamRequest)
+			})
+		}
+	})
+	t.Run("write interactions aren't supported", func(t *testing.T) {
+		server := setup(t, &stubDecider{allow: true})
+
+		httpResponse, _ := doRequest(t, http.MethodPut, server.URL+"/mcsd/fhir/Organization/1", "valid", `{}`)
+
+		assert.Equal(t, http.StatusMethodNotAllowed, httpResponse.StatusCode)
+	})
+}
+
+func TestNew(t *testing.T) {
+	publicURL, _ := url.Parse("http://localhost:8080")
+	t.Run("Query Directory not configured", func(t *testing.T) {
+		_, err := New(Config{Enabled: true, NutsNodeURL: "http://localhost:8081/nuts"}, "", publicURL, &stubDecider{})
+		assert.EqualError(t, err, "mCSD Query Directory is not configured (mcsd.query.fhirbaseurl)")
+	})
+	t.Run("Nuts node not configured", func(t *testing.T) {
+		_, err := New(Config{Enabled: true}, "http://localhost/fhir", publicURL, &stubDecider{})
+		assert.EqualError(t, err, "no Nuts node to introspect access tokens (mcsdquery.nutsnodeurl)")
+	})
+	t.Run("PDP not enabled", func(t *testing.T) {
+		_, err := New(Config{Enabled: true, NutsNodeURL: "http://localhost:8081/nuts"}, "http://localhost/fhir", publicURL, nil)
+		assert.EqualError(t, err, "the PDP must be enabled to authorize requests")
+	})
+}
+
+func TestHasScope(t *testing.T) {
+	assert.True(t, hasScope("openid mcsd_query", "mcsd_query"))
+	assert.True(t, hasScope("MCSD-Query", "mcsd_query"))
+	assert.False(t, hasScope("mcsd_update", "mcsd_query"))
+	assert.False(t, hasScope("", "mcsd_query"))
+}
@@ -0,0 +1,58 @@
+package mcsdquery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nuts-foundation/nuts-knooppunt/component/pdp"
+	"github.com/nuts-foundation/nuts-knooppunt/component/tracing"
+)
+
+// introspector introspects access tokens through the Nuts node's internal introspection API (RFC7662).
+type introspector struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newIntrospector(nutsNodeURL string) *introspector {
+	return &introspector{
+		endpoint: strings.TrimSuffix(nutsNodeURL, "/") + "/internal/auth/v2/accesstoken/introspect",
+		client:   &http.Client{Transport: tracing.WrapTransport(nil), Timeout: 30 * time.Second},
+	}
+}
+
+// introspect returns the subject of the access token. The claims the Nuts node maps from the presented credentials
+// (e.g. organization_ura) end up in the subject, so they're available to the policy.
+// Inactive tokens aren't an error: the subject is returned with Active set to false.
+func (i *introspector) introspect(ctx context.Context, accessToken string) (pdp.APISubject, error) {
+	form := url.Values{"token": {accessToken}}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, i.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return pdp.APISubject{}, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpRequest.Header.Set("Accept", "application/json")
+	httpResponse, err := i.client.Do(httpRequest)
+	if err != nil {
+		return pdp.APISubject{}, fmt.Errorf("token introspection request failed: %w", err)
+	}
+	defer httpResponse.Body.Close()
+	responseBody, err := io.ReadAll(io.LimitReader(httpResponse.Body, 1<<20))
+	if err != nil {
+		return pdp.APISubject{}, fmt.Errorf("token introspection request failed: %w", err)
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return pdp.APISubject{}, fmt.Errorf("token introspection request failed (status=%d): %s", httpResponse.StatusCode, string(responseBody))
+	}
+	var subject pdp.APISubject
+	if err := json.Unmarshal(responseBody, &subject); err != nil {
+		return pdp.APISubject{}, fmt.Errorf("invalid token introspection response: %w", err)
+	}
+	return subject, nil
+}
@@ -0,0 +1,45 @@
+package mcsdquery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntrospector_introspect(t *testing.T) {
+	t.Run("active token", func(t *testing.T) {
+		nutsNode := newNutsNode(t, map[string]string{
+			"token": `{"active":true,"client_id":"https://example.com/oauth2/peer","scope":"mcsd_query","organization_ura":"00000001","organization_name":"Care Inc."}`,
+		})
+
+		subject, err := newIntrospector(nutsNode.URL+"/").introspect(t.Context(), "token")
+
+		require.NoError(t, err)
+		assert.True(t, subject.Active)
+		assert.Equal(t, "https://example.com/oauth2/peer", subject.ClientId)
+		assert.Equal(t, "mcsd_query", subject.Scope)
+		assert.Equal(t, "00000001", subject.OrganizationUra)
+		assert.Equal(t, "Care Inc.", subject.OrganizationName)
+	})
+	t.Run("inactive token", func(t *testing.T) {
+		nutsNode := newNutsNode(t, nil)
+
+		subject, err := newIntrospector(nutsNode.URL).introspect(t.Context(), "token")
+
+		require.NoError(t, err)
+		assert.False(t, subject.Active)
+	})
+	t.Run("introspection fails", func(t *testing.T) {
+		nutsNode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}))
+		defer nutsNode.Close()
+
+		_, err := newIntrospector(nutsNode.URL).introspect(t.Context(), "token")
+
+		assert.ErrorContains(t, err, "token introspection request failed (status=500): internal error")
+	})
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/nuts-foundation/nuts-knooppunt/lib/fhirapi"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/resilience"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/tlsutil"
 	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
 	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
@@ -85,7 +86,7 @@ func New(config Config) (*Component, error) {
 	}, nil
 }
 
-// createHTTPClient creates an HTTP client with optional mTLS configuration and OpenTelemetry instrumentation
+// createHTTPClient creates an HTTP client with optional mTLS configuration, OpenTelemetry instrumentation, retries and circuit breaking
 func createHTTPClient(config Config) (*http.Client, error) {
 	var transport http.RoundTripper = http.DefaultTransport
 
@@ -107,7 +108,7 @@ func createHTTPClient(config Config) (*http.Client, error) {
 	}
 
 	return &http.Client{
-		Transport: tracing.WrapTransport(transport),
+		Transport: resilience.WrapTransport(tracing.WrapTransport(transport)),
 	}, nil
 }
 
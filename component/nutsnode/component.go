@@ -67,6 +67,11 @@ type TracingConfig struct {
 	Insecure     bool
 }
 
+// InternalURL returns the base URL of the embedded Nuts node's internal API.
+func (c *Component) InternalURL() *url.URL {
+	return c.internalAddr
+}
+
 func (c *Component) Start() error {
 	const dataDir = "data/nuts"
 	const configFile = "config/nuts.yml"
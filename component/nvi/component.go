@@ -17,6 +17,7 @@ import (
 	"github.com/nuts-foundation/nuts-knooppunt/lib/coding"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/fhirapi"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/resilience"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/tenants"
 	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
 	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
@@ -64,7 +65,7 @@ func New(config Config, httpClientFn authn.HTTPClientProvider, pseudonymizer pse
 			if err != nil {
 				return nil, err
 			}
-			httpClient.Transport = &loggingTransport{next: tracing.WrapTransport(httpClient.Transport)}
+			httpClient.Transport = &loggingTransport{next: resilience.WrapTransport(tracing.WrapTransport(httpClient.Transport))}
 			clientConfig := fhirutil.ClientConfig()
 			clientConfig.UsePostSearch = false // nvi doesn't support POST searches
 			return fhirclient.New(baseURL, httpClient, clientConfig), nil
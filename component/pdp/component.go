@@ -16,6 +16,7 @@ import (
 	"github.com/nuts-foundation/nuts-knooppunt/component/pdp/policies"
 	"github.com/nuts-foundation/nuts-knooppunt/component/tracing"
 	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/resilience"
 	"golang.org/x/exp/maps"
 )
 
@@ -43,7 +44,7 @@ func New(config Config, consentChecker mitz.ConsentChecker) (*Component, error)
 		if err != nil {
 			return &Component{}, err
 		}
-		pipClient := fhirclient.New(url, tracing.NewHTTPClient(), &fhirclient.Config{
+		pipClient := fhirclient.New(url, &http.Client{Transport: resilience.WrapTransport(tracing.WrapTransport(nil))}, &fhirclient.Config{
 			UsePostSearch: false,
 		})
 		comp.pipClient = pipClient
@@ -125,24 +126,29 @@ func (c *Component) HandleMainPolicy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	writeResponse(r.Context(), w, c.Decide(r.Context(), reqBody, policyNames))
+}
+
+// Decide evaluates the given policies for the request, until one of them allows it.
+// The policy names must be normalized (see policies.NormalizePolicyName).
+func (c *Component) Decide(ctx context.Context, request APIRequest, policyNames []string) APIResponse {
 	response := APIResponse{
 		Policies: make(map[string]PolicyResult),
 	}
 
 	// Step 2: Parse the PDP input and translate to the policy input
-	policyInputTemplate, err := NewPolicyInput(reqBody)
+	policyInputTemplate, err := NewPolicyInput(request)
 	if err != nil {
 		// Invalid request
-		writeResponse(r.Context(), w, APIResponse{
+		return APIResponse{
 			Error: "invalid request: " + err.Error(),
-		})
-		return
+		}
 	}
 
 	// Step 3: Enrich the policy input with data gathered from the policy information point (if available)
-	policyInputTemplate, resultReasonsPIP := c.enrichPolicyInputWithPIP(r.Context(), policyInputTemplate)
+	policyInputTemplate, resultReasonsPIP := c.enrichPolicyInputWithPIP(ctx, policyInputTemplate)
 	// Step 4: Check consent at Mitz
-	policyInputTemplate, resultReasonsMitz := c.enrichPolicyInputWithMitz(r.Context(), policyInputTemplate)
+	policyInputTemplate, resultReasonsMitz := c.enrichPolicyInputWithMitz(ctx, policyInputTemplate)
 	resultReasons := slices.Concat(resultReasonsPIP, resultReasonsMitz)
 
 	// Evaluate all policies
@@ -156,9 +162,9 @@ func (c *Component) HandleMainPolicy(w http.ResponseWriter, r *http.Request) {
 
 		// Check if the policy exists
 		{
-			policyExists, err := c.policyExists(r.Context(), policyName)
+			policyExists, err := c.policyExists(ctx, policyName)
 			if err != nil {
-				slog.ErrorContext(r.Context(), "failed to check if policy exists", logging.Error(err), slog.String("policy", policyName))
+				slog.ErrorContext(ctx, "failed to check if policy exists", logging.Error(err), slog.String("policy", policyName))
 				policyResult.Reasons = append(policyResult.Reasons, ResultReason{
 					Code:        TypeResultCodeInternalError,
 					Description: fmt.Sprintf("failed to check if policy exists: %v", err),
@@ -179,15 +185,15 @@ func (c *Component) HandleMainPolicy(w http.ResponseWriter, r *http.Request) {
 		// Step 5: Check FHIR Capability Statement
 		{
 			var fhirCapStatCheckResultReasons []ResultReason
-			policyInput, fhirCapStatCheckResultReasons = enrichPolicyInputWithCapabilityStatement(r.Context(), policyInput, policyName)
+			policyInput, fhirCapStatCheckResultReasons = enrichPolicyInputWithCapabilityStatement(ctx, policyInput, policyName)
 			policyResult.Reasons = append(policyResult.Reasons, fhirCapStatCheckResultReasons...)
 		}
 
 		// Step 6: Evaluate using Open Policy Agent
 		{
-			regoPolicyResult, err := c.evalRegoPolicy(r.Context(), policyName, policyInput)
+			regoPolicyResult, err := c.evalRegoPolicy(ctx, policyName, policyInput)
 			if err != nil {
-				slog.ErrorContext(r.Context(), "failed to evaluate rego policy", logging.Error(err), slog.String("policy", policyName))
+				slog.ErrorContext(ctx, "failed to evaluate rego policy", logging.Error(err), slog.String("policy", policyName))
 				policyResult.Reasons = append(policyResult.Reasons, ResultReason{
 					Code:        TypeResultCodeInternalError,
 					Description: "failed to evaluate rego policy: " + err.Error(),
@@ -205,7 +211,7 @@ func (c *Component) HandleMainPolicy(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	writeResponse(r.Context(), w, response)
+	return response
 }
 
 func writeResponseWithCode(ctx context.Context, w http.ResponseWriter, response any, statusCode int) {
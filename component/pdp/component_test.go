@@ -207,6 +207,49 @@ func TestHandleMainPolicy_CaseInsensitivePolicyNames(t *testing.T) {
 	})
 }
 
+func TestComponent_Decide(t *testing.T) {
+	mux := http.NewServeMux()
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	service, err := New(Config{Enabled: true}, nil)
+	require.NoError(t, err)
+	service.opaBundleBaseURL = httpServer.URL + "/pdp/bundles/"
+	service.pipClient = &test.StubFHIRClient{}
+
+	service.RegisterHttpHandlers(nil, mux)
+
+	require.NoError(t, service.Start())
+	defer func() {
+		require.NoError(t, service.Stop(context.Background()))
+	}()
+
+	newRequest := func(method string, path string, query string) APIRequest {
+		return APIRequest{
+			Input: APIInput{
+				Subject: APISubject{Active: true, ClientId: "https://example.com/oauth2/peer"},
+				Request: HTTPRequest{Method: method, Protocol: "HTTP/1.1", Path: path, Query: query},
+				Context: APIContext{ConnectionTypeCode: "hl7-fhir-rest"},
+			},
+		}
+	}
+
+	t.Run("allowed by the policy's capability statement", func(t *testing.T) {
+		response := service.Decide(t.Context(), newRequest("GET", "/Organization", "name=Care"), []string{"mcsd_query"})
+
+		assert.True(t, response.Allow)
+	})
+	t.Run("interaction not allowed by the policy's capability statement", func(t *testing.T) {
+		response := service.Decide(t.Context(), newRequest("DELETE", "/Organization/1", ""), []string{"mcsd_query"})
+
+		assert.False(t, response.Allow)
+		assert.Contains(t, response.Policies["mcsd_query"].Reasons, ResultReason{
+			Code:        TypeResultCodeNotAllowed,
+			Description: "capability statement does not allow interaction",
+		})
+	})
+}
+
 func TestHandleMainPolicy_Integration(t *testing.T) {
 	// Load all bundles including test_ prefixed ones for unit testing purposes.
 	// Test bundles are excluded from production bundle loading (policies.Bundles),
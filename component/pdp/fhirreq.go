@@ -147,9 +147,16 @@ func init() {
 	}
 }
 
-var regexId = regexp.MustCompile(`^[A-Za-z0-9\-\.]{1,64}$`)
+// regexId matches FHIR ids (https://hl7.org/fhir/R4/datatypes.html#id), except for those that are only dots:
+// they'd be resolved as relative path segments ("." or "..") by the server the request is forwarded to.
+// Ids are also limited to 64 characters (see isValidId).
+var regexId = regexp.MustCompile(`^\.*[A-Za-z0-9\-][A-Za-z0-9\-\.]*$`)
 var regexOperation = regexp.MustCompile(`^\$[a-z\-\.]+$`)
 
+func isValidId(id string) bool {
+	return len(id) <= 64 && regexId.MatchString(id)
+}
+
 type Tokens struct {
 	Interaction fhir.TypeRestfulInteraction
 
@@ -188,14 +195,14 @@ func parsePath(def PathDef, req HTTPRequest) (Tokens, bool) {
 			out.ResourceType = ptr
 			continue
 		case "[id]":
-			ok := regexId.MatchString(path[idx])
+			ok := isValidId(path[idx])
 			if !ok {
 				return Tokens{}, false
 			}
 			out.ResourceId = path[idx]
 			continue
 		case "[vid]":
-			ok := regexId.MatchString(path[idx])
+			ok := isValidId(path[idx])
 			if !ok {
 				return Tokens{}, false
 			}
@@ -3,6 +3,7 @@ package pdp
 import (
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/nuts-foundation/nuts-knooppunt/lib/to"
@@ -139,6 +140,22 @@ func TestComponent_parsePath(t *testing.T) {
 		assert.Equal(t, fhir.ResourceTypeObservation, *tokens.ResourceType)
 	})
 
+	t.Run("ids", func(t *testing.T) {
+		var def = PathDef{
+			Interaction: fhir.TypeRestfulInteractionRead,
+			PathDef:     []string{"[type]", "[id]"},
+			Verb:        "GET",
+		}
+		for _, id := range []string{"a", "1.2-3", "..a", strings.Repeat("a", 64)} {
+			_, ok := parsePath(def, HTTPRequest{Method: "GET", Path: "/Observation/" + id})
+			assert.True(t, ok, id)
+		}
+		for _, id := range []string{".", "..", "...", "a_b", "a%2Fb", strings.Repeat("a", 65)} {
+			_, ok := parsePath(def, HTTPRequest{Method: "GET", Path: "/Observation/" + id})
+			assert.False(t, ok, id)
+		}
+	})
+
 	t.Run("literals", func(t *testing.T) {
 		var def = PathDef{
 			Interaction: fhir.TypeRestfulInteractionHistorySystem,
@@ -1,15 +1,12 @@
 package pdp
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
 
-	"github.com/nuts-foundation/nuts-knooppunt/lib/to"
-	"github.com/open-policy-agent/opa/v1/logging"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/opa"
 	"github.com/open-policy-agent/opa/v1/sdk"
 )
 
@@ -32,40 +29,14 @@ func createOPAService(ctx context.Context, opaBundleBaseURL string, bundles map[
 			"console": true,
 		},
 	}
-	configData, _ := json.Marshal(configMap)
-	result, err := sdk.New(ctx, sdk.Options{
-		ID:            "knooppunt-pdp",
-		Config:        bytes.NewReader(configData),
-		Logger:        logging.Get(),
-		ConsoleLogger: logging.Get(),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to create OPA SDK instance: %w", err)
-	}
-	return result, nil
+	return opa.NewService(ctx, "knooppunt-pdp", configMap, nil, nil)
 }
 
 // evalRegoPolicy evaluates a Rego policy using Open Policy Agent for the given scope and input
 func (c *Component) evalRegoPolicy(ctx context.Context, policy string, policyInput PolicyInput) (*PolicyResult, error) {
-	opaInputMap, err := to.JSONMap(policyInput)
-	if err != nil {
-		return nil, fmt.Errorf("failed to convert policy input to map: %w", err)
-	}
-	result, err := c.opaService.Decision(ctx, sdk.DecisionOptions{Path: "/" + policy, Input: opaInputMap})
+	allowed, resultMap, err := opa.Decide(ctx, c.opaService, "/"+policy, policyInput)
 	if err != nil {
-		return nil, fmt.Errorf("failed to evaluate policy: %w", err)
-	}
-	resultMap, ok := result.Result.(map[string]any)
-	if !ok {
-		return nil, fmt.Errorf("unexpected policy result type (expected map[string]any with 'allow' field, was %T)", result.Result)
-	}
-	allowValue, exists := resultMap["allow"]
-	if !exists {
-		return nil, fmt.Errorf("missing 'allow' key in policy result")
-	}
-	allowed, ok := allowValue.(bool)
-	if !ok {
-		return nil, fmt.Errorf("unexpected 'allow' result type (expected bool, was %T)", allowValue)
+		return nil, err
 	}
 	policyResult := PolicyResult{
 		Allow: allowed,
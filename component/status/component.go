@@ -2,10 +2,12 @@ package status
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"sync/atomic"
 
 	"github.com/nuts-foundation/nuts-knooppunt/component"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/resilience"
 )
 
 var _ component.Lifecycle = (*Component)(nil)
@@ -46,6 +48,11 @@ func (c *Component) RegisterHttpHandlers(publicMux *http.ServeMux, internalMux *
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("OK"))
 	})
+	internalMux.HandleFunc("GET /status/circuitbreakers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(resilience.BreakerStates())
+	})
 	internalMux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte(BuildInfo()))
@@ -19,3 +19,11 @@ var PayloadCoding = fhir.Coding{
 	System: to.Ptr(MCSDPayloadTypeSystem),
 	Code:   to.Ptr(MCSDPayloadTypeDirectoryCode),
 }
+
+// EndpointAuthorizationServerExtensionURL is the extension on an Endpoint that holds the identifier (valueUrl) of the OAuth2 authorization server
+// that issues the access tokens for it, e.g. the Nuts authorization server of the organization that provides the endpoint.
+const EndpointAuthorizationServerExtensionURL = "http://nuts-foundation.github.io/nuts-knooppunt/StructureDefinition/endpoint-authorization-server"
+
+// ConsolidationTagSystem is the system of the tags the knooppunt sets on the resources it writes and changes to consolidate
+// the copies of an Organization imported from the LRZA and administration directories.
+const ConsolidationTagSystem = "http://nuts-foundation.github.io/nuts-knooppunt/CodeSystem/consolidation"
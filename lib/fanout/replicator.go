@@ -0,0 +1,379 @@
+// Package fanout writes the changes applied to the query directory to additional FHIR servers (query targets),
+// e.g. a FHIR server used by another application. Every target is written to independently:
+// a target that is slow or unavailable doesn't block the query directory or the other targets.
+// Transactions are queued in memory and applied in order; a failing transaction is retried with backoff.
+// A target that misses transactions anyway (they're dropped because its queue is full, keep failing, or are still queued on shutdown)
+// is marked for resynchronization in the state store, and is then resynchronized from the query directory (see resync.go).
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/httpauth"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/statestore"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+const (
+	defaultQueueSize = 100
+	// applyTimeout is the maximum duration of applying a single transaction to a target.
+	applyTimeout = 5 * time.Minute
+	// maxAttempts is the number of times a transaction is applied to a target before giving up on it,
+	// after which the target is resynchronized.
+	maxAttempts = 8
+	// initialRetryDelay is the delay before retrying a failed transaction or resync, which doubles on every retry up to maxRetryDelay.
+	initialRetryDelay = time.Second
+	maxRetryDelay     = 5 * time.Minute
+	// targetsBucket holds the targetState of every target, by name.
+	targetsBucket = "fanout_targets"
+)
+
+// TargetConfig configures a query target: a FHIR server that receives the same transactions as the query directory.
+type TargetConfig struct {
+	FHIRBaseURL string `koanf:"fhirbaseurl"`
+	// Auth optionally configures OAuth2 client-credentials authentication against the target.
+	Auth httpauth.OAuth2Config `koanf:"auth"`
+	// QueueSize is the maximum number of transactions waiting to be applied to the target. When the queue is full,
+	// transactions are dropped (and reported in the target's status), and the target is resynchronized from the query directory
+	// once it catches up. Defaults to 100.
+	QueueSize int `koanf:"queuesize"`
+}
+
+// TargetStatus describes how applying transactions to a query target went since startup.
+type TargetStatus struct {
+	Name        string `json:"name"`
+	FHIRBaseURL string `json:"fhirBaseURL"`
+	// Applied is the number of transactions applied to the target.
+	Applied int `json:"applied"`
+	// Failed is the number of transactions that couldn't be applied to the target, even after retrying.
+	Failed int `json:"failed"`
+	// Dropped is the number of transactions that weren't queued because the target's queue was full.
+	Dropped int `json:"dropped"`
+	// Pending is the number of transactions waiting to be applied.
+	Pending     int        `json:"pending"`
+	LastApplied *time.Time `json:"lastApplied,omitempty"`
+	// LastError describes the last failure, if any.
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+	// ResyncNeeded is set when the target missed transactions, until it's resynchronized from the query directory.
+	ResyncNeeded bool `json:"resyncNeeded"`
+	// LastResync is when the target was last resynchronized.
+	LastResync *time.Time `json:"lastResync,omitempty"`
+}
+
+// targetState is the persisted state of a target.
+type targetState struct {
+	FHIRBaseURL string `json:"fhirBaseURL"`
+	// Resync is the reason the target needs to be resynchronized, or empty if it doesn't.
+	Resync string `json:"resync,omitempty"`
+}
+
+// Replicator applies transactions to the configured query targets in the background, in the order they were given.
+// A nil Replicator has no targets.
+type Replicator struct {
+	targets []*target
+	wg      *sync.WaitGroup
+	source  Source
+	store   statestore.Store
+	// ctx is cancelled when stopping takes too long, aborting the transactions being applied.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// stopCtx is cancelled when stopping, aborting resyncs (they're resumed after a restart).
+	stopCtx  context.Context
+	stopFunc context.CancelFunc
+
+	maxAttempts   int
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+}
+
+type target struct {
+	name        string
+	fhirBaseURL string
+	client      fhirclient.Client
+	queue       chan fhir.Bundle
+
+	mux    sync.Mutex
+	status TargetStatus
+	// resync is the reason the target needs to be resynchronized, or empty if it doesn't.
+	resync string
+	// misses counts the times the target missed transactions, so a resync can tell whether it missed more while resynchronizing.
+	misses int
+}
+
+// New creates a Replicator for the given query targets, by name. The transport is used for the requests to the targets
+// (and their token endpoints); pass nil to use http.DefaultTransport. Targets that missed transactions are resynchronized
+// from the given source. The state of the targets is kept in the given store, which must stay open until the Replicator is stopped.
+// Targets that weren't known in the store yet (or of which the FHIR base URL changed) are resynchronized when started.
+func New(configs map[string]TargetConfig, transport http.RoundTripper, source Source, store statestore.Store) (*Replicator, error) {
+	result := &Replicator{
+		wg:            &sync.WaitGroup{},
+		source:        source,
+		store:         store,
+		maxAttempts:   maxAttempts,
+		retryDelay:    initialRetryDelay,
+		maxRetryDelay: maxRetryDelay,
+	}
+	result.ctx, result.cancel = context.WithCancel(context.Background())
+	result.stopCtx, result.stopFunc = context.WithCancel(result.ctx)
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		config := configs[name]
+		fhirBaseURL, err := url.Parse(config.FHIRBaseURL)
+		if err != nil || (fhirBaseURL.Scheme != "http" && fhirBaseURL.Scheme != "https") || fhirBaseURL.Host == "" {
+			return nil, fmt.Errorf("invalid FHIR base URL of query target %s (url=%s)", name, config.FHIRBaseURL)
+		}
+		httpClient := &http.Client{Transport: transport}
+		if config.Auth.IsConfigured() {
+			if httpClient, err = httpauth.NewOAuth2HTTPClient(config.Auth, transport); err != nil {
+				return nil, fmt.Errorf("failed to create OAuth2 HTTP client for query target %s: %w", name, err)
+			}
+		}
+		queueSize := config.QueueSize
+		if queueSize <= 0 {
+			queueSize = defaultQueueSize
+		}
+		t := &target{
+			name:        name,
+			fhirBaseURL: config.FHIRBaseURL,
+			client:      fhirclient.New(fhirBaseURL, httpClient, &fhirclient.Config{UsePostSearch: false}),
+			queue:       make(chan fhir.Bundle, queueSize),
+			status:      TargetStatus{Name: name, FHIRBaseURL: config.FHIRBaseURL},
+		}
+		var state targetState
+		found, err := store.Get(targetsBucket, name, &state)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read state of query target %s: %w", name, err)
+		}
+		switch {
+		case !found || state.FHIRBaseURL != config.FHIRBaseURL:
+			result.markResync(context.Background(), t, "new query target")
+		case state.Resync != "":
+			t.resync = state.Resync
+			t.status.ResyncNeeded = true
+		}
+		result.targets = append(result.targets, t)
+	}
+	return result, nil
+}
+
+// Start starts applying queued transactions to the targets, after resynchronizing the targets that need it.
+func (r *Replicator) Start() {
+	if r == nil {
+		return
+	}
+	for _, t := range r.targets {
+		t.mux.Lock()
+		queue := t.queue
+		t.mux.Unlock()
+		if queue != nil {
+			r.wg.Go(func() { r.run(t, queue) })
+		}
+	}
+}
+
+// Stop stops accepting transactions, and waits until the queued transactions are applied or the context is done.
+// Running resyncs are aborted. Targets that didn't get all transactions by then are resynchronized after a restart.
+func (r *Replicator) Stop(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+	r.stopFunc()
+	for _, t := range r.targets {
+		t.mux.Lock()
+		if t.queue != nil {
+			close(t.queue)
+			t.queue = nil
+		}
+		t.mux.Unlock()
+	}
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		r.cancel()
+		return nil
+	case <-ctx.Done():
+		// Abort, and wait for the targets to record that they missed transactions
+		r.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Apply queues the given transaction, which was applied to the query directory, for every target. It doesn't block:
+// if a target's queue is full, the transaction is dropped for that target, and the target is marked for resynchronization.
+func (r *Replicator) Apply(ctx context.Context, tx fhir.Bundle) {
+	if r == nil {
+		return
+	}
+	for _, t := range r.targets {
+		t.mux.Lock()
+		if t.queue == nil {
+			// Stopped
+			t.mux.Unlock()
+			continue
+		}
+		select {
+		case t.queue <- tx:
+			t.status.Pending++
+			t.mux.Unlock()
+		default:
+			t.status.Dropped++
+			t.mux.Unlock()
+			slog.WarnContext(ctx, "Query target queue is full, dropping transaction", slog.String("target", t.name), logging.FHIRServer(t.fhirBaseURL), slog.Int("entries", len(tx.Entry)))
+			r.markResync(ctx, t, "transactions were dropped because the queue was full")
+		}
+	}
+}
+
+// Statuses returns the status of every target, ordered by name.
+func (r *Replicator) Statuses() []TargetStatus {
+	result := []TargetStatus{}
+	if r == nil {
+		return result
+	}
+	for _, t := range r.targets {
+		t.mux.Lock()
+		result = append(result, t.status)
+		t.mux.Unlock()
+	}
+	return result
+}
+
+// run applies the queued transactions to the target until the queue is closed, resynchronizing the target first when it needs it.
+// Transactions queued during a resync are applied after it, since they may contain changes the resync didn't see.
+func (r *Replicator) run(t *target, queue <-chan fhir.Bundle) {
+	for {
+		if t.resyncNeeded() && !r.resyncWithRetries(t) {
+			// Stopped: the target is resynchronized after a restart
+			return
+		}
+		tx, ok := <-queue
+		if !ok {
+			return
+		}
+		r.applyWithRetries(t, tx)
+	}
+}
+
+// applyWithRetries applies the transaction to the target, retrying with backoff when it fails.
+// If it keeps failing, or the Replicator is stopped first, the target is marked for resynchronization.
+func (r *Replicator) applyWithRetries(t *target, tx fhir.Bundle) {
+	delay := r.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := t.apply(r.ctx, tx)
+		if err == nil {
+			t.finish(nil)
+			return
+		}
+		if r.ctx.Err() != nil {
+			t.finish(err)
+			r.markResync(r.ctx, t, "stopped before all transactions were applied")
+			return
+		}
+		if attempt >= r.maxAttempts {
+			slog.ErrorContext(r.ctx, "Failed to apply transaction to query target, giving up", slog.String("target", t.name), logging.FHIRServer(t.fhirBaseURL), slog.Int("attempts", attempt), logging.Error(err))
+			t.finish(err)
+			r.markResync(r.ctx, t, fmt.Sprintf("a transaction failed %d times: %s", attempt, err))
+			return
+		}
+		t.recordError(err)
+		slog.WarnContext(r.ctx, "Failed to apply transaction to query target, retrying", slog.String("target", t.name), logging.FHIRServer(t.fhirBaseURL), slog.Int("attempt", attempt), slog.Duration("delay", delay), logging.Error(err))
+		if !sleep(r.ctx, delay) {
+			t.finish(err)
+			r.markResync(r.ctx, t, "stopped before all transactions were applied")
+			return
+		}
+		delay = min(2*delay, r.maxRetryDelay)
+	}
+}
+
+// markResync marks the target for resynchronization, for the given reason. The mark is persisted, so it survives restarts.
+func (r *Replicator) markResync(ctx context.Context, t *target, reason string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.misses++
+	if t.resync != "" {
+		return
+	}
+	t.resync = reason
+	t.status.ResyncNeeded = true
+	slog.WarnContext(ctx, "Query target will be resynchronized from the query directory", slog.String("target", t.name), logging.FHIRServer(t.fhirBaseURL), slog.String("reason", reason))
+	if err := r.store.Put(targetsBucket, t.name, targetState{FHIRBaseURL: t.fhirBaseURL, Resync: reason}); err != nil {
+		// It's still resynchronized if the knooppunt keeps running
+		slog.ErrorContext(ctx, "Failed to persist that query target needs to be resynchronized", slog.String("target", t.name), logging.Error(err))
+	}
+}
+
+func (t *target) resyncNeeded() bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.resync != ""
+}
+
+// finish records the outcome of a dequeued transaction.
+func (t *target) finish(err error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.status.Pending--
+	if err != nil {
+		t.status.Failed++
+		t.recordErrorLocked(err)
+	} else {
+		now := time.Now()
+		t.status.Applied++
+		t.status.LastApplied = &now
+	}
+}
+
+func (t *target) recordError(err error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.recordErrorLocked(err)
+}
+
+func (t *target) recordErrorLocked(err error) {
+	now := time.Now()
+	t.status.LastError = err.Error()
+	t.status.LastErrorTime = &now
+}
+
+func (t *target) apply(ctx context.Context, tx fhir.Bundle) error {
+	ctx, cancel := context.WithTimeout(ctx, applyTimeout)
+	defer cancel()
+	var txResult fhir.Bundle
+	if err := t.client.CreateWithContext(ctx, tx, &txResult, fhirclient.AtPath("/")); err != nil {
+		return err
+	}
+	slog.DebugContext(ctx, "Applied transaction to query target", slog.String("target", t.name), logging.FHIRServer(t.fhirBaseURL), slog.Int("entries", len(tx.Entry)))
+	return nil
+}
+
+// sleep waits for the given duration, returning false if the context is done first.
+func sleep(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,365 @@
+package fanout
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/statestore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestReplicator(t *testing.T) {
+	const sourceBaseURL = "http://example.com/fhir"
+	tx := func(id string) fhir.Bundle {
+		source := sourceBaseURL + "/Organization/" + id
+		return fhir.Bundle{
+			Type: fhir.BundleTypeTransaction,
+			Entry: []fhir.BundleEntry{{
+				Resource: []byte(`{"resourceType":"Organization","meta":{"source":"` + source + `"}}`),
+				Request:  &fhir.BundleEntryRequest{Method: fhir.HTTPVerbPUT, Url: "Organization?" + url.Values{"_source": []string{source}}.Encode()},
+			}},
+		}
+	}
+	owns := func(source string) bool {
+		return strings.HasPrefix(source, sourceBaseURL+"/")
+	}
+	// newReplicator creates a Replicator of which the targets are in sync, and that retries quickly
+	newReplicator := func(t *testing.T, configs map[string]TargetConfig, source Source, store statestore.Store) *Replicator {
+		for name, config := range configs {
+			require.NoError(t, store.Put(targetsBucket, name, targetState{FHIRBaseURL: config.FHIRBaseURL}))
+		}
+		replicator, err := New(configs, nil, source, store)
+		require.NoError(t, err)
+		replicator.maxAttempts = 3
+		replicator.retryDelay = time.Millisecond
+		return replicator
+	}
+
+	t.Run("failing target doesn't affect other targets", func(t *testing.T) {
+		healthy := newFHIRServer(t)
+		failing := newFHIRServer(t)
+		failing.fail(1000)
+		replicator := newReplicator(t, map[string]TargetConfig{
+			"healthy": {FHIRBaseURL: healthy.URL},
+			"failing": {FHIRBaseURL: failing.URL},
+		}, Source{}, statestore.NewMemoryStore())
+		replicator.Start()
+
+		replicator.Apply(t.Context(), tx("1"))
+		replicator.Apply(t.Context(), tx("2"))
+		require.NoError(t, replicator.Stop(t.Context()))
+
+		assert.Len(t, healthy.applied(), 2)
+		statuses := replicator.Statuses()
+		require.Len(t, statuses, 2)
+		// Ordered by name
+		assert.Equal(t, "failing", statuses[0].Name)
+		assert.Equal(t, 1, statuses[0].Failed)
+		assert.Equal(t, 0, statuses[0].Applied)
+		assert.NotEmpty(t, statuses[0].LastError)
+		assert.NotNil(t, statuses[0].LastErrorTime)
+		// Gave up on the first transaction, the second one is covered by the resync after a restart
+		assert.True(t, statuses[0].ResyncNeeded)
+		assert.Equal(t, "healthy", statuses[1].Name)
+		assert.Equal(t, 2, statuses[1].Applied)
+		assert.Equal(t, 0, statuses[1].Pending)
+		assert.NotNil(t, statuses[1].LastApplied)
+		assert.False(t, statuses[1].ResyncNeeded)
+	})
+	t.Run("failed transactions are retried in order", func(t *testing.T) {
+		target := newFHIRServer(t)
+		target.fail(2)
+		replicator := newReplicator(t, map[string]TargetConfig{"other": {FHIRBaseURL: target.URL}}, Source{}, statestore.NewMemoryStore())
+		replicator.Start()
+
+		replicator.Apply(t.Context(), tx("1"))
+		replicator.Apply(t.Context(), tx("2"))
+		require.NoError(t, replicator.Stop(t.Context()))
+
+		assert.Equal(t, [][]string{
+			{"PUT Organization?_source=" + url.QueryEscape(sourceBaseURL+"/Organization/1")},
+			{"PUT Organization?_source=" + url.QueryEscape(sourceBaseURL+"/Organization/2")},
+		}, target.applied())
+		status := replicator.Statuses()[0]
+		assert.Equal(t, 2, status.Applied)
+		assert.Equal(t, 0, status.Failed)
+		assert.False(t, status.ResyncNeeded)
+		assert.Nil(t, status.LastResync)
+	})
+	t.Run("target that missed a transaction is resynchronized from the query directory", func(t *testing.T) {
+		queryDirectory := newFHIRServer(t)
+		queryDirectory.put(`{"resourceType":"Endpoint","id":"e1","meta":{"versionId":"3","source":"` + sourceBaseURL + `/Endpoint/1"}}`)
+		queryDirectory.put(`{"resourceType":"Organization","id":"o1","meta":{"source":"` + sourceBaseURL + `/Organization/1"},"endpoint":[{"reference":"Endpoint/e1"}],"partOf":{"reference":"Organization/o9"}}`)
+		queryDirectory.put(`{"resourceType":"Organization","id":"o9","meta":{"source":"http://other.example.com/fhir/Organization/9"}}`)
+		target := newFHIRServer(t)
+		target.put(`{"resourceType":"Organization","id":"stale","meta":{"source":"` + sourceBaseURL + `/Organization/2"}}`)
+		target.put(`{"resourceType":"Organization","id":"unowned","meta":{"source":"http://other.example.com/fhir/Organization/8"}}`)
+		// Fails the transaction and the first resync
+		target.fail(4)
+		store := statestore.NewMemoryStore()
+		replicator := newReplicator(t, map[string]TargetConfig{"other": {FHIRBaseURL: target.URL}}, Source{
+			Client:        fhirclient.New(must(url.Parse(queryDirectory.URL)), http.DefaultClient, &fhirclient.Config{UsePostSearch: false}),
+			ResourceTypes: []string{"Endpoint", "Organization"},
+			Owns:          owns,
+		}, store)
+		replicator.retryDelay = 50 * time.Millisecond
+		replicator.Start()
+
+		replicator.Apply(t.Context(), tx("1"))
+		require.Eventually(t, func() bool {
+			var state targetState
+			found, _ := store.Get(targetsBucket, "other", &state)
+			return found && state.Resync != ""
+		}, 5*time.Second, 5*time.Millisecond)
+		require.Eventually(t, func() bool {
+			return replicator.Statuses()[0].LastResync != nil
+		}, 5*time.Second, 10*time.Millisecond)
+		require.NoError(t, replicator.Stop(t.Context()))
+
+		status := replicator.Statuses()[0]
+		assert.Equal(t, 1, status.Failed)
+		assert.False(t, status.ResyncNeeded)
+		var state targetState
+		_, _ = store.Get(targetsBucket, "other", &state)
+		assert.Equal(t, targetState{FHIRBaseURL: target.URL}, state)
+		// Owned resources are written with conditional references, stale owned resources are deleted, others are left alone
+		resources := target.resources()
+		assert.Len(t, resources, 3)
+		endpoint := resources[sourceBaseURL+"/Endpoint/1"]
+		require.NotNil(t, endpoint)
+		assert.Equal(t, map[string]any{"source": sourceBaseURL + "/Endpoint/1"}, endpoint["meta"])
+		organization := resources[sourceBaseURL+"/Organization/1"]
+		require.NotNil(t, organization)
+		assert.Equal(t, []any{map[string]any{"reference": "Endpoint?_source=" + url.QueryEscape(sourceBaseURL+"/Endpoint/1")}}, organization["endpoint"])
+		assert.Equal(t, map[string]any{"reference": "Organization/o9"}, organization["partOf"])
+		assert.Contains(t, resources, "http://other.example.com/fhir/Organization/8")
+		// The spool was cleared
+		assert.NoError(t, store.Walk(spoolBucketPrefix+"other", func(key string, _ []byte) error {
+			t.Errorf("unexpected spooled resource: %s", key)
+			return nil
+		}))
+	})
+	t.Run("new target is resynchronized on start", func(t *testing.T) {
+		queryDirectory := newFHIRServer(t)
+		queryDirectory.put(`{"resourceType":"Organization","id":"o1","meta":{"source":"` + sourceBaseURL + `/Organization/1"}}`)
+		target := newFHIRServer(t)
+		store := statestore.NewMemoryStore()
+		replicator, err := New(map[string]TargetConfig{"other": {FHIRBaseURL: target.URL}}, nil, Source{
+			Client:        fhirclient.New(must(url.Parse(queryDirectory.URL)), http.DefaultClient, &fhirclient.Config{UsePostSearch: false}),
+			ResourceTypes: []string{"Organization"},
+			Owns:          owns,
+		}, store)
+		require.NoError(t, err)
+		assert.True(t, replicator.Statuses()[0].ResyncNeeded)
+
+		replicator.Start()
+		require.Eventually(t, func() bool {
+			return !replicator.Statuses()[0].ResyncNeeded
+		}, 5*time.Second, 10*time.Millisecond)
+		require.NoError(t, replicator.Stop(t.Context()))
+
+		assert.Contains(t, target.resources(), sourceBaseURL+"/Organization/1")
+	})
+	t.Run("resync is resumed after a restart", func(t *testing.T) {
+		target := newFHIRServer(t)
+		store := statestore.NewMemoryStore()
+		require.NoError(t, store.Put(targetsBucket, "other", targetState{FHIRBaseURL: target.URL, Resync: "transactions were dropped because the queue was full"}))
+		replicator, err := New(map[string]TargetConfig{"other": {FHIRBaseURL: target.URL}}, nil, Source{}, store)
+		require.NoError(t, err)
+		assert.True(t, replicator.Statuses()[0].ResyncNeeded)
+
+		replicator.Start()
+		require.Eventually(t, func() bool {
+			return !replicator.Statuses()[0].ResyncNeeded
+		}, 5*time.Second, 10*time.Millisecond)
+		require.NoError(t, replicator.Stop(t.Context()))
+
+		var state targetState
+		_, _ = store.Get(targetsBucket, "other", &state)
+		assert.Empty(t, state.Resync)
+	})
+	t.Run("full queue drops transactions, and resynchronizes the target", func(t *testing.T) {
+		blocked := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-blocked
+			w.Header().Set("Content-Type", "application/fhir+json")
+			_, _ = w.Write([]byte(`{"resourceType":"Bundle","type":"transaction-response"}`))
+		}))
+		defer server.Close()
+		replicator := newReplicator(t, map[string]TargetConfig{"slow": {FHIRBaseURL: server.URL, QueueSize: 1}}, Source{}, statestore.NewMemoryStore())
+		replicator.Start()
+
+		// The first transaction is taken from the queue and blocks, the second one waits in the queue
+		replicator.Apply(t.Context(), tx("1"))
+		require.Eventually(t, func() bool {
+			return len(replicator.targets[0].queue) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		replicator.Apply(t.Context(), tx("2"))
+		replicator.Apply(t.Context(), tx("3"))
+
+		status := replicator.Statuses()[0]
+		assert.Equal(t, 1, status.Dropped)
+		assert.Equal(t, 2, status.Pending)
+		assert.True(t, status.ResyncNeeded)
+		close(blocked)
+		require.Eventually(t, func() bool {
+			status := replicator.Statuses()[0]
+			return status.Applied == 2 && !status.ResyncNeeded
+		}, 5*time.Second, 10*time.Millisecond)
+		require.NoError(t, replicator.Stop(t.Context()))
+		assert.NotNil(t, replicator.Statuses()[0].LastResync)
+	})
+	t.Run("stopping aborts retries, and marks the target for resynchronization", func(t *testing.T) {
+		target := newFHIRServer(t)
+		target.fail(1000)
+		store := statestore.NewMemoryStore()
+		replicator := newReplicator(t, map[string]TargetConfig{"other": {FHIRBaseURL: target.URL}}, Source{}, store)
+		replicator.retryDelay = time.Hour
+		replicator.Start()
+
+		replicator.Apply(t.Context(), tx("1"))
+		require.Eventually(t, func() bool {
+			return replicator.Statuses()[0].LastError != ""
+		}, 5*time.Second, 10*time.Millisecond)
+		ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+		defer cancel()
+		err := replicator.Stop(ctx)
+
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		var state targetState
+		_, _ = store.Get(targetsBucket, "other", &state)
+		assert.Equal(t, "stopped before all transactions were applied", state.Resync)
+	})
+	t.Run("invalid FHIR base URL", func(t *testing.T) {
+		_, err := New(map[string]TargetConfig{"other": {FHIRBaseURL: "not-a-url"}}, nil, Source{}, statestore.NewMemoryStore())
+
+		assert.EqualError(t, err, "invalid FHIR base URL of query target other (url=not-a-url)")
+	})
+	t.Run("nil Replicator has no targets", func(t *testing.T) {
+		var replicator *Replicator
+
+		replicator.Start()
+		replicator.Apply(t.Context(), fhir.Bundle{Id: to.Ptr("1")})
+
+		assert.Empty(t, replicator.Statuses())
+		assert.NoError(t, replicator.Stop(t.Context()))
+	})
+}
+
+// fhirServer is a minimal FHIR server: it returns all resources of a type when searched (in a single page),
+// and applies transactions of conditional updates and deletes on _source.
+type fhirServer struct {
+	*httptest.Server
+	mux sync.Mutex
+	// stored holds the resources by meta.source
+	stored map[string]map[string]any
+	// transactions holds the method and URL of the entries of every applied transaction
+	transactions [][]string
+	failures     int
+	nextID       int
+}
+
+func newFHIRServer(t *testing.T) *fhirServer {
+	result := &fhirServer{stored: make(map[string]map[string]any)}
+	result.Server = httptest.NewServer(http.HandlerFunc(result.handle))
+	t.Cleanup(result.Close)
+	return result
+}
+
+// fail makes the next n transactions fail.
+func (s *fhirServer) fail(n int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.failures = n
+}
+
+func (s *fhirServer) put(resource string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var value map[string]any
+	_ = json.Unmarshal([]byte(resource), &value)
+	s.stored[value["meta"].(map[string]any)["source"].(string)] = value
+}
+
+func (s *fhirServer) resources() map[string]map[string]any {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	result := make(map[string]map[string]any, len(s.stored))
+	for source, resource := range s.stored {
+		result[source] = resource
+	}
+	return result
+}
+
+func (s *fhirServer) applied() [][]string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.transactions
+}
+
+func (s *fhirServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	w.Header().Set("Content-Type", "application/fhir+json")
+	if r.Method == http.MethodGet {
+		resourceType := strings.Trim(r.URL.Path, "/")
+		searchSet := fhir.Bundle{Type: fhir.BundleTypeSearchset}
+		for _, resource := range s.stored {
+			if resource["resourceType"] == resourceType {
+				data, _ := json.Marshal(resource)
+				searchSet.Entry = append(searchSet.Entry, fhir.BundleEntry{Resource: data})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(searchSet)
+		return
+	}
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"resourceType":"OperationOutcome"}`))
+		return
+	}
+	var tx fhir.Bundle
+	_ = json.NewDecoder(r.Body).Decode(&tx)
+	var requests []string
+	for _, entry := range tx.Entry {
+		requests = append(requests, entry.Request.Method.String()+" "+entry.Request.Url)
+		_, query, _ := strings.Cut(entry.Request.Url, "?")
+		params, _ := url.ParseQuery(query)
+		source := params.Get("_source")
+		if entry.Request.Method == fhir.HTTPVerbDELETE {
+			delete(s.stored, source)
+			continue
+		}
+		var resource map[string]any
+		_ = json.Unmarshal(entry.Resource, &resource)
+		if existing, ok := s.stored[source]; ok {
+			resource["id"] = existing["id"]
+		} else {
+			s.nextID++
+			resource["id"] = strconv.Itoa(s.nextID)
+		}
+		s.stored[source] = resource
+	}
+	s.transactions = append(s.transactions, requests)
+	_, _ = w.Write([]byte(`{"resourceType":"Bundle","type":"transaction-response"}`))
+}
+
+func must[T any](value T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
@@ -0,0 +1,283 @@
+package fanout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	libfhir "github.com/nuts-foundation/nuts-knooppunt/lib/fhirutil"
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+const (
+	// resyncPageSize is the number of resources per page when reading the query directory or a target during a resync.
+	resyncPageSize = 100
+	// defaultResyncTransactionSize is the maximum number of entries per transaction during a resync, if the Source doesn't specify it.
+	defaultResyncTransactionSize = 100
+	// spoolBucketPrefix prefixes the bucket in which a resync spools the resources read from the query directory, followed by the target name.
+	spoolBucketPrefix = "fanout_resync|"
+)
+
+// Source is the query directory the replicated transactions were applied to. Targets that missed transactions are resynchronized from it.
+type Source struct {
+	// Client is the FHIR client of the query directory.
+	Client fhirclient.Client
+	// ResourceTypes are the types of the replicated resources.
+	ResourceTypes []string
+	// Owns returns whether the resource with the given meta.source is replicated by this Replicator,
+	// e.g. because it was imported from a directory it synchronizes. A resync leaves other resources alone,
+	// both in the query directory and in the target.
+	Owns func(source string) bool
+	// TransactionSize is the maximum number of entries in a transaction applied to a target during a resync.
+	TransactionSize int
+}
+
+// resyncWithRetries resynchronizes the target, retrying with backoff until it succeeds.
+// It returns false if the Replicator was stopped first.
+func (r *Replicator) resyncWithRetries(t *target) bool {
+	delay := r.retryDelay
+	for r.stopCtx.Err() == nil {
+		err := r.resync(r.stopCtx, t)
+		if err == nil {
+			return true
+		}
+		if r.stopCtx.Err() != nil {
+			break
+		}
+		t.recordError(err)
+		slog.ErrorContext(r.stopCtx, "Failed to resynchronize query target, retrying", slog.String("target", t.name), logging.FHIRServer(t.fhirBaseURL), slog.Duration("delay", delay), logging.Error(err))
+		if !sleep(r.stopCtx, delay) {
+			break
+		}
+		delay = min(2*delay, r.maxRetryDelay)
+	}
+	return false
+}
+
+// resync makes the target consistent with the query directory: it writes the owned resources of the query directory to the target,
+// and deletes the owned resources from the target that aren't in the query directory (anymore).
+// The resources are written like the synchronized transactions write them: as conditional updates on meta.source,
+// with references to other owned resources made conditional, in an order that lets the references resolve.
+// References to resources that aren't owned are copied as-is.
+// The resources read from the query directory are spooled in the state store, so the query directory doesn't need to fit in memory.
+func (r *Replicator) resync(ctx context.Context, t *target) error {
+	start := time.Now()
+	t.mux.Lock()
+	misses := t.misses
+	t.mux.Unlock()
+	slog.InfoContext(ctx, "Resynchronizing query target from the query directory", slog.String("target", t.name), logging.FHIRServer(t.fhirBaseURL))
+
+	spoolBucket := spoolBucketPrefix + t.name
+	if err := r.store.DeleteBucket(spoolBucket); err != nil {
+		return fmt.Errorf("failed to clear resync spool: %w", err)
+	}
+	defer func() {
+		if err := r.store.DeleteBucket(spoolBucket); err != nil {
+			slog.WarnContext(ctx, "Failed to clear resync spool", slog.String("target", t.name), logging.Error(err))
+		}
+	}()
+
+	// Read the owned resources from the query directory
+	planner := libfhir.NewTransactionPlanner()
+	// sources maps the "ResourceType/id" of the owned resources in the query directory to their meta.source
+	sources := make(map[string]string)
+	for _, resourceType := range r.source.ResourceTypes {
+		err := r.searchOwned(ctx, r.source.Client, resourceType, func(resources []ownedResource) error {
+			spooled := make(map[string]any, len(resources))
+			for _, resource := range resources {
+				sources[resourceType+"/"+resource.id] = resource.source
+				spooled[spoolKey(planner.Len())] = resource.raw
+				planner.Add(fhir.BundleEntry{Resource: resource.raw})
+			}
+			return r.store.PutAll(spoolBucket, spooled)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read %s resources from query directory: %w", resourceType, err)
+		}
+	}
+
+	// Write them to the target
+	transactionSize := r.source.TransactionSize
+	if transactionSize <= 0 {
+		transactionSize = defaultResyncTransactionSize
+	}
+	for _, chunk := range planner.Chunks(transactionSize) {
+		tx := fhir.Bundle{Type: fhir.BundleTypeTransaction}
+		for _, position := range chunk {
+			var resource json.RawMessage
+			if _, err := r.store.Get(spoolBucket, spoolKey(position), &resource); err != nil {
+				return fmt.Errorf("failed to read resync spool: %w", err)
+			}
+			entry, err := resyncEntry(resource, sources)
+			if err != nil {
+				return err
+			}
+			tx.Entry = append(tx.Entry, entry)
+		}
+		if err := t.apply(ctx, tx); err != nil {
+			return fmt.Errorf("failed to write resources to query target: %w", err)
+		}
+	}
+
+	// Delete the owned resources the target has in addition, e.g. because it missed their deletion
+	current := make(map[string]bool, len(sources))
+	for _, source := range sources {
+		current[source] = true
+	}
+	deleted := 0
+	for _, resourceType := range r.source.ResourceTypes {
+		var stale []string
+		err := r.searchOwned(ctx, t.client, resourceType, func(resources []ownedResource) error {
+			for _, resource := range resources {
+				if !current[resource.source] {
+					stale = append(stale, resource.source)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read %s resources from query target: %w", resourceType, err)
+		}
+		slices.Sort(stale)
+		stale = slices.Compact(stale)
+		for chunk := range slices.Chunk(stale, transactionSize) {
+			if err := t.apply(ctx, conditionalDeleteTransaction(resourceType, chunk)); err != nil {
+				return fmt.Errorf("failed to delete %s resources from query target: %w", resourceType, err)
+			}
+		}
+		deleted += len(stale)
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	now := time.Now()
+	t.status.LastResync = &now
+	slog.InfoContext(ctx, "Resynchronized query target from the query directory", slog.String("target", t.name), logging.FHIRServer(t.fhirBaseURL),
+		slog.Int("written", planner.Len()), slog.Int("deleted", deleted), slog.Duration("duration", time.Since(start)))
+	if t.misses != misses {
+		// Missed transactions while resynchronizing, which the resync might not have seen: it stays marked, so it's resynchronized again
+		return nil
+	}
+	t.resync = ""
+	t.status.ResyncNeeded = false
+	if err := r.store.Put(targetsBucket, t.name, targetState{FHIRBaseURL: t.fhirBaseURL}); err != nil {
+		// Only causes an unnecessary resync after a restart
+		slog.WarnContext(ctx, "Failed to persist that query target was resynchronized", slog.String("target", t.name), logging.Error(err))
+	}
+	return nil
+}
+
+// ownedResource is a resource found during a resync, of which the meta.source is owned by the Replicator.
+type ownedResource struct {
+	id     string
+	source string
+	raw    json.RawMessage
+}
+
+// searchOwned searches all resources of the given type in the FHIR server, and calls fn with the owned ones, page by page.
+func (r *Replicator) searchOwned(ctx context.Context, client fhirclient.Client, resourceType string, fn func(resources []ownedResource) error) error {
+	params := url.Values{
+		"_count": []string{strconv.Itoa(resyncPageSize)},
+	}
+	var searchSet fhir.Bundle
+	if err := client.SearchWithContext(ctx, resourceType, params, &searchSet); err != nil {
+		return err
+	}
+	return fhirclient.Paginate(ctx, client, searchSet, func(searchSet *fhir.Bundle) (bool, error) {
+		var resources []ownedResource
+		for _, entry := range searchSet.Entry {
+			var resource struct {
+				ResourceType string     `json:"resourceType"`
+				ID           string     `json:"id"`
+				Meta         *fhir.Meta `json:"meta"`
+			}
+			if entry.Resource == nil || json.Unmarshal(entry.Resource, &resource) != nil || resource.ResourceType != resourceType ||
+				resource.ID == "" || resource.Meta == nil || resource.Meta.Source == nil || !r.source.Owns(*resource.Meta.Source) {
+				continue
+			}
+			resources = append(resources, ownedResource{id: resource.ID, source: *resource.Meta.Source, raw: entry.Resource})
+		}
+		return true, fn(resources)
+	}, fhirclient.WithMaxIterations(math.MaxInt))
+}
+
+// resyncEntry builds the transaction entry that writes the given resource from the query directory to a target.
+// sources maps the "ResourceType/id" of the owned resources in the query directory to their meta.source.
+func resyncEntry(raw json.RawMessage, sources map[string]string) (fhir.BundleEntry, error) {
+	var resource map[string]any
+	if err := json.Unmarshal(raw, &resource); err != nil {
+		return fhir.BundleEntry{}, fmt.Errorf("invalid resource in resync spool: %w", err)
+	}
+	resourceType, _ := resource["resourceType"].(string)
+	id, _ := resource["id"].(string)
+	source := sources[resourceType+"/"+id]
+	// The target assigns its own id and version
+	delete(resource, "id")
+	if meta, ok := resource["meta"].(map[string]any); ok {
+		delete(meta, "versionId")
+		delete(meta, "lastUpdated")
+	}
+	makeReferencesConditional(resource, sources)
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return fhir.BundleEntry{}, err
+	}
+	return fhir.BundleEntry{
+		Resource: data,
+		Request: &fhir.BundleEntryRequest{
+			Method: fhir.HTTPVerbPUT,
+			Url: resourceType + "?" + url.Values{
+				"_source": []string{source},
+			}.Encode(),
+		},
+	}, nil
+}
+
+// makeReferencesConditional rewrites the local references to owned resources (e.g. "Organization/123")
+// to conditional references on their meta.source, which resolve in the target.
+func makeReferencesConditional(obj any, sources map[string]string) {
+	switch v := obj.(type) {
+	case map[string]any:
+		if reference, ok := v["reference"].(string); ok {
+			if source, ok := sources[reference]; ok {
+				resourceType, _, _ := strings.Cut(reference, "/")
+				v["reference"] = resourceType + "?_source=" + url.QueryEscape(source)
+			}
+		}
+		for _, value := range v {
+			makeReferencesConditional(value, sources)
+		}
+	case []any:
+		for _, item := range v {
+			makeReferencesConditional(item, sources)
+		}
+	}
+}
+
+// conditionalDeleteTransaction builds a transaction that deletes the resources of the given type with the given meta.source values.
+func conditionalDeleteTransaction(resourceType string, sources []string) fhir.Bundle {
+	tx := fhir.Bundle{Type: fhir.BundleTypeTransaction}
+	for _, source := range sources {
+		tx.Entry = append(tx.Entry, fhir.BundleEntry{
+			Request: &fhir.BundleEntryRequest{
+				Method: fhir.HTTPVerbDELETE,
+				Url:    resourceType + "?" + url.Values{"_source": []string{source}}.Encode(),
+			},
+		})
+	}
+	return tx
+}
+
+// spoolKey returns the key of the spooled resource at the given position, which sorts in position order.
+func spoolKey(position int) string {
+	return fmt.Sprintf("%010d", position)
+}
@@ -42,3 +42,21 @@ func BadRequestError(message string, cause error) error {
 		IssueType: fhir.IssueTypeInvalid,
 	}
 }
+
+// UnauthorizedError is returned when the client isn't (properly) authenticated.
+func UnauthorizedError(message string, cause error) error {
+	return &Error{
+		Message:   message,
+		Cause:     cause,
+		IssueType: fhir.IssueTypeLogin,
+	}
+}
+
+// ForbiddenError is returned when the authenticated client isn't allowed to perform the request.
+func ForbiddenError(message string, cause error) error {
+	return &Error{
+		Message:   message,
+		Cause:     cause,
+		IssueType: fhir.IssueTypeForbidden,
+	}
+}
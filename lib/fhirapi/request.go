@@ -5,6 +5,7 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 const JSONMimeType = "application/fhir+json"
@@ -54,3 +55,18 @@ func ParseRequest[T any](httpRequest *http.Request) (*Request[T], error) {
 
 	return &request, nil
 }
+
+// AcceptsFHIR returns whether the client asked for a FHIR (application/fhir+json) response,
+// through the Accept header or the _format parameter.
+func AcceptsFHIR(httpRequest *http.Request) bool {
+	switch httpRequest.URL.Query().Get("_format") {
+	case JSONMimeType, "json":
+		return true
+	}
+	for _, accept := range strings.Split(httpRequest.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mediaType == JSONMimeType {
+			return true
+		}
+	}
+	return false
+}
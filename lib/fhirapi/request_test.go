@@ -53,3 +53,28 @@ func TestReadRequest(t *testing.T) {
 		require.Equal(t, "completed", fhirRequest.Parameters.Get("status"))
 	})
 }
+
+func TestAcceptsFHIR(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		target   string
+		accept   string
+		expected bool
+	}{
+		{name: "no preference", target: "http://localhost", expected: false},
+		{name: "Accept header", target: "http://localhost", accept: "application/json, application/fhir+json;q=0.9", expected: true},
+		{name: "Accept header without FHIR", target: "http://localhost", accept: "application/json", expected: false},
+		{name: "_format parameter", target: "http://localhost?_format=application/fhir%2Bjson", expected: true},
+		{name: "_format shorthand", target: "http://localhost?_format=json", expected: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			httpRequest, err := http.NewRequest(http.MethodPost, tc.target, nil)
+			require.NoError(t, err)
+			if tc.accept != "" {
+				httpRequest.Header.Set("Accept", tc.accept)
+			}
+
+			require.Equal(t, tc.expected, AcceptsFHIR(httpRequest))
+		})
+	}
+}
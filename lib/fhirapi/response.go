@@ -37,6 +37,11 @@ func SendErrorResponse(ctx context.Context, httpResponse http.ResponseWriter, er
 			statusCode = http.StatusServiceUnavailable
 		case fhir.IssueTypeTooCostly:
 			statusCode = http.StatusUnprocessableEntity
+		case fhir.IssueTypeLogin:
+			statusCode = http.StatusUnauthorized
+		case fhir.IssueTypeSecurity,
+			fhir.IssueTypeForbidden:
+			statusCode = http.StatusForbidden
 		}
 		responseResource = fhirError.OperationOutcome()
 	} else {
@@ -96,4 +96,22 @@ func TestSendErrorResponse(t *testing.T) {
 		assert.Contains(t, body, `"code": "processing"`)
 		assert.Contains(t, body, `"diagnostics": "An internal server error occurred"`)
 	})
+	t.Run("authentication and authorization errors", func(t *testing.T) {
+		testCases := []struct {
+			err            error
+			expectedStatus int
+			expectedCode   string
+		}{
+			{err: UnauthorizedError("missing access token", nil), expectedStatus: http.StatusUnauthorized, expectedCode: "login"},
+			{err: ForbiddenError("access denied", nil), expectedStatus: http.StatusForbidden, expectedCode: "forbidden"},
+		}
+		for _, testCase := range testCases {
+			recorder := httptest.NewRecorder()
+
+			SendErrorResponse(context.Background(), recorder, testCase.err)
+
+			assert.Equal(t, testCase.expectedStatus, recorder.Code)
+			assert.Contains(t, recorder.Body.String(), `"code": "`+testCase.expectedCode+`"`)
+		}
+	})
 }
@@ -23,27 +23,43 @@ import (
 // a resource type, so e.g. Organization/1 and Endpoint/1 are distinct resources that must not be
 // collapsed into one.
 func DeduplicateHistoryEntries(entries []fhir.BundleEntry) []fhir.BundleEntry {
-	seen := make(map[string]struct{}, len(entries))
+	deduplicator := NewHistoryDeduplicator()
 	result := make([]fhir.BundleEntry, 0, len(entries))
-
 	for _, entry := range entries {
-		key := historyEntryKey(entry)
-		if key == "" {
-			// No key to dedup on (e.g. a malformed entry); keep it rather than silently drop it.
+		if deduplicator.Keep(entry) {
 			result = append(result, entry)
-			continue
-		}
-		if _, exists := seen[key]; exists {
-			// An older version of a resource we've already kept; skip it.
-			continue
 		}
-		seen[key] = struct{}{}
-		result = append(result, entry)
 	}
-
 	return result
 }
 
+// HistoryDeduplicator is the streaming counterpart of DeduplicateHistoryEntries: it deduplicates a
+// _history feed that is processed page by page, without holding on to the entries themselves. Only
+// the keys of the resources seen so far are kept in memory.
+type HistoryDeduplicator struct {
+	seen map[string]struct{}
+}
+
+func NewHistoryDeduplicator() *HistoryDeduplicator {
+	return &HistoryDeduplicator{seen: make(map[string]struct{})}
+}
+
+// Keep reports whether the entry is the most recent version of its resource, given the entries
+// passed before it. It must be called for every entry of the feed, in feed order.
+func (d *HistoryDeduplicator) Keep(entry fhir.BundleEntry) bool {
+	key := historyEntryKey(entry)
+	if key == "" {
+		// No key to dedup on (e.g. a malformed entry); keep it rather than silently drop it.
+		return true
+	}
+	if _, exists := d.seen[key]; exists {
+		// An older version of a resource we've already kept; skip it.
+		return false
+	}
+	d.seen[key] = struct{}{}
+	return true
+}
+
 // historyEntryKey returns a "ResourceType/id" key identifying the resource an entry refers to: built
 // from the resource body for create/update entries, or from the request URL for DELETE entries
 // (which carry no body). Returns "" when no key can be determined, in which case the entry can't be
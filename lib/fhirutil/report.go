@@ -0,0 +1,184 @@
+package fhirutil
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// Severities of a ReportItem.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Codes of a ReportItem. They are stable, so monitoring can act on them.
+const (
+	// ReportCodeInvalidEntry means an entry fetched from the source couldn't be processed, e.g. because it's malformed.
+	ReportCodeInvalidEntry = "invalid-entry"
+	// ReportCodeRejected means a resource was rejected by validation.
+	ReportCodeRejected = "rejected"
+	// ReportCodeNonConformant means a resource doesn't conform to its profile (StructureDefinition).
+	// Depending on the configured profile validation mode, the resource is still imported or rejected.
+	ReportCodeNonConformant = "nonconformant"
+	// ReportCodeMissingResponse means the FHIR server didn't return the outcome of a transaction entry.
+	ReportCodeMissingResponse = "missing-response"
+	// ReportCodeUnexpectedStatus means a transaction entry was answered with an unexpected status.
+	ReportCodeUnexpectedStatus = "unexpected-status"
+	// ReportCodeDiscoveryFailed means a discovered directory couldn't be registered.
+	ReportCodeDiscoveryFailed = "discovery-failed"
+	// ReportCodeUpdateFailed means the update failed as a whole, e.g. because a FHIR server was unavailable.
+	ReportCodeUpdateFailed = "update-failed"
+	// ReportCodeUnregisteredURA means an authoritative Organization claims a URA that the LRZA doesn't list.
+	ReportCodeUnregisteredURA = "unregistered-ura"
+	// ReportCodeNameMismatch means an authoritative Organization's name differs from the names the LRZA lists for its URA.
+	ReportCodeNameMismatch = "name-mismatch"
+	// ReportCodeCrossCheckFailed means authoritative Organizations couldn't be cross-checked against the LRZA, e.g. because it hasn't been synchronized yet.
+	ReportCodeCrossCheckFailed = "crosscheck-failed"
+	// ReportCodeConsolidationFailed means the copies of the authoritative Organizations in the query directory couldn't be consolidated.
+	ReportCodeConsolidationFailed = "consolidation-failed"
+)
+
+// ReportCodeSystem is the FHIR CodeSystem of the report item codes, used in the OperationOutcome representation of a report.
+const ReportCodeSystem = "http://nuts-foundation.github.io/nuts-knooppunt/CodeSystem/update-report"
+
+// ReportSourceExtensionURL is the extension on a report's OperationOutcome that holds what the report is of (e.g. the FHIR base URL of the synced directory).
+const ReportSourceExtensionURL = "http://nuts-foundation.github.io/nuts-knooppunt/StructureDefinition/update-report-source"
+
+// ReportResourceExtensionURL is the extension on an OperationOutcome issue that references the resource the issue is about.
+const ReportResourceExtensionURL = "http://nuts-foundation.github.io/nuts-knooppunt/StructureDefinition/update-report-resource"
+
+// ReportItem is a machine-readable warning or error of an update report.
+type ReportItem struct {
+	// Code identifies the kind of problem, one of the ReportCode constants.
+	Code string `json:"code"`
+	// Severity is either error or warning.
+	Severity     string `json:"severity"`
+	ResourceType string `json:"resourceType,omitempty"`
+	ResourceID   string `json:"resourceId,omitempty"`
+	// FullURL is the fullUrl of the entry in the source the item is about.
+	FullURL string `json:"fullUrl,omitempty"`
+	Message string `json:"message"`
+}
+
+// EntryReportItem returns a report item about the given Bundle entry. The resource type and ID are taken from the resource,
+// or from the request URL if there's no (valid) resource, e.g. for a DELETE.
+func EntryReportItem(entry fhir.BundleEntry, code string, severity string, message string) ReportItem {
+	item := ReportItem{
+		Code:     code,
+		Severity: severity,
+		FullURL:  to.EmptyString(entry.FullUrl),
+		Message:  message,
+	}
+	if entry.Resource != nil {
+		if info, err := ExtractResourceInfo(entry.Resource); err == nil && info.ResourceType != "" {
+			item.ResourceType, item.ResourceID = info.ResourceType, info.ID
+			return item
+		}
+	}
+	if entry.Request != nil {
+		// A conditional request (e.g. "Organization?_source=...") only identifies the resource type
+		path, _, _ := strings.Cut(entry.Request.Url, "?")
+		if resourceType, id, ok := TypeAndIDFromReference(path); ok {
+			item.ResourceType, item.ResourceID = resourceType, id
+		} else if !strings.Contains(path, "/") {
+			item.ResourceType = path
+		}
+	}
+	return item
+}
+
+// ResourceCounts holds the number of resources created, updated and deleted by an update.
+type ResourceCounts struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Deleted int `json:"deleted"`
+}
+
+// ResourceTypeCounts holds the ResourceCounts per resource type.
+type ResourceTypeCounts map[string]ResourceCounts
+
+// Add counts a change (ChangeCreate, ChangeUpdate or ChangeDelete) of a resource of the given type.
+func (c ResourceTypeCounts) Add(resourceType string, action string) {
+	counts := c[resourceType]
+	switch action {
+	case ChangeCreate:
+		counts.Created++
+	case ChangeUpdate:
+		counts.Updated++
+	case ChangeDelete:
+		counts.Deleted++
+	}
+	c[resourceType] = counts
+}
+
+// ReportOutcome represents report items as FHIR OperationOutcome. Source identifies what the report is of, and summary describes its result:
+// it's added as informational issue, so the OperationOutcome is valid (it requires at least one issue) when there are no items.
+func ReportOutcome(source string, summary string, items []ReportItem) fhir.OperationOutcome {
+	outcome := fhir.OperationOutcome{
+		Issue: []fhir.OperationOutcomeIssue{
+			{
+				Severity:    fhir.IssueSeverityInformation,
+				Code:        fhir.IssueTypeInformational,
+				Diagnostics: to.Ptr(summary),
+			},
+		},
+	}
+	if source != "" {
+		outcome.Extension = []fhir.Extension{{Url: ReportSourceExtensionURL, ValueUri: to.Ptr(source)}}
+	}
+	for _, item := range items {
+		issue := fhir.OperationOutcomeIssue{
+			Severity: fhir.IssueSeverityWarning,
+			Code:     reportIssueType(item.Code),
+			Details: &fhir.CodeableConcept{
+				Coding: []fhir.Coding{{System: to.Ptr(ReportCodeSystem), Code: to.Ptr(item.Code)}},
+				Text:   to.Ptr(item.Message),
+			},
+		}
+		if item.Severity == SeverityError {
+			issue.Severity = fhir.IssueSeverityError
+		}
+		if reference := item.reference(); reference != "" {
+			valueReference := &fhir.Reference{Reference: to.Ptr(reference)}
+			if item.ResourceType != "" {
+				valueReference.Type = to.Ptr(item.ResourceType)
+			}
+			issue.Extension = []fhir.Extension{{Url: ReportResourceExtensionURL, ValueReference: valueReference}}
+			issue.Diagnostics = to.Ptr(fmt.Sprintf("%s (resource=%s)", item.Message, reference))
+		}
+		outcome.Issue = append(outcome.Issue, issue)
+	}
+	return outcome
+}
+
+// reference returns a reference to the resource the item is about: its fullUrl, or its type and ID if there's no fullUrl.
+func (item ReportItem) reference() string {
+	if item.FullURL != "" {
+		return item.FullURL
+	}
+	if item.ResourceType != "" && item.ResourceID != "" {
+		return item.ResourceType + "/" + item.ResourceID
+	}
+	return ""
+}
+
+// reportIssueType maps a report item code to the FHIR issue type.
+func reportIssueType(code string) fhir.IssueType {
+	switch code {
+	case ReportCodeInvalidEntry:
+		return fhir.IssueTypeInvalid
+	case ReportCodeRejected:
+		return fhir.IssueTypeBusinessRule
+	case ReportCodeNonConformant:
+		return fhir.IssueTypeStructure
+	case ReportCodeMissingResponse, ReportCodeUnexpectedStatus:
+		return fhir.IssueTypeProcessing
+	case ReportCodeUpdateFailed, ReportCodeDiscoveryFailed:
+		return fhir.IssueTypeException
+	default:
+		return fhir.IssueTypeProcessing
+	}
+}
@@ -0,0 +1,106 @@
+package fhirutil
+
+import (
+	"testing"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/to"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestEntryReportItem(t *testing.T) {
+	t.Run("from resource", func(t *testing.T) {
+		entry := fhir.BundleEntry{
+			FullUrl:  to.Ptr("http://example.com/fhir/Organization/1"),
+			Resource: []byte(`{"resourceType":"Organization","id":"1"}`),
+			Request:  &fhir.BundleEntryRequest{Method: fhir.HTTPVerbPUT, Url: "Organization/2"},
+		}
+
+		item := EntryReportItem(entry, ReportCodeRejected, SeverityWarning, "rejected")
+
+		assert.Equal(t, ReportItem{
+			Code:         ReportCodeRejected,
+			Severity:     SeverityWarning,
+			ResourceType: "Organization",
+			ResourceID:   "1",
+			FullURL:      "http://example.com/fhir/Organization/1",
+			Message:      "rejected",
+		}, item)
+	})
+	t.Run("from DELETE request", func(t *testing.T) {
+		entry := fhir.BundleEntry{Request: &fhir.BundleEntryRequest{Method: fhir.HTTPVerbDELETE, Url: "Endpoint/2/_history/3"}}
+
+		item := EntryReportItem(entry, ReportCodeInvalidEntry, SeverityWarning, "invalid")
+
+		assert.Equal(t, "Endpoint", item.ResourceType)
+		assert.Equal(t, "2", item.ResourceID)
+		assert.Empty(t, item.FullURL)
+	})
+	t.Run("from conditional request", func(t *testing.T) {
+		entry := fhir.BundleEntry{Request: &fhir.BundleEntryRequest{Method: fhir.HTTPVerbPUT, Url: "Location?_source=http%3A%2F%2Fexample.com%2Ffhir%2FLocation%2F1"}}
+
+		item := EntryReportItem(entry, ReportCodeUnexpectedStatus, SeverityWarning, "failed")
+
+		assert.Equal(t, "Location", item.ResourceType)
+		assert.Empty(t, item.ResourceID)
+	})
+	t.Run("malformed resource", func(t *testing.T) {
+		entry := fhir.BundleEntry{Resource: []byte(`not JSON`)}
+
+		item := EntryReportItem(entry, ReportCodeInvalidEntry, SeverityWarning, "invalid")
+
+		assert.Empty(t, item.ResourceType)
+		assert.Empty(t, item.ResourceID)
+	})
+}
+
+func TestResourceTypeCounts_Add(t *testing.T) {
+	counts := ResourceTypeCounts{}
+	counts.Add("Organization", ChangeCreate)
+	counts.Add("Organization", ChangeCreate)
+	counts.Add("Organization", ChangeDelete)
+	counts.Add("Endpoint", ChangeUpdate)
+
+	assert.Equal(t, ResourceTypeCounts{
+		"Organization": {Created: 2, Deleted: 1},
+		"Endpoint":     {Updated: 1},
+	}, counts)
+}
+
+func TestReportOutcome(t *testing.T) {
+	t.Run("no items", func(t *testing.T) {
+		outcome := ReportOutcome("", "nothing to report", nil)
+
+		assert.Empty(t, outcome.Extension)
+		require.Len(t, outcome.Issue, 1)
+		assert.Equal(t, fhir.IssueSeverityInformation, outcome.Issue[0].Severity)
+		assert.Equal(t, "nothing to report", *outcome.Issue[0].Diagnostics)
+	})
+	t.Run("items", func(t *testing.T) {
+		outcome := ReportOutcome("http://example.com/fhir", "summary", []ReportItem{
+			{Code: ReportCodeRejected, Severity: SeverityWarning, ResourceType: "Organization", ResourceID: "1", Message: "organization must have an identifier"},
+			{Code: ReportCodeUpdateFailed, Severity: SeverityError, Message: "directory unavailable"},
+		})
+
+		require.Len(t, outcome.Extension, 1)
+		assert.Equal(t, ReportSourceExtensionURL, outcome.Extension[0].Url)
+		assert.Equal(t, "http://example.com/fhir", *outcome.Extension[0].ValueUri)
+		require.Len(t, outcome.Issue, 3)
+
+		rejected := outcome.Issue[1]
+		assert.Equal(t, fhir.IssueSeverityWarning, rejected.Severity)
+		assert.Equal(t, fhir.IssueTypeBusinessRule, rejected.Code)
+		assert.Equal(t, ReportCodeSystem, *rejected.Details.Coding[0].System)
+		assert.Equal(t, ReportCodeRejected, *rejected.Details.Coding[0].Code)
+		assert.Equal(t, "organization must have an identifier", *rejected.Details.Text)
+		require.Len(t, rejected.Extension, 1)
+		assert.Equal(t, "Organization/1", *rejected.Extension[0].ValueReference.Reference)
+		assert.Equal(t, "Organization", *rejected.Extension[0].ValueReference.Type)
+
+		failed := outcome.Issue[2]
+		assert.Equal(t, fhir.IssueSeverityError, failed.Severity)
+		assert.Equal(t, fhir.IssueTypeException, failed.Code)
+		assert.Empty(t, failed.Extension)
+	})
+}
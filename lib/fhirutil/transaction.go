@@ -0,0 +1,274 @@
+package fhirutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	fhirclient "github.com/SanteonNL/go-fhir-client"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// Actions of a TransactionChange.
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// TransactionChange describes the change a transaction entry would make to a FHIR server.
+type TransactionChange struct {
+	// Action is the kind of change: create, update or delete.
+	Action       string `json:"action"`
+	ResourceType string `json:"resourceType"`
+	// Source is the meta.source of the changed resource, which identifies it in the FHIR server.
+	Source string `json:"source"`
+	// Resource is the resource as it would be written, for creates and updates.
+	Resource json.RawMessage `json:"resource,omitempty"`
+}
+
+// sourceSearchBatchSize is the number of _source values DescribeTransaction looks up in a single search,
+// keeping the search URL at a reasonable length.
+const sourceSearchBatchSize = 20
+
+// DescribeTransaction determines the changes the given transaction would make to the FHIR server, without applying it.
+// It supports the transactions built to synchronize resources: conditional updates and deletes on _source
+// (e.g. "Organization?_source=https://example.com/fhir/Organization/1"). A conditional update of a resource that doesn't exist
+// in the FHIR server is a create; to find out, the server is searched for the updated resources (in batches).
+// Changes are returned in transaction order.
+func DescribeTransaction(ctx context.Context, client fhirclient.Client, tx fhir.Bundle) ([]TransactionChange, error) {
+	changes := make([]TransactionChange, 0, len(tx.Entry))
+	updatedSources := make(map[string][]string)
+	for i, entry := range tx.Entry {
+		if entry.Request == nil {
+			return nil, fmt.Errorf("transaction entry #%d has no request", i)
+		}
+		resourceType, query, _ := strings.Cut(entry.Request.Url, "?")
+		params, err := url.ParseQuery(query)
+		if err != nil || params.Get("_source") == "" {
+			return nil, fmt.Errorf("transaction entry #%d is not conditional on _source (url=%s)", i, entry.Request.Url)
+		}
+		change := TransactionChange{
+			ResourceType: resourceType,
+			Source:       params.Get("_source"),
+		}
+		switch entry.Request.Method {
+		case fhir.HTTPVerbDELETE:
+			change.Action = ChangeDelete
+		case fhir.HTTPVerbPUT:
+			change.Resource = entry.Resource
+			updatedSources[resourceType] = append(updatedSources[resourceType], change.Source)
+		default:
+			return nil, fmt.Errorf("transaction entry #%d has unsupported method %s", i, entry.Request.Method)
+		}
+		changes = append(changes, change)
+	}
+
+	existingSources := make(map[string]bool)
+	for resourceType, sources := range updatedSources {
+		for batch := range slices.Chunk(sources, sourceSearchBatchSize) {
+			if err := findExistingSources(ctx, client, resourceType, batch, existingSources); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i, change := range changes {
+		if change.Action != "" {
+			continue
+		}
+		if existingSources[change.ResourceType+"|"+change.Source] {
+			changes[i].Action = ChangeUpdate
+		} else {
+			changes[i].Action = ChangeCreate
+		}
+	}
+	return changes, nil
+}
+
+// findExistingSources searches the FHIR server for resources of the given type with any of the given sources,
+// and marks the sources that are found in result (keyed by "ResourceType|source").
+func findExistingSources(ctx context.Context, client fhirclient.Client, resourceType string, sources []string, result map[string]bool) error {
+	escaped := make([]string, len(sources))
+	for i, source := range sources {
+		// Commas separate alternative values in FHIR search, so they must be escaped within a value
+		escaped[i] = strings.ReplaceAll(source, ",", `\,`)
+	}
+	var searchSet fhir.Bundle
+	params := url.Values{
+		"_source": []string{strings.Join(escaped, ",")},
+		"_count":  []string{strconv.Itoa(len(sources))},
+	}
+	if err := client.SearchWithContext(ctx, resourceType, params, &searchSet); err != nil {
+		return fmt.Errorf("failed to search %s by _source: %w", resourceType, err)
+	}
+	return fhirclient.Paginate(ctx, client, searchSet, func(searchSet *fhir.Bundle) (bool, error) {
+		for _, entry := range searchSet.Entry {
+			var resource struct {
+				Meta *fhir.Meta `json:"meta"`
+			}
+			if entry.Resource == nil || json.Unmarshal(entry.Resource, &resource) != nil {
+				continue
+			}
+			if resource.Meta != nil && resource.Meta.Source != nil {
+				result[resourceType+"|"+*resource.Meta.Source] = true
+			}
+		}
+		return true, nil
+	})
+}
+
+// TransactionPlanner splits a (deduplicated) _history feed into chunks that can be applied as separate
+// FHIR transactions, instead of one transaction that can grow without bounds.
+//
+// Splitting must keep referential consistency: resources refer to each other through conditional
+// references, which only resolve when the referenced resource exists in the target server, so a
+// referenced resource must be applied in the same chunk as, or an earlier chunk than, the resource
+// referring to it. Resources that refer to each other (e.g. an Organization and its Endpoints) must
+// be in the same chunk. The planner therefore determines the strongly connected components of the
+// reference graph between the entries of the feed, and packs them in dependency order.
+// References to resources that aren't in the feed are ignored: those either exist in the target
+// server already, or don't resolve regardless of how the feed is split.
+//
+// Only the resource keys and references of the entries are kept in memory, not the entries themselves,
+// so the planner can be fed from a spooled feed.
+type TransactionPlanner struct {
+	// keys holds the "ResourceType/id" key of every added entry, by position ("" if unknown)
+	keys []string
+	// references holds the keys of the resources referenced by every added entry, by position
+	references [][]string
+	// positions maps resource keys to the position of the entry in the feed
+	positions map[string]int
+}
+
+func NewTransactionPlanner() *TransactionPlanner {
+	return &TransactionPlanner{positions: make(map[string]int)}
+}
+
+// Add adds the next entry of the feed to the plan. Entries are identified by their position in the feed,
+// which is the number of entries added before it.
+func (p *TransactionPlanner) Add(entry fhir.BundleEntry) {
+	key := historyEntryKey(entry)
+	if key != "" {
+		p.positions[key] = len(p.keys)
+	}
+	p.keys = append(p.keys, key)
+	var references []string
+	if entry.Resource != nil {
+		var resource any
+		if err := json.Unmarshal(entry.Resource, &resource); err == nil {
+			references = collectLocalReferences(resource, references)
+		}
+	}
+	// Sort references, since they're collected from maps: keeps the plan deterministic
+	slices.Sort(references)
+	references = slices.Compact(references)
+	p.references = append(p.references, references)
+}
+
+// Len returns the number of entries added to the plan.
+func (p *TransactionPlanner) Len() int {
+	return len(p.keys)
+}
+
+// Chunks returns the positions of the added entries, grouped into chunks that should be applied as separate transactions,
+// in the order they should be applied. A chunk contains at most maxSize entries, unless a group of entries that refer to each other
+// is larger than that, in which case that group forms a chunk by itself. Positions within a chunk are in feed order.
+// The result is deterministic for the same feed and maxSize.
+func (p *TransactionPlanner) Chunks(maxSize int) [][]int {
+	maxSize = max(maxSize, 1)
+	var result [][]int
+	var current []int
+	for _, component := range p.stronglyConnectedComponents() {
+		if len(current) > 0 && len(current)+len(component) > maxSize {
+			slices.Sort(current)
+			result = append(result, current)
+			current = nil
+		}
+		current = append(current, component...)
+	}
+	if len(current) > 0 {
+		slices.Sort(current)
+		result = append(result, current)
+	}
+	return result
+}
+
+// stronglyConnectedComponents returns the strongly connected components of the reference graph between the entries,
+// using Tarjan's algorithm. Components are returned in reverse topological order, meaning a component is returned
+// after all components it refers to: exactly the order in which they must be applied.
+func (p *TransactionPlanner) stronglyConnectedComponents() [][]int {
+	const unvisited = -1
+	index := make([]int, len(p.keys))
+	lowLink := make([]int, len(p.keys))
+	onStack := make([]bool, len(p.keys))
+	for i := range index {
+		index[i] = unvisited
+	}
+	var stack []int
+	var result [][]int
+	nextIndex := 0
+
+	var visit func(v int)
+	visit = func(v int) {
+		index[v] = nextIndex
+		lowLink[v] = nextIndex
+		nextIndex++
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, reference := range p.references[v] {
+			w, ok := p.positions[reference]
+			if !ok {
+				continue
+			}
+			if index[w] == unvisited {
+				visit(w)
+				lowLink[v] = min(lowLink[v], lowLink[w])
+			} else if onStack[w] {
+				lowLink[v] = min(lowLink[v], index[w])
+			}
+		}
+		if lowLink[v] == index[v] {
+			var component []int
+			for {
+				w := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[w] = false
+				component = append(component, w)
+				if w == v {
+					break
+				}
+			}
+			result = append(result, component)
+		}
+	}
+	for v := range p.keys {
+		if index[v] == unvisited {
+			visit(v)
+		}
+	}
+	return result
+}
+
+// collectLocalReferences appends the "ResourceType/id" keys of all relative references in the given (unmarshalled) resource to result.
+func collectLocalReferences(obj any, result []string) []string {
+	switch v := obj.(type) {
+	case map[string]any:
+		if ref, ok := v["reference"].(string); ok {
+			if parts := strings.Split(ref, "/"); len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+				result = append(result, ref)
+			}
+		}
+		for _, value := range v {
+			result = collectLocalReferences(value, result)
+		}
+	case []any:
+		for _, item := range v {
+			result = collectLocalReferences(item, result)
+		}
+	}
+	return result
+}
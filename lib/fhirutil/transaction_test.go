@@ -0,0 +1,146 @@
+package fhirutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/caramel/to"
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+func TestTransactionPlanner_Chunks(t *testing.T) {
+	resourceEntry := func(resourceType, id string, references ...string) fhir.BundleEntry {
+		resource := map[string]any{"resourceType": resourceType, "id": id}
+		var refs []any
+		for _, reference := range references {
+			refs = append(refs, map[string]any{"reference": reference})
+		}
+		if len(refs) > 0 {
+			resource["related"] = refs
+		}
+		data, _ := json.Marshal(resource)
+		return fhir.BundleEntry{
+			Resource: data,
+			Request:  &fhir.BundleEntryRequest{Method: fhir.HTTPVerbPUT, Url: resourceType + "/" + id},
+		}
+	}
+
+	t.Run("unrelated entries are packed up to the max size", func(t *testing.T) {
+		planner := NewTransactionPlanner()
+		for _, id := range []string{"1", "2", "3", "4", "5"} {
+			planner.Add(resourceEntry("Organization", id))
+		}
+		assert.Equal(t, 5, planner.Len())
+		assert.Equal(t, [][]int{{0, 1}, {2, 3}, {4}}, planner.Chunks(2))
+	})
+	t.Run("referenced entries are applied first", func(t *testing.T) {
+		planner := NewTransactionPlanner()
+		planner.Add(resourceEntry("Location", "loc", "Organization/org"))
+		planner.Add(resourceEntry("Organization", "other"))
+		planner.Add(resourceEntry("Organization", "org"))
+		assert.Equal(t, [][]int{{2}, {0}, {1}}, planner.Chunks(1))
+	})
+	t.Run("entries referring to each other stay in the same chunk", func(t *testing.T) {
+		planner := NewTransactionPlanner()
+		planner.Add(resourceEntry("Organization", "org", "Endpoint/ep1", "Endpoint/ep2"))
+		planner.Add(resourceEntry("Endpoint", "ep1", "Organization/org"))
+		planner.Add(resourceEntry("Endpoint", "ep2", "Organization/org"))
+		planner.Add(resourceEntry("Location", "loc", "Organization/org"))
+		assert.Equal(t, [][]int{{0, 1, 2}, {3}}, planner.Chunks(2))
+	})
+	t.Run("references to resources outside the feed are ignored", func(t *testing.T) {
+		planner := NewTransactionPlanner()
+		planner.Add(resourceEntry("Location", "loc1", "Organization/unknown"))
+		planner.Add(resourceEntry("Location", "loc2", "Organization/unknown"))
+		assert.Equal(t, [][]int{{0}, {1}}, planner.Chunks(1))
+	})
+	t.Run("DELETE entries and entries without key", func(t *testing.T) {
+		planner := NewTransactionPlanner()
+		planner.Add(fhir.BundleEntry{
+			FullUrl: to.Ptr("http://example.com/fhir/Endpoint/1"),
+			Request: &fhir.BundleEntryRequest{Method: fhir.HTTPVerbDELETE, Url: "Endpoint/1"},
+		})
+		planner.Add(fhir.BundleEntry{})
+		assert.Equal(t, [][]int{{0, 1}}, planner.Chunks(10))
+	})
+	t.Run("empty", func(t *testing.T) {
+		assert.Empty(t, NewTransactionPlanner().Chunks(10))
+	})
+}
+
+func TestHistoryDeduplicator_Keep(t *testing.T) {
+	deduplicator := NewHistoryDeduplicator()
+	newer := fhir.BundleEntry{Resource: []byte(`{"resourceType":"Organization","id":"1","name":"new"}`)}
+	older := fhir.BundleEntry{Resource: []byte(`{"resourceType":"Organization","id":"1","name":"old"}`)}
+	other := fhir.BundleEntry{Resource: []byte(`{"resourceType":"Endpoint","id":"1"}`)}
+	assert.True(t, deduplicator.Keep(newer))
+	assert.False(t, deduplicator.Keep(older))
+	assert.True(t, deduplicator.Keep(other))
+	assert.True(t, deduplicator.Keep(fhir.BundleEntry{}))
+	assert.True(t, deduplicator.Keep(fhir.BundleEntry{}))
+}
+
+func TestDescribeTransaction(t *testing.T) {
+	ctx := context.Background()
+	const existingSource = "https://example.com/fhir/Organization/existing"
+	client := &test.StubFHIRClient{
+		Resources: []any{
+			fhir.Organization{Id: to.Ptr("1"), Meta: &fhir.Meta{Source: to.Ptr(existingSource)}},
+		},
+	}
+	upsert := func(resourceType, source string) fhir.BundleEntry {
+		return fhir.BundleEntry{
+			Resource: []byte(`{"resourceType":"` + resourceType + `"}`),
+			Request: &fhir.BundleEntryRequest{
+				Method: fhir.HTTPVerbPUT,
+				Url:    resourceType + "?_source=" + source,
+			},
+		}
+	}
+
+	t.Run("creates, updates and deletes", func(t *testing.T) {
+		tx := fhir.Bundle{
+			Type: fhir.BundleTypeTransaction,
+			Entry: []fhir.BundleEntry{
+				upsert("Organization", "https://example.com/fhir/Organization/new"),
+				upsert("Organization", existingSource),
+				upsert("Endpoint", existingSource),
+				{
+					Request: &fhir.BundleEntryRequest{
+						Method: fhir.HTTPVerbDELETE,
+						Url:    "Location?_source=https://example.com/fhir/Location/1",
+					},
+				},
+			},
+		}
+
+		changes, err := DescribeTransaction(ctx, client, tx)
+
+		require.NoError(t, err)
+		require.Len(t, changes, 4)
+		assert.Equal(t, ChangeCreate, changes[0].Action)
+		assert.Equal(t, "https://example.com/fhir/Organization/new", changes[0].Source)
+		assert.JSONEq(t, `{"resourceType":"Organization"}`, string(changes[0].Resource))
+		assert.Equal(t, ChangeUpdate, changes[1].Action)
+		assert.Equal(t, "Organization", changes[1].ResourceType)
+		assert.Equal(t, ChangeCreate, changes[2].Action, "source exists, but for another resource type")
+		assert.Equal(t, ChangeDelete, changes[3].Action)
+		assert.Equal(t, "Location", changes[3].ResourceType)
+		assert.Nil(t, changes[3].Resource)
+	})
+	t.Run("entry not conditional on _source", func(t *testing.T) {
+		tx := fhir.Bundle{Entry: []fhir.BundleEntry{{Request: &fhir.BundleEntryRequest{Method: fhir.HTTPVerbPUT, Url: "Organization/1"}}}}
+		_, err := DescribeTransaction(ctx, client, tx)
+		assert.ErrorContains(t, err, "not conditional on _source")
+	})
+	t.Run("search fails", func(t *testing.T) {
+		tx := fhir.Bundle{Entry: []fhir.BundleEntry{upsert("Organization", existingSource)}}
+		_, err := DescribeTransaction(ctx, &test.StubFHIRClient{Error: errors.New("unavailable")}, tx)
+		assert.ErrorContains(t, err, "failed to search Organization by _source")
+	})
+}
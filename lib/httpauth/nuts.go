@@ -0,0 +1,112 @@
+package httpauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// NutsTokenConfig holds the configuration for requesting access tokens through a Nuts node's request-service-access-token API.
+type NutsTokenConfig struct {
+	// NodeURL is the base URL of the Nuts node's internal API.
+	NodeURL string
+	// Subject is the Nuts subject that requests the access token.
+	Subject string
+	// AuthorizationServer is the identifier of the OAuth2 authorization server the access token is requested from.
+	AuthorizationServer string
+	// Scope is the scope of the requested access token.
+	Scope string
+}
+
+// IsConfigured returns true if the Nuts token configuration has all required fields set.
+func (c NutsTokenConfig) IsConfigured() bool {
+	return c.NodeURL != "" && c.Subject != "" && c.AuthorizationServer != "" && c.Scope != ""
+}
+
+// NewNutsHTTPClient creates an http.Client that authenticates requests with a service access token,
+// obtained through the Nuts node's request-service-access-token API. Tokens are cached until they expire.
+// The baseTransport is used for both the requests to the Nuts node and resource requests (e.g., for tracing).
+// Pass nil to use http.DefaultTransport.
+func NewNutsHTTPClient(config NutsTokenConfig, baseTransport http.RoundTripper) (*http.Client, error) {
+	if !config.IsConfigured() {
+		return nil, fmt.Errorf("nuts token configuration is incomplete: node URL, subject, authorization server and scope are required")
+	}
+	if baseTransport == nil {
+		baseTransport = http.DefaultTransport
+	}
+	source := &nutsTokenSource{
+		config: config,
+		client: &http.Client{Transport: baseTransport, Timeout: 30 * time.Second},
+	}
+	return &http.Client{
+		Transport: &oauth2.Transport{
+			Source: oauth2.ReuseTokenSource(nil, source),
+			Base:   baseTransport,
+		},
+	}, nil
+}
+
+// nutsTokenSource is an oauth2.TokenSource that requests a service access token from the Nuts node.
+type nutsTokenSource struct {
+	config NutsTokenConfig
+	client *http.Client
+}
+
+type nutsTokenRequest struct {
+	AuthorizationServer string `json:"authorization_server"`
+	Scope               string `json:"scope"`
+	TokenType           string `json:"token_type"`
+}
+
+type nutsTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   *int   `json:"expires_in"`
+}
+
+func (s *nutsTokenSource) Token() (*oauth2.Token, error) {
+	requestURL := strings.TrimSuffix(s.config.NodeURL, "/") + "/internal/auth/v2/" + url.PathEscape(s.config.Subject) + "/request-service-access-token"
+	requestBody, err := json.Marshal(nutsTokenRequest{
+		AuthorizationServer: s.config.AuthorizationServer,
+		Scope:               s.config.Scope,
+		// DPoP-bound tokens would require signing every request through the Nuts node
+		TokenType: "Bearer",
+	})
+	if err != nil {
+		return nil, err
+	}
+	httpResponse, err := s.client.Post(requestURL, "application/json", bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("nuts access token request failed: %w", err)
+	}
+	defer httpResponse.Body.Close()
+	responseBody, err := io.ReadAll(io.LimitReader(httpResponse.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("nuts access token request failed: %w", err)
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("nuts access token request failed (status=%d): %s", httpResponse.StatusCode, string(responseBody))
+	}
+	var response nutsTokenResponse
+	if err := json.Unmarshal(responseBody, &response); err != nil {
+		return nil, fmt.Errorf("invalid nuts access token response: %w", err)
+	}
+	if response.AccessToken == "" {
+		return nil, fmt.Errorf("invalid nuts access token response: no access token")
+	}
+	token := &oauth2.Token{
+		AccessToken: response.AccessToken,
+		TokenType:   response.TokenType,
+	}
+	if response.ExpiresIn != nil {
+		token.Expiry = time.Now().Add(time.Duration(*response.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
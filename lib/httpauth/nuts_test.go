@@ -0,0 +1,108 @@
+package httpauth_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/httpauth"
+	"github.com/stretchr/testify/require"
+)
+
+// newNutsNodeServer creates a test Nuts node that issues access tokens through its request-service-access-token API,
+// and returns a counter of the token requests.
+func newNutsNodeServer(t *testing.T, status int, expiresIn int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/internal/auth/v2/my-subject/request-service-access-token", r.URL.Path)
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Equal(t, "https://example.com/oauth2/directory", body["authorization_server"])
+		require.Equal(t, "mcsd", body["scope"])
+		require.Equal(t, "Bearer", body["token_type"])
+		if status != http.StatusOK {
+			http.Error(w, "no matching credentials", status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(tokenResponse{
+			AccessToken: "nuts-access-token",
+			TokenType:   "Bearer",
+			ExpiresIn:   expiresIn,
+		}))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestNewNutsHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	newConfig := func(nodeURL string) httpauth.NutsTokenConfig {
+		return httpauth.NutsTokenConfig{
+			NodeURL:             nodeURL,
+			Subject:             "my-subject",
+			AuthorizationServer: "https://example.com/oauth2/directory",
+			Scope:               "mcsd",
+		}
+	}
+
+	t.Run("returns error for incomplete config", func(t *testing.T) {
+		t.Parallel()
+		_, err := httpauth.NewNutsHTTPClient(httpauth.NutsTokenConfig{NodeURL: "http://localhost"}, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("makes authenticated requests and caches the token", func(t *testing.T) {
+		t.Parallel()
+		nutsNode, tokenRequests := newNutsNodeServer(t, http.StatusOK, hourExpiry)
+		resourceServer, getAuth := newCaptureServer(t)
+
+		client, err := httpauth.NewNutsHTTPClient(newConfig(nutsNode.URL+"/"), nil)
+		require.NoError(t, err)
+
+		for range 2 {
+			resp, err := client.Get(resourceServer.URL)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+		}
+
+		require.Equal(t, "Bearer nuts-access-token", getAuth())
+		require.Equal(t, int32(1), tokenRequests.Load())
+	})
+
+	t.Run("requests a new token when it expired", func(t *testing.T) {
+		t.Parallel()
+		nutsNode, tokenRequests := newNutsNodeServer(t, http.StatusOK, 0)
+		resourceServer, _ := newCaptureServer(t)
+
+		client, err := httpauth.NewNutsHTTPClient(newConfig(nutsNode.URL), nil)
+		require.NoError(t, err)
+
+		for range 2 {
+			resp, err := client.Get(resourceServer.URL)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+		}
+
+		require.Equal(t, int32(2), tokenRequests.Load())
+	})
+
+	t.Run("token request fails", func(t *testing.T) {
+		t.Parallel()
+		nutsNode, _ := newNutsNodeServer(t, http.StatusBadRequest, 0)
+		resourceServer, getAuth := newCaptureServer(t)
+
+		client, err := httpauth.NewNutsHTTPClient(newConfig(nutsNode.URL), nil)
+		require.NoError(t, err)
+
+		_, err = client.Get(resourceServer.URL)
+		require.ErrorContains(t, err, "nuts access token request failed (status=400): no matching credentials")
+		require.Empty(t, getAuth(), "the request must not be sent without a token")
+	})
+}
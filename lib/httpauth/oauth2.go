@@ -27,6 +27,13 @@ func (c OAuth2Config) IsConfigured() bool {
 // The baseTransport is used for both token endpoint calls and resource requests (e.g., for tracing).
 // Pass nil to use http.DefaultTransport.
 func NewOAuth2HTTPClient(config OAuth2Config, baseTransport http.RoundTripper) (*http.Client, error) {
+	return NewOAuth2HTTPClientWithTokenTransport(config, baseTransport, baseTransport)
+}
+
+// NewOAuth2HTTPClientWithTokenTransport is like NewOAuth2HTTPClient, but sends the token endpoint calls through tokenTransport,
+// and the resource requests through baseTransport: e.g. to apply a timeout to the token requests, but not to downloads.
+// Pass nil to use http.DefaultTransport.
+func NewOAuth2HTTPClientWithTokenTransport(config OAuth2Config, tokenTransport http.RoundTripper, baseTransport http.RoundTripper) (*http.Client, error) {
 	if !config.IsConfigured() {
 		return nil, fmt.Errorf("oauth2 configuration is incomplete: tokenendpoint, clientid, and clientsecret are required")
 	}
@@ -39,13 +46,15 @@ func NewOAuth2HTTPClient(config OAuth2Config, baseTransport http.RoundTripper) (
 		AuthStyle:    oauth2.AuthStyleInParams,
 	}
 
+	if tokenTransport == nil {
+		tokenTransport = http.DefaultTransport
+	}
 	if baseTransport == nil {
 		baseTransport = http.DefaultTransport
 	}
 
-	// Inject the base transport via context so x/oauth2 uses it for both
-	// token requests and the returned client's underlying transport.
-	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: baseTransport})
+	// The token source uses the HTTP client injected via context for token requests
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: tokenTransport})
 
-	return conf.Client(ctx), nil
-}
\ No newline at end of file
+	return &http.Client{Transport: &oauth2.Transport{Source: conf.TokenSource(ctx), Base: baseTransport}}, nil
+}
@@ -226,6 +226,38 @@ func TestNewOAuth2HTTPClient(t *testing.T) {
 
 		require.True(t, transportUsed, "custom base transport should be used")
 	})
+
+	t.Run("uses token transport for token requests", func(t *testing.T) {
+		t.Parallel()
+		tokenServer := newOAuth2TokenServer(t, "token", hourExpiry, nil)
+		resourceServer, getAuth := newCaptureServer(t)
+		var tokenRequests, resourceRequests atomic.Int32
+		tokenTransport := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			tokenRequests.Add(1)
+			return http.DefaultTransport.RoundTrip(req)
+		})
+		baseTransport := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			resourceRequests.Add(1)
+			return http.DefaultTransport.RoundTrip(req)
+		})
+
+		config := httpauth.OAuth2Config{
+			TokenEndpoint: tokenServer.URL,
+			ClientID:      "id",
+			ClientSecret:  "secret",
+		}
+
+		client, err := httpauth.NewOAuth2HTTPClientWithTokenTransport(config, tokenTransport, baseTransport)
+		require.NoError(t, err)
+
+		resp, err := client.Get(resourceServer.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		require.Equal(t, "Bearer token", getAuth())
+		require.Equal(t, int32(1), tokenRequests.Load())
+		require.Equal(t, int32(1), resourceRequests.Load())
+	})
 }
 
 // roundTripFunc is an adapter to allow use of ordinary functions as http.RoundTripper.
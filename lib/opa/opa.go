@@ -0,0 +1,64 @@
+// Package opa embeds Open Policy Agent, which evaluates the Rego policies of the knooppunt's components.
+package opa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/to"
+	"github.com/open-policy-agent/opa/v1/loader"
+	"github.com/open-policy-agent/opa/v1/logging"
+	"github.com/open-policy-agent/opa/v1/plugins"
+	"github.com/open-policy-agent/opa/v1/sdk"
+	"github.com/open-policy-agent/opa/v1/storage"
+)
+
+// NewService creates an embedded Open Policy Agent instance with the given ID and configuration (see https://www.openpolicyagent.org/docs/configuration).
+// Policies and data that aren't loaded through the configuration (e.g. from a bundle service) can be passed as files, which are loaded on startup.
+// If store isn't nil, the instance keeps its data in it, so the caller can write data that isn't known on startup.
+func NewService(ctx context.Context, id string, config map[string]any, files *loader.Result, store storage.Store) (*sdk.OPA, error) {
+	configData, _ := json.Marshal(config)
+	options := sdk.Options{
+		ID:            id,
+		Config:        bytes.NewReader(configData),
+		Logger:        logging.Get(),
+		ConsoleLogger: logging.Get(),
+		Store:         store,
+	}
+	if files != nil {
+		options.ManagerOpts = []func(*plugins.Manager){plugins.InitFiles(*files)}
+	}
+	result, err := sdk.New(ctx, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OPA SDK instance: %w", err)
+	}
+	return result, nil
+}
+
+// Decide evaluates the decision at the given path (e.g. /mcsd/update) for the given input.
+// The decision must be an object with an 'allow' field, which is returned along with the decision.
+func Decide(ctx context.Context, service *sdk.OPA, path string, input any) (bool, map[string]any, error) {
+	inputMap, err := to.JSONMap(input)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to convert policy input to map: %w", err)
+	}
+	result, err := service.Decision(ctx, sdk.DecisionOptions{Path: path, Input: inputMap})
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to evaluate policy: %w", err)
+	}
+	resultMap, ok := result.Result.(map[string]any)
+	if !ok {
+		return false, nil, fmt.Errorf("unexpected policy result type (expected map[string]any with 'allow' field, was %T)", result.Result)
+	}
+	allowValue, exists := resultMap["allow"]
+	if !exists {
+		return false, nil, fmt.Errorf("missing 'allow' key in policy result")
+	}
+	allowed, ok := allowValue.(bool)
+	if !ok {
+		return false, nil, fmt.Errorf("unexpected 'allow' result type (expected bool, was %T)", allowValue)
+	}
+	return allowed, resultMap, nil
+}
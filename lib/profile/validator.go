@@ -0,0 +1,230 @@
+package profile
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/zorgbijjou/golang-fhir-models/fhir-models/fhir"
+)
+
+// Modes of profile validation, as configured for the components that validate resources.
+const (
+	// ValidationOff disables profile validation.
+	ValidationOff = "off"
+	// ValidationWarn reports resources that don't conform to their profile, but still accepts them.
+	ValidationWarn = "warn"
+	// ValidationReject rejects resources that don't conform to their profile.
+	ValidationReject = "reject"
+)
+
+// ParseValidationMode parses a configured profile validation mode. An empty mode means ValidationOff.
+func ParseValidationMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return ValidationOff, nil
+	case ValidationOff, ValidationWarn, ValidationReject:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid profile validation mode %q (valid: %s, %s, %s)", mode, ValidationOff, ValidationWarn, ValidationReject)
+}
+
+// definitions holds the StructureDefinitions that resources are validated against, and the ValueSets they bind to.
+// They aren't the published nl-gf profiles (http://nuts-foundation.github.io/nl-generic-functions-ig/StructureDefinition/nl-gf-*),
+// but hand-written subsets of their cardinalities and required bindings, with canonical URLs of their own.
+// The ValueSets hold the codes of the FHIR R4 (4.0.1) ValueSets they bind to.
+//
+//go:embed definitions/*.json
+var definitions embed.FS
+
+// ConformanceError is returned when a resource doesn't conform to its profile.
+type ConformanceError struct {
+	Profile string
+	Issues  []string
+}
+
+func (e ConformanceError) Error() string {
+	return fmt.Sprintf("resource doesn't conform to profile %s: %s", e.Profile, strings.Join(e.Issues, "; "))
+}
+
+// Validator validates resources against the embedded StructureDefinitions: it checks the cardinality of the constrained elements,
+// and whether coded elements with a required binding have a code from the bound ValueSet.
+// Slicing, invariants and extensible or preferred bindings aren't validated.
+type Validator struct {
+	// profiles holds the StructureDefinitions by the resource type they constrain
+	profiles  map[string]fhir.StructureDefinition
+	valueSets map[string]fhir.ValueSet
+}
+
+// NewValidator creates a Validator for the embedded StructureDefinitions.
+func NewValidator() (*Validator, error) {
+	result := &Validator{
+		profiles:  make(map[string]fhir.StructureDefinition),
+		valueSets: make(map[string]fhir.ValueSet),
+	}
+	files, err := fs.Glob(definitions, "definitions/*.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := definitions.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var resource struct {
+			ResourceType string `json:"resourceType"`
+		}
+		if err := json.Unmarshal(data, &resource); err != nil {
+			return nil, fmt.Errorf("invalid definition %s: %w", file, err)
+		}
+		switch resource.ResourceType {
+		case "StructureDefinition":
+			var structureDefinition fhir.StructureDefinition
+			if err := json.Unmarshal(data, &structureDefinition); err != nil {
+				return nil, fmt.Errorf("invalid StructureDefinition %s: %w", file, err)
+			}
+			result.profiles[structureDefinition.Type] = structureDefinition
+		case "ValueSet":
+			var valueSet fhir.ValueSet
+			if err := json.Unmarshal(data, &valueSet); err != nil {
+				return nil, fmt.Errorf("invalid ValueSet %s: %w", file, err)
+			}
+			if valueSet.Url != nil {
+				result.valueSets[*valueSet.Url] = valueSet
+			}
+		}
+	}
+	return result, nil
+}
+
+// Validate validates the given resource against the profile for its resource type.
+// It returns a ConformanceError if the resource doesn't conform, and nil if it does or there's no profile for its resource type.
+func (v *Validator) Validate(resourceJSON []byte) error {
+	var resource map[string]any
+	if err := json.Unmarshal(resourceJSON, &resource); err != nil {
+		return fmt.Errorf("failed to unmarshal resource: %w", err)
+	}
+	resourceType, _ := resource["resourceType"].(string)
+	structureDefinition, ok := v.profiles[resourceType]
+	if !ok || structureDefinition.Differential == nil {
+		return nil
+	}
+	var issues []string
+	for _, element := range structureDefinition.Differential.Element {
+		parentPath, name, ok := cutLast(element.Path)
+		if !ok {
+			continue
+		}
+		for _, parent := range resolvePath(resource, strings.Split(parentPath, ".")[1:]) {
+			values := asList(parent[name])
+			if element.Min != nil && len(values) < *element.Min {
+				issues = append(issues, fmt.Sprintf("%s: minimum required = %d, but only found %d", element.Path, *element.Min, len(values)))
+			}
+			if element.Max != nil && *element.Max != "*" {
+				if maxCount, err := strconv.Atoi(*element.Max); err == nil && len(values) > maxCount {
+					issues = append(issues, fmt.Sprintf("%s: maximum allowed = %d, but found %d", element.Path, maxCount, len(values)))
+				}
+			}
+			if element.Binding != nil && element.Binding.Strength == fhir.BindingStrengthRequired && element.Binding.ValueSet != nil {
+				for _, value := range values {
+					if !v.inValueSet(*element.Binding.ValueSet, value) {
+						issues = append(issues, fmt.Sprintf("%s: value %s is not in the required value set %s", element.Path, codeString(value), *element.Binding.ValueSet))
+					}
+				}
+			}
+		}
+	}
+	if len(issues) > 0 {
+		return ConformanceError{Profile: structureDefinition.Url, Issues: issues}
+	}
+	return nil
+}
+
+// inValueSet returns whether the given code, Coding or CodeableConcept is in the ValueSet with the given canonical URL.
+// A CodeableConcept is in the ValueSet if any of its codings is. Values bound to an unknown ValueSet are accepted.
+func (v *Validator) inValueSet(canonical string, value any) bool {
+	url, _, _ := strings.Cut(canonical, "|")
+	valueSet, ok := v.valueSets[url]
+	if !ok || valueSet.Compose == nil {
+		return true
+	}
+	switch value := value.(type) {
+	case string:
+		return includesCode(valueSet, "", value)
+	case map[string]any:
+		if codings, ok := value["coding"]; ok {
+			for _, coding := range asList(codings) {
+				if codingMap, ok := coding.(map[string]any); ok && v.inValueSet(canonical, codingMap) {
+					return true
+				}
+			}
+			return false
+		}
+		system, _ := value["system"].(string)
+		code, _ := value["code"].(string)
+		return includesCode(valueSet, system, code)
+	}
+	return false
+}
+
+// includesCode returns whether the ValueSet includes the code. If the system is empty (for an element of type code), any system matches.
+func includesCode(valueSet fhir.ValueSet, system string, code string) bool {
+	for _, include := range valueSet.Compose.Include {
+		if system != "" && (include.System == nil || *include.System != system) {
+			continue
+		}
+		if len(include.Concept) == 0 || slices.ContainsFunc(include.Concept, func(concept fhir.ValueSetComposeIncludeConcept) bool {
+			return concept.Code == code
+		}) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath returns the (complex) values at the given path of elements, starting at the given resource.
+func resolvePath(resource map[string]any, path []string) []map[string]any {
+	current := []map[string]any{resource}
+	for _, name := range path {
+		var next []map[string]any
+		for _, node := range current {
+			for _, child := range asList(node[name]) {
+				if childMap, ok := child.(map[string]any); ok {
+					next = append(next, childMap)
+				}
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+// asList returns the value of an element as list: repeating elements are arrays in JSON, others aren't.
+func asList(value any) []any {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case []any:
+		return value
+	}
+	return []any{value}
+}
+
+// cutLast splits an element path into the path of its parent and its name.
+func cutLast(path string) (string, string, bool) {
+	i := strings.LastIndex(path, ".")
+	if i == -1 {
+		return "", "", false
+	}
+	return path[:i], path[i+1:], true
+}
+
+// codeString returns a coded value for use in an issue.
+func codeString(value any) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
@@ -0,0 +1,75 @@
+package profile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const organizationSubsetProfile = "https://github.com/nuts-foundation/nuts-knooppunt/StructureDefinition/knooppunt-nl-gf-organization-subset"
+
+func TestValidator_Validate(t *testing.T) {
+	validator, err := NewValidator()
+	require.NoError(t, err)
+
+	t.Run("conforming resources", func(t *testing.T) {
+		for name, resource := range map[string]string{
+			"Organization":      `{"resourceType":"Organization","name":"Example","identifier":[{"system":"http://fhir.nl/fhir/NamingSystem/ura","value":"1234"}]}`,
+			"Endpoint":          `{"resourceType":"Endpoint","status":"active","connectionType":{"system":"http://terminology.hl7.org/CodeSystem/endpoint-connection-type","code":"hl7-fhir-rest"},"payloadType":[{"text":"mCSD"}],"address":"https://example.com/fhir"}`,
+			"Location":          `{"resourceType":"Location","name":"Example","status":"active","mode":"instance"}`,
+			"HealthcareService": `{"resourceType":"HealthcareService","name":"Example","providedBy":{"reference":"Organization/1"}}`,
+			"no profile":        `{"resourceType":"Practitioner"}`,
+		} {
+			t.Run(name, func(t *testing.T) {
+				assert.NoError(t, validator.Validate([]byte(resource)))
+			})
+		}
+	})
+	t.Run("missing required element", func(t *testing.T) {
+		err := validator.Validate([]byte(`{"resourceType":"Organization"}`))
+
+		var conformanceErr ConformanceError
+		require.ErrorAs(t, err, &conformanceErr)
+		assert.Equal(t, organizationSubsetProfile, conformanceErr.Profile)
+		assert.Equal(t, []string{"Organization.name: minimum required = 1, but only found 0"}, conformanceErr.Issues)
+	})
+	t.Run("missing required element of a complex element", func(t *testing.T) {
+		err := validator.Validate([]byte(`{"resourceType":"Organization","name":"Example","identifier":[{"value":"1234"}]}`))
+
+		assert.EqualError(t, err, "resource doesn't conform to profile "+organizationSubsetProfile+": Organization.identifier.system: minimum required = 1, but only found 0")
+	})
+	t.Run("too many values", func(t *testing.T) {
+		err := validator.Validate([]byte(`{"resourceType":"HealthcareService","name":"Example","providedBy":[{"reference":"Organization/1"},{"reference":"Organization/2"}]}`))
+
+		assert.ErrorContains(t, err, "HealthcareService.providedBy: maximum allowed = 1, but found 2")
+	})
+	t.Run("code not in required value set", func(t *testing.T) {
+		err := validator.Validate([]byte(`{"resourceType":"Location","name":"Example","status":"closed"}`))
+
+		assert.ErrorContains(t, err, `Location.status: value "closed" is not in the required value set http://hl7.org/fhir/ValueSet/location-status|4.0.1`)
+	})
+	t.Run("multiple issues", func(t *testing.T) {
+		err := validator.Validate([]byte(`{"resourceType":"Endpoint","status":"unknown","payloadType":[]}`))
+
+		var conformanceErr ConformanceError
+		require.ErrorAs(t, err, &conformanceErr)
+		assert.Len(t, conformanceErr.Issues, 4)
+	})
+	t.Run("invalid JSON", func(t *testing.T) {
+		assert.Error(t, validator.Validate([]byte(`{`)))
+	})
+}
+
+func TestParseValidationMode(t *testing.T) {
+	mode, err := ParseValidationMode("")
+	require.NoError(t, err)
+	assert.Equal(t, ValidationOff, mode)
+
+	mode, err = ParseValidationMode(ValidationReject)
+	require.NoError(t, err)
+	assert.Equal(t, ValidationReject, mode)
+
+	_, err = ParseValidationMode("strict")
+	assert.EqualError(t, err, `invalid profile validation mode "strict" (valid: off, warn, reject)`)
+}
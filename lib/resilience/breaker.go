@@ -0,0 +1,127 @@
+package resilience
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a circuit breaker.
+const (
+	// StateClosed means requests are sent to the host.
+	StateClosed = "closed"
+	// StateOpen means requests to the host are rejected, because it failed too often.
+	StateOpen = "open"
+	// StateHalfOpen means a single request is sent to the host, to probe whether it recovered.
+	StateHalfOpen = "half-open"
+)
+
+// BreakerState describes the circuit breaker of a host.
+type BreakerState struct {
+	Host  string `json:"host"`
+	State string `json:"state"`
+	// ConsecutiveFailures is the number of failed requests since the last successful one.
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	// LastFailure describes the last failure, if any.
+	LastFailure string `json:"lastFailure,omitempty"`
+	// OpenUntil is when an open circuit breaker lets a request through to probe the host.
+	OpenUntil *time.Time `json:"openUntil,omitempty"`
+}
+
+// breaker is the circuit breaker of a single host. It opens after a number of consecutive failures, rejecting requests for the cooldown period.
+// After that, a single request is let through: if it succeeds the breaker closes, otherwise it opens again.
+type breaker struct {
+	host      string
+	threshold int
+	cooldown  time.Duration
+
+	mux                 sync.Mutex
+	consecutiveFailures int
+	lastFailure         string
+	openedAt            time.Time
+	// probing is set while the request that probes whether the host recovered is in flight
+	probing bool
+}
+
+// allow returns an error if a request to the host must not be sent.
+func (b *breaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	switch b.stateLocked(time.Now()) {
+	case StateOpen:
+		return fmt.Errorf("%w for %s until %s (last failure: %s)", ErrCircuitOpen, b.host, b.openedAt.Add(b.cooldown).Format(time.RFC3339), b.lastFailure)
+	case StateHalfOpen:
+		if b.probing {
+			return fmt.Errorf("%w for %s, probing whether it recovered (last failure: %s)", ErrCircuitOpen, b.host, b.lastFailure)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record records the outcome of a request. A request that was cancelled by the caller neither counts as success nor as failure.
+func (b *breaker) record(failed bool, reason string, cancelled bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	wasProbing := b.probing
+	b.probing = false
+	if !failed {
+		if cancelled {
+			return
+		}
+		if b.consecutiveFailures >= b.threshold {
+			slog.Info("Circuit breaker closed, host recovered", slog.String("host", b.host))
+		}
+		b.consecutiveFailures = 0
+		b.openedAt = time.Time{}
+		return
+	}
+	b.consecutiveFailures++
+	b.lastFailure = reason
+	if b.consecutiveFailures == b.threshold || wasProbing {
+		b.openedAt = time.Now()
+		slog.Warn("Circuit breaker opened, rejecting requests to host", slog.String("host", b.host),
+			slog.Int("consecutiveFailures", b.consecutiveFailures), slog.Duration("cooldown", b.cooldown), slog.String("lastFailure", reason))
+	}
+}
+
+func (b *breaker) stateLocked(now time.Time) string {
+	if b.openedAt.IsZero() {
+		return StateClosed
+	}
+	if now.Before(b.openedAt.Add(b.cooldown)) {
+		return StateOpen
+	}
+	return StateHalfOpen
+}
+
+func (b *breaker) state() BreakerState {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	result := BreakerState{
+		Host:                b.host,
+		State:               b.stateLocked(time.Now()),
+		ConsecutiveFailures: b.consecutiveFailures,
+		LastFailure:         b.lastFailure,
+	}
+	if result.State != StateClosed {
+		openUntil := b.openedAt.Add(b.cooldown)
+		result.OpenUntil = &openUntil
+	}
+	return result
+}
+
+func sortStates(states []BreakerState) {
+	slices.SortFunc(states, func(a, b BreakerState) int {
+		return strings.Compare(a.Host, b.Host)
+	})
+}
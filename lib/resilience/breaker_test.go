@@ -0,0 +1,74 @@
+package resilience
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayer_circuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	config := testConfig()
+	config.MaxRetries = 0
+	config.BreakerThreshold = 2
+	config.BreakerCooldown = 50 * time.Millisecond
+	layer := New(config)
+	client := &http.Client{Transport: layer.Wrap(nil)}
+	get := func() (*http.Response, error) {
+		response, err := client.Get(server.URL)
+		if err == nil {
+			_ = response.Body.Close()
+		}
+		return response, err
+	}
+
+	// Opens after 2 consecutive failures
+	for range 2 {
+		_, err := get()
+		require.NoError(t, err)
+	}
+	_, err := get()
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, int32(2), requests.Load(), "requests must not be sent while the breaker is open")
+	states := layer.BreakerStates()
+	require.Len(t, states, 1)
+	assert.Equal(t, strings.TrimPrefix(server.URL, "http://"), states[0].Host)
+	assert.Equal(t, StateOpen, states[0].State)
+	assert.Equal(t, 2, states[0].ConsecutiveFailures)
+	assert.Equal(t, "status 503", states[0].LastFailure)
+	assert.NotNil(t, states[0].OpenUntil)
+
+	// A failed probe opens it again
+	time.Sleep(config.BreakerCooldown)
+	assert.Equal(t, StateHalfOpen, layer.BreakerStates()[0].State)
+	_, err = get()
+	require.NoError(t, err)
+	_, err = get()
+	require.ErrorIs(t, err, ErrCircuitOpen)
+
+	// A successful probe closes it
+	failing.Store(false)
+	time.Sleep(config.BreakerCooldown)
+	response, err := get()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	states = layer.BreakerStates()
+	assert.Equal(t, StateClosed, states[0].State)
+	assert.Zero(t, states[0].ConsecutiveFailures)
+	assert.Nil(t, states[0].OpenUntil)
+}
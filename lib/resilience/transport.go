@@ -0,0 +1,306 @@
+// Package resilience makes outbound HTTP requests resilient to transient failures of the servers they're sent to:
+// it limits the duration of requests, retries idempotent requests with jittered exponential backoff (honouring Retry-After),
+// and stops sending requests to a host that keeps failing through a circuit breaker per host.
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config configures the resilience of outbound HTTP requests.
+type Config struct {
+	// Timeout is the maximum duration of a single attempt of a request, including reading the response body. Zero means no timeout.
+	Timeout time.Duration `koanf:"timeout"`
+	// MaxRetries is the maximum number of times an idempotent request is retried after a transient failure. Zero disables retries.
+	MaxRetries int `koanf:"maxretries"`
+	// RetryBackoff is the delay before the first retry. It doubles for every next retry, and is randomized (jitter) to spread load.
+	RetryBackoff time.Duration `koanf:"retrybackoff"`
+	// MaxRetryBackoff is the maximum delay before a retry. A request isn't retried if the server asks (through Retry-After) to wait longer.
+	MaxRetryBackoff time.Duration `koanf:"maxretrybackoff"`
+	// BreakerThreshold is the number of consecutive failures after which the circuit breaker of a host opens. Zero disables circuit breaking.
+	BreakerThreshold int `koanf:"breakerthreshold"`
+	// BreakerCooldown is how long an open circuit breaker rejects requests, before a single request is let through to probe the host.
+	BreakerCooldown time.Duration `koanf:"breakercooldown"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Timeout:          2 * time.Minute,
+		MaxRetries:       3,
+		RetryBackoff:     500 * time.Millisecond,
+		MaxRetryBackoff:  30 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+}
+
+// ErrCircuitOpen is returned for requests to a host of which the circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// retryableStatusCodes are the response statuses that indicate a transient failure of the server.
+var retryableStatusCodes = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// Layer adds resilience to HTTP transports. The circuit breakers are shared by all transports wrapped by the same Layer,
+// so a failing host is recognized regardless of which component talks to it.
+type Layer struct {
+	config   Config
+	mux      sync.Mutex
+	breakers map[string]*breaker
+}
+
+// New creates a Layer with the given configuration.
+func New(config Config) *Layer {
+	return &Layer{
+		config:   config,
+		breakers: make(map[string]*breaker),
+	}
+}
+
+// Wrap returns a transport that sends requests through the given transport, resiliently.
+// Pass nil to use http.DefaultTransport.
+func (l *Layer) Wrap(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &transport{layer: l, next: next}
+}
+
+// WrapStreaming is like Wrap, but without the per-attempt timeout: it's meant for downloading large bodies (e.g. bulk export files),
+// which could take longer than the timeout to read. Requests are only bounded by their context.
+func (l *Layer) WrapStreaming(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &transport{layer: l, next: next, streaming: true}
+}
+
+// BreakerStates returns the state of the circuit breakers of all hosts requests were sent to, sorted by host.
+func (l *Layer) BreakerStates() []BreakerState {
+	l.mux.Lock()
+	breakers := make([]*breaker, 0, len(l.breakers))
+	for _, b := range l.breakers {
+		breakers = append(breakers, b)
+	}
+	l.mux.Unlock()
+	result := make([]BreakerState, 0, len(breakers))
+	for _, b := range breakers {
+		result = append(result, b.state())
+	}
+	sortStates(result)
+	return result
+}
+
+func (l *Layer) breaker(host string) *breaker {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	b, ok := l.breakers[host]
+	if !ok {
+		b = &breaker{host: host, threshold: l.config.BreakerThreshold, cooldown: l.config.BreakerCooldown}
+		l.breakers[host] = b
+	}
+	return b
+}
+
+type transport struct {
+	layer *Layer
+	next  http.RoundTripper
+	// streaming disables the per-attempt timeout
+	streaming bool
+}
+
+func (t *transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	config := t.layer.config
+	b := t.layer.breaker(request.URL.Host)
+	retryable := isIdempotent(request) && (request.Body == nil || request.Body == http.NoBody || request.GetBody != nil)
+	for attempt := 0; ; attempt++ {
+		if err := b.allow(); err != nil {
+			return nil, err
+		}
+		attemptRequest, err := prepareAttempt(request, attempt)
+		if err != nil {
+			return nil, err
+		}
+		response, err := t.attempt(attemptRequest)
+		failed, reason := isTransientFailure(request, response, err)
+		b.record(failed, reason, request.Context().Err() != nil)
+		if !failed || !retryable || attempt >= config.MaxRetries {
+			return response, err
+		}
+		delay, ok := retryDelay(config, attempt, response)
+		if !ok {
+			return response, err
+		}
+		slog.DebugContext(request.Context(), "Retrying HTTP request after transient failure",
+			slog.String("method", request.Method), slog.String("url", request.URL.Redacted()),
+			slog.Int("attempt", attempt+1), slog.Duration("delay", delay), slog.String("reason", reason))
+		if response != nil {
+			// Drain the body, so the connection can be reused
+			_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+			_ = response.Body.Close()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-request.Context().Done():
+			timer.Stop()
+			return nil, request.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt sends the request once, limited by the configured timeout (unless streaming).
+func (t *transport) attempt(request *http.Request) (*http.Response, error) {
+	if t.layer.config.Timeout <= 0 || t.streaming {
+		return t.next.RoundTrip(request)
+	}
+	ctx, cancel := context.WithTimeout(request.Context(), t.layer.config.Timeout)
+	response, err := t.next.RoundTrip(request.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The timeout also applies to reading the body, so it's only released when the body is closed
+	response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+// prepareAttempt returns the request to send for the given attempt: retries need a fresh copy of the request body.
+func prepareAttempt(request *http.Request, attempt int) (*http.Request, error) {
+	if attempt == 0 || request.GetBody == nil {
+		return request, nil
+	}
+	body, err := request.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("failed to rewind request body for retry: %w", err)
+	}
+	result := request.Clone(request.Context())
+	result.Body = body
+	return result, nil
+}
+
+// isIdempotent returns whether the request can safely be sent more than once, like net/http determines it for its own retries.
+func isIdempotent(request *http.Request) bool {
+	switch request.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return request.Header.Get("Idempotency-Key") != "" || request.Header.Get("X-Idempotency-Key") != ""
+}
+
+// isTransientFailure returns whether the outcome of an attempt indicates the server is (temporarily) unable to handle requests, and why.
+// Failures caused by the caller cancelling the request don't count.
+func isTransientFailure(request *http.Request, response *http.Response, err error) (bool, string) {
+	if err != nil {
+		if request.Context().Err() != nil {
+			return false, ""
+		}
+		return true, err.Error()
+	}
+	if retryableStatusCodes[response.StatusCode] {
+		return true, "status " + strconv.Itoa(response.StatusCode)
+	}
+	return false, ""
+}
+
+// retryDelay returns how long to wait before retrying, and false if the server asked to wait longer than the maximum backoff.
+func retryDelay(config Config, attempt int, response *http.Response) (time.Duration, bool) {
+	if response != nil {
+		if retryAfter, ok := parseRetryAfter(response.Header.Get("Retry-After")); ok {
+			if config.MaxRetryBackoff > 0 && retryAfter > config.MaxRetryBackoff {
+				return 0, false
+			}
+			return retryAfter, true
+		}
+	}
+	backoff := config.RetryBackoff << attempt
+	if backoff <= 0 || (config.MaxRetryBackoff > 0 && backoff > config.MaxRetryBackoff) {
+		backoff = config.MaxRetryBackoff
+	}
+	if backoff <= 0 {
+		return 0, true
+	}
+	// Full backoff would make clients that failed at the same time retry at the same time: wait between half and the full backoff
+	return backoff/2 + rand.N(backoff/2+1), true
+}
+
+// parseRetryAfter parses a Retry-After header, which holds either a number of seconds or an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// defaultLayer is the Layer used by WrapTransport, set by Configure.
+var defaultLayer atomic.Pointer[Layer]
+
+// Configure sets up the Layer used by WrapTransport and BreakerStates. It must be called before the HTTP clients are created,
+// since transports wrapped before are left as they are.
+func Configure(config Config) *Layer {
+	layer := New(config)
+	defaultLayer.Store(layer)
+	slog.Debug("Configured resilience of outbound HTTP requests", slog.Duration("timeout", config.Timeout), slog.Int("maxRetries", config.MaxRetries), slog.Int("breakerThreshold", config.BreakerThreshold))
+	return layer
+}
+
+// WrapTransport wraps the given transport with the Layer set up by Configure. If it isn't configured (e.g. in tests),
+// the transport is returned as-is (or http.DefaultTransport if nil).
+func WrapTransport(next http.RoundTripper) http.RoundTripper {
+	if layer := defaultLayer.Load(); layer != nil {
+		return layer.Wrap(next)
+	}
+	if next == nil {
+		return http.DefaultTransport
+	}
+	return next
+}
+
+// WrapStreamingTransport is like WrapTransport, but without the per-attempt timeout (see Layer.WrapStreaming).
+func WrapStreamingTransport(next http.RoundTripper) http.RoundTripper {
+	if layer := defaultLayer.Load(); layer != nil {
+		return layer.WrapStreaming(next)
+	}
+	if next == nil {
+		return http.DefaultTransport
+	}
+	return next
+}
+
+// BreakerStates returns the state of the circuit breakers of the Layer set up by Configure.
+func BreakerStates() []BreakerState {
+	if layer := defaultLayer.Load(); layer != nil {
+		return layer.BreakerStates()
+	}
+	return []BreakerState{}
+}
@@ -0,0 +1,207 @@
+package resilience
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig() Config {
+	return Config{
+		MaxRetries:       2,
+		RetryBackoff:     time.Millisecond,
+		MaxRetryBackoff:  10 * time.Millisecond,
+		BreakerThreshold: 10,
+		BreakerCooldown:  time.Minute,
+	}
+}
+
+// newFlakyServer returns a server that responds with the given statuses in order, then 200 OK, and a counter of its requests.
+func newFlakyServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := int(requests.Add(1))
+		if r.Body != nil {
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Request-Body", string(body))
+		}
+		if count <= len(statuses) {
+			w.WriteHeader(statuses[count-1])
+			return
+		}
+		_, _ = w.Write([]byte("OK"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestLayer_retries(t *testing.T) {
+	t.Run("retries transient failures of idempotent requests", func(t *testing.T) {
+		server, requests := newFlakyServer(t, http.StatusServiceUnavailable, http.StatusBadGateway)
+		client := &http.Client{Transport: New(testConfig()).Wrap(nil)}
+
+		response, err := client.Get(server.URL)
+
+		require.NoError(t, err)
+		_ = response.Body.Close()
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, int32(3), requests.Load())
+	})
+	t.Run("gives up after the maximum number of retries", func(t *testing.T) {
+		server, requests := newFlakyServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+		client := &http.Client{Transport: New(testConfig()).Wrap(nil)}
+
+		response, err := client.Get(server.URL)
+
+		require.NoError(t, err)
+		_ = response.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+		assert.Equal(t, int32(3), requests.Load())
+	})
+	t.Run("retries PUT with its body", func(t *testing.T) {
+		server, requests := newFlakyServer(t, http.StatusTooManyRequests)
+		client := &http.Client{Transport: New(testConfig()).Wrap(nil)}
+		request, _ := http.NewRequest(http.MethodPut, server.URL, strings.NewReader(`{"resourceType":"Organization"}`))
+
+		response, err := client.Do(request)
+
+		require.NoError(t, err)
+		_ = response.Body.Close()
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, `{"resourceType":"Organization"}`, response.Header.Get("X-Request-Body"))
+		assert.Equal(t, int32(2), requests.Load())
+	})
+	t.Run("doesn't retry POST", func(t *testing.T) {
+		server, requests := newFlakyServer(t, http.StatusServiceUnavailable)
+		client := &http.Client{Transport: New(testConfig()).Wrap(nil)}
+
+		response, err := client.Post(server.URL, "application/fhir+json", strings.NewReader(`{}`))
+
+		require.NoError(t, err)
+		_ = response.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+		assert.Equal(t, int32(1), requests.Load())
+	})
+	t.Run("doesn't retry other errors", func(t *testing.T) {
+		server, requests := newFlakyServer(t, http.StatusInternalServerError)
+		client := &http.Client{Transport: New(testConfig()).Wrap(nil)}
+
+		response, err := client.Get(server.URL)
+
+		require.NoError(t, err)
+		_ = response.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, response.StatusCode)
+		assert.Equal(t, int32(1), requests.Load())
+	})
+	t.Run("doesn't wait longer than the maximum backoff for Retry-After", func(t *testing.T) {
+		var requests atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer server.Close()
+		client := &http.Client{Transport: New(testConfig()).Wrap(nil)}
+
+		response, err := client.Get(server.URL)
+
+		require.NoError(t, err)
+		_ = response.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+		assert.Equal(t, int32(1), requests.Load())
+	})
+	t.Run("stops retrying when the request is cancelled", func(t *testing.T) {
+		server, _ := newFlakyServer(t, http.StatusServiceUnavailable)
+		config := testConfig()
+		config.RetryBackoff = time.Hour
+		config.MaxRetryBackoff = time.Hour
+		client := &http.Client{Transport: New(config).Wrap(nil)}
+		ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+		defer cancel()
+		request, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+
+		_, err := client.Do(request)
+
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestLayer_timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+	config := testConfig()
+	config.Timeout = 20 * time.Millisecond
+	config.MaxRetries = 0
+	client := &http.Client{Transport: New(config).Wrap(nil)}
+
+	_, err := client.Get(server.URL)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	t.Run("streaming", func(t *testing.T) {
+		// The body is written slower than the timeout
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for range 3 {
+				_, _ = w.Write([]byte("chunk"))
+				w.(http.Flusher).Flush()
+				time.Sleep(20 * time.Millisecond)
+			}
+		}))
+		defer server.Close()
+		client := &http.Client{Transport: New(config).WrapStreaming(nil)}
+
+		response, err := client.Get(server.URL)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+
+		require.NoError(t, err)
+		assert.Equal(t, "chunkchunkchunk", string(body))
+	})
+}
+
+func TestWrapTransport(t *testing.T) {
+	// Not configured: transports are left as-is
+	transport := &http.Transport{}
+	assert.Same(t, transport, WrapTransport(transport))
+	assert.Equal(t, http.DefaultTransport, WrapTransport(nil))
+	assert.Same(t, transport, WrapStreamingTransport(transport))
+	assert.Empty(t, BreakerStates())
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	delay, ok := parseRetryAfter("3")
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, delay)
+
+	delay, ok = parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.InDelta(t, time.Hour, delay, float64(2*time.Second))
+
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok)
+}
+
+func TestRetryDelay(t *testing.T) {
+	config := Config{RetryBackoff: 100 * time.Millisecond, MaxRetryBackoff: time.Second}
+	for attempt, expectedBackoff := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		delay, ok := retryDelay(config, attempt, nil)
+		assert.True(t, ok)
+		assert.GreaterOrEqual(t, delay, expectedBackoff/2)
+		assert.LessOrEqual(t, delay, expectedBackoff)
+	}
+}
@@ -0,0 +1,146 @@
+// Package scheduler runs a task periodically in the background. It supports an initial delay after
+// start, random jitter on every delay (so multiple replicas don't hit the same servers at the same
+// moment) and exponential backoff after failed runs.
+package scheduler
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/nuts-foundation/nuts-knooppunt/lib/logging"
+)
+
+// Config configures a schedule. The zero value is a disabled schedule.
+type Config struct {
+	// Interval is the time between the end of one run and the start of the next. Zero disables the schedule.
+	Interval time.Duration `koanf:"interval"`
+	// Jitter is the maximum random duration added to every delay.
+	Jitter time.Duration `koanf:"jitter"`
+	// InitialDelay is the time between starting the scheduler and the first run.
+	InitialDelay time.Duration `koanf:"initialdelay"`
+	// MaxBackoff caps the delay after consecutive failed runs: every consecutive failure doubles the
+	// interval, up to MaxBackoff. If it is not greater than Interval, failed runs don't slow down the schedule.
+	MaxBackoff time.Duration `koanf:"maxbackoff"`
+}
+
+// Enabled returns true if the schedule should run at all.
+func (c Config) Enabled() bool {
+	return c.Interval > 0
+}
+
+// Task is the work performed on every run. A returned error counts as a failed run.
+type Task func(ctx context.Context) error
+
+// Scheduler runs a Task according to a Config. Runs never overlap: the next run is scheduled after
+// the previous one has finished.
+type Scheduler struct {
+	name   string
+	config Config
+	task   Task
+
+	mux    sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	// jitterFn returns a random duration in [0, n). It can be replaced in tests.
+	jitterFn func(n time.Duration) time.Duration
+}
+
+// New creates a scheduler for the given task. The name is used for logging only.
+func New(name string, config Config, task Task) *Scheduler {
+	return &Scheduler{
+		name:   name,
+		config: config,
+		task:   task,
+		jitterFn: func(n time.Duration) time.Duration {
+			return rand.N(n)
+		},
+	}
+}
+
+// Start starts running the task in the background. It is a no-op if the schedule is disabled or already started.
+func (s *Scheduler) Start() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.config.Enabled() {
+		slog.Info("Scheduled task is disabled (no interval configured)", slog.String("task", s.name))
+		return
+	}
+	if s.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	slog.Info("Starting scheduled task", slog.String("task", s.name),
+		slog.Duration("interval", s.config.Interval),
+		slog.Duration("initial_delay", s.config.InitialDelay))
+	go s.loop(ctx, s.done)
+}
+
+// Stop cancels any running task and waits for it to return, or until the given context expires.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.mux.Lock()
+	cancel, done := s.cancel, s.done
+	s.cancel, s.done = nil, nil
+	s.mux.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	timer := time.NewTimer(s.delay(s.config.InitialDelay))
+	defer timer.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		start := time.Now()
+		if err := s.task(ctx); err != nil {
+			if ctx.Err() != nil {
+				// Stopped while running, not a failure of the task itself
+				return
+			}
+			failures++
+			slog.ErrorContext(ctx, "Scheduled task failed", slog.String("task", s.name), slog.Int("consecutive_failures", failures), logging.Error(err))
+		} else {
+			failures = 0
+			slog.DebugContext(ctx, "Scheduled task completed", slog.String("task", s.name), slog.Duration("duration", time.Since(start)))
+		}
+		timer.Reset(s.delay(s.backoff(failures)))
+	}
+}
+
+// backoff returns the interval to wait after the given number of consecutive failed runs.
+func (s *Scheduler) backoff(failures int) time.Duration {
+	result := s.config.Interval
+	for i := 0; i < failures && result < s.config.MaxBackoff; i++ {
+		result *= 2
+	}
+	if failures > 0 && s.config.MaxBackoff > s.config.Interval {
+		result = min(result, s.config.MaxBackoff)
+	}
+	return result
+}
+
+// delay adds the configured jitter to the given duration.
+func (s *Scheduler) delay(d time.Duration) time.Duration {
+	if s.config.Jitter > 0 {
+		d += s.jitterFn(s.config.Jitter)
+	}
+	return d
+}
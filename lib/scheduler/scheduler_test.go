@@ -0,0 +1,117 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduler_Start(t *testing.T) {
+	t.Run("runs the task repeatedly", func(t *testing.T) {
+		var runs atomic.Int32
+		s := New("test", Config{Interval: 5 * time.Millisecond}, func(ctx context.Context) error {
+			runs.Add(1)
+			return nil
+		})
+		s.Start()
+		defer s.Stop(context.Background())
+
+		require.Eventually(t, func() bool {
+			return runs.Load() >= 3
+		}, time.Second, time.Millisecond)
+	})
+	t.Run("disabled schedule doesn't run", func(t *testing.T) {
+		var runs atomic.Int32
+		s := New("test", Config{}, func(ctx context.Context) error {
+			runs.Add(1)
+			return nil
+		})
+		s.Start()
+		time.Sleep(20 * time.Millisecond)
+		require.NoError(t, s.Stop(context.Background()))
+
+		assert.Zero(t, runs.Load())
+	})
+	t.Run("waits for the initial delay", func(t *testing.T) {
+		var runs atomic.Int32
+		s := New("test", Config{Interval: time.Millisecond, InitialDelay: time.Hour}, func(ctx context.Context) error {
+			runs.Add(1)
+			return nil
+		})
+		s.Start()
+		time.Sleep(20 * time.Millisecond)
+		require.NoError(t, s.Stop(context.Background()))
+
+		assert.Zero(t, runs.Load())
+	})
+}
+
+func TestScheduler_Stop(t *testing.T) {
+	t.Run("cancels a running task and waits for it", func(t *testing.T) {
+		started := make(chan struct{})
+		var cancelled atomic.Bool
+		s := New("test", Config{Interval: time.Millisecond}, func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			cancelled.Store(true)
+			return ctx.Err()
+		})
+		s.Start()
+		<-started
+
+		require.NoError(t, s.Stop(context.Background()))
+		assert.True(t, cancelled.Load())
+	})
+	t.Run("returns when the context expires", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		defer close(release)
+		s := New("test", Config{Interval: time.Millisecond}, func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		})
+		s.Start()
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, s.Stop(ctx), context.DeadlineExceeded)
+	})
+	t.Run("not started", func(t *testing.T) {
+		s := New("test", Config{Interval: time.Millisecond}, func(ctx context.Context) error {
+			return errors.New("should not run")
+		})
+		assert.NoError(t, s.Stop(context.Background()))
+	})
+}
+
+func TestScheduler_backoff(t *testing.T) {
+	t.Run("doubles the interval per consecutive failure, up to the max", func(t *testing.T) {
+		s := New("test", Config{Interval: time.Minute, MaxBackoff: 10 * time.Minute}, nil)
+		assert.Equal(t, time.Minute, s.backoff(0))
+		assert.Equal(t, 2*time.Minute, s.backoff(1))
+		assert.Equal(t, 4*time.Minute, s.backoff(2))
+		assert.Equal(t, 8*time.Minute, s.backoff(3))
+		assert.Equal(t, 10*time.Minute, s.backoff(4))
+		assert.Equal(t, 10*time.Minute, s.backoff(100))
+	})
+	t.Run("no backoff if max is not greater than the interval", func(t *testing.T) {
+		s := New("test", Config{Interval: time.Minute}, nil)
+		assert.Equal(t, time.Minute, s.backoff(5))
+	})
+}
+
+func TestScheduler_delay(t *testing.T) {
+	s := New("test", Config{Interval: time.Minute, Jitter: time.Second}, nil)
+	for i := 0; i < 100; i++ {
+		d := s.delay(time.Minute)
+		assert.GreaterOrEqual(t, d, time.Minute)
+		assert.Less(t, d, time.Minute+time.Second)
+	}
+}
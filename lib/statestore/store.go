@@ -0,0 +1,295 @@
+// Package statestore provides key/value stores for component state that should survive restarts,
+// e.g. synchronization timestamps. Values are stored as JSON, grouped in named buckets.
+package statestore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+	bbolterrors "go.etcd.io/bbolt/errors"
+)
+
+// Store is a key/value store, in which keys are grouped into buckets.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Get reads the value stored under the given key into target.
+	// It returns false if the bucket or key does not exist.
+	Get(bucket, key string, target any) (bool, error)
+	// Put stores the value under the given key, creating the bucket if it does not exist.
+	Put(bucket, key string, value any) error
+	// PutAll stores all given values (by key) at once, creating the bucket if it does not exist.
+	// Prefer it over repeated calls to Put when storing many values, since every write may sync to disk.
+	PutAll(bucket string, values map[string]any) error
+	// Delete removes the given key. It is not an error if the key does not exist.
+	Delete(bucket, key string) error
+	// DeleteBucket removes the bucket and all keys in it. It is not an error if the bucket does not exist.
+	DeleteBucket(bucket string) error
+	// Walk calls fn for every key in the bucket, in lexicographical key order.
+	// Walking stops when fn returns an error, which is then returned.
+	Walk(bucket string, fn func(key string, value []byte) error) error
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// Open opens the store for the given file. If the path is empty, an in-memory store is returned,
+// of which the state is lost on restart.
+func Open(path string) (Store, error) {
+	if path == "" {
+		return NewMemoryStore(), nil
+	}
+	return NewBBoltStore(path)
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// MemoryStore is a Store that keeps its state in memory only.
+type MemoryStore struct {
+	mux     sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]map[string][]byte),
+	}
+}
+
+func (m *MemoryStore) Get(bucket, key string, target any) (bool, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	data, ok := m.buckets[bucket][key]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, target); err != nil {
+		return false, fmt.Errorf("unmarshal state (bucket=%s, key=%s): %w", bucket, key, err)
+	}
+	return true, nil
+}
+
+func (m *MemoryStore) Put(bucket, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("marshal state (bucket=%s, key=%s): %w", bucket, key, err)
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.buckets[bucket] == nil {
+		m.buckets[bucket] = make(map[string][]byte)
+	}
+	m.buckets[bucket][key] = data
+	return nil
+}
+
+func (m *MemoryStore) PutAll(bucket string, values map[string]any) error {
+	data := make(map[string][]byte, len(values))
+	for key, value := range values {
+		valueData, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("marshal state (bucket=%s, key=%s): %w", bucket, key, err)
+		}
+		data[key] = valueData
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.buckets[bucket] == nil {
+		m.buckets[bucket] = make(map[string][]byte)
+	}
+	for key, valueData := range data {
+		m.buckets[bucket][key] = valueData
+	}
+	return nil
+}
+
+func (m *MemoryStore) Delete(bucket, key string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+func (m *MemoryStore) DeleteBucket(bucket string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	delete(m.buckets, bucket)
+	return nil
+}
+
+func (m *MemoryStore) Walk(bucket string, fn func(key string, value []byte) error) error {
+	// Copy the bucket, so fn can modify the store while walking
+	m.mux.RLock()
+	keys := make([]string, 0, len(m.buckets[bucket]))
+	values := make(map[string][]byte, len(m.buckets[bucket]))
+	for key, value := range m.buckets[bucket] {
+		keys = append(keys, key)
+		values[key] = value
+	}
+	m.mux.RUnlock()
+	slices.Sort(keys)
+	for _, key := range keys {
+		if err := fn(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+var _ Store = (*BBoltStore)(nil)
+
+// BBoltStore is a Store that persists its state in an embedded bbolt database file.
+type BBoltStore struct {
+	db *bbolt.DB
+}
+
+// NewBBoltStore opens (or creates) the bbolt database at the given path.
+// The file is locked while open, so it can't be shared by multiple processes or components.
+func NewBBoltStore(path string) (*BBoltStore, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("create state directory (path=%s): %w", dir, err)
+		}
+	}
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open state file (path=%s): %w", path, err)
+	}
+	return &BBoltStore{db: db}, nil
+}
+
+func (b *BBoltStore) Get(bucket, key string, target any) (bool, error) {
+	var data []byte
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		if value := bkt.Get([]byte(key)); value != nil {
+			// Value is only valid during the transaction
+			data = slices.Clone(value)
+		}
+		return nil
+	})
+	if err != nil || data == nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, target); err != nil {
+		return false, fmt.Errorf("unmarshal state (bucket=%s, key=%s): %w", bucket, key, err)
+	}
+	return true, nil
+}
+
+func (b *BBoltStore) Put(bucket, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("marshal state (bucket=%s, key=%s): %w", bucket, key, err)
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(key), data)
+	})
+}
+
+func (b *BBoltStore) PutAll(bucket string, values map[string]any) error {
+	data := make(map[string][]byte, len(values))
+	for key, value := range values {
+		valueData, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("marshal state (bucket=%s, key=%s): %w", bucket, key, err)
+		}
+		data[key] = valueData
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for key, valueData := range data {
+			if err := bkt.Put([]byte(key), valueData); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BBoltStore) Delete(bucket, key string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.Delete([]byte(key))
+	})
+}
+
+func (b *BBoltStore) DeleteBucket(bucket string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := tx.DeleteBucket([]byte(bucket))
+		if errors.Is(err, bbolterrors.ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+// walkBatchSize is the number of entries BBoltStore.Walk reads per read transaction.
+const walkBatchSize = 500
+
+func (b *BBoltStore) Walk(bucket string, fn func(key string, value []byte) error) error {
+	// Read entries in batches outside fn, so fn can modify the store while walking (bbolt doesn't allow nested write transactions),
+	// without reading large buckets into memory at once.
+	var after []byte
+	for {
+		var keys []string
+		var values [][]byte
+		err := b.db.View(func(tx *bbolt.Tx) error {
+			bkt := tx.Bucket([]byte(bucket))
+			if bkt == nil {
+				return nil
+			}
+			cursor := bkt.Cursor()
+			k, v := cursor.First()
+			if after != nil {
+				k, v = cursor.Seek(after)
+				if k != nil && string(k) == string(after) {
+					k, v = cursor.Next()
+				}
+			}
+			for ; k != nil && len(keys) < walkBatchSize; k, v = cursor.Next() {
+				keys = append(keys, string(k))
+				values = append(values, slices.Clone(v))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			if err := fn(key, values[i]); err != nil {
+				return err
+			}
+		}
+		if len(keys) < walkBatchSize {
+			return nil
+		}
+		after = []byte(keys[len(keys)-1])
+	}
+}
+
+func (b *BBoltStore) Close() error {
+	return b.db.Close()
+}
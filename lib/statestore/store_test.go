@@ -0,0 +1,146 @@
+package statestore
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testValue struct {
+	Name string `json:"name"`
+}
+
+func TestStore(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store {
+			return NewMemoryStore()
+		},
+		"bbolt": func(t *testing.T) Store {
+			store, err := NewBBoltStore(filepath.Join(t.TempDir(), "state", "test.db"))
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				_ = store.Close()
+			})
+			return store
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			t.Run("put, get and delete", func(t *testing.T) {
+				store := newStore(t)
+				require.NoError(t, store.Put("bucket", "key", testValue{Name: "value"}))
+
+				var actual testValue
+				found, err := store.Get("bucket", "key", &actual)
+				require.NoError(t, err)
+				assert.True(t, found)
+				assert.Equal(t, "value", actual.Name)
+
+				require.NoError(t, store.Delete("bucket", "key"))
+				found, err = store.Get("bucket", "key", &actual)
+				require.NoError(t, err)
+				assert.False(t, found)
+			})
+			t.Run("get from unknown bucket", func(t *testing.T) {
+				store := newStore(t)
+				var actual testValue
+				found, err := store.Get("unknown", "key", &actual)
+				require.NoError(t, err)
+				assert.False(t, found)
+			})
+			t.Run("delete from unknown bucket", func(t *testing.T) {
+				store := newStore(t)
+				require.NoError(t, store.Delete("unknown", "key"))
+			})
+			t.Run("walk in key order", func(t *testing.T) {
+				store := newStore(t)
+				require.NoError(t, store.Put("bucket", "b", testValue{Name: "2"}))
+				require.NoError(t, store.Put("bucket", "a", testValue{Name: "1"}))
+				require.NoError(t, store.Put("other", "c", testValue{Name: "3"}))
+
+				var keys []string
+				err := store.Walk("bucket", func(key string, value []byte) error {
+					keys = append(keys, key)
+					// Modifying the store while walking must not deadlock
+					return store.Delete("bucket", key)
+				})
+				require.NoError(t, err)
+				assert.Equal(t, []string{"a", "b"}, keys)
+			})
+			t.Run("put all and delete bucket", func(t *testing.T) {
+				store := newStore(t)
+				require.NoError(t, store.PutAll("bucket", map[string]any{
+					"a": testValue{Name: "1"},
+					"b": testValue{Name: "2"},
+				}))
+				var actual testValue
+				found, err := store.Get("bucket", "b", &actual)
+				require.NoError(t, err)
+				assert.True(t, found)
+				assert.Equal(t, "2", actual.Name)
+
+				require.NoError(t, store.DeleteBucket("bucket"))
+				require.NoError(t, store.DeleteBucket("unknown"))
+				found, err = store.Get("bucket", "a", &actual)
+				require.NoError(t, err)
+				assert.False(t, found)
+			})
+			t.Run("walk large bucket", func(t *testing.T) {
+				store := newStore(t)
+				values := make(map[string]any)
+				for i := 0; i < 2*walkBatchSize+1; i++ {
+					values[fmt.Sprintf("%05d", i)] = testValue{}
+				}
+				require.NoError(t, store.PutAll("bucket", values))
+
+				var keys []string
+				err := store.Walk("bucket", func(key string, value []byte) error {
+					keys = append(keys, key)
+					return store.Delete("bucket", key)
+				})
+				require.NoError(t, err)
+				require.Len(t, keys, 2*walkBatchSize+1)
+				assert.True(t, slices.IsSorted(keys))
+			})
+			t.Run("walk stops on error", func(t *testing.T) {
+				store := newStore(t)
+				require.NoError(t, store.Put("bucket", "a", testValue{}))
+				require.NoError(t, store.Put("bucket", "b", testValue{}))
+
+				calls := 0
+				err := store.Walk("bucket", func(key string, value []byte) error {
+					calls++
+					return errors.New("stop")
+				})
+				assert.EqualError(t, err, "stop")
+				assert.Equal(t, 1, calls)
+			})
+		})
+	}
+	t.Run("bbolt state survives reopening", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		store, err := Open(path)
+		require.NoError(t, err)
+		require.NoError(t, store.Put("bucket", "key", testValue{Name: "value"}))
+		require.NoError(t, store.Close())
+
+		store, err = Open(path)
+		require.NoError(t, err)
+		defer store.Close()
+		var actual testValue
+		found, err := store.Get("bucket", "key", &actual)
+		require.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, "value", actual.Name)
+	})
+	t.Run("no path opens an in-memory store", func(t *testing.T) {
+		store, err := Open("")
+		require.NoError(t, err)
+		assert.IsType(t, &MemoryStore{}, store)
+	})
+}
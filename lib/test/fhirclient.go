@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -153,8 +154,22 @@ func (s *StubFHIRClient) SearchWithContext(ctx context.Context, resourceType str
 				return false
 			})
 		case "_id":
+			// Comma-separated values are alternatives
+			ids := strings.Split(value, ",")
 			filterCandidates(func(candidate BaseResource) bool {
-				return candidate.Id == value
+				return slices.Contains(ids, candidate.Id)
+			})
+		case "partof", "organization":
+			// Reference search parameters of Organization.partOf and HealthcareService.providedBy
+			property := map[string]string{"partof": "partOf", "organization": "providedBy"}[name]
+			references := strings.Split(value, ",")
+			filterCandidates(func(candidate BaseResource) bool {
+				reference, ok := candidate.asMap()[property].(map[string]any)
+				if !ok {
+					return false
+				}
+				value, _ := reference["reference"].(string)
+				return slices.Contains(references, value)
 			})
 		case "_include":
 			filterCandidates(func(candidate BaseResource) bool {
@@ -278,8 +293,15 @@ func (s *StubFHIRClient) SearchWithContext(ctx context.Context, resourceType str
 				return fmt.Errorf("invalid _count parameter value: %s", value)
 			}
 		case "_source":
+			// Comma-separated values are alternatives
+			sources := strings.Split(value, ",")
+			filterCandidates(func(candidate BaseResource) bool {
+				return candidate.Meta != nil && candidate.Meta.Source != nil && slices.Contains(sources, *candidate.Meta.Source)
+			})
+		case "_source:below":
 			filterCandidates(func(candidate BaseResource) bool {
-				return candidate.Meta != nil && candidate.Meta.Source != nil && *candidate.Meta.Source == value
+				return candidate.Meta != nil && candidate.Meta.Source != nil &&
+					(*candidate.Meta.Source == value || strings.HasPrefix(*candidate.Meta.Source, strings.TrimRight(value, "/")+"/"))
 			})
 		case "status":
 			filterCandidates(func(candidate BaseResource) bool {